@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// budgetThresholds are the percentages of the budget that trigger a warning.
+var budgetThresholds = []int{50, 80, 90, 100}
+
+const budgetFlushInterval = 10 * time.Second
+
+// usageBudget tracks how much traffic this machine has pushed through the
+// tunnel in the current calendar month. Usage lives in a small JSON file so
+// it survives restarts and is shared by every client process on the machine.
+type usageBudget struct {
+	limit    int64
+	path     string
+	throttle *rate.Limiter // nil only warns once the budget is used up
+
+	mu      sync.Mutex
+	month   string
+	used    int64
+	pending int64
+	warned  int
+}
+
+type usageFile struct {
+	Month  string `json:"month"`
+	Bytes  int64  `json:"bytes"`
+	Warned int    `json:"warned"`
+}
+
+func newUsageBudget(limit int64, path string, throttle int64) (*usageBudget, error) {
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "darkflare", "usage.json")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	b := &usageBudget{limit: limit, path: path, month: currentMonth()}
+	if throttle > 0 {
+		b.throttle = rate.NewLimiter(rate.Limit(throttle), int(throttle))
+	}
+
+	stored, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+	if stored.Month == b.month {
+		b.used, b.warned = stored.Bytes, stored.Warned
+	}
+	go b.flushLoop()
+	return b, nil
+}
+
+func currentMonth() string {
+	return time.Now().Format("2006-01")
+}
+
+func (b *usageBudget) load() (usageFile, error) {
+	var stored usageFile
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return stored, nil
+	}
+	if err != nil {
+		return stored, err
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return stored, fmt.Errorf("error parsing %s: %v", b.path, err)
+	}
+	return stored, nil
+}
+
+// add records n bytes of tunnel traffic. Once the budget is used up and a
+// throttle is configured, it blocks until the throttle lets the bytes pass.
+func (b *usageBudget) add(ctx context.Context, n int) error {
+	if b == nil || n == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	if month := currentMonth(); month != b.month {
+		b.month, b.used, b.warned = month, 0, 0
+	}
+	b.used += int64(n)
+	b.pending += int64(n)
+	percent := int(b.used * 100 / b.limit)
+	crossed := 0
+	for _, threshold := range budgetThresholds {
+		if percent >= threshold && b.warned < threshold {
+			crossed = threshold
+		}
+	}
+	if crossed > 0 {
+		b.warned = crossed
+		log.Printf("Warning: %d%% of the monthly bandwidth budget used (%s of %s)",
+			crossed, formatByteSize(b.used), formatByteSize(b.limit))
+	}
+	exceeded := b.used >= b.limit
+	b.mu.Unlock()
+
+	if !exceeded || b.throttle == nil {
+		return nil
+	}
+	for n > 0 {
+		chunk := min(n, b.throttle.Burst())
+		if err := b.throttle.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (b *usageBudget) flushLoop() {
+	for range time.Tick(budgetFlushInterval) {
+		if err := b.flush(); err != nil {
+			log.Printf("Failed to save bandwidth usage: %v", err)
+		}
+	}
+}
+
+// flush adds the traffic counted since the last flush to the usage file.
+// Re-reading the file first keeps the totals right when several client
+// processes share it.
+func (b *usageBudget) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending == 0 {
+		return nil
+	}
+
+	stored, err := b.load()
+	if err != nil {
+		return err
+	}
+	if stored.Month != b.month {
+		stored = usageFile{Month: b.month}
+	}
+	stored.Bytes += b.pending
+	stored.Warned = max(stored.Warned, b.warned)
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	b.used, b.pending = stored.Bytes, 0
+	return nil
+}
+
+// parseByteSize parses sizes such as "512MB" or "50GB" (powers of 1024).
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), 64)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return int64(n * float64(unit.scale)), nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 50GB)", s)
+	}
+	return n, nil
+}
+
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,6 @@
+//go:build !router
+
+package main
+
+// routerBuild is true in builds made with -tags router, see build_router.go.
+const routerBuild = false
@@ -0,0 +1,10 @@
+//go:build router
+
+package main
+
+// A router build (go build -tags router) is for OpenWrt boxes with 64MB of
+// RAM and little flash. It leaves out HTTP/3, whose QUIC stack is about a
+// fifth of the binary, and the system keyring, which routers don't have
+// (as -tags noh3,nokeyring would), and starts with -low-memory and
+// -max-sessions 32.
+const routerBuild = true
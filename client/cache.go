@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// probeCacheTTL is how long what the client found out about a server is
+// trusted before it's probed again.
+const probeCacheTTL = 24 * time.Hour
+
+// probeCache keeps what the client found out about its server on disk: the
+// carrier that gets past the zone's WAF, whether the CDN changes responses
+// and which transports don't connect. A restarted client starts out with
+// those instead of probing for them again. The file holds an entry per
+// server and is shared by every client process on the machine.
+type probeCache struct {
+	path   string
+	server string // scheme://host:port/prefix the entry belongs to
+
+	mu sync.Mutex
+}
+
+type cachedProbes struct {
+	Carrier         string               `json:"carrier,omitempty"`
+	CarrierChecked  time.Time            `json:"carrier_checked,omitempty"`
+	SafeEncoding    bool                 `json:"safe_encoding,omitempty"`
+	EncodingChecked time.Time            `json:"encoding_checked,omitempty"`
+	TransportsDown  map[string]time.Time `json:"transports_down,omitempty"` // until when
+}
+
+func newProbeCache(path, server string) (*probeCache, error) {
+	if path == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "darkflare", "probes.json")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return &probeCache{path: path, server: server}, nil
+}
+
+// load reads the file. It's only a cache, so one that can't be read is
+// started over.
+func (p *probeCache) load() map[string]*cachedProbes {
+	servers := make(map[string]*cachedProbes)
+	if data, err := os.ReadFile(p.path); err == nil {
+		json.Unmarshal(data, &servers)
+	}
+	return servers
+}
+
+// restore applies what's known about the server and still fresh.
+func (p *probeCache) restore(carrierAuto bool, transports *transportPicker) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	entry := p.load()[p.server]
+	p.mu.Unlock()
+	if entry == nil {
+		return
+	}
+
+	now := time.Now()
+	if carrierAuto && entry.Carrier != "" && now.Sub(entry.CarrierChecked) < probeCacheTTL {
+		preflightMu.Lock()
+		preflightDone = true
+		activeCarrier.Store(entry.Carrier)
+		preflightMu.Unlock()
+		switch entry.Carrier {
+		case "cookie":
+			log.Printf("Sending the tunnel's fields as cookies, like last time")
+		case "query":
+			log.Printf("Sending the tunnel's fields as query parameters, like last time")
+		}
+	}
+	if now.Sub(entry.EncodingChecked) < probeCacheTTL {
+		canaryMu.Lock()
+		canaryDone = true
+		safeEncoding.Store(entry.SafeEncoding)
+		canaryMu.Unlock()
+		if entry.SafeEncoding {
+			log.Printf("Using transformation-safe encoding, the CDN changed responses last time")
+		}
+	}
+	transports.mu.Lock()
+	for transport, retry := range entry.TransportsDown {
+		if now.Before(retry) {
+			transports.down[transport] = retry
+		}
+	}
+	transports.mu.Unlock()
+}
+
+// update changes the server's entry and writes the file.
+func (p *probeCache) update(change func(*cachedProbes)) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	servers := p.load()
+	entry := servers[p.server]
+	if entry == nil {
+		entry = &cachedProbes{}
+		servers[p.server] = entry
+	}
+	change(entry)
+	p.save(servers)
+}
+
+// forget drops the server's entry, so the next client probes everything.
+func (p *probeCache) forget() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	servers := p.load()
+	if _, ok := servers[p.server]; !ok {
+		return
+	}
+	delete(servers, p.server)
+	p.save(servers)
+}
+
+func (p *probeCache) save(servers map[string]*cachedProbes) {
+	data, err := json.MarshalIndent(servers, "", "  ")
+	if err != nil {
+		return
+	}
+	// Other client processes read it at any time, so it's replaced whole
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), "probes-*.tmp")
+	if err != nil {
+		log.Printf("Error saving %s: %v", p.path, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Error saving %s: %v", p.path, err)
+	}
+}
+
+// carrierFound records the carrier the preflight probe settled on.
+func (p *probeCache) carrierFound(carrier string) {
+	p.update(func(entry *cachedProbes) {
+		entry.Carrier, entry.CarrierChecked = carrier, time.Now()
+	})
+}
+
+// encodingChecked records what the canary check found.
+func (p *probeCache) encodingChecked(safe bool) {
+	p.update(func(entry *cachedProbes) {
+		entry.SafeEncoding, entry.EncodingChecked = safe, time.Now()
+	})
+}
+
+// transportDown records that transport is passed over until retry, or that
+// it works again if retry is zero.
+func (p *probeCache) transportDown(transport string, retry time.Time) {
+	p.update(func(entry *cachedProbes) {
+		if retry.IsZero() {
+			delete(entry.TransportsDown, transport)
+			return
+		}
+		if entry.TransportsDown == nil {
+			entry.TransportsDown = make(map[string]time.Time)
+		}
+		entry.TransportsDown[transport] = retry
+	})
+}
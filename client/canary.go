@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// canarySize must match the server's.
+const canarySize = 16 * 1024
+
+var (
+	// canaryMu guards canaryDone: the check runs once per process, with
+	// the first connection that gets through to the server.
+	canaryMu   sync.Mutex
+	canaryDone bool
+	// safeEncoding is set once the check has seen the CDN change a
+	// response. Requests then ask for responses to be left alone.
+	safeEncoding atomic.Bool
+)
+
+// canaryData is the content of a canary poll. Both ends derive it from the
+// session ID, so the client can tell whether it arrived unchanged.
+func canaryData(sessionID string) []byte {
+	data := make([]byte, 0, canarySize)
+	block := sha256.Sum256([]byte("darkflare canary " + sessionID))
+	for len(data) < canarySize {
+		data = append(data, block[:]...)
+		block = sha256.Sum256(block[:])
+	}
+	return data[:canarySize]
+}
+
+// checkTransforms polls for known data to catch CDN features that rewrite
+// response bodies (compression the client doesn't undo, Email Obfuscation,
+// Rocket Loader, image optimization). If the data comes back changed, it
+// warns and switches to transformation-safe encoding.
+func (c *Client) checkTransforms(ctx context.Context) {
+	canaryMu.Lock()
+	defer canaryMu.Unlock()
+	if canaryDone {
+		return
+	}
+
+	problem, err := c.runCanary(ctx)
+	if err != nil {
+		c.debugLog("Canary check failed: %v", err)
+		return
+	}
+	canaryDone = true
+	if problem == "" {
+		c.debugLog("Canary check passed, responses arrive unchanged")
+		c.cache.encodingChecked(false)
+		return
+	}
+
+	log.Printf("Warning: the CDN changes tunnel responses (%s), switching to transformation-safe encoding", problem)
+	safeEncoding.Store(true)
+	c.cache.encodingChecked(true)
+	problem, err = c.runCanary(ctx)
+	switch {
+	case err != nil:
+		log.Printf("Warning: couldn't check transformation-safe encoding: %v", err)
+	case problem != "":
+		log.Printf("Warning: responses are still changed in transit (%s). Turn the feature off for this hostname in the CDN's settings, the tunnel won't work until then", problem)
+	default:
+		log.Printf("Transformation-safe encoding works")
+	}
+}
+
+// runCanary asks for a canary poll and describes what the CDN changed about
+// it, or returns "" if it came through intact. Servers that don't know about
+// canaries answer with an ordinary poll, which counts as intact.
+func (c *Client) runCanary(ctx context.Context) (string, error) {
+	req, err := c.createDebugRequest(http.MethodGet, c.cloudflareHost, nil, false)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Capabilities", req.Header.Get("X-Capabilities")+",canary")
+
+	resp, err := c.withStepUp(func(code string) (*http.Response, error) {
+		attempt, err := c.withOneTimeCode(req, code)
+		if err != nil {
+			return nil, err
+		}
+		c.carry(attempt)
+		return c.httpClient.Do(attempt)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Canary") == "" {
+		return "", nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.maxBodySize))
+	if err != nil {
+		return "", err
+	}
+
+	want := canaryData(c.sessionID)
+	png := c.stego == "png"
+	if got, err := decodeCanary(resp, body, png); err == nil && bytes.Equal(got, want) {
+		return "", nil
+	}
+
+	contentType := "application/octet-stream"
+	if png {
+		contentType = "image/png"
+	}
+	switch encoding := resp.Header.Get("Content-Encoding"); {
+	case encoding != "" && encoding != "identity":
+		return "responses are re-encoded as " + encoding, nil
+	case bytes.Contains(body, []byte("/cdn-cgi/")):
+		return "scripts are injected, probably by Email Obfuscation or Rocket Loader", nil
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), contentType):
+		return "content type changed to " + resp.Header.Get("Content-Type"), nil
+	case png:
+		return "images are re-encoded, probably by image optimization", nil
+	}
+	return "bodies are rewritten", nil
+}
+
+// decodeCanary undoes the poll encoding of a canary response.
+func decodeCanary(resp *http.Response, body []byte, png bool) ([]byte, error) {
+	if png {
+		return decodePNG(body)
+	}
+	body, err := unpad(resp, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, errors.New("empty canary")
+	}
+	return decodePoll(resp, body)
+}
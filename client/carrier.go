@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// carriedFields are the tunnel's request headers with the cookie and query
+// parameter names they travel under when a WAF won't let the headers
+// through. They must match the server's.
+var carriedFields = []struct{ header, name string }{
+	{"X-For", "sid"},
+	{"X-Requested-With", "ref"},
+	{"X-Csrf-Token", "csrf"},
+	{"X-Capabilities", "v"},
+	{"X-Connection-Close", "close"},
+	{"X-Otp", "otp"},
+	{"X-Break-Glass", "bg"},
+	{"X-Checksum", "sum"},
+	{"X-Resend", "resend"},
+	{"X-Seq", "seq"},
+	{"X-Ack", "ack"},
+	{"X-Packed", "packed"},
+	{"X-Invite", "invite"},
+}
+
+// carriers are the ways of carrying the fields, in the order -carrier auto
+// tries them.
+var carriers = []string{"header", "cookie", "query"}
+
+var (
+	// preflightMu guards preflightDone: with -carrier auto the probe runs
+	// once per process, with the first connection.
+	preflightMu   sync.Mutex
+	preflightDone bool
+	// activeCarrier is how requests carry the tunnel's fields.
+	activeCarrier atomic.Value
+)
+
+func init() {
+	activeCarrier.Store("header")
+}
+
+// carry moves the tunnel's headers of req to where the active carrier puts
+// them, just before it's sent.
+func (c *Client) carry(req *http.Request) {
+	carryAs(req, activeCarrier.Load().(string))
+}
+
+func carryAs(req *http.Request, carrier string) {
+	if carrier == "header" {
+		return
+	}
+	query := req.URL.Query()
+	for _, f := range carriedFields {
+		value := req.Header.Get(f.header)
+		if value == "" {
+			continue
+		}
+		req.Header.Del(f.header)
+		if carrier == "cookie" {
+			req.AddCookie(&http.Cookie{Name: f.name, Value: url.QueryEscape(value)})
+		} else {
+			query.Set(f.name, value)
+		}
+	}
+	if carrier == "query" {
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
+// preflightCarriers finds a way of carrying the tunnel's fields that gets
+// past the zone's WAF. Some rules block unusual headers, or unusual values
+// in them, before the request ever reaches the server, which looks like a
+// server that isn't there. Each carrier is tried with a probe the server
+// answers with the carrier it found the fields in.
+func (c *Client) preflightCarriers(ctx context.Context) {
+	preflightMu.Lock()
+	defer preflightMu.Unlock()
+	if preflightDone {
+		return
+	}
+
+	var failed []string
+	for _, carrier := range carriers {
+		status, err := c.probeCarrier(ctx, carrier)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.debugLog("Carrier probe (%s) failed: %v", carrier, err)
+			failed = append(failed, carrier+": "+err.Error())
+			continue
+		}
+		if status != "" {
+			c.debugLog("Carrier probe (%s): %s", carrier, status)
+			failed = append(failed, carrier+": "+status)
+			continue
+		}
+		preflightDone = true
+		activeCarrier.Store(carrier)
+		c.cache.carrierFound(carrier)
+		switch carrier {
+		case "cookie":
+			log.Printf("Tunnel headers don't get through to the server, sending them as cookies instead")
+		case "query":
+			log.Printf("Tunnel headers don't get through to the server, sending them as query parameters instead")
+		default:
+			c.debugLog("Carrier probe (header) passed")
+		}
+		return
+	}
+	preflightDone = true
+	log.Printf("Warning: no way of sending the tunnel's fields got through to the server (%s). Check the zone's WAF rules (darkflare-server check-zone) and the server's keys", strings.Join(failed, "; "))
+}
+
+// probeCarrier sends a probe with the fields carried as carrier. It returns
+// what went wrong, or "" if the server got them.
+func (c *Client) probeCarrier(ctx context.Context, carrier string) (string, error) {
+	req, err := c.createDebugRequest(http.MethodGet, c.cloudflareHost, nil, false)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Capabilities", req.Header.Get("X-Capabilities")+",preflight")
+	if err := c.sign(req); err != nil {
+		return "", err
+	}
+	carryAs(req, carrier)
+
+	// A server that didn't get the fields answers with its decoy redirect
+	httpClient := *c.httpClient
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK && carrier == "header":
+		// A server from before carriers took it for a poll, so the
+		// headers got through
+		return "", nil
+	case resp.StatusCode == http.StatusForbidden:
+		return "blocked (status 403)", nil
+	case resp.StatusCode != http.StatusNoContent:
+		return fmt.Sprintf("not answered by the server (status %d)", resp.StatusCode), nil
+	case resp.Header.Get("X-Carrier") != carrier:
+		return "server doesn't know about carriers, upgrade it", nil
+	}
+	return "", nil
+}
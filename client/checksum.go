@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+)
+
+// checksumRetries is how often a payload that arrives corrupted is sent or
+// asked for again before the connection gives up.
+const checksumRetries = 3
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// payloadChecksum goes in X-Checksum with uploads and comes back with poll
+// responses, to catch bodies a middlebox has mangled on the way.
+func payloadChecksum(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(data, castagnoli))
+}
+
+// verifyPoll checks a decoded poll response against its checksum. A
+// corrupted response is dropped and the next poll asks for it again, up to
+// checksumRetries times in a row.
+func (c *Client) verifyPoll(resp *http.Response, data []byte, sessionID string) (bool, error) {
+	sum := resp.Header.Get("X-Checksum")
+	if sum == "" || sum == payloadChecksum(data) {
+		c.badPolls = 0
+		return true, nil
+	}
+	c.badPolls++
+	if c.badPolls > checksumRetries {
+		return false, fmt.Errorf("responses keep arriving corrupted (%d in a row)", c.badPolls)
+	}
+	log.Printf("Response for connection %s arrived corrupted, asking for it again", redactID(sessionID[:8]))
+	return false, nil
+}
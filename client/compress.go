@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// With -compress the client offers its algorithms in X-Capabilities and
+// the server answers with the one it picked in X-Compression. Either side
+// then compresses bodies with it when that helps, saying so in X-Packed;
+// payloads that look random, like encrypted or already compressed streams,
+// go as they are. Servers that don't compress never answer and nothing
+// changes.
+
+const (
+	// minPackSize is the smallest payload worth compressing.
+	minPackSize = 256
+	// maxUnpackedSize bounds what a compressed body may expand to.
+	maxUnpackedSize = 16 << 20
+	// randomEntropy is the entropy per byte above which a payload is taken
+	// as random and not compressed.
+	randomEntropy = 7.5
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxUnpackedSize), zstd.WithDecoderConcurrency(1))
+	gzipWriters    = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	}}
+)
+
+// serverCompression is the algorithm the server picked, once a response
+// has said.
+var serverCompression atomic.Value
+
+func noteCompression(resp *http.Response) {
+	if algorithm := resp.Header.Get("X-Compression"); algorithm != "" {
+		serverCompression.Store(algorithm)
+	}
+}
+
+// parseCompression parses -compress, algorithms in order of preference.
+func parseCompression(spec string) ([]string, error) {
+	var algorithms []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "" || name == "off":
+		case name == "zstd" || name == "gzip":
+			algorithms = append(algorithms, name)
+		default:
+			return nil, fmt.Errorf("unknown algorithm %q (use zstd, gzip or off)", name)
+		}
+	}
+	return algorithms, nil
+}
+
+// packUpload compresses an upload with the server's pick, if this client
+// offered it. The algorithm is "" for data to send as it is.
+func (c *Client) packUpload(data []byte) ([]byte, string) {
+	algorithm, _ := serverCompression.Load().(string)
+	if algorithm == "" || !slices.Contains(c.compress, algorithm) {
+		return data, ""
+	}
+	if packed, ok := pack(algorithm, data); ok {
+		return packed, algorithm
+	}
+	return data, ""
+}
+
+// unpackPoll undoes the compression of a poll response, if it has any.
+func unpackPoll(resp *http.Response, data []byte) ([]byte, error) {
+	algorithm := resp.Header.Get("X-Packed")
+	if algorithm == "" {
+		return data, nil
+	}
+	data, err := unpack(algorithm, data)
+	if err != nil {
+		return nil, fmt.Errorf("error unpacking data: %v", err)
+	}
+	return data, nil
+}
+
+// pack compresses data with algorithm, if it looks like it would shrink
+// and does. It reports false for data to send as it is.
+func pack(algorithm string, data []byte) ([]byte, bool) {
+	if len(data) < minPackSize || entropy(data[:min(len(data), 4096)]) > randomEntropy {
+		return nil, false
+	}
+	var packed []byte
+	switch algorithm {
+	case "zstd":
+		packed = zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	case "gzip":
+		var b bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		w.Reset(&b)
+		w.Write(data)
+		w.Close()
+		gzipWriters.Put(w)
+		packed = b.Bytes()
+	default:
+		return nil, false
+	}
+	// Not worth the header otherwise
+	if len(packed) > len(data)-len(data)/8 {
+		return nil, false
+	}
+	return packed, true
+}
+
+// unpack undoes pack.
+func unpack(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case "zstd":
+		return zstdDecoder.DecodeAll(data, nil)
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(io.LimitReader(r, maxUnpackedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxUnpackedSize {
+			return nil, fmt.Errorf("compressed body too large")
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
+
+// entropy is the Shannon entropy of data in bits per byte.
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	bits := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
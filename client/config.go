@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// encryptedConfigMagic prefixes config files written by -encrypt-config.
+var encryptedConfigMagic = []byte("DFCONF1\n")
+
+const (
+	configSaltLen  = 16
+	configNonceLen = 12
+)
+
+// clientConfig mirrors the client's command line flags so that keys and
+// server URLs can live in a file instead of shell history.
+type clientConfig struct {
+	Listen         string `json:"listen"`
+	Target         string `json:"target"`
+	Dest           string `json:"dest"`
+	Proxy          string `json:"proxy"`
+	PSK            string `json:"psk"`
+	PSKKDF         string `json:"psk_kdf"`
+	Debug          bool   `json:"debug"`
+	Redact         bool   `json:"redact"`
+	IdleTimeout    string `json:"idle_timeout"`
+	MaxLifetime    string `json:"max_lifetime"`
+	Watchdog       string `json:"watchdog"`
+	PathPrefix     string `json:"path_prefix"`
+	Paths          string `json:"paths"`
+	OnUp           string `json:"on_up"`
+	OnDown         string `json:"on_down"`
+	OnDrain        string `json:"on_drain"`
+	OnFailover     string `json:"on_failover"`
+	Transport      string `json:"transport"`
+	StreamPolls    bool   `json:"stream_polls"`
+	PollInterval   string `json:"poll_interval"`
+	IdlePoll       string `json:"idle_poll"`
+	Cover          string `json:"cover"`
+	Compress       string `json:"compress"`
+	Encoding       string `json:"encoding"`
+	EndpointsKey   string `json:"endpoints_key"`
+	Status         string `json:"status"`
+	SOCKS5         string `json:"socks5"`
+	HTTPProxy      string `json:"http_proxy"`
+	TUN            bool   `json:"tun"`
+	TUNRoutes      string `json:"tun_routes"`
+	Mux            bool   `json:"mux"`
+	Carrier        string `json:"carrier"`
+	E2E            bool   `json:"e2e"`
+	EarlyData      bool   `json:"early_data"`
+	Resume         bool   `json:"resume"`
+	MaxSessions    int    `json:"max_sessions"`
+	LowMemory      bool   `json:"low_memory"`
+	Budget         string `json:"budget"`
+	BudgetFile     string `json:"budget_file"`
+	BudgetThrottle string `json:"budget_throttle"`
+	ConnectWait    string `json:"connect_wait"`
+	CacheFile      string `json:"cache_file"`
+	NoCache        bool   `json:"no_cache"`
+	Batch          string `json:"batch"`
+	Stego          string `json:"stego"`
+	UseKeyring     bool   `json:"use_keyring"`
+}
+
+// loadClientConfig reads a plain or encrypted config file. Encrypted files
+// prompt for their passphrase unless DARKFLARE_CONFIG_PASSPHRASE is set.
+func loadClientConfig(path string) (*clientConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, encryptedConfigMagic) {
+		passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", path))
+		if err != nil {
+			return nil, err
+		}
+		data, err = decryptConfig(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &clientConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config: %v", err)
+	}
+	return cfg, nil
+}
+
+// apply copies config values into the flag set. Flags given on the command
+// line always win over the file.
+func (cfg *clientConfig) apply() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	values := map[string]string{
+		"l":               cfg.Listen,
+		"t":               cfg.Target,
+		"d":               cfg.Dest,
+		"p":               cfg.Proxy,
+		"psk":             cfg.PSK,
+		"psk-kdf":         cfg.PSKKDF,
+		"idle-timeout":    cfg.IdleTimeout,
+		"max-lifetime":    cfg.MaxLifetime,
+		"watchdog":        cfg.Watchdog,
+		"path-prefix":     cfg.PathPrefix,
+		"paths":           cfg.Paths,
+		"on-up":           cfg.OnUp,
+		"on-down":         cfg.OnDown,
+		"on-drain":        cfg.OnDrain,
+		"on-failover":     cfg.OnFailover,
+		"transport":       cfg.Transport,
+		"socks5":          cfg.SOCKS5,
+		"http-proxy":      cfg.HTTPProxy,
+		"tun-routes":      cfg.TUNRoutes,
+		"carrier":         cfg.Carrier,
+		"poll-interval":   cfg.PollInterval,
+		"idle-poll":       cfg.IdlePoll,
+		"cover":           cfg.Cover,
+		"compress":        cfg.Compress,
+		"encoding":        cfg.Encoding,
+		"endpoints-key":   cfg.EndpointsKey,
+		"status":          cfg.Status,
+		"budget":          cfg.Budget,
+		"budget-file":     cfg.BudgetFile,
+		"budget-throttle": cfg.BudgetThrottle,
+		"connect-wait":    cfg.ConnectWait,
+		"cache-file":      cfg.CacheFile,
+		"batch":           cfg.Batch,
+		"stego":           cfg.Stego,
+	}
+	if cfg.Debug {
+		values["debug"] = strconv.FormatBool(cfg.Debug)
+	}
+	if cfg.Redact {
+		values["redact"] = strconv.FormatBool(cfg.Redact)
+	}
+	if cfg.StreamPolls {
+		values["stream-polls"] = strconv.FormatBool(cfg.StreamPolls)
+	}
+	if cfg.TUN {
+		values["tun"] = strconv.FormatBool(cfg.TUN)
+	}
+	if cfg.Mux {
+		values["mux"] = strconv.FormatBool(cfg.Mux)
+	}
+	if cfg.E2E {
+		values["e2e"] = strconv.FormatBool(cfg.E2E)
+	}
+	if cfg.EarlyData {
+		values["early-data"] = strconv.FormatBool(cfg.EarlyData)
+	}
+	if cfg.Resume {
+		values["resume"] = strconv.FormatBool(cfg.Resume)
+	}
+	if cfg.MaxSessions != 0 {
+		values["max-sessions"] = strconv.Itoa(cfg.MaxSessions)
+	}
+	if cfg.LowMemory {
+		values["low-memory"] = strconv.FormatBool(cfg.LowMemory)
+	}
+	if cfg.NoCache {
+		values["no-cache"] = strconv.FormatBool(cfg.NoCache)
+	}
+	if cfg.UseKeyring {
+		values["use-keyring"] = strconv.FormatBool(cfg.UseKeyring)
+	}
+
+	for name, value := range values {
+		if value == "" || explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// encryptConfigFile writes an encrypted copy of a plaintext config file to
+// path + ".enc" and returns the new path.
+func encryptConfigFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(data, encryptedConfigMagic) {
+		return "", errors.New("config is already encrypted")
+	}
+	if err := json.Unmarshal(data, &clientConfig{}); err != nil {
+		return "", fmt.Errorf("error parsing config: %v", err)
+	}
+
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if os.Getenv("DARKFLARE_CONFIG_PASSPHRASE") == "" {
+		confirm, err := readPassphrase("Repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(passphrase, confirm) {
+			return "", errors.New("passphrases do not match")
+		}
+	}
+	if len(passphrase) == 0 {
+		return "", errors.New("empty passphrase")
+	}
+
+	encrypted, err := encryptConfig(data, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	out := path + ".enc"
+	if err := os.WriteFile(out, encrypted, 0600); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+func configCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key := argon2.IDKey(passphrase, salt, 3, 64*1024, 4, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptConfig(plaintext, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, configSaltLen+configNonceLen)
+	if _, err := cryptorand.Read(salt); err != nil {
+		return nil, err
+	}
+	salt, nonce := salt[:configSaltLen], salt[configSaltLen:]
+
+	aead, err := configCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, encryptedConfigMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, encryptedConfigMagic), nil
+}
+
+func decryptConfig(data, passphrase []byte) ([]byte, error) {
+	data = data[len(encryptedConfigMagic):]
+	if len(data) < configSaltLen+configNonceLen {
+		return nil, errors.New("encrypted config is truncated")
+	}
+	salt, nonce := data[:configSaltLen], data[configSaltLen:configSaltLen+configNonceLen]
+
+	aead, err := configCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, data[configSaltLen+configNonceLen:], encryptedConfigMagic)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted config")
+	}
+	return plaintext, nil
+}
+
+// readPassphrase prompts on the controlling terminal rather than stdin, which
+// carries tunnel data in stdin:stdout mode.
+func readPassphrase(prompt string) ([]byte, error) {
+	if passphrase := os.Getenv("DARKFLARE_CONFIG_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	tty, err := openTerminal()
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to prompt for passphrase (set DARKFLARE_CONFIG_PASSPHRASE): %v", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// openTerminal opens the controlling terminal, which is still there when
+// stdin and stdout carry the tunnel.
+func openTerminal() (*os.File, error) {
+	ttyPath := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		ttyPath = "CONIN$"
+	}
+	return os.OpenFile(ttyPath, os.O_RDWR, 0)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// With -cover the client makes traffic that carries nothing, so someone
+// watching request timing and sizes at the ISP or CDN can't tell an idle
+// tunnel from a busy one, or pick out bursts:
+//
+//   - idle polls come at random intervals around -cover instead of backing
+//     off to a steady -idle-poll, and busy ones are jittered
+//   - empty uploads go out at random intervals around -cover, busy or not
+//   - every request carries a cookie of random length, so request sizes
+//     don't follow what's in them
+//
+// All of it looks like ordinary requests to the server, older ones too.
+// Pair it with -pad-sizes on the server to pad responses.
+
+// coverPadMax bounds the padding cookie, well under what CDNs allow for
+// headers.
+const coverPadMax = 1536
+
+// coverDelay draws a wait around mean, exponentially distributed like the
+// gaps between independent events, so there's no period to spot.
+func coverDelay(mean time.Duration) time.Duration {
+	d := time.Duration(rand.ExpFloat64() * float64(mean))
+	if d > 5*mean {
+		return 5 * mean
+	}
+	return max(mean/10, d)
+}
+
+// jitter spreads d over half to one and a half of it.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)+1))
+}
+
+// padRequest adds the padding cookie to a tunnel request.
+func (c *Client) padRequest(req *http.Request) {
+	if c.cover == 0 {
+		return
+	}
+	b := make([]byte, rand.Intn(coverPadMax))
+	cryptorand.Read(b)
+	req.AddCookie(&http.Cookie{Name: "_gid", Value: "GA1." + base64.RawURLEncoding.EncodeToString(b)})
+}
+
+// sendCover sends empty uploads for a connection until it's done. It
+// waits for the server to have answered for the session, so a late one
+// can't open it again.
+func (c *Client) sendCover(ctx context.Context, sessionID string, done <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-time.After(coverDelay(c.cover)):
+		}
+		if !c.established.Load() {
+			continue
+		}
+		resp, err := c.postData(ctx, sessionID, nil, false, false)
+		if err != nil {
+			c.debugLog("Cover upload for connection %s failed: %v", redactID(sessionID[:8]), err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// serverDrain is the shutdown the server last announced with X-Drain, so
+// it's logged and handed to -on-drain once rather than on every response.
+var serverDrain drainNotice
+
+type drainNotice struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// note looks for a drain announcement on a response from the server. Open
+// connections keep going until the server closes them; new ones are
+// refused by it in the meantime.
+func (d *drainNotice) note(resp *http.Response, hooks *tunnelHooks) {
+	value := resp.Header.Get("X-Drain")
+	if value == "" {
+		return
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return
+	}
+
+	d.mu.Lock()
+	known := time.Now().Before(d.until)
+	d.until = time.Now().Add(time.Duration(seconds) * time.Second)
+	d.mu.Unlock()
+	if known {
+		return
+	}
+	log.Printf("Server is shutting down, open connections have up to %ds left", seconds)
+	hooks.drained(seconds)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// earlyDataWait is how long a new connection waits for the application's
+// first bytes so they can go with the request that opens the session.
+// Protocols where the server speaks first (SSH, SMTP) lose this much.
+const earlyDataWait = 50 * time.Millisecond
+
+// sendEarlyData sends the first bytes written to conn along with the request
+// that opens the session, and writes what the destination answers back to
+// conn, saving the round trips of a separate upload and poll. Servers from
+// before early data open the session and answer with nothing, which the
+// next poll makes up for.
+func (c *Client) sendEarlyData(ctx context.Context, sessionID string, conn net.Conn, buffer []byte) error {
+	conn.SetReadDeadline(time.Now().Add(earlyDataWait))
+	n, err := conn.Read(buffer)
+	if err == nil && c.e2e && n == e2eSaltSize {
+		// All the first read of a sealed connection gets is its salt
+		var more int
+		more, err = conn.Read(buffer[n:])
+		n += more
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+
+	data := make([]byte, n)
+	copy(data, buffer[:n])
+	c.debugLog("Sending %s bytes of early data for connection %s", redactSize(n), redactID(sessionID[:8]))
+	resp, err := c.postData(ctx, sessionID, data, false, true)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK {
+		c.upSeq.Add(uint64(n))
+	}
+	return c.readPoll(ctx, resp, sessionID, conn)
+}
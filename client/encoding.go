@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// Poll responses come hex encoded unless the client asks for something
+// denser in X-Capabilities: "binary", or "base64" for paths that mangle
+// bytes that aren't text. Servers that do it say so in X-Encoding, older
+// ones don't and keep sending hex.
+
+// pollEncodings are the values -encoding takes.
+var pollEncodings = []string{"auto", "binary", "base64", "hex"}
+
+func validPollEncoding(encoding string) error {
+	for _, e := range pollEncodings {
+		if e == encoding {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown encoding %q (use auto, binary, base64 or hex)", encoding)
+}
+
+// pollEncodingCapability is the capability asking for c's encoding, "" for
+// hex. Auto takes binary, and base64 once the CDN has been caught changing
+// responses.
+func (c *Client) pollEncodingCapability() string {
+	switch c.encoding {
+	case "hex":
+		return ""
+	case "binary", "base64":
+		return c.encoding
+	}
+	if safeEncoding.Load() {
+		return "base64"
+	}
+	return "binary"
+}
+
+// decodePoll undoes the encoding of a poll response body.
+func decodePoll(resp *http.Response, body []byte) ([]byte, error) {
+	switch resp.Header.Get("X-Encoding") {
+	case "binary":
+		return body, nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(string(body))
+	}
+	return hex.DecodeString(string(body))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operators can hand clients a signed list of other ways to reach the
+// server: more hostnames, other zones, edge IPs (darkflare-server
+// -endpoints). With -endpoints-key the client fetches it through the server
+// it gets through to, keeps the newest one on disk and falls back to it
+// when -t stops answering, so blocking the hostname a client was set up
+// with doesn't cut it off for good.
+
+const (
+	// maxEndpointsSize bounds the list, like the server's.
+	maxEndpointsSize = 64 << 10
+	// endpointsRefresh is how often a running client fetches the list again.
+	endpointsRefresh = 24 * time.Hour
+	// bootstrapTimeout is how long each candidate gets to answer.
+	bootstrapTimeout = 15 * time.Second
+)
+
+type endpointList struct {
+	Issued    time.Time  `json:"issued"`
+	Endpoints []endpoint `json:"endpoints"`
+}
+
+type endpoint struct {
+	URL string `json:"url"`          // like -t, the path is the server's -path-prefix
+	IP  string `json:"ip,omitempty"` // edge IP to connect to instead of looking the host up
+}
+
+// signedEndpoints is the list exactly as it was signed, and the signature.
+// It's kept on disk the way the server sends it, and checked again when
+// it's read back.
+type signedEndpoints struct {
+	List      []byte `json:"list"`
+	Signature []byte `json:"signature"`
+}
+
+func (s *signedEndpoints) verify(publicKey ed25519.PublicKey) (*endpointList, error) {
+	if !ed25519.Verify(publicKey, s.List, s.Signature) {
+		return nil, errors.New("signature doesn't verify")
+	}
+	var list endpointList
+	if err := json.Unmarshal(s.List, &list); err != nil {
+		return nil, fmt.Errorf("invalid list: %v", err)
+	}
+	for _, e := range list.Endpoints {
+		if _, _, _, _, err := parseTarget(e.URL); err != nil {
+			return nil, fmt.Errorf("invalid list: %s: %v", e.URL, err)
+		}
+		if e.IP != "" && net.ParseIP(e.IP) == nil {
+			return nil, fmt.Errorf("invalid list: %s: bad IP %q", e.URL, e.IP)
+		}
+	}
+	return &list, nil
+}
+
+// endpointBook keeps the newest list signed with the key in endpoints.json,
+// next to the probe cache. -no-cache doesn't apply to it: it's what gets
+// the client back in.
+type endpointBook struct {
+	path      string
+	publicKey ed25519.PublicKey
+	hooks     *tunnelHooks // -on-failover
+
+	mu sync.Mutex
+}
+
+func newEndpointBook(cacheFile string, publicKey ed25519.PublicKey) (*endpointBook, error) {
+	dir := filepath.Dir(cacheFile)
+	if cacheFile == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cacheDir, "darkflare")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &endpointBook{path: filepath.Join(dir, "endpoints.json"), publicKey: publicKey}, nil
+}
+
+// read returns the file's lists by key, started over if it can't be read.
+func (b *endpointBook) read() map[string]*signedEndpoints {
+	lists := make(map[string]*signedEndpoints)
+	if data, err := os.ReadFile(b.path); err == nil {
+		json.Unmarshal(data, &lists)
+	}
+	return lists
+}
+
+// load returns the kept list, nil if there's none that verifies.
+func (b *endpointBook) load() *endpointList {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	signed := b.read()[base64.StdEncoding.EncodeToString(b.publicKey)]
+	if signed == nil {
+		return nil
+	}
+	list, err := signed.verify(b.publicKey)
+	if err != nil {
+		log.Printf("Warning: ignoring the kept endpoints list: %v", err)
+		return nil
+	}
+	return list
+}
+
+// keep stores a list from the server unless the one on disk is newer, so
+// an old list can't be played back to the client.
+func (b *endpointBook) keep(signed *signedEndpoints) error {
+	list, err := signed.verify(b.publicKey)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lists := b.read()
+	key := base64.StdEncoding.EncodeToString(b.publicKey)
+	if kept := lists[key]; kept != nil {
+		if old, err := kept.verify(b.publicKey); err == nil && old.Issued.After(list.Issued) {
+			return fmt.Errorf("it's older than the one kept (issued %s)", old.Issued.Format(time.RFC3339))
+		}
+	}
+	lists[key] = signed
+	data, err := json.MarshalIndent(lists, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// refresh fetches the server's list through c and keeps it. It only fails
+// if c didn't get through to the server; a list that doesn't verify is the
+// operator's problem, not the connection's.
+func (b *endpointBook) refresh(c *Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+	defer cancel()
+	signed, err := c.fetchEndpoints(ctx)
+	if err != nil || signed == nil {
+		return err
+	}
+	if err := b.keep(signed); err != nil {
+		log.Printf("Warning: not keeping the server's endpoints list: %v", err)
+		return nil
+	}
+	c.debugLog("Kept the server's endpoints list")
+	return nil
+}
+
+// bootstrap picks what to connect to: target if it answers, otherwise the
+// first endpoint on the kept list that does, which fires -on-failover.
+// Whichever answers refreshes the list. dial makes a client for an endpoint.
+func (b *endpointBook) bootstrap(target endpoint, dial func(endpoint) (*Client, error)) endpoint {
+	candidates := []endpoint{target}
+	if list := b.load(); list != nil {
+		for _, e := range list.Endpoints {
+			if e != target {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	var targetErr error
+	for i, e := range candidates {
+		c, err := dial(e)
+		if err == nil {
+			err = b.refresh(c)
+		}
+		if err == nil {
+			if i > 0 {
+				log.Printf("%s doesn't answer, connecting via %s from the endpoints list", redactAddr(target.URL), redactAddr(e.URL))
+				b.hooks.failedOver(e.URL, targetErr)
+			}
+			return e
+		}
+		log.Printf("%s doesn't answer: %v", redactAddr(e.URL), err)
+		if i == 0 {
+			targetErr = err
+		}
+	}
+	if len(candidates) > 1 {
+		log.Printf("Warning: nothing on the endpoints list answers either, trying %s anyway", redactAddr(target.URL))
+	}
+	return target
+}
+
+// refreshEvery fetches the list again every endpointsRefresh, for clients
+// that run for weeks.
+func (b *endpointBook) refreshEvery(newClient func() *Client) {
+	for range time.Tick(endpointsRefresh) {
+		if c := newClient(); c != nil {
+			if err := b.refresh(c); err != nil {
+				c.debugLog("Endpoints list refresh failed: %v", err)
+			}
+		}
+	}
+}
+
+// fetchEndpoints asks the server for its list. It returns nil without an
+// error if the server can't read its list right now, and an error if no
+// darkflare server with -endpoints that lets the client in answered.
+func (c *Client) fetchEndpoints(ctx context.Context) (*signedEndpoints, error) {
+	req, err := c.createDebugRequest(http.MethodGet, c.cloudflareHost, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	// Without a destination a server that doesn't know the request answers
+	// with its decoy instead of opening a connection
+	req.Header.Del("X-Requested-With")
+	req.Header.Set("X-Capabilities", req.Header.Get("X-Capabilities")+",endpoints")
+	if err := c.sign(req); err != nil {
+		return nil, err
+	}
+	c.carry(req)
+
+	// The decoy's redirect isn't worth following
+	httpClient := *c.httpClient
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Endpoints") == "" {
+		return nil, fmt.Errorf("no tunnel server with -endpoints answered (status %d)", resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	var signed signedEndpoints
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 2*maxEndpointsSize)).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("invalid endpoints response: %v", err)
+	}
+	return &signed, nil
+}
+
+// connectTo has the client connect to ip for its server's hostname, which
+// still goes in SNI and Host. Through an HTTP proxy the proxy resolves the
+// hostname, so there it's ignored.
+func (c *Client) connectTo(ip string) {
+	transport, ok := c.httpClient.Transport.(*http.Transport)
+	if ip == "" || !ok || transport.Proxy != nil {
+		return
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			addr = net.JoinHostPort(ip, port)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// parseTarget splits a -t URL (the scheme defaults to https) into what the
+// client connects to, with the path as a path prefix.
+func parseTarget(target string) (scheme, host string, port int, prefix string, err error) {
+	if !strings.Contains(target, "://") {
+		target = "https://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", 0, "", err
+	}
+	scheme = strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", "", 0, "", errors.New("scheme must be either 'http' or 'https'")
+	}
+	if u.Hostname() == "" {
+		return "", "", 0, "", errors.New("no host")
+	}
+	port = 443
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil {
+			return "", "", 0, "", fmt.Errorf("invalid port number: %v", err)
+		}
+	} else if scheme == "http" {
+		port = 80
+	}
+	return scheme, u.Hostname(), port, u.Path, nil
+}
@@ -0,0 +1,18 @@
+//go:build !noh3 && !router
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// haveH3 reports whether this build can use -transport h3. Building with
+// -tags noh3 (or router) leaves out QUIC.
+const haveH3 = true
+
+func newH3Transport(tlsConfig *tls.Config) http.RoundTripper {
+	return &http3.Transport{TLSClientConfig: tlsConfig}
+}
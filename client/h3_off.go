@@ -0,0 +1,14 @@
+//go:build noh3 || router
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+const haveH3 = false
+
+func newH3Transport(tlsConfig *tls.Config) http.RoundTripper {
+	panic("-transport h3 isn't in this build")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hookTimeout bounds how long a single hook command may run.
+const hookTimeout = time.Minute
+
+type hookEvent struct {
+	name     string
+	detail   string
+	drain    int    // seconds the server gave, for drain events
+	endpoint string // what the client connects via, for failover events
+}
+
+// tunnelHooks runs user commands when the tunnel comes up or goes down, the
+// server announces it's shutting down, or -t doesn't answer and the client
+// connects via the endpoints list instead. It
+// is shared by all local connections, so hooks fire when the overall state
+// changes rather than once per connection. Commands run one at a time, in
+// order, off the data path.
+type tunnelHooks struct {
+	up       string
+	down     string
+	drain    string
+	failover string
+	target   string
+	dest     string
+	listen   string
+
+	mu     sync.Mutex
+	state  string // "", "up" or "down"
+	events chan hookEvent
+}
+
+func newTunnelHooks(up, down, drain, failover, target, dest, listen string) *tunnelHooks {
+	h := &tunnelHooks{
+		up:       up,
+		down:     down,
+		drain:    drain,
+		failover: failover,
+		target:   target,
+		dest:     dest,
+		listen:   listen,
+		events:   make(chan hookEvent, 16),
+	}
+	go h.run()
+	return h
+}
+
+// report records the outcome of a request to the server. A nil hooks is
+// fine and does nothing.
+func (h *tunnelHooks) report(err error) {
+	if h == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	state, detail := "up", ""
+	if err != nil {
+		state, detail = "down", err.Error()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == state || (h.state == "" && state == "down" && h.down == "") {
+		return
+	}
+	h.state = state
+	select {
+	case h.events <- hookEvent{name: state, detail: detail}:
+	default:
+		log.Printf("Hook queue full, skipping %s hook", state)
+	}
+}
+
+// drained queues the drain hook. It doesn't change the tunnel's state, the
+// server is still up for the moment.
+func (h *tunnelHooks) drained(seconds int) {
+	if h == nil || h.drain == "" {
+		return
+	}
+	select {
+	case h.events <- hookEvent{name: "drain", drain: seconds}:
+	default:
+		log.Printf("Hook queue full, skipping drain hook")
+	}
+}
+
+// failedOver queues the failover hook: -t didn't answer, with err, and the
+// client connects via endpoint from the endpoints list.
+func (h *tunnelHooks) failedOver(endpoint string, err error) {
+	if h == nil || h.failover == "" {
+		return
+	}
+	event := hookEvent{name: "failover", endpoint: endpoint}
+	if err != nil {
+		event.detail = err.Error()
+	}
+	select {
+	case h.events <- event:
+	default:
+		log.Printf("Hook queue full, skipping failover hook")
+	}
+}
+
+func (h *tunnelHooks) run() {
+	for event := range h.events {
+		command := h.up
+		switch event.name {
+		case "down":
+			command = h.down
+		case "drain":
+			command = h.drain
+		case "failover":
+			command = h.failover
+		}
+		if command == "" {
+			continue
+		}
+		h.exec(command, event)
+	}
+}
+
+func (h *tunnelHooks) exec(command string, event hookEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(),
+		"DARKFLARE_EVENT="+event.name,
+		"DARKFLARE_TARGET="+h.target,
+		"DARKFLARE_DEST="+h.dest,
+		"DARKFLARE_LISTEN="+h.listen,
+		"DARKFLARE_ERROR="+event.detail,
+		"DARKFLARE_DRAIN="+strconv.Itoa(event.drain),
+		"DARKFLARE_ENDPOINT="+event.endpoint,
+	)
+	// stdout may be the tunnel itself in stdin:stdout mode
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		log.Printf("Tunnel %s hook failed: %v", event.name, err)
+	}
+}
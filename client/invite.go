@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// invitation holds the parts of a server invitation the client needs to know
+// where to redeem it. The signature is checked by the server.
+type invitation struct {
+	ID       string `json:"id"`
+	Expires  int64  `json:"exp"`
+	Dest     string `json:"dest"`
+	Endpoint string `json:"endpoint"`
+}
+
+func parseInvitation(blob string) (*invitation, error) {
+	data, err := base64.RawURLEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, errors.New("malformed invitation")
+	}
+	inv := &invitation{}
+	if err := json.Unmarshal(data, inv); err != nil || inv.Endpoint == "" || inv.Dest == "" {
+		return nil, errors.New("malformed invitation")
+	}
+	return inv, nil
+}
+
+// redeemInvite exchanges an invitation for its credential. The server only
+// answers once per invitation, so the result must be saved.
+func (c *Client) redeemInvite(blob string) (*clientConfig, error) {
+	req, err := c.createDebugRequest(http.MethodGet, c.cloudflareHost, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Invite", blob)
+
+	// A rejected invitation gets the decoy redirect; don't follow it
+	httpClient := *c.httpClient
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	c.carry(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	var granted struct {
+		Target string `json:"target"`
+		Dest   string `json:"dest"`
+		PSK    string `json:"psk"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &granted) != nil || granted.PSK == "" {
+		return nil, errors.New("invitation rejected (expired, already redeemed or not for this server)")
+	}
+	return &clientConfig{Target: granted.Target, Dest: granted.Dest, PSK: granted.PSK}, nil
+}
+
+// saveClientConfig writes cfg as a plain config file readable only by the
+// current user. It refuses to overwrite an existing file.
+func saveClientConfig(path string, cfg *clientConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
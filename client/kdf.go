@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2Params are the argon2id cost parameters used to stretch password
+// style keys. They must match the server's -psk-kdf setting.
+type argon2Params struct {
+	time    uint32
+	memory  uint32 // KiB
+	threads uint8
+}
+
+var defaultArgon2Params = argon2Params{time: 3, memory: 64 * 1024, threads: 4}
+
+// parseKDF parses a -psk-kdf value such as "argon2id" or
+// "argon2id:t=4,m=131072,p=2" (m is in KiB).
+func parseKDF(spec string) (*argon2Params, error) {
+	name, opts, _ := strings.Cut(spec, ":")
+	if name != "argon2id" {
+		return nil, fmt.Errorf("unsupported KDF %q (supported: argon2id)", name)
+	}
+
+	params := defaultArgon2Params
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid KDF option %q", opt)
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid KDF option %q", opt)
+		}
+		switch key {
+		case "t":
+			params.time = uint32(n)
+		case "m":
+			params.memory = uint32(n)
+		case "p":
+			if n > 255 {
+				return nil, fmt.Errorf("invalid KDF option %q", opt)
+			}
+			params.threads = uint8(n)
+		default:
+			return nil, fmt.Errorf("unknown KDF option %q", key)
+		}
+	}
+	return &params, nil
+}
+
+// deriveKey stretches a password into the 32-byte wire key for keyID, so a
+// captured request token can't be cheaply brute-forced offline.
+func (p *argon2Params) deriveKey(keyID string, password []byte) []byte {
+	return argon2.IDKey(password, []byte("darkflare-psk:"+keyID), p.time, p.memory, p.threads, 32)
+}
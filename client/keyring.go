@@ -0,0 +1,32 @@
+//go:build !nokeyring && !router
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zalando/go-keyring"
+)
+
+// keyringService is the service name entries are stored under in the macOS
+// Keychain, Windows Credential Manager or the Secret Service on Linux.
+const keyringService = "darkflare"
+
+// keyringLoad returns the pre-shared key stored for the given server host.
+func keyringLoad(host string) (string, error) {
+	psk, err := keyring.Get(keyringService, host)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", fmt.Errorf("no key stored for %s (store one with -keyring-set)", host)
+	}
+	return psk, err
+}
+
+// keyringStore saves the pre-shared key for the given server host, replacing
+// any existing entry.
+func keyringStore(host, psk string) error {
+	if _, _, err := parseKey(psk); err != nil {
+		return err
+	}
+	return keyring.Set(keyringService, host, psk)
+}
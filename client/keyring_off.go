@@ -0,0 +1,17 @@
+//go:build nokeyring || router
+
+package main
+
+import "errors"
+
+// Builds with -tags nokeyring (or router) don't link the macOS, Windows and
+// D-Bus keyring code.
+var errNoKeyring = errors.New("the system keyring isn't in this build, use -psk or a config file")
+
+func keyringLoad(host string) (string, error) {
+	return "", errNoKeyring
+}
+
+func keyringStore(host, psk string) error {
+	return errNoKeyring
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// activityConn records when data last moved through a local connection in
+// either direction, and since when the application has been waiting for an
+// answer to what it sent.
+type activityConn struct {
+	net.Conn
+	last    atomic.Int64
+	waiting atomic.Int64 // first read since the last write, 0 if none
+}
+
+func newActivityConn(conn net.Conn) *activityConn {
+	a := &activityConn{Conn: conn}
+	a.last.Store(time.Now().UnixNano())
+	return a
+}
+
+func (a *activityConn) Read(p []byte) (int, error) {
+	n, err := a.Conn.Read(p)
+	if n > 0 {
+		now := time.Now().UnixNano()
+		a.last.Store(now)
+		a.waiting.CompareAndSwap(0, now)
+	}
+	return n, err
+}
+
+func (a *activityConn) Write(p []byte) (int, error) {
+	n, err := a.Conn.Write(p)
+	if n > 0 {
+		a.last.Store(time.Now().UnixNano())
+		a.waiting.Store(0)
+	}
+	return n, err
+}
+
+func (a *activityConn) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// unanswered is how long the application has been sending without getting
+// anything back.
+func (a *activityConn) unanswered() time.Duration {
+	since := a.waiting.Load()
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// resetConn closes a local connection with a TCP RST where it can, so the
+// application sees it fail straight away rather than a clean end of stream.
+func resetConn(conn net.Conn) {
+	if a, ok := conn.(*activityConn); ok {
+		conn = a.Conn
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// enforceLimits closes conn once it has been idle for idleTimeout or open for
+// maxLifetime, so forgotten connections don't hold a session open through
+// the CDN forever. It returns when done is closed.
+//
+// With -watchdog it also resets connections whose session looks wedged:
+// the application sent something and nothing has come back for that long,
+// though the polls themselves still work. That's what a server that lost
+// the session, by restarting say, looks like from here. Closing the
+// connection ends its session, and the application's next connection gets
+// a new one.
+func (c *Client) enforceLimits(conn *activityConn, sessionID string, done <-chan struct{}) {
+	opened := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reason := ""
+			if c.idleTimeout > 0 && conn.idle() >= c.idleTimeout {
+				reason = "idle for " + c.idleTimeout.String()
+			} else if c.maxLifetime > 0 && time.Since(opened) >= c.maxLifetime {
+				reason = "open for " + c.maxLifetime.String()
+			}
+			if reason != "" {
+				log.Printf("Closing connection %s: %s", redactID(sessionID[:8]), reason)
+				conn.Close()
+				return
+			}
+			if c.watchdog > 0 && conn.unanswered() >= c.watchdog {
+				log.Printf("Resetting connection %s: nothing back from the server for %s, the session looks wedged", redactID(sessionID[:8]), c.watchdog)
+				resetConn(conn)
+				return
+			}
+		}
+	}
+}
+
+// sessionSlots caps the local connections tunneled at once (-max-sessions),
+// across listeners. A nil sessionSlots has no cap.
+type sessionSlots chan struct{}
+
+var sessionLimit sessionSlots
+
+func newSessionSlots(n int) sessionSlots {
+	if n <= 0 {
+		return nil
+	}
+	return make(sessionSlots, n)
+}
+
+// take claims a slot for conn, or closes conn if there's none left.
+func (s sessionSlots) take(conn net.Conn) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		log.Printf("Refusing connection from %s: -max-sessions (%d) reached", conn.RemoteAddr(), cap(s))
+		conn.Close()
+		return false
+	}
+}
+
+func (s sessionSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
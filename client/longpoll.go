@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// longRequestClient returns an HTTP client for requests the server holds
+// open. They need connections of their own, since the regular client only
+// keeps one per host and the POSTs must not queue up behind them.
+func (c *Client) longRequestClient() *http.Client {
+	httpClient := *c.httpClient
+	httpClient.Timeout = 0 // held requests last as long as the server likes
+	if transport, ok := c.httpClient.Transport.(*http.Transport); ok {
+		httpClient.Transport = transport.Clone()
+	}
+	return &httpClient
+}
+
+// readStreamedPoll copies a poll the server holds open (-stream-polls) to
+// conn as the data trickles in, raw or hex encoded.
+func (c *Client) readStreamedPoll(ctx context.Context, resp *http.Response, conn net.Conn) error {
+	decoder := hex.NewDecoder(resp.Body)
+	if resp.Header.Get("X-Encoding") == "binary" {
+		decoder = resp.Body
+	}
+	buffer := make([]byte, c.readBufferSize)
+	for {
+		n, err := decoder.Read(buffer)
+		if n > 0 {
+			if berr := c.budget.add(ctx, n); berr != nil {
+				return berr
+			}
+			if _, werr := conn.Write(buffer[:n]); werr != nil {
+				return fmt.Errorf("error writing to connection: %v", werr)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
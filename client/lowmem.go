@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"runtime/debug"
+)
+
+// -low-memory settings, for routers with 64MB of RAM where every session's
+// buffers count and the runtime shouldn't wait to collect garbage.
+const (
+	lowMemoryBuffer = 8 * 1024
+	lowMemoryChunk  = 16 * 1024 // largest upload read at once
+	lowMemoryLimit  = 24 << 20
+)
+
+// useLowMemory shrinks the client's buffers.
+func (c *Client) useLowMemory() {
+	c.readBufferSize = lowMemoryBuffer
+	c.writeBufferSize = lowMemoryBuffer
+	c.maxBodySize = 1 << 20
+	c.bufferPool.New = func() interface{} {
+		return make([]byte, lowMemoryChunk)
+	}
+}
+
+// lowMemoryRuntime sets a soft memory limit unless GOMEMLIMIT already did.
+func lowMemoryRuntime() {
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(lowMemoryLimit)
+	}
+}
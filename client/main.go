@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	cryptorand "crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -19,10 +21,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"crypto/x509"
 
+	"github.com/gorilla/websocket"
 	"golang.org/x/net/proxy"
 	"golang.org/x/time/rate"
 )
@@ -47,9 +51,41 @@ type Client struct {
 	sessions        sync.Map
 	readBufferSize  int
 	writeBufferSize int
-	pollInterval    time.Duration
+	pollInterval    time.Duration // the fastest, see pacing.go
+	idlePoll        time.Duration // the slowest
+	cover           time.Duration // mean gap of cover traffic, see cover.go
 	batchSize       int
 	proxyURL        string
+	keyID           string
+	key             []byte
+	stego           string
+	connectWait     time.Duration
+	idleTimeout     time.Duration
+	maxLifetime     time.Duration
+	watchdog        time.Duration
+	pathPrefix      string
+	paths           []pathTemplate // nil for random file names
+	stats           *connStats     // with -status
+	budget          *usageBudget
+	hooks           *tunnelHooks
+	transport       string           // the one this connection uses
+	transports      *transportPicker // the -transport list
+	breakGlass      string
+	pollClient      *http.Client  // set with -stream-polls
+	batcher         *batcher      // set with -batch
+	udp             bool          // set for -l udp:PORT flows
+	mux             *muxSession   // set with -mux
+	badPolls        int           // corrupted poll responses in a row
+	upSeq           atomic.Uint64 // bytes uploaded, see sequence.go
+	downSeq         atomic.Uint64 // and received
+	preflight       bool          // set with -carrier auto
+	e2e             bool          // encrypt payloads with the key, set with -e2e
+	earlyData       bool          // set with -early-data
+	cache           *probeCache   // nil with -no-cache
+	resume          bool          // open lost sessions again, set with -resume
+	established     atomic.Bool   // the server has answered for the session
+	compress        []string      // algorithms to offer, set with -compress
+	encoding        string        // how polls should be encoded, see encoding.go
 }
 
 func generateSessionID() string {
@@ -87,6 +123,7 @@ func NewClient(cloudflareHost string, destPort int, scheme string, destAddr stri
 		readBufferSize:  32 * 1024,
 		writeBufferSize: 32 * 1024,
 		pollInterval:    50 * time.Millisecond,
+		idlePoll:        2 * time.Second,
 		batchSize:       32 * 1024,
 		proxyURL:        proxyURL,
 		bufferPool: sync.Pool{
@@ -138,7 +175,7 @@ func NewClient(cloudflareHost string, destPort int, scheme string, destAddr stri
 	// Configure proxy support
 	if proxyURL != "" {
 		if client.debug {
-			client.debugLog("Configuring proxy: %s", proxyURL)
+			client.debugLog("Configuring proxy: %s", redactAddr(proxyURL))
 		}
 
 		proxyURLParsed, err := url.Parse(proxyURL)
@@ -169,7 +206,7 @@ func NewClient(cloudflareHost string, destPort int, scheme string, destAddr stri
 
 			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 				if client.debug {
-					client.debugLog("SOCKS5 dialing %s via %s", addr, proxyURLParsed.Host)
+					client.debugLog("SOCKS5 dialing %s via %s", redactAddr(addr), redactAddr(proxyURLParsed.Host))
 				}
 				return dialer.Dial(network, addr)
 			}
@@ -211,11 +248,24 @@ func (c *Client) createDebugRequest(method, baseURL string, body io.Reader, clos
 	baseURL = strings.TrimPrefix(baseURL, "http://")
 	baseURL = strings.TrimPrefix(baseURL, "https://")
 
+	// Image transport polls must look like image fetches
+	stegoPoll := c.stego == "png" && method == http.MethodGet
+	filename := randomFilename()
+	if len(c.paths) > 0 {
+		filename = randomPath(c.paths, stegoPoll)
+	} else if stegoPoll {
+		filename = randomString(minLen, maxLen) + ".png"
+	}
+
+	if c.pathPrefix != "" {
+		filename = c.pathPrefix + filename
+	}
+
 	var fullURL string
 	if (c.scheme == "https" && c.destPort == 443) || (c.scheme == "http" && c.destPort == 80) {
-		fullURL = fmt.Sprintf("%s://%s/%s", c.scheme, baseURL, randomFilename())
+		fullURL = fmt.Sprintf("%s://%s/%s", c.scheme, baseURL, filename)
 	} else {
-		fullURL = fmt.Sprintf("%s://%s:%d/%s", c.scheme, baseURL, c.destPort, randomFilename())
+		fullURL = fmt.Sprintf("%s://%s:%d/%s", c.scheme, baseURL, c.destPort, filename)
 	}
 
 	req, err := http.NewRequest(method, fullURL, body)
@@ -237,6 +287,9 @@ func (c *Client) createDebugRequest(method, baseURL string, body io.Reader, clos
 	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	if safeEncoding.Load() {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
 	req.Header.Set("Sec-Ch-Ua", "\"Chromium\";v=\"122\", \"Not(A:Brand\";v=\"24\", \"Google Chrome\";v=\"122\"")
 	req.Header.Set("Sec-Ch-Ua-Mobile", "?0")
 	req.Header.Set("Sec-Ch-Ua-Platform", "\"Windows\"")
@@ -256,15 +309,56 @@ func (c *Client) createDebugRequest(method, baseURL string, body io.Reader, clos
 	req.Header.Set("X-Requested-With", encodedDest)
 	req.Header.Set("X-For", c.sessionID)
 
+	if c.breakGlass != "" {
+		req.Header.Set("X-Break-Glass", c.breakGlass)
+	}
+	capabilities := clientCapabilities
+	if c.udp {
+		capabilities = append(capabilities[:len(capabilities):len(capabilities)], "udp")
+	}
+	if c.e2e {
+		capabilities = append(capabilities[:len(capabilities):len(capabilities)], "e2e")
+	}
+	if safeEncoding.Load() {
+		capabilities = append(capabilities[:len(capabilities):len(capabilities)], "safe")
+	}
+	if len(c.compress) > 0 {
+		capabilities = append(capabilities[:len(capabilities):len(capabilities)], c.compress...)
+	}
+	if encoding := c.pollEncodingCapability(); encoding != "" {
+		capabilities = append(capabilities[:len(capabilities):len(capabilities)], encoding)
+	}
+	if c.established.Load() {
+		capabilities = append(capabilities[:len(capabilities):len(capabilities)], "known")
+	}
+	if stegoPoll {
+		capabilities = append(capabilities[:len(capabilities):len(capabilities)], "png")
+		req.Header.Set("Accept", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8")
+		req.Header.Set("Sec-Fetch-Dest", "image")
+		req.Header.Set("Sec-Fetch-Mode", "no-cors")
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		req.Header.Del("Sec-Fetch-User")
+		req.Header.Del("Upgrade-Insecure-Requests")
+	}
+	req.Header.Set("X-Capabilities", strings.Join(capabilities, ","))
+
 	// Conditionally add the X-Connection-Close header
 	if closeConnection {
 		req.Header.Set("X-Connection-Close", "true")
 	}
 
+	if err := c.sign(req); err != nil {
+		return nil, err
+	}
+
 	// Debug logging for headers
 	if c.debug {
-		c.debugLog("Request Headers for %s:", fullURL)
+		c.debugLog("Request Headers for %s:", redactAddr(fullURL))
 		for k, v := range req.Header {
+			if redactLogs {
+				c.debugLog("  %s", k)
+				continue
+			}
 			c.debugLog("  %s: %s", k, v)
 		}
 	}
@@ -303,39 +397,172 @@ func (c *Client) handleConnection(conn net.Conn) {
 		})
 	}
 
+	// Set once the server hands the session to another client
+	var takenOver atomic.Bool
+	noteTakenOver := func(err error) {
+		if errors.Is(err, errSessionTakenOver) && takenOver.CompareAndSwap(false, true) {
+			log.Printf("Connection %s was taken over by another client, closing it", redactID(sessionID[:8]))
+		}
+	}
+
 	c.sessions.Store(sessionID, sessionInfo)
-	defer c.sessions.Delete(sessionID)
+	defer func() { c.sessions.Delete(sessionID) }()
 	defer safeClose()
 
-	// Start the polling goroutine
-	go func() {
-		ticker := time.NewTicker(c.pollInterval)
-		defer ticker.Stop()
+	c.stats = trackConn(sessionID, c.destAddr)
+	defer c.stats.done()
+	if c.stats != nil {
+		conn = &statsConn{Conn: conn, stats: c.stats}
+	}
 
-		for {
-			select {
-			case <-ctx.Done():
+	if c.idleTimeout > 0 || c.maxLifetime > 0 || c.watchdog > 0 {
+		tracked := newActivityConn(conn)
+		conn = tracked
+		sessionInfo.conn = tracked
+		go c.enforceLimits(tracked, sessionID, sessionInfo.done)
+	}
+
+	if c.mux != nil {
+		c.stats.noteTransport("mux")
+		c.mux.relay(conn, c.destAddr)
+		return
+	}
+	if c.preflight {
+		c.preflightCarriers(ctx)
+	}
+	// Try the -transport list in order until one connects
+	plain := conn
+	var events *http.Response // with sse
+	var eventClient *http.Client
+	candidates := c.transports.candidates()
+	for i, transport := range candidates {
+		if i > 0 {
+			// The server may have opened a session for the failed attempt
+			c.sessions.Delete(sessionID)
+			sessionID = generateSessionID()
+			c.sessionID = sessionID
+			c.sessions.Store(sessionID, sessionInfo)
+		}
+		c.transport = transport
+		c.stats.noteTransport(transport)
+		conn = plain
+		if c.e2e {
+			sealed, err := newSealedConn(conn, c.key, sessionID, "client", "server")
+			if err != nil {
+				log.Printf("Error setting up encryption for connection %s: %v", redactID(sessionID[:8]), err)
+				return
+			}
+			conn = sealed
+		}
+
+		var err error
+		switch transport {
+		case "ws":
+			var ws *websocket.Conn
+			if ws, err = c.connectWebSocket(ctx, sessionID); err == nil {
+				c.transportWorked(transport)
+				c.runWebSocket(ctx, sessionID, conn, ws)
+				return
+			}
+		case "h2", "h3":
+			var pw *io.PipeWriter
+			var resp *http.Response
+			if pw, resp, err = c.connectStream(ctx, sessionID); err == nil {
+				c.transportWorked(transport)
+				c.runStream(ctx, sessionID, conn, pw, resp)
+				return
+			}
+		case "sse":
+			// Downstream data arrives on one long GET, uploads stay POSTs
+			eventClient = c.longRequestClient()
+			events, err = c.connectEventStream(ctx, eventClient, sessionID)
+		}
+		if err == nil {
+			c.transportWorked(transport)
+			break
+		}
+		c.transportFailed(transport)
+		if i == len(candidates)-1 || ctx.Err() != nil {
+			if ctx.Err() == nil {
+				// Maybe what the client remembers is out of date
+				c.cache.forget()
+			}
+			log.Printf("Transport %s failed for connection %s: %v", transport, redactID(sessionID[:8]), err)
+			return
+		}
+		log.Printf("Transport %s failed for connection %s, trying %s: %v", transport, redactID(sessionID[:8]), candidates[i+1], err)
+	}
+
+	var pacer *pollPacer // with polling
+	if c.transport == "sse" {
+		go func() {
+			c.runEventStream(ctx, eventClient, sessionID, conn, events)
+			safeClose()
+			conn.Close()
+		}()
+	} else {
+		pacer = newPollPacer(c.pollInterval, c.idlePoll)
+		pacer.cover = c.cover
+		if c.connectWait > 0 {
+			if err := c.waitForSession(ctx, sessionID, conn); err != nil {
+				log.Printf("Tunnel not ready after %s, dropping connection: %v", c.connectWait, err)
 				return
-			case <-sessionInfo.done:
+			}
+		}
+		c.checkTransforms(ctx)
+		if c.earlyData {
+			if err := c.sendEarlyData(ctx, sessionID, conn, buffer); err != nil {
+				log.Printf("Early data for connection %s failed: %v", redactID(sessionID[:8]), err)
 				return
-			case <-ticker.C:
-				if err := c.pollData(ctx, sessionID, conn); err != nil {
+			}
+		}
+
+		// Start the polling goroutine
+		go func() {
+			timer := time.NewTimer(c.pollInterval)
+			defer timer.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-sessionInfo.done:
+					return
+				case <-pacer.wake:
+					pacer.next(true)
+					timer.Stop()
+				case <-timer.C:
+				}
+				held := c.pollClient != nil
+				counted := &countingConn{Conn: conn}
+				if err := c.pollData(ctx, sessionID, counted, held); err != nil {
 					if !strings.Contains(err.Error(), "EOF") {
-						c.debugLog("Poll error for connection %s: %v", sessionID, err)
+						c.debugLog("Poll error for connection %s: %v", redactID(sessionID), err)
 					}
 					safeClose()
+					if errors.Is(err, errSessionUnknown) {
+						dropLost(sessionID, plain)
+					}
+					noteTakenOver(err)
+					conn.Close()
 					return
 				}
+				// Held polls wait for data on the server already
+				timer.Reset(pacer.next(held || counted.written > 0))
 			}
-		}
-	}()
+		}()
+	}
+
+	if c.cover > 0 {
+		go c.sendCover(ctx, sessionID, sessionInfo.done)
+	}
 
 	// Main read loop - directly handle data without channels
 	for {
 		n, err := conn.Read(buffer)
 		if err != nil {
 			if err != io.EOF {
-				c.debugLog("Read error for connection %s: %v", sessionID, err)
+				c.debugLog("Read error for connection %s: %v", redactID(sessionID), err)
 			}
 			safeClose()
 			break
@@ -344,56 +571,145 @@ func (c *Client) handleConnection(conn net.Conn) {
 			data := make([]byte, n)
 			copy(data, buffer[:n])
 			if err := c.sendData(ctx, sessionID, data, false); err != nil {
-				c.debugLog("Send error for connection %s: %v", sessionID, err)
+				c.debugLog("Send error for connection %s: %v", redactID(sessionID), err)
 				safeClose()
+				if errors.Is(err, errSessionUnknown) {
+					dropLost(sessionID, plain)
+				}
+				noteTakenOver(err)
 				break
 			}
+			pacer.kick()
 		}
 	}
 
-	// Send connection termination notification
+	// Send connection termination notification, unless the session isn't
+	// this client's any more
+	if takenOver.Load() {
+		return
+	}
 	req, err := c.createDebugRequest(http.MethodPost, c.cloudflareHost, nil, true)
 	if err == nil {
 		req = req.WithContext(context.Background())
 		req.Header.Set("X-For", sessionID)
 		req.Header.Set("X-Connection-Close", "true")
-		resp, err := c.httpClient.Do(req)
+		resp, err := c.do(c.httpClient, req)
 		if err == nil {
 			resp.Body.Close()
 		}
 	}
 }
 
-func (c *Client) sendData(ctx context.Context, sessionID string, data []byte, closeConnection bool) error {
-	if c.debug {
-		c.debugLog("Sending data for session %s: %d bytes, closeConnection: %v", sessionID[:8], len(data), closeConnection)
+// do sends a tunnel request, as part of a batch with -batch.
+func (c *Client) do(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	if c.batcher != nil {
+		return c.batcher.do(req)
 	}
-
-	req, err := c.createDebugRequest(http.MethodPost, c.cloudflareHost, bytes.NewReader(data), closeConnection)
-	if err != nil {
-		return err
+	c.carry(req)
+	c.padRequest(req)
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err == nil {
+		serverDrain.note(resp, c.hooks)
+		if httpClient != c.pollClient {
+			// Held polls take as long as the server likes
+			c.stats.noteRTT(time.Since(start))
+		}
 	}
+	return resp, err
+}
 
-	req = req.WithContext(ctx)
-	req.Header.Set("X-For", sessionID)
-
-	resp, err := c.httpClient.Do(req)
+func (c *Client) sendData(ctx context.Context, sessionID string, data []byte, closeConnection bool) error {
+	resp, err := c.postData(ctx, sessionID, data, closeConnection, false)
 	if err != nil {
 		return err
 	}
+	if sessionUnknown(resp) {
+		// What the server didn't take goes into the session opened again
+		resp.Body.Close()
+		if err := c.lostSession(sessionID); err != nil {
+			return err
+		}
+		if resp, err = c.postData(ctx, sessionID, data, closeConnection, false); err != nil {
+			return err
+		}
+	}
 	defer resp.Body.Close()
 
 	if c.debug {
-		c.debugLog("Received response for session %s: %d", sessionID[:8], resp.StatusCode)
+		c.debugLog("Received response for session %s: %d", redactID(sessionID[:8]), resp.StatusCode)
+	}
+
+	if sessionTakenOver(resp) {
+		return errSessionTakenOver
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		err := c.statusError(resp)
+		c.hooks.report(err)
+		return err
 	}
 
+	c.upSeq.Add(uint64(len(data)))
+	noteSequenced(resp)
+	noteCompression(resp)
+	c.established.Store(true)
+	c.hooks.report(nil)
 	return nil
 }
 
+// postData uploads data, sending it again if it arrives corrupted, and
+// returns the response. With early set the request may open the session
+// and is answered like a poll.
+func (c *Client) postData(ctx context.Context, sessionID string, data []byte, closeConnection, early bool) (*http.Response, error) {
+	if c.debug {
+		c.debugLog("Sending data for session %s: %s bytes, closeConnection: %v", redactID(sessionID[:8]), redactSize(len(data)), closeConnection)
+	}
+
+	body, packed := c.packUpload(data)
+	if err := c.budget.add(ctx, len(body)); err != nil {
+		return nil, err
+	}
+
+	req, err := c.createDebugRequest(http.MethodPost, c.cloudflareHost, bytes.NewReader(body), closeConnection)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("X-For", sessionID)
+	req.Header.Set("X-Checksum", payloadChecksum(body))
+	if packed != "" {
+		req.Header.Set("X-Packed", packed)
+	}
+	req.Header.Set("X-Seq", strconv.FormatUint(c.upSeq.Load(), 10))
+	if early {
+		req.Header.Set("X-Capabilities", req.Header.Get("X-Capabilities")+",early")
+	}
+
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		resp, err = c.retryLost(ctx, sessionID, "Upload", func() (*http.Response, error) {
+			return c.withStepUp(func(code string) (*http.Response, error) {
+				signed, err := c.withOneTimeCode(req, code)
+				if err != nil {
+					return nil, err
+				}
+				return c.do(c.httpClient, signed)
+			})
+		})
+		if err != nil {
+			c.hooks.report(err)
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnprocessableEntity || attempt > checksumRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+		log.Printf("Upload for connection %s arrived corrupted, sending it again", redactID(sessionID[:8]))
+	}
+}
+
 func (c *Client) handleResponse(resp *http.Response, body []byte) {
 	if resp.StatusCode != http.StatusOK {
 		// Format error message
@@ -444,7 +760,20 @@ func (c *Client) handleResponse(resp *http.Response, body []byte) {
 	// ... handle successful response ...
 }
 
-func (c *Client) pollData(ctx context.Context, sessionID string, conn net.Conn) error {
+// statusError is the error for a response that isn't a 200.
+func (c *Client) statusError(resp *http.Response) error {
+	if resp.Header.Get("X-Destination-Unhealthy") != "" {
+		// The server's health probe for it is failing, there's no point
+		// trying again right away
+		log.Printf("Server reports %s as unhealthy, dropping connection", redactAddr(c.destAddr))
+		return fmt.Errorf("destination unhealthy")
+	}
+	return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+}
+
+// pollData fetches whatever the server has for a session. A held poll may be
+// kept open by the server, which then streams data into it (-stream-polls).
+func (c *Client) pollData(ctx context.Context, sessionID string, conn net.Conn, held bool) error {
 	req, err := c.createDebugRequest(http.MethodGet, c.cloudflareHost, nil, false)
 	if err != nil {
 		return err
@@ -452,17 +781,63 @@ func (c *Client) pollData(ctx context.Context, sessionID string, conn net.Conn)
 
 	req = req.WithContext(ctx)
 	req.Header.Set("X-For", sessionID)
+	req.Header.Set("X-Ack", strconv.FormatUint(c.downSeq.Load(), 10))
+	if c.badPolls > 0 {
+		req.Header.Set("X-Resend", "1")
+	}
 
-	resp, err := c.httpClient.Do(req)
+	httpClient := c.httpClient
+	if held {
+		httpClient = c.pollClient
+		req.Header.Set("X-Capabilities", req.Header.Get("X-Capabilities")+",chunked")
+	}
+	send := func() (*http.Response, error) {
+		return c.withStepUp(func(code string) (*http.Response, error) {
+			attempt, err := c.withOneTimeCode(req, code)
+			if err != nil {
+				return nil, err
+			}
+			return c.do(httpClient, attempt)
+		})
+	}
+	var resp *http.Response
+	if held {
+		// Streamed polls aren't numbered
+		resp, err = send()
+	} else {
+		resp, err = c.retryLost(ctx, sessionID, "Poll", send)
+	}
 	if err != nil {
+		c.hooks.report(err)
 		return err
 	}
+	return c.readPoll(ctx, resp, sessionID, conn)
+}
+
+// readPoll writes what a poll response brings to conn.
+func (c *Client) readPoll(ctx context.Context, resp *http.Response, sessionID string, conn net.Conn) error {
 	defer resp.Body.Close()
 
+	if sessionUnknown(resp) {
+		return c.lostSession(sessionID)
+	}
+	if sessionTakenOver(resp) {
+		return errSessionTakenOver
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, c.maxBodySize))
 		c.handleResponse(resp, body)
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		err := c.statusError(resp)
+		c.hooks.report(err)
+		return err
+	}
+	c.established.Store(true)
+	c.hooks.report(nil)
+	noteSequenced(resp)
+	noteCompression(resp)
+
+	if resp.Header.Get("X-Accel-Buffering") == "no" {
+		return c.readStreamedPoll(ctx, resp, conn)
 	}
 
 	data, err := io.ReadAll(io.LimitReader(resp.Body, c.maxBodySize))
@@ -470,9 +845,32 @@ func (c *Client) pollData(ctx context.Context, sessionID string, conn net.Conn)
 		return err
 	}
 
+	if err := c.budget.add(ctx, len(data)); err != nil {
+		return err
+	}
+
+	if c.stego == "png" && strings.HasPrefix(resp.Header.Get("Content-Type"), "image/png") {
+		decoded, err := decodePNG(data)
+		if err != nil {
+			return err
+		}
+		if ok, err := c.verifyPoll(resp, decoded, sessionID); !ok {
+			return err
+		}
+		if decoded, err = unpackPoll(resp, decoded); err != nil {
+			return err
+		}
+		if _, err := conn.Write(c.inSequence(resp, decoded)); err != nil {
+			return fmt.Errorf("error writing to connection: %v", err)
+		}
+		return nil
+	}
+
 	if len(data) > 0 {
-		// Check for HTML responses that indicate errors
-		if bytes.Contains(data, []byte("<!DOCTYPE html>")) || bytes.Contains(data, []byte("<html>")) {
+		// Check for HTML responses that indicate errors. Servers that say
+		// how they encoded a response did answer, and binary data may well
+		// be HTML
+		if resp.Header.Get("X-Encoding") == "" && (bytes.Contains(data, []byte("<!DOCTYPE html>")) || bytes.Contains(data, []byte("<html>"))) {
 			switch {
 			case bytes.Contains(data, []byte("Index of /")):
 				return fmt.Errorf("server returned directory listing")
@@ -489,12 +887,23 @@ func (c *Client) pollData(ctx context.Context, sessionID string, conn net.Conn)
 			}
 		}
 
-		decoded, err := hex.DecodeString(string(data))
+		data, err = unpad(resp, data)
 		if err != nil {
+			return err
+		}
+
+		decoded, err := decodePoll(resp, data)
+		if err != nil && resp.Header.Get("X-Checksum") == "" {
 			return fmt.Errorf("error decoding data: %v", err)
 		}
+		if ok, err := c.verifyPoll(resp, decoded, sessionID); !ok {
+			return err
+		}
+		if decoded, err = unpackPoll(resp, decoded); err != nil {
+			return err
+		}
 
-		_, err = conn.Write(decoded)
+		_, err = conn.Write(c.inSequence(resp, decoded))
 		if err != nil {
 			return fmt.Errorf("error writing to connection: %v", err)
 		}
@@ -509,50 +918,123 @@ func main() {
 	var destAddr string
 	var debug bool
 	var proxyURL string
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "DarkFlare Client - TCP-over-CDN tunnel client component\n")
-		fmt.Fprintf(os.Stderr, "(c) 2024 Barrett Lyon\n\n")
-		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		fmt.Fprintf(os.Stderr, "  -l        Local port or stdin:stdout for ProxyCommand mode\n")
-		fmt.Fprintf(os.Stderr, "            Format: <port> or stdin:stdout\n")
-		fmt.Fprintf(os.Stderr, "            Examples: 2222 or stdin:stdout\n\n")
-		fmt.Fprintf(os.Stderr, "  -t        Target URL of your cdn-protected darkflare-server\n")
-		fmt.Fprintf(os.Stderr, "            Format: [http(s)://]hostname[:port]\n")
-		fmt.Fprintf(os.Stderr, "            Default scheme: https, Default ports: 80/443\n")
-		fmt.Fprintf(os.Stderr, "            This server will receive and forward your traffic\n\n")
-		fmt.Fprintf(os.Stderr, "  -d        Destination address for the final connection\n")
-		fmt.Fprintf(os.Stderr, "            Format: hostname:port\n")
-		fmt.Fprintf(os.Stderr, "            This is where your traffic will ultimately be sent\n\n")
-		fmt.Fprintf(os.Stderr, "  -debug    Enable detailed debug logging\n")
-		fmt.Fprintf(os.Stderr, "            Shows connection details, data transfer, and errors\n\n")
-		fmt.Fprintf(os.Stderr, "  -p        Proxy URL for outbound connections\n")
-		fmt.Fprintf(os.Stderr, "            Format: scheme://[user:pass@]host:port\n")
-		fmt.Fprintf(os.Stderr, "            Supported schemes: http, https, socks5\n\n")
-		fmt.Fprintf(os.Stderr, "Examples:\n")
-		fmt.Fprintf(os.Stderr, "  Basic SSH tunnel:\n")
-		fmt.Fprintf(os.Stderr, "    %s -l 2222 -t cdn.example.com -d ssh.target.com:22\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  SSH ProxyCommand mode:\n")
-		fmt.Fprintf(os.Stderr, "    ssh -o ProxyCommand=\"%s -l stdin:stdout -t cdn.example.com -d localhost:22\" user@remote\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  Usage with SSH ProxyCommand:\n")
-		fmt.Fprintf(os.Stderr, "    Add to ~/.ssh/config:\n")
-		fmt.Fprintf(os.Stderr, "      Host remote.example.com\n")
-		fmt.Fprintf(os.Stderr, "        ProxyCommand %s -l stdin:stdout -t cdn.example.com -d localhost:22\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "    Then simply: ssh remote.example.com\n\n")
-		fmt.Fprintf(os.Stderr, "Notes:\n")
-		fmt.Fprintf(os.Stderr, "  - Proxy authentication is supported via URL format user:pass@host\n")
-		fmt.Fprintf(os.Stderr, "  - SOCKS5 variant will resolve hostnames through the proxy\n")
-		fmt.Fprintf(os.Stderr, "  - Debug mode will show proxy connection details and errors\n\n")
-		fmt.Fprintf(os.Stderr, "For more information: https://github.com/doxx/darkflare\n")
+	var psk string
+	var configFile string
+	var encryptConfigPath string
+	var useKeyring bool
+	var keyringSet bool
+	var pskKDF string
+	var stego string
+	var redeem string
+	var connectWait time.Duration
+	var idleTimeout time.Duration
+	var maxLifetime time.Duration
+	var watchdog time.Duration
+	var resume bool
+	var maxSessions int
+	var lowMemory bool
+	var certFile string
+	var keyFile string
+	var pathPrefix string
+	var budget string
+	var budgetFile string
+	var cacheFile string
+	var noCache bool
+	var budgetThrottle string
+	var onUp string
+	var onDown string
+	var onDrain string
+	var onFailover string
+	var transport string
+	var breakGlass string
+	var socks5Addr string
+	var httpProxyAddr string
+	var tunMode bool
+	var tunRoutes string
+	var muxMode bool
+	var carrierMode string
+	var e2e bool
+	var earlyData bool
+	var batchWindow time.Duration
+	var streamPolls bool
+	var pollInterval time.Duration
+	var idlePoll time.Duration
+	var cover time.Duration
+	var endpointsKey string
+	var pathTemplates string
+	var compress string
+	var encoding string
+	var statusAddr string
+
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		runServiceCommand(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "update" {
+		runUpdateCommand(os.Args[2:])
 	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		runWatchCommand(os.Args[2:])
+	}
+
+	flag.Usage = usage
 
 	flag.StringVar(&localAddr, "l", "", "")
 	flag.StringVar(&targetURL, "t", "", "")
 	flag.StringVar(&destAddr, "d", "", "")
 	flag.BoolVar(&debug, "debug", false, "")
+	flag.BoolVar(&redactLogs, "redact", false, "Hash destinations and omit sizes in logs")
 	flag.StringVar(&proxyURL, "p", "", "Proxy URL (http://host:port or socks5://host:port)")
+	flag.StringVar(&psk, "psk", "", "Pre-shared key (format: id:secret)")
+	flag.StringVar(&pskKDF, "psk-kdf", "", "Key derivation for password-style keys (argon2id[:t=,m=,p=])")
+	flag.StringVar(&stego, "stego", "", "Experimental image transport for downstream data (png)")
+	flag.StringVar(&configFile, "config", "", "Config file (plain or encrypted JSON)")
+	flag.StringVar(&encryptConfigPath, "encrypt-config", "", "Encrypt a config file and exit")
+	flag.BoolVar(&useKeyring, "use-keyring", false, "Read the pre-shared key from the system keyring")
+	flag.BoolVar(&keyringSet, "keyring-set", false, "Store -psk in the system keyring and exit")
+	flag.StringVar(&transport, "transport", "poll", "Tunnel transports in order of preference (poll, ws, h2, h3, sse)")
+	flag.DurationVar(&connectWait, "connect-wait", 0, "How long to hold local connections while the tunnel comes up")
+	flag.StringVar(&budget, "budget", "", "Monthly transfer budget (e.g. 50GB)")
+	flag.StringVar(&budgetThrottle, "budget-throttle", "", "Bytes per second once the budget is used up (e.g. 128KB)")
+	flag.StringVar(&budgetFile, "budget-file", "", "Monthly usage file")
+	flag.StringVar(&cacheFile, "cache-file", "", "File that keeps probe results across restarts")
+	flag.BoolVar(&noCache, "no-cache", false, "Don't use or update the probe cache")
+	flag.StringVar(&pathTemplates, "paths", "random", "Request path templates (random, site, @FILE or TEMPLATE,...)")
+	flag.StringVar(&pathPrefix, "path-prefix", "", "URL path prefix the server is mounted under")
+	flag.StringVar(&breakGlass, "break-glass", "", "Break-glass token from the server admin")
+	flag.StringVar(&socks5Addr, "socks5", "", "SOCKS5 listen address (e.g. 127.0.0.1:1080)")
+	flag.StringVar(&httpProxyAddr, "http-proxy", "", "HTTP proxy listen address (e.g. 127.0.0.1:8118)")
+	flag.BoolVar(&tunMode, "tun", false, "Carry whole-device traffic through a TUN device")
+	flag.StringVar(&tunRoutes, "tun-routes", "", "Networks to route through -tun (CIDRs or default)")
+	flag.BoolVar(&muxMode, "mux", false, "Carry all local connections over one tunnel session")
+	flag.BoolVar(&e2e, "e2e", false, "Encrypt tunnel data end to end with a key derived from -psk")
+	flag.BoolVar(&earlyData, "early-data", false, "Send a connection's first bytes with the request that opens its session")
+	flag.StringVar(&carrierMode, "carrier", "header", "Where requests carry the tunnel's fields (header, cookie, query or auto)")
+	flag.DurationVar(&batchWindow, "batch", 0, "Collect requests of all connections this long and send them together")
+	flag.BoolVar(&streamPolls, "stream-polls", false, "Let the server hold polls open and stream into them")
+	flag.DurationVar(&pollInterval, "poll-interval", 50*time.Millisecond, "Poll this often while data flows")
+	flag.DurationVar(&idlePoll, "idle-poll", 2*time.Second, "Back off to polling this often while idle")
+	flag.DurationVar(&cover, "cover", 0, "Send cover traffic and pad requests, at random intervals around this")
+	flag.StringVar(&compress, "compress", "", "Compress payloads when the server agrees (zstd, gzip, in order of preference)")
+	flag.StringVar(&encoding, "encoding", "auto", "How poll responses are encoded (auto, binary, base64 or hex)")
+	flag.StringVar(&endpointsKey, "endpoints-key", "", "Public key the server's endpoints list is signed with (base64), to fall back to it")
+	flag.StringVar(&certFile, "cert", "", "Client certificate for mTLS at the edge")
+	flag.StringVar(&keyFile, "key", "", "Private key for -cert")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "Close local connections idle for this long")
+	flag.DurationVar(&maxLifetime, "max-lifetime", 0, "Close local connections open for this long")
+	flag.DurationVar(&watchdog, "watchdog", 0, "Reset local connections unanswered for this long")
+	flag.BoolVar(&resume, "resume", false, "Open sessions the server lost again instead of resetting")
+	flag.StringVar(&statusAddr, "status", "", "Serve live connection stats for watch on this address (e.g. 127.0.0.1:9091)")
+	defaultMaxSessions := 0
+	if routerBuild {
+		defaultMaxSessions = 32
+	}
+	flag.IntVar(&maxSessions, "max-sessions", defaultMaxSessions, "Local connections to tunnel at once")
+	flag.BoolVar(&lowMemory, "low-memory", routerBuild, "Small buffers and a soft memory limit")
+	flag.StringVar(&onUp, "on-up", "", "Command to run when the tunnel comes up")
+	flag.StringVar(&onDown, "on-down", "", "Command to run when the tunnel goes down")
+	flag.StringVar(&onDrain, "on-drain", "", "Command to run when the server is shutting down")
+	flag.StringVar(&onFailover, "on-failover", "", "Command to run when connecting via the endpoints list instead of -t")
+	flag.StringVar(&redeem, "redeem", "", "Redeem an invitation into the -config file and exit")
 	flag.Parse()
 
 	if len(os.Args) == 1 {
@@ -560,54 +1042,417 @@ func main() {
 		os.Exit(1)
 	}
 
-	if localAddr == "" || targetURL == "" || destAddr == "" {
+	if encryptConfigPath != "" {
+		out, err := encryptConfigFile(encryptConfigPath)
+		if err != nil {
+			log.Fatalf("Failed to encrypt config: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Encrypted config written to %s\n", out)
+		fmt.Fprintf(os.Stderr, "Remember to securely delete %s\n", encryptConfigPath)
+		return
+	}
+
+	if redeem != "" {
+		if configFile == "" {
+			log.Fatal("-redeem requires -config to save the credential to")
+		}
+		inv, err := parseInvitation(redeem)
+		if err != nil {
+			log.Fatalf("Invalid -redeem: %v", err)
+		}
+		targetURL, destAddr = inv.Endpoint, inv.Dest
+	} else if configFile != "" {
+		cfg, err := loadClientConfig(configFile)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		if err := cfg.apply(); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+	}
+
+	proxyMode := socks5Addr != "" || httpProxyAddr != ""
+	if keyringSet {
+		if targetURL == "" || psk == "" {
+			fmt.Fprintf(os.Stderr, "Error: -keyring-set requires -t and -psk\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if tunMode && (targetURL == "" || localAddr != "" || destAddr != "" || proxyMode) {
+		fmt.Fprintf(os.Stderr, "Error: -tun requires -t and replaces -l, -d, -socks5 and -http-proxy\n\n")
+		flag.Usage()
+		os.Exit(1)
+	} else if proxyMode && (targetURL == "" || (localAddr != "") != (destAddr != "")) {
+		fmt.Fprintf(os.Stderr, "Error: -socks5 and -http-proxy require -t (and -l and -d go together)\n\n")
+		flag.Usage()
+		os.Exit(1)
+	} else if !proxyMode && !tunMode && redeem == "" && (localAddr == "" || targetURL == "" || destAddr == "") {
 		fmt.Fprintf(os.Stderr, "Error: -l, -t, and -d parameters are required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	var routes []string
+	if tunMode {
+		destAddr = tunDestination
+		var err error
+		routes, err = parseTunRoutes(tunRoutes)
+		if err != nil {
+			log.Fatalf("Invalid -tun-routes: %v", err)
+		}
+	} else if tunRoutes != "" {
+		log.Fatal("-tun-routes requires -tun")
+	}
+	if muxMode && (tunMode || strings.HasPrefix(localAddr, "udp:")) {
+		log.Fatal("-mux carries TCP connections only, not -tun or -l udp:PORT")
+	}
+	switch carrierMode {
+	case "header", "cookie", "query":
+		activeCarrier.Store(carrierMode)
+	case "auto":
+	default:
+		log.Fatalf("Invalid -carrier: %s (use header, cookie, query or auto)", carrierMode)
+	}
+
 	// Parse the target URL
 	if !strings.Contains(targetURL, "://") {
 		targetURL = "https://" + targetURL
 	}
-	u, err := url.Parse(targetURL)
+	scheme, host, destPort, _, err := parseTarget(targetURL)
 	if err != nil {
 		log.Fatalf("Invalid target URL: %v", err)
 	}
 
-	// Extract scheme
-	scheme := strings.ToLower(u.Scheme)
-	if scheme != "http" && scheme != "https" {
-		log.Fatal("Scheme must be either 'http' or 'https'")
+	if debug {
+		log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+		log.Printf("Debug mode enabled")
 	}
 
-	// Extract host and port
-	host := u.Hostname()
-	port := u.Port()
-	destPort := 443
-	if port != "" {
-		destPort, err = strconv.Atoi(port)
+	if redeem != "" {
+		client := NewClient(host, destPort, scheme, destAddr, debug, proxyURL)
+		if client == nil {
+			log.Fatal("Failed to create client")
+		}
+		cfg, err := client.redeemInvite(redeem)
 		if err != nil {
-			log.Fatalf("Invalid port number: %v", err)
+			log.Fatalf("Failed to redeem invitation: %v", err)
+		}
+		cfg.Listen = localAddr
+		cfg.Proxy = proxyURL
+		if err := saveClientConfig(configFile, cfg); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
 		}
-	} else if scheme == "http" {
-		destPort = 80
+		inv, _ := parseInvitation(redeem)
+		fmt.Fprintf(os.Stderr, "Access to %s saved to %s (valid until %s)\n",
+			cfg.Dest, configFile, time.Unix(inv.Expires, 0).Format(time.RFC1123))
+		fmt.Fprintf(os.Stderr, "Start the tunnel with: %s -config %s -l <port>\n", os.Args[0], configFile)
+		return
 	}
 
-	if debug {
-		log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-		log.Printf("Debug mode enabled")
+	if keyringSet {
+		if err := keyringStore(host, psk); err != nil {
+			log.Fatalf("Failed to store key in keyring: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Key for %s stored in the system keyring\n", host)
+		return
+	}
+
+	if useKeyring {
+		if psk != "" {
+			log.Fatal("-use-keyring cannot be combined with -psk")
+		}
+		psk, err = keyringLoad(host)
+		if err != nil {
+			log.Fatalf("Failed to read key from keyring: %v", err)
+		}
+	}
+
+	if stego != "" && stego != "png" {
+		log.Fatalf("Unsupported -stego format: %s", stego)
+	}
+	transportOrder, err := parseTransports(transport)
+	if err != nil {
+		log.Fatalf("Invalid -transport: %v", err)
+	}
+	for _, t := range transportOrder {
+		if (t == "h2" || t == "h3") && scheme != "https" {
+			log.Fatalf("-transport %s needs an https target", t)
+		}
+		if t == "h3" && !haveH3 {
+			log.Fatal("-transport h3 isn't in this build (built with -tags noh3 or router), use h2")
+		}
+		if t == "h3" && proxyURL != "" {
+			log.Fatal("-transport h3 can't go through -p proxies (QUIC runs over UDP)")
+		}
+	}
+	transports := newTransportPicker(transportOrder)
+	if transport != "poll" && stego != "" {
+		log.Fatal("-stego only works with -transport poll")
+	}
+	if streamPolls && (transport != "poll" || stego != "") {
+		log.Fatal("-stream-polls only works with -transport poll and without -stego")
+	}
+	if batchWindow < 0 {
+		log.Fatalf("Invalid -batch: %s", batchWindow)
+	}
+	if pollInterval <= 0 {
+		log.Fatalf("Invalid -poll-interval: %s", pollInterval)
+	}
+	if idlePoll < pollInterval {
+		log.Fatalf("Invalid -idle-poll: %s (at least -poll-interval)", idlePoll)
+	}
+	if cover < 0 || (cover > 0 && cover < pollInterval) {
+		log.Fatalf("Invalid -cover: %s (at least -poll-interval)", cover)
+	}
+	if batchWindow > 0 && (transport != "poll" || streamPolls) {
+		log.Fatal("-batch only works with -transport poll and without -stream-polls")
+	}
+	compression, err := parseCompression(compress)
+	if err != nil {
+		log.Fatalf("Invalid -compress: %v", err)
+	}
+	if err := validPollEncoding(encoding); err != nil {
+		log.Fatalf("Invalid -encoding: %v", err)
+	}
+	paths, err := parsePaths(pathTemplates)
+	if err != nil {
+		log.Fatalf("Invalid -paths: %v", err)
+	}
+
+	var keyID string
+	var key []byte
+	if psk != "" {
+		keyID, key, err = parseKey(psk)
+		if err != nil {
+			log.Fatalf("Invalid -psk: %v", err)
+		}
+		if pskKDF != "" {
+			params, err := parseKDF(pskKDF)
+			if err != nil {
+				log.Fatalf("Invalid -psk-kdf: %v", err)
+			}
+			key = params.deriveKey(keyID, key)
+		}
+	}
+	if earlyData && localAddr == "stdin:stdout" {
+		log.Fatal("-early-data doesn't work with -l stdin:stdout, stdin can't be read with a timeout")
+	}
+	if e2e && key == nil {
+		log.Fatal("-e2e needs -psk, the encryption key is derived from it")
+	}
+
+	var clientCert *tls.Certificate
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			log.Fatal("-cert and -key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load client certificate: %v", err)
+		}
+		clientCert = &cert
+	}
+
+	var usage *usageBudget
+	if budget != "" {
+		limit, err := parseByteSize(budget)
+		if err != nil {
+			log.Fatalf("Invalid -budget: %v", err)
+		}
+		var throttle int64
+		if budgetThrottle != "" {
+			if throttle, err = parseByteSize(budgetThrottle); err != nil {
+				log.Fatalf("Invalid -budget-throttle: %v", err)
+			}
+		}
+		usage, err = newUsageBudget(limit, budgetFile, throttle)
+		if err != nil {
+			log.Fatalf("Failed to load bandwidth usage: %v", err)
+		}
+	} else if budgetThrottle != "" {
+		log.Fatal("-budget-throttle requires -budget")
+	}
+
+	var cache *probeCache
+	var hooks *tunnelHooks
+	if onUp != "" || onDown != "" || onDrain != "" || onFailover != "" {
+		listen := localAddr
+		if listen == "" {
+			listen = strings.TrimPrefix(socks5Addr+","+httpProxyAddr, ",")
+			listen = strings.TrimSuffix(listen, ",")
+		}
+		hooks = newTunnelHooks(onUp, onDown, onDrain, onFailover, targetURL, destAddr, listen)
+	}
+
+	if lowMemory {
+		lowMemoryRuntime()
+	}
+	sessionLimit = newSessionSlots(maxSessions)
+
+	var batch *batcher
+	var mux *muxSession
+	var edgeIP string
+	newClient := func() *Client {
+		client := NewClient(host, destPort, scheme, destAddr, debug, proxyURL)
+		if client != nil {
+			client.keyID = keyID
+			client.key = key
+			client.stego = stego
+			client.connectWait = connectWait
+			client.pollInterval = pollInterval
+			client.idlePoll = idlePoll
+			client.cover = cover
+			client.idleTimeout = idleTimeout
+			client.maxLifetime = maxLifetime
+			client.watchdog = watchdog
+			client.resume = resume
+			client.pathPrefix = normalizePathPrefix(pathPrefix)
+			client.paths = paths
+			client.budget = usage
+			client.hooks = hooks
+			client.transport = transportOrder[0]
+			client.transports = transports
+			client.breakGlass = breakGlass
+			client.connectTo(edgeIP)
+			if clientCert != nil {
+				client.useClientCertificate(clientCert)
+			}
+			if streamPolls {
+				client.pollClient = client.longRequestClient()
+			}
+			client.batcher = batch
+			client.mux = mux
+			client.preflight = carrierMode == "auto"
+			client.e2e = e2e
+			client.earlyData = earlyData
+			client.compress = compression
+			client.encoding = encoding
+			client.cache = cache
+			if lowMemory {
+				client.useLowMemory()
+			}
+		}
+		return client
+	}
+	if endpointsKey != "" {
+		publicKey, err := base64.StdEncoding.DecodeString(endpointsKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			log.Fatalf("Invalid -endpoints-key: not a base64 Ed25519 public key")
+		}
+		book, err := newEndpointBook(cacheFile, publicKey)
+		if err != nil {
+			log.Fatalf("Failed to keep the endpoints list: %v", err)
+		}
+		book.hooks = hooks
+		// -t keeps -path-prefix, the list's entries have theirs in the URL
+		flagPrefix := pathPrefix
+		use := func(e endpoint) error {
+			var prefix string
+			var err error
+			if scheme, host, destPort, prefix, err = parseTarget(e.URL); err != nil {
+				return err
+			}
+			pathPrefix = prefix
+			if e.URL == targetURL {
+				pathPrefix = flagPrefix
+			}
+			edgeIP = e.IP
+			return nil
+		}
+		chosen := book.bootstrap(endpoint{URL: targetURL}, func(e endpoint) (*Client, error) {
+			if err := use(e); err != nil {
+				return nil, err
+			}
+			client := newClient()
+			if client == nil {
+				return nil, errors.New("failed to create client")
+			}
+			return client, nil
+		})
+		use(chosen)
+		go book.refreshEvery(newClient)
+	}
+
+	if !noCache {
+		server := fmt.Sprintf("%s://%s:%d%s", scheme, host, destPort, normalizePathPrefix(pathPrefix))
+		if cache, err = newProbeCache(cacheFile, server); err != nil {
+			log.Printf("Warning: not keeping probe results across restarts: %v", err)
+		}
+		cache.restore(carrierMode == "auto", transports)
+	}
+
+	if statusAddr != "" {
+		serveStatus(statusAddr)
+	}
+	if muxMode {
+		mux = newMuxSession(newClient)
+	}
+	if batchWindow > 0 {
+		carrier := newClient()
+		if carrier == nil {
+			log.Fatal("Failed to create client")
+		}
+		batch = newBatcher(carrier, batchWindow)
+	}
+
+	if tunMode {
+		pin := []string{host}
+		if edgeIP != "" {
+			pin = append(pin, edgeIP)
+		}
+		if proxy, err := url.Parse(proxyURL); err == nil && proxy.Hostname() != "" {
+			pin = append(pin, proxy.Hostname())
+		}
+		log.Printf("Connecting via %s", redactAddr(fmt.Sprintf("%s://%s:%d", scheme, host, destPort)))
+		runTun(routes, pin, newClient)
+	}
+
+	proxies := []struct {
+		addr, kind string
+		handshake  proxyHandshake
+	}{
+		{socks5Addr, "SOCKS5", socks5Handshake},
+		{httpProxyAddr, "HTTP proxy", httpProxyHandshake},
+	}
+	for _, p := range proxies {
+		if p.addr == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", p.addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("DarkFlare client %s listening on %s", p.kind, listener.Addr())
+		go serveProxy(listener, p.kind, p.handshake, newClient)
+	}
+	if localAddr == "" && proxyMode {
+		log.Printf("Connecting via %s", redactAddr(fmt.Sprintf("%s://%s:%d", scheme, host, destPort)))
+		select {}
 	}
 
 	if localAddr == "stdin:stdout" {
 		// Create client in stdin/stdout mode
-		client := NewClient(host, destPort, scheme, destAddr, debug, proxyURL)
+		client := newClient()
 		// Use os.Stdin and os.Stdout as the connection
 		stdinStdout := &StdinStdoutConn{
 			Reader: os.Stdin,
 			Writer: os.Stdout,
 		}
 		client.handleConnection(stdinStdout)
+	} else if port, ok := strings.CutPrefix(localAddr, "udp:"); ok {
+		localPort, err := strconv.Atoi(port)
+		if err != nil {
+			log.Fatalf("Invalid local port: %v", err)
+		}
+
+		sock, err := net.ListenUDP("udp", &net.UDPAddr{Port: localPort})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("DarkFlare client listening on UDP port %d", localPort)
+		log.Printf("Connecting via %s", redactAddr(fmt.Sprintf("%s://%s:%d", scheme, host, destPort)))
+		serveUDP(sock, newClient)
 	} else {
 		// Parse port number for traditional mode
 		localPort, err := strconv.Atoi(localAddr)
@@ -621,7 +1466,7 @@ func main() {
 		}
 
 		log.Printf("DarkFlare client listening on port %d", localPort)
-		log.Printf("Connecting via %s://%s:%d", scheme, host, destPort)
+		log.Printf("Connecting via %s", redactAddr(fmt.Sprintf("%s://%s:%d", scheme, host, destPort)))
 
 		for {
 			conn, err := listener.Accept()
@@ -630,12 +1475,28 @@ func main() {
 				continue
 			}
 
-			client := NewClient(host, destPort, scheme, destAddr, debug, proxyURL)
-			go client.handleConnection(conn)
+			if !sessionLimit.take(conn) {
+				continue
+			}
+			client := newClient()
+			go func() {
+				defer sessionLimit.release()
+				client.handleConnection(conn)
+			}()
 		}
 	}
 }
 
+// normalizePathPrefix turns "/a/b", "a/b/" etc. into "a/b/" so it can go
+// between the host and the random filename.
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
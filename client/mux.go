@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// muxDestination asks the server for a session that carries yamux streams
+// instead of one TCP connection. Each stream starts with its destination on
+// a line.
+const muxDestination = "mux"
+
+// muxConfig must tolerate writes that wait for a slow POST.
+func muxConfig(debug bool) *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.ConnectionWriteTimeout = time.Minute
+	config.LogOutput = io.Discard
+	if debug {
+		config.LogOutput = os.Stderr
+	}
+	return config
+}
+
+// muxSession carries every local connection of a -mux client as a stream of
+// one tunnel session, so a browser opening dozens of sockets still costs
+// one polling loop. The session is opened on first use and again after it
+// ends.
+type muxSession struct {
+	newClient func() *Client
+
+	mu      sync.Mutex
+	session *yamux.Session
+}
+
+func newMuxSession(newClient func() *Client) *muxSession {
+	return &muxSession{newClient: newClient}
+}
+
+// open starts a stream, opening a new tunnel session if there's none.
+func (m *muxSession) open() (net.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.session != nil && !m.session.IsClosed() {
+		stream, err := m.session.Open()
+		if err == nil {
+			return stream, nil
+		}
+		// A draining server lets the streams it has finish
+		if err != yamux.ErrRemoteGoAway {
+			m.session.Close()
+		}
+	}
+
+	carrier := m.newClient()
+	carrier.destAddr = muxDestination
+	carrier.mux = nil
+	// Limits are for the local connections, not the session they share. The
+	// watchdog stays: yamux keepalives get answered while the session works
+	carrier.idleTimeout = 0
+	carrier.maxLifetime = 0
+
+	local, tunnel := bufferedPipe()
+	session, err := yamux.Client(local, muxConfig(carrier.debug))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		carrier.handleConnection(tunnel)
+		session.Close()
+		carrier.debugLog("Multiplexed session %s closed", redactID(carrier.sessionID[:8]))
+	}()
+	carrier.debugLog("Multiplexed session %s opened", redactID(carrier.sessionID[:8]))
+	m.session = session
+	return session.Open()
+}
+
+// relay carries conn to dest over a stream of the shared session.
+func (m *muxSession) relay(conn net.Conn, dest string) {
+	stream, err := m.open()
+	if err != nil {
+		log.Printf("Error opening stream to %s: %v", redactAddr(dest), err)
+		return
+	}
+	defer stream.Close()
+	if _, err := io.WriteString(stream, dest+"\n"); err != nil {
+		return
+	}
+
+	go func() {
+		io.Copy(stream, conn)
+		// Closing a stream only ends our side of it
+		stream.Close()
+	}()
+	io.Copy(conn, stream)
+}
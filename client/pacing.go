@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// pollPacer spaces a connection's polls: -poll-interval apart while they
+// bring data, and each empty one waits twice as long as the last, up to
+// -idle-poll, so an idle connection costs a request every few seconds
+// instead of twenty a second.
+type pollPacer struct {
+	min, max time.Duration
+	delay    time.Duration
+	cover    time.Duration // with -cover
+	wake     chan struct{}
+}
+
+func newPollPacer(min, max time.Duration) *pollPacer {
+	return &pollPacer{min: min, max: max, delay: min, wake: make(chan struct{}, 1)}
+}
+
+// next returns how long to wait after a poll that brought data or didn't.
+func (p *pollPacer) next(data bool) time.Duration {
+	if p.cover > 0 {
+		// No backoff giving idle away, and no steady beat
+		p.delay = p.min
+		if data {
+			return jitter(p.min)
+		}
+		return max(p.min, coverDelay(p.cover))
+	}
+	if data {
+		p.delay = p.min
+		return p.delay
+	}
+	p.delay *= 2
+	if p.delay > p.max {
+		p.delay = p.max
+	}
+	return p.delay
+}
+
+// kick has the next poll go out now, at full speed again: the local side
+// sent something, and its answer is usually on the way. Uploads of other
+// transports have no pacer to kick.
+func (p *pollPacer) kick() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// countingConn counts what a poll writes to the local connection.
+type countingConn struct {
+	net.Conn
+	written int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += n
+	return n, err
+}
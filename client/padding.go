@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// clientCapabilities are advertised in the X-Capabilities header so the
+// server only uses response features this client understands.
+var clientCapabilities = []string{"pad", "crc", "seq"}
+
+// unpad strips response padding. Padded responses carry the real payload
+// length as the first part of an Apache style ETag; responses without one
+// are returned unchanged.
+func unpad(resp *http.Response, data []byte) ([]byte, error) {
+	etag := strings.TrimPrefix(resp.Header.Get("ETag"), "W/")
+	etag = strings.Trim(etag, "\"")
+	lenHex, _, ok := strings.Cut(etag, "-")
+	if !ok {
+		return data, nil
+	}
+	n, err := strconv.ParseInt(lenHex, 16, 64)
+	if err != nil || n > int64(len(data)) {
+		return nil, fmt.Errorf("invalid padded length %q for %d byte response", lenHex, len(data))
+	}
+	return data[:n], nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request paths come from -paths templates instead of a random name with a
+// random extension, so a tunnel's URLs look like a site's:
+//
+//	/wp-content/uploads/{year}/{month}/{slug}-{num:100-1999}.{jpg|png|webp}
+//	/api/v2/{word}s?page={num:1-40}
+//
+// The server takes any path (under -path-prefix), so clients can change
+// theirs whenever they like.
+
+// sitePaths is -paths site: a blog with a shop and an API behind it.
+var sitePaths = []string{
+	"/wp-content/uploads/{year}/{month}/{slug}-{num:100-1999}.{jpg|png|webp}",
+	"/wp-content/themes/{word}/assets/{word}.{css|js}?ver={num:1-6}.{num:0-9}.{num:0-9}",
+	"/wp-includes/js/{word}.min.js?ver={num:4-6}.{num:0-9}",
+	"/{year}/{month}/{day}/{slug}/",
+	"/blog/{slug}",
+	"/api/v{1|2|3}/{word}s?page={num:1-40}",
+	"/api/v2/{word}s/{num:1000-99999}",
+	"/products/{slug}?variant={num:10000000-99999999}",
+	"/search?q={word}+{word}&page={num:1-9}",
+	"/static/js/{word}.{hex:8}.chunk.js",
+	"/static/css/main.{hex:8}.css",
+	"/assets/img/{slug}@2x.{png|jpg}",
+	"/images/{word}/{hex:12}.jpg",
+	"/fonts/{word}-{regular|bold|italic}.woff2",
+}
+
+// pathWords fill {word} and {slug}.
+var pathWords = []string{
+	"about", "account", "archive", "article", "banner", "blue", "cart",
+	"category", "city", "coffee", "comment", "contact", "cover", "daily",
+	"design", "event", "feature", "garden", "gallery", "guide", "header",
+	"home", "hotel", "house", "image", "kitchen", "light", "logo", "market",
+	"menu", "modern", "music", "news", "order", "page", "photo", "post",
+	"price", "product", "recipe", "review", "sale", "season", "shop",
+	"slider", "spring", "store", "summer", "team", "theme", "travel",
+	"update", "user", "video", "winter", "world",
+}
+
+// pathTemplate is a template split into literal text and placeholders.
+type pathTemplate []func() string
+
+// parsePaths reads -paths: "random" (or nothing) for random file names,
+// "site" for sitePaths, "@FILE" for a file of templates, one per line, or
+// templates separated by commas.
+func parsePaths(spec string) ([]pathTemplate, error) {
+	var templates []string
+	switch {
+	case spec == "" || spec == "random":
+		return nil, nil
+	case spec == "site":
+		templates = sitePaths
+	case strings.HasPrefix(spec, "@"):
+		f, err := os.Open(spec[1:])
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				templates = append(templates, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		templates = strings.Split(spec, ",")
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("no templates in %s", spec)
+	}
+
+	parsed := make([]pathTemplate, 0, len(templates))
+	for _, t := range templates {
+		p, err := parsePathTemplate(strings.TrimSpace(t))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", t, err)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+func parsePathTemplate(template string) (pathTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("must start with /")
+	}
+	var p pathTemplate
+	rest := template
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			open = len(rest)
+		}
+		if literal := rest[:open]; literal != "" {
+			if strings.ContainsAny(literal, "}# ") {
+				return nil, fmt.Errorf("unexpected character in %q", literal)
+			}
+			p = append(p, func() string { return literal })
+		}
+		if open == len(rest) {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed {")
+		}
+		placeholder, err := parsePlaceholder(rest[open+1 : open+end])
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, placeholder)
+		rest = rest[open+end+1:]
+	}
+
+	// Query parameters named like the tunnel's carried fields would be
+	// taken for them
+	u, err := url.Parse(p.expand())
+	if err != nil {
+		return nil, err
+	}
+	for name := range u.Query() {
+		for _, f := range carriedFields {
+			if name == f.name {
+				return nil, fmt.Errorf("query parameter %q is taken by the tunnel", name)
+			}
+		}
+	}
+	return p, nil
+}
+
+func parsePlaceholder(name string) (func() string, error) {
+	if choices := strings.Split(name, "|"); len(choices) > 1 {
+		return func() string { return choices[rand.Intn(len(choices))] }, nil
+	}
+	kind, arg, _ := strings.Cut(name, ":")
+	switch kind {
+	case "year":
+		return func() string { return strconv.Itoa(time.Now().Year() - rand.Intn(6)) }, nil
+	case "month":
+		return func() string { return fmt.Sprintf("%02d", 1+rand.Intn(12)) }, nil
+	case "day":
+		return func() string { return fmt.Sprintf("%02d", 1+rand.Intn(28)) }, nil
+	case "word":
+		return func() string { return pathWords[rand.Intn(len(pathWords))] }, nil
+	case "slug":
+		return func() string {
+			words := make([]string, 2+rand.Intn(3))
+			for i := range words {
+				words[i] = pathWords[rand.Intn(len(pathWords))]
+			}
+			return strings.Join(words, "-")
+		}, nil
+	case "name":
+		return func() string { return randomString(minLen, maxLen) }, nil
+	case "num":
+		low, high := 1, 9999
+		if arg != "" {
+			a, b, ok := strings.Cut(arg, "-")
+			var errA, errB error
+			low, errA = strconv.Atoi(a)
+			high, errB = strconv.Atoi(b)
+			if !ok || errA != nil || errB != nil || low < 0 || high < low {
+				return nil, fmt.Errorf("{num:%s}: expected {num:LOW-HIGH}", arg)
+			}
+		}
+		return func() string { return strconv.Itoa(low + rand.Intn(high-low+1)) }, nil
+	case "hex":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > 64 {
+			return nil, fmt.Errorf("{hex:%s}: expected {hex:N}, N up to 64", arg)
+		}
+		return func() string {
+			const digits = "0123456789abcdef"
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = digits[rand.Intn(len(digits))]
+			}
+			return string(b)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown placeholder {%s}", name)
+}
+
+func (p pathTemplate) expand() string {
+	var b strings.Builder
+	for _, part := range p {
+		b.WriteString(part())
+	}
+	return b.String()
+}
+
+// randomPath is a path from one of the templates, without the leading
+// slash. Image polls (-stego png) get a .png name instead of whatever the
+// template ends in.
+func randomPath(templates []pathTemplate, png bool) string {
+	p := strings.TrimPrefix(templates[rand.Intn(len(templates))].expand(), "/")
+	if !png {
+		return p
+	}
+	p, _, _ = strings.Cut(p, "?")
+	p = strings.TrimSuffix(p, "/")
+	if p == "" {
+		return randomString(minLen, maxLen) + ".png"
+	}
+	return strings.TrimSuffix(p, path.Ext(p)) + ".png"
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// bufferedPipe returns the two ends of an in-memory connection. Unlike
+// net.Pipe, writes don't wait for the reader and a read returns everything
+// written since the last one, so the many small writes of a mux layer leave
+// in one request instead of one each.
+func bufferedPipe() (net.Conn, net.Conn) {
+	a, b := newPipeQueue(), newPipeQueue()
+	return &pipeEnd{in: a, out: b}, &pipeEnd{in: b, out: a}
+}
+
+type pipeQueue struct {
+	mu       sync.Mutex
+	data     []byte
+	closed   bool
+	deadline time.Time
+	ready    chan struct{} // nudged on writes, close and deadline changes
+}
+
+func newPipeQueue() *pipeQueue {
+	return &pipeQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *pipeQueue) nudge() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *pipeQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.nudge()
+}
+
+type pipeEnd struct {
+	in, out *pipeQueue
+}
+
+func (p *pipeEnd) Read(b []byte) (int, error) {
+	q := p.in
+	for {
+		q.mu.Lock()
+		if len(q.data) > 0 {
+			n := copy(b, q.data)
+			q.data = q.data[n:]
+			if len(q.data) == 0 {
+				q.data = nil
+			} else {
+				q.nudge()
+			}
+			q.mu.Unlock()
+			return n, nil
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return 0, io.EOF
+		}
+		if q.deadline.IsZero() {
+			q.mu.Unlock()
+			<-q.ready
+			continue
+		}
+		wait := time.Until(q.deadline)
+		q.mu.Unlock()
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.ready:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (p *pipeEnd) Write(b []byte) (int, error) {
+	q := p.out
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	q.data = append(q.data, b...)
+	q.mu.Unlock()
+	q.nudge()
+	return len(b), nil
+}
+
+func (p *pipeEnd) Close() error {
+	p.in.close()
+	p.out.close()
+	return nil
+}
+
+func (p *pipeEnd) SetReadDeadline(t time.Time) error {
+	p.in.mu.Lock()
+	p.in.deadline = t
+	p.in.mu.Unlock()
+	p.in.nudge()
+	return nil
+}
+
+func (p *pipeEnd) SetDeadline(t time.Time) error      { return p.SetReadDeadline(t) }
+func (p *pipeEnd) SetWriteDeadline(t time.Time) error { return nil }
+func (p *pipeEnd) LocalAddr() net.Addr                { return pipeAddr{} }
+func (p *pipeEnd) RemoteAddr() net.Addr               { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
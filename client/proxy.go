@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// proxyHandshake reads a proxy request from a local app and returns the
+// connection to tunnel (it may have buffered data in front) and its
+// destination.
+type proxyHandshake func(conn net.Conn) (net.Conn, string, error)
+
+// serveProxy accepts proxy connections (-socks5, -http-proxy) and tunnels
+// each one to the destination it asks for, so one client can serve a whole
+// browser.
+func serveProxy(listener net.Listener, kind string, handshake proxyHandshake, newClient func() *Client) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		if !sessionLimit.take(conn) {
+			continue
+		}
+		go func() {
+			defer sessionLimit.release()
+			tunneled, dest, err := handshake(conn)
+			if err != nil {
+				log.Printf("%s request from %s rejected: %v", kind, conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			client := newClient()
+			client.destAddr = dest
+			client.debugLog("%s connection %s → %s", kind, redactID(client.sessionID[:8]), redactAddr(dest))
+			client.handleConnection(tunneled)
+		}()
+	}
+}
+
+// prefixedConn replays bytes already read from a connection before the rest.
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// httpProxyHandshake handles a CONNECT request, or forwards a plain
+// http:// proxy request (one per connection) to its origin server.
+func httpProxyHandshake(conn net.Conn) (net.Conn, string, error) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTime))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if req.Method == http.MethodConnect {
+		dest := req.Host
+		if _, _, err := net.SplitHostPort(dest); err != nil {
+			dest = net.JoinHostPort(dest, "443")
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return nil, "", err
+		}
+		return &prefixedConn{Conn: conn, r: reader}, dest, nil
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, "", fmt.Errorf("not a proxy request: %s %s", req.Method, req.RequestURI)
+	}
+	dest := req.URL.Host
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		dest = net.JoinHostPort(dest, "80")
+	}
+
+	// Send it on in origin form; the body, if any, follows untouched
+	for name := range req.Header {
+		if strings.HasPrefix(name, "Proxy-") {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Set("Connection", "close") // this connection only ever reaches one host
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	req.Header.Write(&head)
+	head.WriteString("\r\n")
+	return &prefixedConn{Conn: conn, r: io.MultiReader(&head, reader)}, dest, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// redactLogs is set by -redact for users whose client-side logs are a risk
+// in themselves.
+var redactLogs bool
+
+// redactKey salts destination hashes so they stay consistent within one run
+// but can't be matched against a list of known hosts.
+var redactKey = func() []byte {
+	b := make([]byte, 32)
+	if _, err := cryptorand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// redactAddr replaces a hostname, address or URL with a short keyed hash.
+func redactAddr(addr string) string {
+	if !redactLogs {
+		return addr
+	}
+	mac := hmac.New(sha256.New, redactKey)
+	mac.Write([]byte(addr))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// redactID truncates a session ID to a handful of characters.
+func redactID(sessionID string) string {
+	if redactLogs && len(sessionID) > 4 {
+		return sessionID[:4]
+	}
+	return sessionID
+}
+
+// redactSize hides payload sizes, which can fingerprint the tunneled protocol.
+func redactSize(n int) string {
+	if redactLogs {
+		return "-"
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Once the server has answered for a session, the client's requests say so
+// with the "known" capability. A server that doesn't have the session any
+// more, because it restarted or expired it, then answers 410 with
+// X-Session-Unknown instead of opening a new one and writing the middle of
+// a stream into a fresh connection to the destination.
+
+// errSessionUnknown is that answer.
+var errSessionUnknown = errors.New("server doesn't know the session")
+
+func sessionUnknown(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusGone && resp.Header.Get("X-Session-Unknown") != ""
+}
+
+// lostSession handles the server not knowing a session it had. With -resume
+// the next request opens it again, and the connection carries on with a new
+// connection to the destination; otherwise the local connection has to go.
+func (c *Client) lostSession(sessionID string) error {
+	if !c.resume {
+		return errSessionUnknown
+	}
+	if c.established.CompareAndSwap(true, false) {
+		log.Printf("Server lost connection %s, opening it again (-resume)", redactID(sessionID[:8]))
+		// The new session's streams start over
+		c.upSeq.Store(0)
+		c.downSeq.Store(0)
+	}
+	return nil
+}
+
+// dropLost resets conn, whose session the server lost.
+func dropLost(sessionID string, conn net.Conn) {
+	log.Printf("Server lost connection %s (restarted?), resetting it", redactID(sessionID[:8]))
+	resetConn(conn)
+}
+
+// A server with -dup-session takeover hands a session to the newest client
+// that uses its ID, and answers the one it displaced with 409 and
+// X-Session-Takeover. The session is somebody else's now, so the local
+// connection goes and nothing is sent again.
+
+// errSessionTakenOver is that answer.
+var errSessionTakenOver = errors.New("session taken over by another client")
+
+func sessionTakenOver(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusConflict && resp.Header.Get("X-Session-Takeover") == "true"
+}
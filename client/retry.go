@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	connectRetryMin = 250 * time.Millisecond
+	connectRetryMax = 2 * time.Second
+)
+
+// waitForSession opens the tunnel session before any local data is read,
+// retrying until the server answers or connectWait runs out. A local app that
+// connects while the server or the edge is still coming up is held on an
+// accepted socket instead of being dropped straight away.
+func (c *Client) waitForSession(ctx context.Context, sessionID string, conn net.Conn) error {
+	return c.retryConnect(ctx, sessionID, func() error {
+		return c.pollData(ctx, sessionID, conn, false)
+	})
+}
+
+// retryConnect calls connect until it succeeds or connectWait runs out,
+// backing off between attempts.
+func (c *Client) retryConnect(ctx context.Context, sessionID string, connect func() error) error {
+	deadline := time.Now().Add(c.connectWait)
+	backoff := connectRetryMin
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("Tunnel ready for connection %s after %d attempts", redactID(sessionID[:8]), attempt)
+			}
+			return nil
+		}
+		if errors.Is(err, errSessionTakenOver) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		c.debugLog("Tunnel not ready for connection %s, retrying in %s: %v", redactID(sessionID[:8]), backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > connectRetryMax {
+			backoff = connectRetryMax
+		}
+	}
+}
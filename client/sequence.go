@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Uploads say where they start in the stream to the destination (X-Seq),
+// polls how much of the stream back has arrived (X-Ack), and responses
+// where they start in it (X-Seq), so the server can drop uploads the CDN
+// sent twice and send again what a lost response carried. Servers without
+// "seq" leave the headers out of responses and everything is taken as is,
+// and requests the CDN lost end the connection as they always did.
+
+// inSequence returns the part of a poll response's data that comes next in
+// the stream back, nothing if it was all here already or if it starts
+// after a gap, which the server fills in with the next poll.
+func (c *Client) inSequence(resp *http.Response, data []byte) []byte {
+	seq := resp.Header.Get("X-Seq")
+	if seq == "" || len(data) == 0 {
+		return data
+	}
+	offset, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return data
+	}
+	have := c.downSeq.Load()
+	end := offset + uint64(len(data))
+	if offset > have || end <= have {
+		return nil
+	}
+	c.downSeq.Store(end)
+	return data[have-offset:]
+}
+
+// serverSequences is set once a response says where it is in the stream,
+// so connections opened later know lost requests can be sent again from
+// their first one.
+var serverSequences atomic.Bool
+
+func noteSequenced(resp *http.Response) {
+	if resp.Header.Get("X-Seq") != "" {
+		serverSequences.Store(true)
+	}
+}
+
+const (
+	lostRetries    = 4
+	lostRetryDelay = 200 * time.Millisecond
+)
+
+// edgeFailure reports whether resp is the CDN saying it lost the request or
+// the server's response to it, like Cloudflare's 520 and 524.
+func edgeFailure(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusGatewayTimeout, 520, 521, 522, 523, 524:
+		return true
+	}
+	return false
+}
+
+// retryLost sends a request again when the CDN lost it or its response, a
+// few times, backing off. Only with a server that numbers the stream: it
+// takes an upload it already has once, and sends again what a lost poll
+// response carried, so nothing is doubled or dropped.
+func (c *Client) retryLost(ctx context.Context, sessionID, what string, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send()
+		if !serverSequences.Load() || attempt > lostRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			if !edgeFailure(resp) {
+				return resp, nil
+			}
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		c.debugLog("%s for connection %s lost (%v), sending it again", what, redactID(sessionID[:8]), err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * lostRetryDelay):
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInSequence(t *testing.T) {
+	type response struct {
+		seq  string // X-Seq, "" for servers without "seq"
+		data string
+	}
+	tests := []struct {
+		name      string
+		responses []response
+		want      string // written to the local connection, in order
+		downSeq   uint64
+	}{
+		{
+			name:      "in order",
+			responses: []response{{"0", "hello"}, {"5", ", "}, {"7", "world"}},
+			want:      "hello, world",
+			downSeq:   12,
+		},
+		{
+			name:      "duplicated",
+			responses: []response{{"0", "hello"}, {"0", "hello"}, {"5", "world"}, {"5", "world"}},
+			want:      "helloworld",
+			downSeq:   10,
+		},
+		{
+			name:      "resent with more",
+			responses: []response{{"0", "hel"}, {"0", "hello world"}},
+			want:      "hello world",
+			downSeq:   11,
+		},
+		{
+			name:      "ahead, filled in by the next poll",
+			responses: []response{{"0", "hello"}, {"8", "rld"}, {"5", "world"}},
+			want:      "helloworld",
+			downSeq:   10,
+		},
+		{
+			name:      "empty response",
+			responses: []response{{"0", "hello"}, {"5", ""}},
+			want:      "hello",
+			downSeq:   5,
+		},
+		{
+			name:      "server without seq",
+			responses: []response{{"", "hello"}, {"", "hello"}},
+			want:      "hellohello",
+			downSeq:   0,
+		},
+		{
+			name:      "invalid offset taken as is",
+			responses: []response{{"x", "hello"}},
+			want:      "hello",
+			downSeq:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{}
+			var written strings.Builder
+			for _, r := range tt.responses {
+				resp := &http.Response{Header: http.Header{}}
+				if r.seq != "" {
+					resp.Header.Set("X-Seq", r.seq)
+				}
+				written.Write(c.inSequence(resp, []byte(r.data)))
+			}
+			if written.String() != tt.want {
+				t.Errorf("wrote %q, want %q", written.String(), tt.want)
+			}
+			if got := c.downSeq.Load(); got != tt.downSeq {
+				t.Errorf("downSeq = %d, want %d", got, tt.downSeq)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+//go:build !windows
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const defaultServiceName = "darkflare-client"
+
+// runServiceCommand handles "service generate [systemd|launchd] [name]
+// [flags]", which prints a systemd unit or launchd plist running the client
+// with flags. Installing it is left to the init system's own tools.
+func runServiceCommand(args []string) {
+	if len(args) == 0 || args[0] != "generate" {
+		fmt.Fprintf(os.Stderr, "Usage: %s service generate [systemd|launchd] [name] [options]\n", os.Args[0])
+		os.Exit(2)
+	}
+	args = args[1:]
+	format := "systemd"
+	if runtime.GOOS == "darwin" {
+		format = "launchd"
+	}
+	if len(args) > 0 && (args[0] == "systemd" || args[0] == "launchd") {
+		format, args = args[0], args[1:]
+	}
+	name := defaultServiceName
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	unit, err := generateUnit(format, name, args)
+	if err != nil {
+		log.Fatalf("Service %s: %v", name, err)
+	}
+	fmt.Print(unit)
+	os.Exit(0)
+}
+
+// serviceSetup is what a unit needs to know besides the options.
+type serviceSetup struct {
+	name string
+	exe  string
+	args []string
+	dir  string // relative paths in args are from here
+	user string // empty to run as root
+	tun  bool   // needs CAP_NET_ADMIN and /dev/net/tun
+	low  bool   // listens below port 1024
+}
+
+func generateUnit(format, name string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("no options, the service would have nothing to do")
+	}
+	if listen, _ := flagValue(args, "l"); listen == "stdin:stdout" {
+		return "", fmt.Errorf("a service has no stdin, use -l PORT")
+	}
+	if _, ok := flagValue(args, "psk"); ok {
+		// On stderr, the unit goes to stdout
+		log.Printf("Warning: units are readable by anyone, better put -psk in a -config file only the service's user can read")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	setup := &serviceSetup{name: name, exe: exe, args: args, dir: dir}
+	setup.user = serviceUser()
+	if value, ok := flagValue(args, "tun"); ok && value != "false" {
+		setup.tun = true
+	}
+	if listen, ok := flagValue(args, "l"); ok {
+		port, err := strconv.Atoi(strings.TrimPrefix(listen, "udp:"))
+		setup.low = err == nil && port < 1024
+	}
+
+	switch format {
+	case "systemd":
+		return systemdUnit(setup), nil
+	case "launchd":
+		return launchdPlist(setup), nil
+	}
+	return "", fmt.Errorf("unknown format %q (use systemd or launchd)", format)
+}
+
+// serviceUser is who runs the service: whoever is generating it, or the
+// user behind sudo. Empty for root, whose unit runs without capabilities.
+func serviceUser() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && sudoUser != "root" {
+		return sudoUser
+	}
+	if u, err := user.Current(); err == nil && u.Uid != "0" {
+		return u.Username
+	}
+	return ""
+}
+
+// flagValue finds -name or --name in args, with its value for -name=value
+// and -name value, or "true" when it's the last one or followed by another
+// flag.
+func flagValue(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name {
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				return args[i+1], true
+			}
+			return "true", true
+		}
+		if value, ok := strings.CutPrefix(arg, name+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func systemdUnit(s *serviceSetup) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Save as /etc/systemd/system/%s.service, then:\n", s.name)
+	fmt.Fprintf(&b, "#   systemctl daemon-reload && systemctl enable --now %s\n", s.name)
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=DarkFlare client (%s)\n", s.name)
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n\n")
+
+	b.WriteString("[Service]\n")
+	exec := []string{systemdQuote(s.exe)}
+	for _, arg := range s.args {
+		exec = append(exec, systemdQuote(arg))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(exec, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", systemdQuote(s.dir))
+	if s.user != "" {
+		fmt.Fprintf(&b, "User=%s\n", s.user)
+	} else {
+		b.WriteString("# Runs as root, better set an account that can read the options' files\n")
+		b.WriteString("#User=darkflare\n")
+	}
+	b.WriteString("Restart=always\n")
+	b.WriteString("RestartSec=5\n\n")
+
+	b.WriteString("NoNewPrivileges=yes\n")
+	b.WriteString("ProtectSystem=strict\n")
+	b.WriteString("ProtectHome=read-only\n")
+	b.WriteString("PrivateTmp=yes\n")
+	b.WriteString("ProtectKernelTunables=yes\n")
+	b.WriteString("ProtectKernelModules=yes\n")
+	b.WriteString("ProtectControlGroups=yes\n")
+	b.WriteString("RestrictNamespaces=yes\n")
+	b.WriteString("RestrictRealtime=yes\n")
+	b.WriteString("LockPersonality=yes\n")
+	b.WriteString("SystemCallArchitectures=native\n")
+	var caps []string
+	if s.tun {
+		// The TUN device and its routes
+		caps = append(caps, "CAP_NET_ADMIN")
+		b.WriteString("DeviceAllow=/dev/net/tun rw\n")
+		b.WriteString("RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX AF_NETLINK\n")
+	} else {
+		b.WriteString("PrivateDevices=yes\n")
+		b.WriteString("RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX\n")
+	}
+	if s.low {
+		caps = append(caps, "CAP_NET_BIND_SERVICE")
+	}
+	fmt.Fprintf(&b, "CapabilityBoundingSet=%s\n", strings.Join(caps, " "))
+	if len(caps) > 0 {
+		fmt.Fprintf(&b, "AmbientCapabilities=%s\n", strings.Join(caps, " "))
+	}
+
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// systemdQuote quotes an ExecStart word, and escapes the specifiers and
+// variables systemd would expand.
+func systemdQuote(word string) string {
+	word = strings.ReplaceAll(word, "%", "%%")
+	word = strings.ReplaceAll(word, "$", "$$")
+	if word != "" && !strings.ContainsAny(word, " \t\"'\\;") {
+		return word
+	}
+	word = strings.ReplaceAll(word, `\`, `\\`)
+	word = strings.ReplaceAll(word, `"`, `\"`)
+	return `"` + word + `"`
+}
+
+func launchdPlist(s *serviceSetup) string {
+	label := "com.darkflare." + s.name
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	fmt.Fprintf(&b, "<!-- Save as /Library/LaunchDaemons/%s.plist, then:\n", label)
+	fmt.Fprintf(&b, "     sudo launchctl bootstrap system /Library/LaunchDaemons/%s.plist -->\n", label)
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	plistString(&b, "Label", label)
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{s.exe}, s.args...) {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", xmlEscape(arg))
+	}
+	b.WriteString("\t</array>\n")
+	plistString(&b, "WorkingDirectory", s.dir)
+	if s.user != "" {
+		plistString(&b, "UserName", s.user)
+	}
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	// Restarted when it exits, at most every 5 seconds
+	b.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	b.WriteString("\t<key>ThrottleInterval</key>\n\t<integer>5</integer>\n")
+	plistString(&b, "StandardErrorPath", "/Library/Logs/"+s.name+".log")
+	b.WriteString("</dict>\n</plist>\n")
+	return b.String()
+}
+
+func plistString(b *strings.Builder, key, value string) {
+	fmt.Fprintf(b, "\t<key>%s</key>\n\t<string>%s</string>\n", key, xmlEscape(value))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,168 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	defaultServiceName = "darkflare-client"
+	serviceDisplayName = "DarkFlare client"
+)
+
+// runServiceCommand handles "service <action> [name] [flags]", which puts
+// the client in the Windows service manager so it runs without anyone
+// logged in. The service starts the client as "service run <name> <flags>",
+// which returns to main with the flags in os.Args; every other action exits.
+func runServiceCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s service install|uninstall|start|stop [name] [options]\n", os.Args[0])
+		os.Exit(2)
+	}
+	action, args := args[0], args[1:]
+	name := defaultServiceName
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	var err error
+	done := action + "ed"
+	switch action {
+	case "run":
+		runAsService(name)
+		os.Args = append(os.Args[:1], args...)
+		return
+	case "install":
+		err = installService(name, args)
+	case "uninstall":
+		err = withService(name, func(s *mgr.Service) error { return s.Delete() })
+	case "start":
+		err = withService(name, func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = withService(name, stopService)
+		done = "stopped"
+	default:
+		err = fmt.Errorf("unknown action %q (use install, uninstall, start or stop)", action)
+	}
+	if err != nil {
+		log.Fatalf("Service %s: %v", name, err)
+	}
+	log.Printf("Service %s %s", name, done)
+	os.Exit(0)
+}
+
+// installService registers the client, with args, to start at boot and to
+// be restarted if it dies.
+func installService(name string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no options, the service would have nothing to do")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: serviceDisplayName + " (" + name + ")",
+		Description: "TCP-over-CDN tunnel: " + strings.Join(args, " "),
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run", name}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+}
+
+func withService(name string, do func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return do(s)
+}
+
+// stopService asks the service to stop and waits for it.
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still running after 10s")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAsService logs to %ProgramData%\darkflare\<name>.log, since a service
+// has no console, and answers the service manager in the background while
+// main runs the client. A stop request exits. Relative paths in the options
+// are from the executable's directory, not System32 where services start.
+// Run from a console it does none of this, to try a service's options out.
+func runAsService(name string) {
+	if inService, err := svc.IsWindowsService(); err != nil || !inService {
+		return
+	}
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	dir := filepath.Join(os.Getenv("ProgramData"), "darkflare")
+	if err := os.MkdirAll(dir, 0700); err == nil {
+		if file, err := os.OpenFile(filepath.Join(dir, name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+			os.Stderr = file
+			log.SetOutput(file)
+		}
+	}
+	go func() {
+		if err := svc.Run(name, serviceHandler{}); err != nil {
+			log.Fatalf("Service %s: %v", name, err)
+		}
+		log.Printf("Service %s stopped", name)
+		os.Exit(0)
+	}()
+}
+
+type serviceHandler struct{}
+
+func (serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
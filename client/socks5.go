@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 (RFC 1928) constants used by the -socks5 listener.
+const (
+	socksVersion       = 5
+	socksNoAuth        = 0x00
+	socksNoMethods     = 0xff
+	socksConnect       = 0x01
+	socksAddrIPv4      = 0x01
+	socksAddrDomain    = 0x03
+	socksAddrIPv6      = 0x04
+	socksSucceeded     = 0x00
+	socksCmdNotSupp    = 0x07
+	socksAddrNotSupp   = 0x08
+	socksHandshakeTime = 10 * time.Second
+)
+
+// socks5Handshake negotiates a CONNECT request without authentication and
+// returns the requested host:port. Success is reported right away; if the
+// server can't reach the destination the connection is simply closed.
+func socks5Handshake(conn net.Conn) (net.Conn, string, error) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTime))
+	defer conn.SetDeadline(time.Time{})
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, "", err
+	}
+	if header[0] != socksVersion {
+		return nil, "", fmt.Errorf("not a SOCKS5 client (version %d)", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == socksNoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoMethods})
+		return nil, "", errors.New("client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return nil, "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, "", err
+	}
+	if request[1] != socksConnect {
+		socks5Reply(conn, socksCmdNotSupp)
+		return nil, "", fmt.Errorf("unsupported command %d (only CONNECT)", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, "", err
+		}
+		host = string(name)
+	default:
+		socks5Reply(conn, socksAddrNotSupp)
+		return nil, "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, "", err
+	}
+	if err := socks5Reply(conn, socksSucceeded); err != nil {
+		return nil, "", err
+	}
+	return conn, net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// socks5Reply answers a request. The bound address is always 0.0.0.0:0,
+// since the real connection is made by the server.
+func socks5Reply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
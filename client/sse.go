@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sseReconnects is how many times in a row a dropped event stream is
+// reopened before the connection is given up.
+const sseReconnects = 3
+
+// connectEventStream opens the event stream for a connection, retrying for
+// -connect-wait.
+func (c *Client) connectEventStream(ctx context.Context, httpClient *http.Client, sessionID string) (*http.Response, error) {
+	var events *http.Response
+	openEvents := func() (err error) {
+		events, err = c.openEventStream(ctx, httpClient, sessionID)
+		return err
+	}
+	var err error
+	if c.connectWait > 0 {
+		err = c.retryConnect(ctx, sessionID, openEvents)
+	} else {
+		err = openEvents()
+	}
+	c.hooks.report(err)
+	return events, err
+}
+
+// openEventStream starts the long-lived GET that brings downstream data for
+// -transport sse, dressed up like a browser's EventSource.
+func (c *Client) openEventStream(ctx context.Context, httpClient *http.Client, sessionID string) (*http.Response, error) {
+	req, err := c.createDebugRequest(http.MethodGet, c.cloudflareHost, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-For", sessionID)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "cors")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	req.Header.Del("Sec-Fetch-User")
+	req.Header.Del("Upgrade-Insecure-Requests")
+
+	resp, err := c.withStepUp(func(code string) (*http.Response, error) {
+		attempt, err := c.withOneTimeCode(req, code)
+		if err != nil {
+			return nil, err
+		}
+		c.carry(attempt)
+		return httpClient.Do(attempt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, c.maxBodySize))
+		resp.Body.Close()
+		c.handleResponse(resp, body)
+		return nil, c.statusError(resp)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body.Close()
+		return nil, errors.New("server doesn't accept event streams (start it with -transport sse)")
+	}
+	return resp, nil
+}
+
+// readEvents writes the data events of one event stream to conn. It returns
+// nil once the server says the upstream connection is closed.
+func (c *Client) readEvents(ctx context.Context, conn net.Conn, body io.Reader) error {
+	reader := bufio.NewReaderSize(body, 64*1024)
+	event := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, ":"):
+			// Keepalive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if event == "close" {
+				return nil
+			}
+			data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			if err != nil {
+				return fmt.Errorf("error decoding data: %v", err)
+			}
+			if err := c.budget.add(ctx, len(data)); err != nil {
+				return err
+			}
+			if _, err := conn.Write(data); err != nil {
+				return fmt.Errorf("error writing to connection: %v", err)
+			}
+		}
+	}
+}
+
+// runEventStream feeds downstream data from the event stream to conn until
+// the upstream connection closes, reopening the stream if it drops.
+func (c *Client) runEventStream(ctx context.Context, httpClient *http.Client, sessionID string, conn net.Conn, resp *http.Response) {
+	defer httpClient.CloseIdleConnections()
+
+	failures := 0
+	for {
+		opened := time.Now()
+		err := c.readEvents(ctx, conn, resp.Body)
+		resp.Body.Close()
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if time.Since(opened) > time.Minute {
+			failures = 0
+		}
+		c.debugLog("Event stream for connection %s dropped: %v", redactID(sessionID[:8]), err)
+
+		for {
+			if failures++; failures > sseReconnects {
+				log.Printf("Event stream for connection %s lost: %v", redactID(sessionID[:8]), err)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(failures) * connectRetryMin):
+			}
+			resp, err = c.openEventStream(ctx, httpClient, sessionID)
+			c.hooks.report(err)
+			if err == nil {
+				break
+			}
+		}
+	}
+}
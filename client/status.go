@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -status serves what the client's connections are doing, for
+// "darkflare-client watch" or curl. It has no authentication and shows
+// destinations, so keep it on localhost.
+
+// liveConns holds the stats of open connections by session ID, with
+// -status.
+var (
+	liveConns     sync.Map
+	statusEnabled bool
+)
+
+// connStats counts a connection's bytes at the local end, before
+// compression and encoding, and times its requests.
+type connStats struct {
+	id        string
+	dest      string
+	started   time.Time
+	transport atomic.Value // string, once one connects
+	last      atomic.Int64 // unix nanoseconds of the last read or write
+	sent      atomic.Int64 // bytes from the local application
+	received  atomic.Int64 // and to it
+	rtt       atomic.Int64 // smoothed request round trip, nanoseconds
+}
+
+type connInfo struct {
+	ID          string `json:"id"`
+	Destination string `json:"destination"`
+	Transport   string `json:"transport,omitempty"`
+	Age         string `json:"age"`
+	Idle        string `json:"idle"`
+	Sent        int64  `json:"sent"`
+	Received    int64  `json:"received"`
+	RTT         string `json:"rtt,omitempty"`
+}
+
+// trackConn registers a connection's stats, or returns nil without -status.
+func trackConn(sessionID, dest string) *connStats {
+	if !statusEnabled {
+		return nil
+	}
+	stats := &connStats{id: sessionID, dest: dest, started: time.Now()}
+	stats.last.Store(stats.started.UnixNano())
+	liveConns.Store(sessionID, stats)
+	return stats
+}
+
+func (s *connStats) done() {
+	if s != nil {
+		liveConns.Delete(s.id)
+	}
+}
+
+func (s *connStats) noteTransport(transport string) {
+	if s != nil {
+		s.transport.Store(transport)
+	}
+}
+
+// noteRTT folds a request's round trip into the average, an eighth at a
+// time like TCP's.
+func (s *connStats) noteRTT(rtt time.Duration) {
+	if s == nil {
+		return
+	}
+	for {
+		old := s.rtt.Load()
+		smoothed := int64(rtt)
+		if old != 0 {
+			smoothed = old + (int64(rtt)-old)/8
+		}
+		if s.rtt.CompareAndSwap(old, smoothed) {
+			return
+		}
+	}
+}
+
+func (s *connStats) describe(now time.Time) connInfo {
+	info := connInfo{
+		ID:          s.id,
+		Destination: s.dest,
+		Age:         now.Sub(s.started).Round(time.Second).String(),
+		Idle:        now.Sub(time.Unix(0, s.last.Load())).Round(time.Second).String(),
+		Sent:        s.sent.Load(),
+		Received:    s.received.Load(),
+	}
+	info.Transport, _ = s.transport.Load().(string)
+	if rtt := time.Duration(s.rtt.Load()); rtt >= time.Millisecond {
+		info.RTT = rtt.Round(time.Millisecond).String()
+	} else if rtt > 0 {
+		info.RTT = rtt.Round(time.Microsecond).String()
+	}
+	return info
+}
+
+// statsConn counts what goes through the local end of a connection.
+type statsConn struct {
+	net.Conn
+	stats *connStats
+}
+
+func (c *statsConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.stats.sent.Add(int64(n))
+		c.stats.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *statsConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.stats.received.Add(int64(n))
+		c.stats.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// serveStatus binds addr, then serves GET /sessions in the background.
+func serveStatus(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Status API: %v", err)
+	}
+	statusEnabled = true
+	log.Printf("Status API listening on %s", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		conns := make([]connInfo, 0)
+		liveConns.Range(func(_, value interface{}) bool {
+			conns = append(conns, value.(*connStats).describe(now))
+			return true
+		})
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].ID < conns[j].ID
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conns)
+	})
+	go func() {
+		log.Fatal(http.Serve(listener, mux))
+	}()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+)
+
+// decodePNG extracts the payload the server hid in a grayscale PNG: a four
+// byte big-endian length followed by the data.
+func decodePNG(body []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %v", err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		return nil, fmt.Errorf("unexpected image type %T (is the CDN re-encoding images?)", img)
+	}
+	if len(gray.Pix) < 4 {
+		return nil, fmt.Errorf("image too small")
+	}
+	n := binary.BigEndian.Uint32(gray.Pix)
+	if uint64(n) > uint64(len(gray.Pix)-4) {
+		return nil, fmt.Errorf("invalid payload length %d", n)
+	}
+	return gray.Pix[4 : 4+n], nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// stepUpAttempts is how many codes the user gets per challenge.
+const stepUpAttempts = 3
+
+// stepUpMu keeps connections from prompting for a code at the same time.
+var stepUpMu sync.Mutex
+
+func needsStepUp(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("X-Step-Up") == "totp"
+}
+
+// withStepUp calls try, which sends one request with the given one-time code
+// (none at first) and returns the response. When the server asks for a
+// second factor before opening a sensitive session, the user is prompted for
+// a code and the request sent again.
+func (c *Client) withStepUp(try func(code string) (*http.Response, error)) (*http.Response, error) {
+	resp, err := try("")
+	if !needsStepUp(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	stepUpMu.Lock()
+	defer stepUpMu.Unlock()
+
+	// Another connection may have been approved while this one waited
+	resp, err = try("")
+	if !needsStepUp(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	for attempt := 1; ; attempt++ {
+		code, err := readOneTimeCode(c.destAddr)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = try(code)
+		if !needsStepUp(resp) {
+			return resp, err
+		}
+		resp.Body.Close()
+		if attempt == stepUpAttempts {
+			return nil, fmt.Errorf("second factor for %s rejected", redactAddr(c.destAddr))
+		}
+		fmt.Fprintf(os.Stderr, "Code rejected, try again\n")
+	}
+}
+
+func readOneTimeCode(dest string) (string, error) {
+	tty, err := openTerminal()
+	if err != nil {
+		return "", fmt.Errorf("%s needs a one-time code but there's no terminal to ask for it: %v", redactAddr(dest), err)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "One-time code for %s: ", redactAddr(dest))
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// withOneTimeCode returns a fresh copy of req, with its body rewound and a
+// new signature, that carries code if there is one.
+func (c *Client) withOneTimeCode(req *http.Request, code string) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	if code != "" {
+		r.Header.Set("X-Otp", code)
+	}
+	if err := c.sign(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
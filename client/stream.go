@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// streamClient returns an HTTP client for -transport h2 or h3: the regular
+// one, but negotiating HTTP/2 (or speaking HTTP/3 over QUIC) and without an
+// overall timeout, since a stream lasts as long as the connection it carries.
+func (c *Client) streamClient() *http.Client {
+	transport, ok := c.httpClient.Transport.(*http.Transport)
+	if !ok {
+		return c.httpClient
+	}
+	if c.transport == "h3" {
+		return &http.Client{Transport: newH3Transport(transport.TLSClientConfig.Clone())}
+	}
+	transport = transport.Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSClientConfig.NextProtos = []string{"h2", "http/1.1"}
+	return &http.Client{Transport: transport}
+}
+
+// openStream starts the single request that carries a connection in both
+// directions. Writes to the returned pipe go to the server; the response
+// body is everything the server sends back.
+func (c *Client) openStream(ctx context.Context, httpClient *http.Client) (*io.PipeWriter, *http.Response, error) {
+	var pw *io.PipeWriter
+	resp, err := c.withStepUp(func(code string) (*http.Response, error) {
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		req, err := c.createDebugRequest(http.MethodPost, c.cloudflareHost, pr, false)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Del("Connection")
+		req.Header.Set("X-Capabilities", req.Header.Get("X-Capabilities")+",stream")
+		if code != "" {
+			req.Header.Set("X-Otp", code)
+		}
+		if err := c.sign(req); err != nil {
+			return nil, err
+		}
+		c.carry(req)
+		return httpClient.Do(req)
+	})
+	if err != nil {
+		if pw != nil {
+			pw.Close()
+		}
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotImplemented {
+		resp.Body.Close()
+		pw.Close()
+		return nil, nil, fmt.Errorf("server doesn't accept %s streams (start it with -transport %s)", c.transport, c.transport)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		return nil, nil, c.statusError(resp)
+	}
+	if resp.ProtoMajor < 2 {
+		resp.Body.Close()
+		pw.Close()
+		return nil, nil, errors.New("no HTTP/2 to the server (-transport h2 needs https all the way)")
+	}
+	return pw, resp, nil
+}
+
+// connectStream opens the request that carries a connection, retrying for
+// -connect-wait. The request lives as long as ctx.
+func (c *Client) connectStream(ctx context.Context, sessionID string) (*io.PipeWriter, *http.Response, error) {
+	httpClient := c.streamClient()
+	var pw *io.PipeWriter
+	var resp *http.Response
+	var err error
+	if c.connectWait > 0 {
+		err = c.retryConnect(ctx, sessionID, func() error {
+			pw, resp, err = c.openStream(ctx, httpClient)
+			return err
+		})
+	} else {
+		pw, resp, err = c.openStream(ctx, httpClient)
+	}
+	c.hooks.report(err)
+	return pw, resp, err
+}
+
+// runStream carries a local connection over one long-lived HTTP/2 request
+// instead of polling.
+func (c *Client) runStream(ctx context.Context, sessionID string, conn net.Conn, pw *io.PipeWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	c.debugLog("HTTP/2 stream open for connection %s", redactID(sessionID[:8]))
+
+	// Local to server
+	go func() {
+		buffer := c.bufferPool.Get().([]byte)
+		defer c.bufferPool.Put(buffer)
+		for {
+			n, err := conn.Read(buffer)
+			if n > 0 {
+				if berr := c.budget.add(ctx, n); berr != nil {
+					break
+				}
+				if _, werr := pw.Write(buffer[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		pw.Close()
+	}()
+
+	// Server to local
+	buffer := make([]byte, c.readBufferSize)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if berr := c.budget.add(ctx, n); berr != nil {
+				return
+			}
+			if _, werr := conn.Write(buffer[:n]); werr != nil {
+				c.debugLog("Write error for connection %s: %v", redactID(sessionID[:8]), werr)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				c.debugLog("Stream read error for connection %s: %v", redactID(sessionID[:8]), err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// useClientCertificate makes the client present cert in its TLS handshakes,
+// for CDN edges that enforce mTLS (e.g. Cloudflare API Shield).
+func (c *Client) useClientCertificate(cert *tls.Certificate) {
+	if transport, ok := c.httpClient.Transport.(*http.Transport); ok {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transportRetry is how long a transport that failed to connect is passed
+// over before it gets another chance.
+const transportRetry = 5 * time.Minute
+
+// parseTransports splits a -transport list such as "h2,ws,poll".
+func parseTransports(spec string) ([]string, error) {
+	var order []string
+	for _, t := range strings.Split(spec, ",") {
+		t = strings.TrimSpace(t)
+		switch t {
+		case "poll", "ws", "h2", "h3", "sse":
+		default:
+			return nil, fmt.Errorf("unknown transport %q (use poll, ws, h2, h3 or sse)", t)
+		}
+		for _, seen := range order {
+			if seen == t {
+				return nil, fmt.Errorf("transport %s listed twice", t)
+			}
+		}
+		order = append(order, t)
+	}
+	return order, nil
+}
+
+// transportPicker chooses the transport for each connection from the
+// ordered -transport list. Every connection is a health check: a transport
+// that fails to connect is moved to the back for a while, so later
+// connections go straight to one that works, and it's tried first again
+// once the while is up.
+type transportPicker struct {
+	order []string
+
+	mu   sync.Mutex
+	down map[string]time.Time // when a failed transport gets another chance
+}
+
+func newTransportPicker(order []string) *transportPicker {
+	return &transportPicker{order: order, down: make(map[string]time.Time)}
+}
+
+// candidates returns the transports to try for a new connection, best
+// first. Those that failed recently come last rather than not at all.
+func (p *transportPicker) candidates() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var up, down []string
+	now := time.Now()
+	for _, t := range p.order {
+		if retry, ok := p.down[t]; ok && now.Before(retry) {
+			down = append(down, t)
+			continue
+		}
+		up = append(up, t)
+	}
+	return append(up, down...)
+}
+
+// failed records that transport couldn't connect, and returns when it gets
+// another chance.
+func (p *transportPicker) failed(transport string) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	retry := time.Now().Add(transportRetry)
+	p.down[transport] = retry
+	return retry
+}
+
+// worked records that transport connected, and reports whether it had
+// failed before.
+func (p *transportPicker) worked(transport string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, wasDown := p.down[transport]
+	delete(p.down, transport)
+	return wasDown
+}
+
+// transportWorked notes that transport connected, and says so if it had
+// been failing.
+func (c *Client) transportWorked(transport string) {
+	if c.transports.worked(transport) {
+		log.Printf("Transport %s works again", transport)
+		c.cache.transportDown(transport, time.Time{})
+	}
+}
+
+// transportFailed notes that transport couldn't connect.
+func (c *Client) transportFailed(transport string) {
+	c.cache.transportDown(transport, c.transports.failed(transport))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// tunDestination asks the server for a -tun session instead of a TCP
+	// connection.
+	tunDestination = "tun"
+	// tunQueue is how many packets may wait for the tunnel before more are
+	// dropped.
+	tunQueue = 256
+	// tunWriteSize is about how much is handed to the tunnel at once, so
+	// a burst of packets goes out in one request.
+	tunWriteSize = 32 * 1024
+)
+
+// parseTunRoutes checks a -tun-routes list: networks to send through the
+// tunnel, or "default" for everything.
+func parseTunRoutes(spec string) ([]string, error) {
+	var routes []string
+	for _, route := range strings.Split(spec, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		if route != "default" {
+			prefix, err := netip.ParsePrefix(route)
+			if err != nil || !prefix.Addr().Is4() {
+				return nil, fmt.Errorf("invalid route %q (want an IPv4 network or default)", route)
+			}
+			route = prefix.Masked().String()
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// runTun carries the traffic of a TUN device through the tunnel, opening a
+// new session whenever the last one ends. pin lists the hosts the tunnel
+// itself talks to, which keep their current route when routes include
+// "default".
+func runTun(routes, pin []string, newClient func() *Client) {
+	dev, name, err := openTun("darkflare%d")
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("TUN device %s created", name)
+
+	var pinned [][]string
+	if slices.Contains(routes, "default") {
+		pinned, err = pinRoutes(pin)
+		if err != nil {
+			log.Fatalf("Error pinning routes to the server: %v", err)
+		}
+	}
+	// Routes through the device go away with it; the pinned ones don't
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		for _, route := range pinned {
+			ipCommand(append([]string{"route", "del"}, route...)...)
+		}
+		os.Exit(0)
+	}()
+
+	out := make(chan []byte, tunQueue)
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, err := dev.Read(buffer)
+			if err != nil {
+				log.Fatalf("Error reading from %s: %v", name, err)
+			}
+			select {
+			case out <- append([]byte(nil), buffer[:n]...):
+			default:
+			}
+		}
+	}()
+
+	for {
+		client := newClient()
+		session, tunnel := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			client.handleConnection(session)
+			close(done)
+		}()
+		if err := runTunSession(tunnel, dev, name, routes, out); err != nil {
+			log.Printf("Error setting up %s: %v", name, err)
+		}
+		<-done
+		log.Printf("Tunnel for %s closed, reconnecting", name)
+		time.Sleep(time.Second)
+	}
+}
+
+// runTunSession moves packets between the device and one tunnel session
+// until it ends. The server's first frame, a zero byte followed by the
+// session's settings, configures the device.
+func runTunSession(tunnel net.Conn, dev io.Writer, name string, routes []string, out chan []byte) error {
+	defer tunnel.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case packet := <-out:
+				if writeQueued(tunnel, packet, out) != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var partial []byte
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := tunnel.Read(buffer)
+		if err != nil {
+			return nil
+		}
+		partial, err = splitFrames(append(partial, buffer[:n]...), func(packet []byte) error {
+			if len(packet) > 0 && packet[0] == 0 {
+				return configureTun(name, string(packet[1:]), routes)
+			}
+			dev.Write(packet)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeQueued writes packet and whatever else is already queued as one
+// batch of frames.
+func writeQueued(w io.Writer, packet []byte, queue chan []byte) error {
+	batch := appendFrame(nil, packet)
+drain:
+	for len(batch) < tunWriteSize {
+		select {
+		case packet := <-queue:
+			batch = appendFrame(batch, packet)
+		default:
+			break drain
+		}
+	}
+	_, err := w.Write(batch)
+	return err
+}
+
+// configureTun applies the settings the server sent for this session.
+func configureTun(name, settings string, routes []string) error {
+	values := make(map[string]string)
+	for _, field := range strings.Fields(settings) {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			values[key] = value
+		}
+	}
+	addr, gateway, mtu := values["addr"], values["gateway"], values["mtu"]
+	if addr == "" || gateway == "" || mtu == "" {
+		return fmt.Errorf("incomplete settings from server: %q", settings)
+	}
+
+	commands := [][]string{
+		{"addr", "flush", "dev", name},
+		{"addr", "add", addr, "dev", name},
+		{"link", "set", "dev", name, "mtu", mtu, "up"},
+	}
+	for _, route := range routes {
+		if route == "default" {
+			// Two halves beat the existing default route without replacing it
+			commands = append(commands,
+				[]string{"route", "replace", "0.0.0.0/1", "via", gateway, "dev", name},
+				[]string{"route", "replace", "128.0.0.0/1", "via", gateway, "dev", name})
+			continue
+		}
+		commands = append(commands, []string{"route", "replace", route, "via", gateway, "dev", name})
+	}
+	for _, args := range commands {
+		if err := ipCommand(args...); err != nil {
+			return err
+		}
+	}
+	log.Printf("TUN device %s up as %s", name, redactAddr(addr))
+	return nil
+}
+
+// pinRoutes gives each address of hosts a host route along its current path,
+// so the tunnel keeps working once the default route points into it. It
+// returns the routes added.
+func pinRoutes(hosts []string) ([][]string, error) {
+	var pinned [][]string
+	for _, host := range hosts {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return pinned, err
+		}
+		for _, ip := range ips {
+			if ip.To4() == nil || ip.IsLoopback() {
+				continue
+			}
+			current, err := ipOutput("route", "get", ip.String())
+			if err != nil {
+				return pinned, err
+			}
+			route := []string{ip.String() + "/32"}
+			fields := strings.Fields(current)
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[i] == "via" || fields[i] == "dev" {
+					route = append(route, fields[i], fields[i+1])
+				}
+			}
+			if len(route) == 1 {
+				return pinned, errors.New("no route to " + ip.String())
+			}
+			if err := ipCommand(append([]string{"route", "replace"}, route...)...); err != nil {
+				return pinned, err
+			}
+			pinned = append(pinned, route)
+		}
+	}
+	return pinned, nil
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTun creates a TUN device from a name pattern such as "darkflare%d"
+// and returns it with the name the kernel picked.
+func openTun(pattern string) (io.ReadWriteCloser, string, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", fmt.Errorf("error opening /dev/net/tun: %v", err)
+	}
+	ifr, err := unix.NewIfreq(pattern)
+	if err != nil {
+		unix.Close(fd)
+		return nil, "", err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, "", fmt.Errorf("error creating TUN device (root or CAP_NET_ADMIN needed): %v", err)
+	}
+	unix.SetNonblock(fd, true)
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), ifr.Name(), nil
+}
+
+// ipOutput runs ip(8) and returns what it printed.
+func ipOutput(args ...string) (string, error) {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// ipCommand runs ip(8) to set up addresses and routes.
+func ipCommand(args ...string) error {
+	_, err := ipOutput(args...)
+	return err
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+var errNoTun = errors.New("-tun is only supported on Linux")
+
+func openTun(pattern string) (io.ReadWriteCloser, string, error) {
+	return nil, "", errNoTun
+}
+
+func ipOutput(args ...string) (string, error) {
+	return "", errNoTun
+}
+
+func ipCommand(args ...string) error {
+	return errNoTun
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// udpFlowIdle is how long a local UDP peer can stay quiet before its
+	// tunnel is closed, like a NAT mapping expiring.
+	udpFlowIdle = 2 * time.Minute
+	// udpFlowQueue is how many datagrams may wait for the tunnel before
+	// more are dropped.
+	udpFlowQueue = 64
+)
+
+// udpFlow is one local UDP peer, seen by handleConnection as a stream of
+// datagrams, each prefixed with its length as two big-endian bytes. The
+// server uses the same framing towards the destination.
+type udpFlow struct {
+	sock *net.UDPConn
+	peer *net.UDPAddr
+
+	in         chan []byte
+	done       chan struct{}
+	closeOnce  sync.Once
+	lastActive atomic.Int64
+
+	unread  []byte // rest of the frame being read
+	partial []byte // incomplete frame from the tunnel
+}
+
+func newUDPFlow(sock *net.UDPConn, peer *net.UDPAddr) *udpFlow {
+	f := &udpFlow{
+		sock: sock,
+		peer: peer,
+		in:   make(chan []byte, udpFlowQueue),
+		done: make(chan struct{}),
+	}
+	f.touch()
+	return f
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, f.lastActive.Load()))
+}
+
+// deliver queues a datagram from the peer, dropping it if the tunnel is
+// behind.
+func (f *udpFlow) deliver(datagram []byte) {
+	f.touch()
+	select {
+	case f.in <- datagram:
+	default:
+	}
+}
+
+func (f *udpFlow) Read(p []byte) (int, error) {
+	if len(f.unread) == 0 {
+		select {
+		case datagram := <-f.in:
+			frame := make([]byte, 2+len(datagram))
+			binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+			copy(frame[2:], datagram)
+			f.unread = frame
+		case <-f.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, f.unread)
+	f.unread = f.unread[n:]
+	return n, nil
+}
+
+func (f *udpFlow) Write(p []byte) (int, error) {
+	select {
+	case <-f.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	f.touch()
+	var err error
+	f.partial, err = splitFrames(append(f.partial, p...), func(datagram []byte) error {
+		_, err := f.sock.WriteToUDP(datagram, f.peer)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *udpFlow) Close() error {
+	f.closeOnce.Do(func() { close(f.done) })
+	return nil
+}
+
+func (f *udpFlow) LocalAddr() net.Addr                { return f.sock.LocalAddr() }
+func (f *udpFlow) RemoteAddr() net.Addr               { return f.peer }
+func (f *udpFlow) SetDeadline(t time.Time) error      { return nil }
+func (f *udpFlow) SetReadDeadline(t time.Time) error  { return nil }
+func (f *udpFlow) SetWriteDeadline(t time.Time) error { return nil }
+
+// serveUDP relays datagrams arriving on sock, with a tunnel session per
+// local peer.
+func serveUDP(sock *net.UDPConn, newClient func() *Client) {
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	go func() {
+		for range time.Tick(udpFlowIdle / 4) {
+			mu.Lock()
+			for _, flow := range flows {
+				if flow.idle() > udpFlowIdle {
+					flow.Close()
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buffer := make([]byte, 65535)
+	for {
+		n, peer, err := sock.ReadFromUDP(buffer)
+		if err != nil {
+			log.Printf("Error reading UDP datagram: %v", err)
+			continue
+		}
+		datagram := append([]byte(nil), buffer[:n]...)
+
+		key := peer.String()
+		mu.Lock()
+		flow := flows[key]
+		if flow == nil {
+			flow = newUDPFlow(sock, peer)
+			flows[key] = flow
+			client := newClient()
+			client.udp = true
+			client.debugLog("UDP flow from %s", redactAddr(key))
+			go func() {
+				client.handleConnection(flow)
+				mu.Lock()
+				if flows[key] == flow {
+					delete(flows, key)
+				}
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		flow.deliver(datagram)
+	}
+}
+
+// splitFrames calls send for each complete length-prefixed frame in data
+// and returns what's left of an incomplete one, reusing data's storage.
+func splitFrames(data []byte, send func([]byte) error) ([]byte, error) {
+	rest := data
+	for len(rest) >= 2 {
+		n := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+n {
+			break
+		}
+		if err := send(rest[2 : 2+n]); err != nil {
+			return nil, err
+		}
+		rest = rest[2+n:]
+	}
+	return append(data[:0], rest...), nil
+}
+
+// appendFrame appends payload to b as one length-prefixed frame.
+func appendFrame(b, payload []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
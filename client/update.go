@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set at build time with -ldflags -X, see the Makefile.
+var (
+	version   = "dev"
+	updateKey string // Ed25519 public key release manifests are signed with, base64
+	updateURL string // where "update" looks for the release manifest
+)
+
+// maxManifestSize and maxBinarySize bound what "update" downloads.
+const (
+	maxManifestSize = 1 << 20
+	maxBinarySize   = 256 << 20
+)
+
+// releaseManifest lists a release's client binaries. It's signed as is:
+// the signature, base64, is at the manifest's URL plus ".sig".
+type releaseManifest struct {
+	Version string                 `json:"version"`
+	Files   map[string]releaseFile `json:"files"` // by GOOS-GOARCH
+}
+
+type releaseFile struct {
+	URL    string `json:"url"` // relative to the manifest's
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// runUpdateCommand handles "update [options]", which replaces the running
+// binary with the latest release if the manifest's signature checks out.
+func runUpdateCommand(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	manifestURL := fs.String("url", updateURL, "Release manifest URL")
+	key := fs.String("key", updateKey, "Ed25519 public key the manifest must be signed with (base64)")
+	proxyURL := fs.String("p", "", "Proxy URL (http://host:port or socks5://host:port)")
+	check := fs.Bool("check", false, "Only say whether there's a newer release")
+	force := fs.Bool("force", false, "Install the release even if it isn't newer")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s update [options]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *manifestURL == "" {
+		log.Fatal("This build doesn't know where releases are, use -url")
+	}
+	if *key == "" {
+		log.Fatal("This build has no release key, use -key")
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(*key)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		log.Fatalf("Invalid -key: not a base64 Ed25519 public key")
+	}
+	httpClient, err := updateClient(*proxyURL)
+	if err != nil {
+		log.Fatalf("Invalid -p: %v", err)
+	}
+
+	if err := selfUpdate(httpClient, *manifestURL, publicKey, *check, *force); err != nil {
+		log.Fatalf("Update failed: %v", err)
+	}
+	os.Exit(0)
+}
+
+// updateClient fetches releases directly, or through a proxy. Pointing it
+// at a running client's -socks5 or -http-proxy listener updates through
+// the tunnel.
+func updateClient(proxyURL string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Minute}, nil
+}
+
+func selfUpdate(httpClient *http.Client, manifestURL string, publicKey ed25519.PublicKey, check, force bool) error {
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return err
+	}
+	data, err := fetch(httpClient, manifestURL, maxManifestSize)
+	if err != nil {
+		return err
+	}
+	sig, err := fetch(httpClient, manifestURL+".sig", 1024)
+	if err != nil {
+		return err
+	}
+	sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(publicKey, data, sig) {
+		return errors.New("manifest signature doesn't verify, not updating")
+	}
+	var manifest releaseManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	newer, comparable := compareVersions(manifest.Version, version)
+	switch {
+	case !comparable && !force:
+		return fmt.Errorf("can't tell whether %s is newer than this build (%s), use -force to install it anyway", manifest.Version, version)
+	case newer <= 0 && !force:
+		// An old manifest is still validly signed, never go back to it
+		log.Printf("Up to date (%s, latest release %s)", version, manifest.Version)
+		return nil
+	case check:
+		log.Printf("Release %s is available, this is %s", manifest.Version, version)
+		return nil
+	}
+
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	file, ok := manifest.Files[platform]
+	if !ok {
+		return fmt.Errorf("release %s has no client for %s", manifest.Version, platform)
+	}
+	want, err := hex.DecodeString(file.SHA256)
+	if err != nil || len(want) != sha256.Size || file.Size <= 0 || file.Size > maxBinarySize {
+		return fmt.Errorf("invalid manifest entry for %s", platform)
+	}
+	ref, err := url.Parse(file.URL)
+	if err != nil {
+		return fmt.Errorf("invalid manifest entry for %s: %v", platform, err)
+	}
+	binary, err := fetch(httpClient, base.ResolveReference(ref).String(), file.Size)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(binary); int64(len(binary)) != file.Size || !bytes.Equal(sum[:], want) {
+		return errors.New("download doesn't match the manifest, not updating")
+	}
+
+	exe, err := replaceExecutable(binary)
+	if err != nil {
+		return err
+	}
+	log.Printf("Updated %s from %s to %s, restart it to use the new version", exe, version, manifest.Version)
+	return nil
+}
+
+// fetch downloads a URL, refusing anything over limit bytes.
+func fetch(httpClient *http.Client, rawURL string, limit int64) ([]byte, error) {
+	resp, err := httpClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rawURL, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s: larger than %d bytes", rawURL, limit)
+	}
+	return data, nil
+}
+
+// replaceExecutable writes binary next to the running executable and
+// renames it over it, so the file is either the old one or the new one,
+// never half of each. Windows won't replace a running executable, but
+// will let it be moved aside; what's moved aside goes with the next update.
+func replaceExecutable(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".new-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil && runtime.GOOS != "windows" {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp.Name(), exe); err != nil {
+			os.Rename(old, exe)
+			return "", err
+		}
+		return exe, nil
+	}
+	return exe, os.Rename(tmp.Name(), exe)
+}
+
+// compareVersions compares dotted release numbers like "1.4.2" or
+// "v1.5", returning >0 if a is newer than b. comparable is false if either
+// isn't one, like the "dev" of builds from source.
+func compareVersions(a, b string) (newer int, comparable bool) {
+	parse := func(v string) ([]int, bool) {
+		parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+		numbers := make([]int, len(parts))
+		for i, p := range parts {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			numbers[i] = n
+		}
+		return numbers, true
+	}
+	x, okA := parse(a)
+	y, okB := parse(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := 0; i < max(len(x), len(y)); i++ {
+		var m, n int
+		if i < len(x) {
+			m = x[i]
+		}
+		if i < len(y) {
+			n = y[i]
+		}
+		if m != n {
+			return m - n, true
+		}
+	}
+	return 0, true
+}
@@ -0,0 +1,207 @@
+//go:build !stealth
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// usage prints the client's options. Stealth builds print a bare list
+// instead, see usage_stealth.go.
+func usage() {
+	fmt.Fprintf(os.Stderr, "DarkFlare Client %s - TCP-over-CDN tunnel client component\n", version)
+	fmt.Fprintf(os.Stderr, "(c) 2024 Barrett Lyon\n\n")
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s service install|uninstall|start|stop [name] [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "            Run as a Windows service\n")
+	fmt.Fprintf(os.Stderr, "  %s service generate [systemd|launchd] [name] [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "            Print a systemd unit or launchd plist running with the options\n")
+	fmt.Fprintf(os.Stderr, "  %s update [-check] [-p proxy]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "            Replace this binary with the latest signed release\n")
+	fmt.Fprintf(os.Stderr, "  %s watch [-status addr] [-interval 1s]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "            Live view of a running client's connections (see -status)\n\n")
+	fmt.Fprintf(os.Stderr, "Options:\n")
+	fmt.Fprintf(os.Stderr, "  -l        Local port, udp:<port> to relay UDP, or stdin:stdout for ProxyCommand mode\n")
+	fmt.Fprintf(os.Stderr, "            Format: <port>, udp:<port> or stdin:stdout\n")
+	fmt.Fprintf(os.Stderr, "            Examples: 2222, udp:51820 or stdin:stdout\n\n")
+	fmt.Fprintf(os.Stderr, "  -t        Target URL of your cdn-protected darkflare-server\n")
+	fmt.Fprintf(os.Stderr, "            Format: [http(s)://]hostname[:port]\n")
+	fmt.Fprintf(os.Stderr, "            Default scheme: https, Default ports: 80/443\n")
+	fmt.Fprintf(os.Stderr, "            This server will receive and forward your traffic\n\n")
+	fmt.Fprintf(os.Stderr, "  -d        Destination address for the final connection\n")
+	fmt.Fprintf(os.Stderr, "            Format: hostname:port or a service name defined on the server\n")
+	fmt.Fprintf(os.Stderr, "            This is where your traffic will ultimately be sent\n\n")
+	fmt.Fprintf(os.Stderr, "  -socks5   Also (or instead of -l/-d) run a SOCKS5 proxy on this address\n")
+	fmt.Fprintf(os.Stderr, "            Each connection goes to the destination it asks for\n")
+	fmt.Fprintf(os.Stderr, "            Example: 127.0.0.1:1080 (no authentication, keep it local)\n\n")
+	fmt.Fprintf(os.Stderr, "  -http-proxy\n")
+	fmt.Fprintf(os.Stderr, "            The same as an HTTP proxy (CONNECT and plain http:// requests)\n")
+	fmt.Fprintf(os.Stderr, "            Example: 127.0.0.1:8118\n\n")
+	fmt.Fprintf(os.Stderr, "  -tun      Carry whole-device traffic like a VPN instead of -l/-d\n")
+	fmt.Fprintf(os.Stderr, "            The server must run with -tun (Linux, needs root)\n\n")
+	fmt.Fprintf(os.Stderr, "  -tun-routes\n")
+	fmt.Fprintf(os.Stderr, "            Networks to route through -tun, or default for everything\n")
+	fmt.Fprintf(os.Stderr, "            Example: 10.0.0.0/8,192.168.10.0/24\n")
+	fmt.Fprintf(os.Stderr, "            Default: Only the server's -tun network\n\n")
+	fmt.Fprintf(os.Stderr, "  -debug    Enable detailed debug logging\n")
+	fmt.Fprintf(os.Stderr, "            Shows connection details, data transfer, and errors\n\n")
+	fmt.Fprintf(os.Stderr, "  -redact   Keep sensitive details out of logs\n")
+	fmt.Fprintf(os.Stderr, "            Hashes destinations, truncates session IDs, omits sizes\n\n")
+	fmt.Fprintf(os.Stderr, "  -p        Proxy URL for outbound connections\n")
+	fmt.Fprintf(os.Stderr, "            Format: scheme://[user:pass@]host:port\n")
+	fmt.Fprintf(os.Stderr, "            Supported schemes: http, https, socks5\n\n")
+	fmt.Fprintf(os.Stderr, "  -transport\n")
+	fmt.Fprintf(os.Stderr, "            poll: repeated GET/POST requests (default)\n")
+	fmt.Fprintf(os.Stderr, "            ws: one WebSocket per connection, much lower latency\n")
+	fmt.Fprintf(os.Stderr, "            h2: one streaming HTTP/2 request per connection\n")
+	fmt.Fprintf(os.Stderr, "            h3: the same over HTTP/3 (QUIC), no proxy support\n")
+	fmt.Fprintf(os.Stderr, "            sse: downstream data pushed over one event stream, uploads\n")
+	fmt.Fprintf(os.Stderr, "                 still POSTed; about half the requests of polling\n")
+	fmt.Fprintf(os.Stderr, "            (all but poll need the server's -transport to include them)\n")
+	fmt.Fprintf(os.Stderr, "            List several to fall back when one doesn't connect, best first\n")
+	fmt.Fprintf(os.Stderr, "            Example: h2,ws,poll\n\n")
+	fmt.Fprintf(os.Stderr, "  -e2e      Encrypt tunnel data with a key derived from -psk, so the CDN\n")
+	fmt.Fprintf(os.Stderr, "            can't read it even when the inner protocol isn't encrypted\n")
+	fmt.Fprintf(os.Stderr, "            (needs a server that supports it)\n\n")
+	fmt.Fprintf(os.Stderr, "  -early-data\n")
+	fmt.Fprintf(os.Stderr, "            Send a connection's first bytes with the request that opens\n")
+	fmt.Fprintf(os.Stderr, "            its session and get the first answer back in the response\n")
+	fmt.Fprintf(os.Stderr, "            (poll transport; use with -psk, which stops replays)\n\n")
+	fmt.Fprintf(os.Stderr, "  -carrier  Where requests carry the tunnel's fields: header (default),\n")
+	fmt.Fprintf(os.Stderr, "            cookie or query, for WAF rules that block unusual headers\n")
+	fmt.Fprintf(os.Stderr, "            auto: probe which gets through before the first connection\n\n")
+	fmt.Fprintf(os.Stderr, "  -mux      Carry all local connections as streams of one tunnel\n")
+	fmt.Fprintf(os.Stderr, "            session, cutting requests when apps open many (-socks5)\n\n")
+	fmt.Fprintf(os.Stderr, "  -batch    Send the requests of all connections together, collected\n")
+	fmt.Fprintf(os.Stderr, "            for this long (needs -transport batch on the server)\n")
+	fmt.Fprintf(os.Stderr, "            Example: 20ms, worth it with many connections (-socks5)\n\n")
+	fmt.Fprintf(os.Stderr, "  -stream-polls\n")
+	fmt.Fprintf(os.Stderr, "            Let the server hold polls open and stream data into them\n")
+	fmt.Fprintf(os.Stderr, "            (needs -stream-polls on the server, ignored otherwise)\n\n")
+	fmt.Fprintf(os.Stderr, "  -poll-interval\n")
+	fmt.Fprintf(os.Stderr, "            Poll this often while data flows (default: 50ms)\n\n")
+	fmt.Fprintf(os.Stderr, "  -idle-poll Poll idle connections this rarely: each empty poll doubles the\n")
+	fmt.Fprintf(os.Stderr, "            wait up to it, data or a local write goes back to -poll-interval\n")
+	fmt.Fprintf(os.Stderr, "            Example: 5s (default: 2s, the same as -poll-interval for fixed)\n\n")
+	fmt.Fprintf(os.Stderr, "  -cover    Send cover traffic: idle polls and empty uploads at random\n")
+	fmt.Fprintf(os.Stderr, "            intervals around this, and requests padded to random sizes\n")
+	fmt.Fprintf(os.Stderr, "            Example: 1s (default: off)\n\n")
+	fmt.Fprintf(os.Stderr, "  -compress Compress polls and uploads when the server agrees, with these\n")
+	fmt.Fprintf(os.Stderr, "            algorithms in order of preference (zstd, gzip); what looks\n")
+	fmt.Fprintf(os.Stderr, "            encrypted or compressed already is sent as it is\n")
+	fmt.Fprintf(os.Stderr, "            Example: zstd,gzip (default: off)\n\n")
+	fmt.Fprintf(os.Stderr, "  -encoding How the server encodes poll responses: binary, base64 or hex\n")
+	fmt.Fprintf(os.Stderr, "            Older servers always send hex, whatever this says\n")
+	fmt.Fprintf(os.Stderr, "            Default: auto (binary, base64 if the CDN changes responses)\n\n")
+	fmt.Fprintf(os.Stderr, "  -connect-wait\n")
+	fmt.Fprintf(os.Stderr, "            Hold new local connections up to this long while the\n")
+	fmt.Fprintf(os.Stderr, "            tunnel comes up, instead of dropping them right away\n")
+	fmt.Fprintf(os.Stderr, "            Example: 15s (default: 0, don't wait)\n\n")
+	fmt.Fprintf(os.Stderr, "  -idle-timeout\n")
+	fmt.Fprintf(os.Stderr, "            Close local connections with no traffic for this long\n")
+	fmt.Fprintf(os.Stderr, "            Example: 30m (default: 0, never)\n\n")
+	fmt.Fprintf(os.Stderr, "  -max-lifetime\n")
+	fmt.Fprintf(os.Stderr, "            Close local connections after this long regardless\n")
+	fmt.Fprintf(os.Stderr, "            Example: 8h (default: 0, never)\n\n")
+	fmt.Fprintf(os.Stderr, "  -watchdog Reset local connections that sent data and got nothing\n")
+	fmt.Fprintf(os.Stderr, "            back for this long, e.g. after the server lost the session\n")
+	fmt.Fprintf(os.Stderr, "            Example: 2m (default: 0, never)\n\n")
+	fmt.Fprintf(os.Stderr, "  -resume   When the server lost a connection's session (it restarted),\n")
+	fmt.Fprintf(os.Stderr, "            open it again and carry on instead of resetting the connection\n")
+	fmt.Fprintf(os.Stderr, "            Only for protocols that cope with a new connection mid-stream\n\n")
+	fmt.Fprintf(os.Stderr, "  -status   Serve live stats of open connections (bytes, transport, RTT)\n")
+	fmt.Fprintf(os.Stderr, "            as JSON at /sessions, for \"%s watch\"\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "            Example: 127.0.0.1:9091 (no authentication, keep it local)\n\n")
+	fmt.Fprintf(os.Stderr, "  -max-sessions\n")
+	fmt.Fprintf(os.Stderr, "            Refuse local connections beyond this many at once\n")
+	fmt.Fprintf(os.Stderr, "            Default: 0, no limit (32 in router builds)\n\n")
+	fmt.Fprintf(os.Stderr, "  -low-memory\n")
+	fmt.Fprintf(os.Stderr, "            Small buffers and a 24MB soft memory limit, for routers\n")
+	fmt.Fprintf(os.Stderr, "            Default: on in router builds (-tags router)\n\n")
+	fmt.Fprintf(os.Stderr, "  -path-prefix\n")
+	fmt.Fprintf(os.Stderr, "            URL path the server is mounted under, e.g. /wp-json/wp/v2/\n")
+	fmt.Fprintf(os.Stderr, "            Must match the server's -path-prefix\n\n")
+	fmt.Fprintf(os.Stderr, "  -paths    Where requests go under it: random (file names), site (a\n")
+	fmt.Fprintf(os.Stderr, "            blog, shop and API), @FILE with a template per line, or\n")
+	fmt.Fprintf(os.Stderr, "            templates separated by commas, with {year} {month} {day}\n")
+	fmt.Fprintf(os.Stderr, "            {word} {slug} {name} {num:LOW-HIGH} {hex:N} {a|b|c}\n")
+	fmt.Fprintf(os.Stderr, "            Example: /api/v2/{word}s?page={num:1-40} (default: random)\n\n")
+	fmt.Fprintf(os.Stderr, "  -budget   Monthly transfer budget, e.g. 50GB\n")
+	fmt.Fprintf(os.Stderr, "            Warns at 50%%, 80%%, 90%% and 100%%\n\n")
+	fmt.Fprintf(os.Stderr, "  -budget-throttle\n")
+	fmt.Fprintf(os.Stderr, "            Limit traffic to this many bytes per second once the\n")
+	fmt.Fprintf(os.Stderr, "            budget is used up, e.g. 128KB (default: only warn)\n\n")
+	fmt.Fprintf(os.Stderr, "  -budget-file\n")
+	fmt.Fprintf(os.Stderr, "            Where monthly usage is kept\n")
+	fmt.Fprintf(os.Stderr, "            Default: <user config dir>/darkflare/usage.json\n\n")
+	fmt.Fprintf(os.Stderr, "  -cache-file\n")
+	fmt.Fprintf(os.Stderr, "            Where what the client found out about servers (carrier, CDN\n")
+	fmt.Fprintf(os.Stderr, "            transformations, failing transports) is kept for a day\n")
+	fmt.Fprintf(os.Stderr, "            Default: <user cache dir>/darkflare/probes.json\n\n")
+	fmt.Fprintf(os.Stderr, "  -no-cache Probe everything again instead of using the cache file\n\n")
+	fmt.Fprintf(os.Stderr, "  -endpoints-key\n")
+	fmt.Fprintf(os.Stderr, "            Public key of the server's signed endpoints list (-endpoints):\n")
+	fmt.Fprintf(os.Stderr, "            fetch and keep it next to the cache file, and connect via it\n")
+	fmt.Fprintf(os.Stderr, "            when -t doesn't answer\n\n")
+	fmt.Fprintf(os.Stderr, "  -on-up    Command to run when the tunnel comes up\n")
+	fmt.Fprintf(os.Stderr, "  -on-down  Command to run when the tunnel stops working\n")
+	fmt.Fprintf(os.Stderr, "  -on-drain Command to run when the server announces it's shutting down\n")
+	fmt.Fprintf(os.Stderr, "  -on-failover\n")
+	fmt.Fprintf(os.Stderr, "            Command to run when -t doesn't answer and the client connects\n")
+	fmt.Fprintf(os.Stderr, "            via the endpoints list (-endpoints-key) instead\n")
+	fmt.Fprintf(os.Stderr, "            Run with DARKFLARE_EVENT, DARKFLARE_TARGET, DARKFLARE_DEST,\n")
+	fmt.Fprintf(os.Stderr, "            DARKFLARE_LISTEN, DARKFLARE_ERROR, DARKFLARE_DRAIN (the\n")
+	fmt.Fprintf(os.Stderr, "            seconds open connections have left) and DARKFLARE_ENDPOINT\n")
+	fmt.Fprintf(os.Stderr, "            (what the client fails over to) set\n\n")
+	fmt.Fprintf(os.Stderr, "  -stego    Experimental: hide downstream data in image responses\n")
+	fmt.Fprintf(os.Stderr, "            Supported: png (disable CDN image optimization)\n\n")
+	fmt.Fprintf(os.Stderr, "  -psk      Pre-shared key for server authentication\n")
+	fmt.Fprintf(os.Stderr, "            Format: id:secret (must match one of the server's keys)\n\n")
+	fmt.Fprintf(os.Stderr, "  -psk-kdf  Treat the -psk secret as a password and stretch it\n")
+	fmt.Fprintf(os.Stderr, "            Format: argon2id[:t=3,m=65536,p=4] (must match the server)\n\n")
+	fmt.Fprintf(os.Stderr, "  -break-glass\n")
+	fmt.Fprintf(os.Stderr, "            Emergency token from the server admin that unlocks a\n")
+	fmt.Fprintf(os.Stderr, "            destination your access doesn't normally cover\n\n")
+	fmt.Fprintf(os.Stderr, "  -cert     Client certificate to present to the CDN edge (mTLS)\n")
+	fmt.Fprintf(os.Stderr, "  -key      Private key for -cert\n\n")
+	fmt.Fprintf(os.Stderr, "  -use-keyring\n")
+	fmt.Fprintf(os.Stderr, "            Read the pre-shared key from the system keyring\n")
+	fmt.Fprintf(os.Stderr, "            (Keychain, Credential Manager or Secret Service)\n\n")
+	fmt.Fprintf(os.Stderr, "  -keyring-set\n")
+	fmt.Fprintf(os.Stderr, "            Store the -psk key in the system keyring for -t and exit\n\n")
+	fmt.Fprintf(os.Stderr, "  -config   Load settings from a JSON config file\n")
+	fmt.Fprintf(os.Stderr, "            Keys: listen, target, dest, proxy, psk, psk_kdf, debug, redact,\n")
+	fmt.Fprintf(os.Stderr, "                  idle_timeout, max_lifetime, watchdog, path_prefix, on_up,\n")
+	fmt.Fprintf(os.Stderr, "                  on_down, on_drain, transport\n")
+	fmt.Fprintf(os.Stderr, "            Encrypted files prompt for their passphrase on start\n")
+	fmt.Fprintf(os.Stderr, "            Command line flags override values from the file\n\n")
+	fmt.Fprintf(os.Stderr, "  -redeem   Redeem an invitation from darkflare-server invite and exit\n")
+	fmt.Fprintf(os.Stderr, "            Saves the granted credential to the -config file\n")
+	fmt.Fprintf(os.Stderr, "            Invitations work once; the credential expires with them\n\n")
+	fmt.Fprintf(os.Stderr, "  -encrypt-config\n")
+	fmt.Fprintf(os.Stderr, "            Encrypt a config file with a passphrase and exit\n")
+	fmt.Fprintf(os.Stderr, "            Writes <file>.enc; delete the plaintext afterwards\n\n")
+	fmt.Fprintf(os.Stderr, "Examples:\n")
+	fmt.Fprintf(os.Stderr, "  Basic SSH tunnel:\n")
+	fmt.Fprintf(os.Stderr, "    %s -l 2222 -t cdn.example.com -d ssh.target.com:22\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  SSH ProxyCommand mode:\n")
+	fmt.Fprintf(os.Stderr, "    ssh -o ProxyCommand=\"%s -l stdin:stdout -t cdn.example.com -d localhost:22\" user@remote\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Usage with SSH ProxyCommand:\n")
+	fmt.Fprintf(os.Stderr, "    Add to ~/.ssh/config:\n")
+	fmt.Fprintf(os.Stderr, "      Host remote.example.com\n")
+	fmt.Fprintf(os.Stderr, "        ProxyCommand %s -l stdin:stdout -t cdn.example.com -d localhost:22\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "    Then simply: ssh remote.example.com\n\n")
+	fmt.Fprintf(os.Stderr, "  Encrypted config file:\n")
+	fmt.Fprintf(os.Stderr, "    %s -encrypt-config tunnel.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "    %s -config tunnel.json.enc\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Redeem an invitation:\n")
+	fmt.Fprintf(os.Stderr, "    %s -redeem <invitation> -config ssh.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "    %s -config ssh.json -l 2222\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Notes:\n")
+	fmt.Fprintf(os.Stderr, "  - Proxy authentication is supported via URL format user:pass@host\n")
+	fmt.Fprintf(os.Stderr, "  - SOCKS5 variant will resolve hostnames through the proxy\n")
+	fmt.Fprintf(os.Stderr, "  - Debug mode will show proxy connection details and errors\n\n")
+	fmt.Fprintf(os.Stderr, "For more information: https://github.com/doxx/darkflare\n")
+}
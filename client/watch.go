@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runWatchCommand handles "watch [options]": a live, top-like view of a
+// running client's connections from its -status listener.
+func runWatchCommand(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	addr := fs.String("status", "127.0.0.1:9091", "The client's -status address")
+	interval := fs.Duration("interval", time.Second, "Refresh this often")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s watch [options]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *interval <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -interval: %s\n", *interval)
+		os.Exit(2)
+	}
+
+	url := "http://" + strings.TrimPrefix(*addr, "http://") + "/sessions"
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	var previous map[string]connInfo
+	var previousAt time.Time
+	for ; ; time.Sleep(*interval) {
+		var conns []connInfo
+		err := getJSON(httpClient, url, &conns)
+		now := time.Now()
+
+		var out strings.Builder
+		fmt.Fprintf(&out, "darkflare-client watch %s, every %s, %s\n", *addr, *interval, now.Format("15:04:05"))
+		if err != nil {
+			fmt.Fprintf(&out, "\n%v\n", err)
+			fmt.Print("\033[H\033[2J" + out.String())
+			previous = nil
+			continue
+		}
+
+		rows := make([]watchRow, len(conns))
+		var up, down float64
+		for i, conn := range conns {
+			rows[i] = watchRow{info: conn}
+			if prev, ok := previous[conn.ID]; ok {
+				seconds := now.Sub(previousAt).Seconds()
+				rows[i].up = float64(conn.Sent-prev.Sent) / seconds
+				rows[i].down = float64(conn.Received-prev.Received) / seconds
+			}
+			// -mux streams are also counted by the session carrying them
+			if conn.Transport != "mux" {
+				up += rows[i].up
+				down += rows[i].down
+			}
+		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			return rows[i].up+rows[i].down > rows[j].up+rows[j].down
+		})
+		fmt.Fprintf(&out, "%d connections, up %s/s, down %s/s\n\n", len(conns), formatRate(up), formatRate(down))
+
+		tw := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tDESTINATION\tTRANSPORT\tAGE\tIDLE\tUP/S\tDOWN/S\tSENT\tRECEIVED\tRTT")
+		for _, row := range rows {
+			c := row.info
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				c.ID[:min(8, len(c.ID))], c.Destination, orDash(c.Transport), c.Age, c.Idle,
+				formatRate(row.up), formatRate(row.down), formatByteSize(c.Sent), formatByteSize(c.Received), orDash(c.RTT))
+		}
+		tw.Flush()
+		fmt.Print("\033[H\033[2J" + out.String())
+
+		previous = make(map[string]connInfo, len(conns))
+		for _, conn := range conns {
+			previous[conn.ID] = conn
+		}
+		previousAt = now
+	}
+}
+
+type watchRow struct {
+	info     connInfo
+	up, down float64 // bytes per second since the last refresh
+}
+
+func getJSON(httpClient *http.Client, url string, v interface{}) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func formatRate(bytesPerSecond float64) string {
+	return formatByteSize(int64(bytesPerSecond))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
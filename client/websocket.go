@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPingInterval keeps quiet WebSockets from being dropped by the CDN edge,
+// which closes them after about 100 seconds without traffic.
+const wsPingInterval = 30 * time.Second
+
+// dialWebSocket opens a WebSocket to the server carrying the same headers
+// as a poll, through the same proxy and TLS settings.
+func (c *Client) dialWebSocket(ctx context.Context) (*websocket.Conn, error) {
+	req, err := c.createDebugRequest(http.MethodGet, c.cloudflareHost, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 30 * time.Second,
+		ReadBufferSize:   c.readBufferSize,
+		WriteBufferSize:  c.writeBufferSize,
+	}
+	if transport, ok := c.httpClient.Transport.(*http.Transport); ok {
+		dialer.Proxy = transport.Proxy
+		dialer.NetDialContext = transport.DialContext
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+
+	var ws *websocket.Conn
+	resp, err := c.withStepUp(func(code string) (*http.Response, error) {
+		attempt, err := c.withOneTimeCode(req, code)
+		if err != nil {
+			return nil, err
+		}
+		c.carry(attempt)
+		header := attempt.Header.Clone()
+		header.Del("Connection") // set by the dialer
+		header.Set("Host", attempt.Host)
+
+		u := *attempt.URL
+		u.Scheme = "ws"
+		if c.scheme == "https" {
+			u.Scheme = "wss"
+		}
+
+		var resp *http.Response
+		ws, resp, err = dialer.DialContext(ctx, u.String(), header)
+		return resp, err
+	})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("server doesn't accept WebSockets (start it with -transport ws)")
+		}
+		if resp != nil {
+			return nil, fmt.Errorf("%v (status %d)", err, resp.StatusCode)
+		}
+		return nil, err
+	}
+	return ws, nil
+}
+
+// connectWebSocket opens the WebSocket for a connection, retrying for
+// -connect-wait.
+func (c *Client) connectWebSocket(ctx context.Context, sessionID string) (*websocket.Conn, error) {
+	var ws *websocket.Conn
+	var err error
+	if c.connectWait > 0 {
+		err = c.retryConnect(ctx, sessionID, func() error {
+			ws, err = c.dialWebSocket(ctx)
+			return err
+		})
+	} else {
+		ws, err = c.dialWebSocket(ctx)
+	}
+	c.hooks.report(err)
+	return ws, err
+}
+
+// runWebSocket carries a local connection over a single WebSocket instead of
+// polling. Each chunk read locally goes out as one binary message and each
+// message from the server is written straight back.
+func (c *Client) runWebSocket(ctx context.Context, sessionID string, conn net.Conn, ws *websocket.Conn) {
+	defer ws.Close()
+	c.debugLog("WebSocket open for connection %s", redactID(sessionID[:8]))
+
+	// Server to local
+	downDone := make(chan struct{})
+	go func() {
+		defer close(downDone)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					c.debugLog("WebSocket read error for connection %s: %v", redactID(sessionID[:8]), err)
+				}
+				return
+			}
+			if err := c.budget.add(ctx, len(data)); err != nil {
+				return
+			}
+			if _, err := conn.Write(data); err != nil {
+				c.debugLog("Write error for connection %s: %v", redactID(sessionID[:8]), err)
+				return
+			}
+		}
+	}()
+
+	// Local to server
+	upDone := make(chan struct{})
+	go func() {
+		defer close(upDone)
+		buffer := c.bufferPool.Get().([]byte)
+		defer c.bufferPool.Put(buffer)
+		for {
+			n, err := conn.Read(buffer)
+			if n > 0 {
+				if berr := c.budget.add(ctx, n); berr != nil {
+					return
+				}
+				if werr := ws.WriteMessage(websocket.BinaryMessage, buffer[:n]); werr != nil {
+					c.debugLog("WebSocket write error for connection %s: %v", redactID(sessionID[:8]), werr)
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-downDone:
+			return
+		case <-ctx.Done():
+			return
+		case <-upDone:
+			// Let the server finish sending before the socket goes away
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			select {
+			case <-downDone:
+			case <-time.After(5 * time.Second):
+			}
+			return
+		case <-ping.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
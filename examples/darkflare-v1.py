@@ -0,0 +1,125 @@
+#!/usr/bin/env python3
+"""Minimal DarkFlare client speaking protocol v1 (see PROTOCOL.md).
+
+Tunnels stdin/stdout, so it works as an SSH ProxyCommand:
+
+    ssh -o ProxyCommand="darkflare-v1.py https://cdn.example.com localhost:22 -psk id:secret" user@host
+
+The server needs -compat v1. Only the Python standard library is used.
+"""
+
+import argparse
+import base64
+import hashlib
+import hmac
+import os
+import sys
+import threading
+import time
+import urllib.error
+import urllib.request
+
+POLL_INTERVAL = 0.1
+
+
+class NoRedirect(urllib.request.HTTPRedirectHandler):
+    # The server turns requests it doesn't accept away with a redirect
+    def redirect_request(self, req, fp, code, msg, headers, newurl):
+        return None
+
+
+opener = urllib.request.build_opener(NoRedirect)
+
+
+class Tunnel:
+    def __init__(self, server, destination, key=None):
+        self.url = server.rstrip("/") + "/assets/app.js"
+        self.session = os.urandom(16).hex()
+        self.destination = base64.b64encode(destination.encode()).decode()
+        self.key_id, self.secret = (None, None)
+        if key:
+            self.key_id, secret = key.split(":", 1)
+            self.secret = secret.encode()
+
+    def request(self, method, body=b"", close=False):
+        headers = {
+            "X-For": self.session,
+            "X-Requested-With": self.destination,
+            "X-Capabilities": "v1",
+            "User-Agent": "Mozilla/5.0",
+        }
+        if close:
+            headers["X-Connection-Close"] = "true"
+        if self.secret:
+            timestamp = str(int(time.time() * 1000))
+            signed = "\n".join([method, "app.js", self.session, timestamp, hashlib.sha256(body).hexdigest(),
+                                self.destination, headers.get("X-Connection-Close", ""), headers["X-Capabilities"]])
+            signature = hmac.new(self.secret, signed.encode(), hashlib.sha256).hexdigest()
+            headers["X-Csrf-Token"] = f"{self.key_id}.{timestamp}.{signature}"
+
+        req = urllib.request.Request(self.url, data=body if method == "POST" else None, headers=headers, method=method)
+        try:
+            with opener.open(req, timeout=30) as resp:
+                if resp.headers.get("X-Protocol") != "v1":
+                    raise IOError("not a DarkFlare server with -compat v1")
+                return resp.read()
+        except urllib.error.HTTPError as e:
+            if 300 <= e.code < 400:
+                raise IOError("the server didn't accept the request (check -psk)")
+            raise IOError(f"server answered {e.code}: {e.read(200).decode(errors='replace').strip()}")
+
+    def upload(self, data):
+        self.request("POST", data)
+
+    def poll(self):
+        return bytes.fromhex(self.request("GET").decode())
+
+    def close(self):
+        try:
+            self.request("POST", close=True)
+        except IOError:
+            pass
+
+
+def main():
+    parser = argparse.ArgumentParser(description="DarkFlare protocol v1 client (stdin/stdout)")
+    parser.add_argument("server", help="server URL, e.g. https://cdn.example.com")
+    parser.add_argument("destination", help="host:port to reach from the server")
+    parser.add_argument("-psk", help="key as id:secret")
+    args = parser.parse_args()
+
+    tunnel = Tunnel(args.server, args.destination, args.psk)
+    done = threading.Event()
+
+    def downstream():
+        try:
+            while not done.is_set():
+                data = tunnel.poll()
+                if data:
+                    sys.stdout.buffer.write(data)
+                    sys.stdout.buffer.flush()
+                if len(data) < 64 * 1024:
+                    time.sleep(POLL_INTERVAL)
+        except IOError as e:
+            print(f"darkflare-v1: {e}", file=sys.stderr)
+        finally:
+            done.set()
+
+    threading.Thread(target=downstream, daemon=True).start()
+    try:
+        while not done.is_set():
+            data = os.read(sys.stdin.fileno(), 32 * 1024)
+            if not data:
+                break
+            tunnel.upload(data)
+    except IOError as e:
+        if not done.is_set():
+            print(f"darkflare-v1: {e}", file=sys.stderr)
+    # Give the destination a moment to answer what was sent last
+    time.sleep(1)
+    done.set()
+    tunnel.close()
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager gets certificates for hosts from Let's Encrypt on first
+// use and renews them before they expire, keeping them in cacheDir so a
+// restart doesn't ask again. Challenges are answered with TLS-ALPN-01 on
+// the HTTPS listener, and HTTP-01 if -acme-http serves HTTPHandler.
+func newACMEManager(hosts, email, cacheDir string) (*autocert.Manager, error) {
+	var names []string
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if strings.ContainsAny(host, "*:/ ") {
+			return nil, fmt.Errorf("invalid hostname %q", host)
+		}
+		names = append(names, host)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no hostnames")
+	}
+
+	if cacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("no -acme-cache and no cache directory: %v", err)
+		}
+		cacheDir = filepath.Join(dir, "darkflare", "acme")
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(names...),
+		Email:      email,
+	}, nil
+}
+
+// serveACMEChallenges answers HTTP-01 challenges on addr, in the
+// background once it's bound. Anything else there is redirected to HTTPS.
+func serveACMEChallenges(m *autocert.Manager, addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Invalid -acme-http: %v", err)
+	}
+	log.Printf("Answering ACME HTTP-01 challenges on %s", addr)
+	go func() {
+		log.Fatal(http.Serve(listener, m.HTTPHandler(nil)))
+	}()
+}
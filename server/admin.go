@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type adminRole int
+
+const (
+	roleNone adminRole = iota
+	roleViewer
+	roleAdmin
+)
+
+func (r adminRole) String() string {
+	switch r {
+	case roleAdmin:
+		return "admin"
+	case roleViewer:
+		return "viewer"
+	default:
+		return "none"
+	}
+}
+
+// adminAPI serves session inspection and control on a separate listener.
+// Viewer tokens may only read state; admin tokens may also change it.
+type adminAPI struct {
+	server      *Server
+	adminToken  string
+	viewerToken string
+}
+
+type sessionInfo struct {
+	ID          string `json:"id"`
+	ClientIP    string `json:"client_ip"`
+	Destination string `json:"destination"`
+	Tenant      string `json:"tenant,omitempty"`
+	Age         string `json:"age"`
+	Idle        string `json:"idle"`
+	Colo        string `json:"colo,omitempty"`
+	Sent        int64  `json:"sent"`     // bytes to the destination
+	Received    int64  `json:"received"` // and from it
+	Transport   string `json:"transport,omitempty"`
+	Gap         string `json:"gap,omitempty"` // smoothed time between requests
+}
+
+func newAdminAPI(server *Server, adminToken, viewerToken string) *adminAPI {
+	return &adminAPI{
+		server:      server,
+		adminToken:  adminToken,
+		viewerToken: viewerToken,
+	}
+}
+
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", a.require(roleViewer, a.listSessions))
+	mux.HandleFunc("GET /sessions/{id...}", a.require(roleViewer, a.getSession))
+	mux.HandleFunc("DELETE /sessions/{id...}", a.require(roleAdmin, a.closeSession))
+	mux.HandleFunc("POST /breakglass", a.require(roleAdmin, a.issueBreakGlass))
+	mux.HandleFunc("GET /breakglass", a.require(roleViewer, a.listBreakGlass))
+	mux.HandleFunc("DELETE /breakglass/{id}", a.require(roleAdmin, a.revokeBreakGlass))
+	mux.HandleFunc("GET /colos", a.require(roleViewer, a.listColos))
+	mux.HandleFunc("GET /probes", a.require(roleViewer, a.listProbes))
+	mux.HandleFunc("GET /services", a.require(roleViewer, a.listServices))
+	mux.HandleFunc("GET /metrics", a.require(roleViewer, a.server.metrics.handler().ServeHTTP))
+	// Load balancers and uptime monitors don't bring tokens
+	mux.HandleFunc("GET /healthz", a.server.serveHealth)
+	return mux
+}
+
+// listenAndServe binds addr, then serves in the background.
+func (a *adminAPI) listenAndServe(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Admin API: %v", err)
+	}
+	log.Printf("Admin API listening on %s", addr)
+	go func() {
+		log.Fatal(http.Serve(listener, a.handler()))
+	}()
+}
+
+func (a *adminAPI) roleFor(r *http.Request) adminRole {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return roleNone
+	}
+	if a.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1 {
+		return roleAdmin
+	}
+	if a.viewerToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.viewerToken)) == 1 {
+		return roleViewer
+	}
+	return roleNone
+}
+
+func (a *adminAPI) require(role adminRole, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := a.roleFor(r)
+		if got == roleNone {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if got < role {
+			a.server.warn("Admin API denied", "admin", r.RemoteAddr, "method", r.Method, "path", r.URL.Path, "role", got.String())
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// setTransport records how the client carries the session.
+func (session *Session) setTransport(transport string) {
+	session.mu.Lock()
+	session.transport = transport
+	session.mu.Unlock()
+}
+
+// describe reports a session as the API shows it.
+func describe(id string, session *Session, now time.Time) sessionInfo {
+	session.mu.Lock()
+	lastActive := session.lastActive
+	clientIP := session.clientIP
+	colo := session.colo
+	transport := session.transport
+	gap := session.gap
+	session.mu.Unlock()
+	info := sessionInfo{
+		ID:          id,
+		ClientIP:    clientIP,
+		Destination: session.destination,
+		Tenant:      session.tenant,
+		Age:         now.Sub(session.created).Round(time.Second).String(),
+		Idle:        now.Sub(lastActive).Round(time.Second).String(),
+		Colo:        colo,
+		Sent:        session.sent.Load(),
+		Received:    session.received.Load(),
+		Transport:   transport,
+	}
+	if gap >= time.Millisecond {
+		info.Gap = gap.Round(time.Millisecond).String()
+	} else if gap > 0 {
+		info.Gap = gap.Round(time.Microsecond).String()
+	}
+	return info
+}
+
+func (a *adminAPI) listSessions(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	sessions := make([]sessionInfo, 0)
+	a.server.sessions.Range(func(key, value interface{}) bool {
+		sessions = append(sessions, describe(key.(string), value.(*Session), now))
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (a *adminAPI) getSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	sessionInterface, exists := a.server.sessions.Load(id)
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(describe(id, sessionInterface.(*Session), time.Now()))
+}
+
+func (a *adminAPI) listColos(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.server.metrics.colos.snapshot())
+}
+
+func (a *adminAPI) listProbes(w http.ResponseWriter, r *http.Request) {
+	probes := make([]probeInfo, 0)
+	if a.server.probes != nil {
+		probes = a.server.probes.snapshot()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(probes)
+}
+
+func (a *adminAPI) listServices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.server.describeServices())
+}
+
+func (a *adminAPI) closeSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	sessionInterface, exists := a.server.sessions.LoadAndDelete(id)
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	session := sessionInterface.(*Session)
+	session.conn.Close()
+	a.server.retired.Store(id, time.Now())
+
+	if !a.server.noLogDests.match(session.destination) {
+		attrs := append(sessionAttrs(session.clientIP, id, session.destination), byteAttrs(session)...)
+		a.server.info("Admin API closed session", append(attrs, "admin", r.RemoteAddr)...)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// keyRing holds the pre-shared keys accepted by the server, indexed by key ID.
+// More than one key can be active at a time so a fleet of clients can be moved
+// from the current key to the next one without a flag-day outage.
+type keyRing struct {
+	keys  map[string][]byte
+	order []string
+}
+
+// parseKeyRing parses a comma separated list of id:secret pairs. The first
+// entry is the current key, any following entries are also accepted.
+func parseKeyRing(spec string) (*keyRing, error) {
+	ring := &keyRing{keys: make(map[string][]byte)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid key %q (format: id:secret)", entry)
+		}
+		if strings.ContainsAny(id, ".,") {
+			return nil, fmt.Errorf("key ID %q must not contain '.' or ','", id)
+		}
+		if _, exists := ring.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate key ID %q", id)
+		}
+		ring.keys[id] = []byte(secret)
+		ring.order = append(ring.order, id)
+	}
+	if len(ring.order) == 0 {
+		return nil, fmt.Errorf("no keys configured")
+	}
+	return ring, nil
+}
+
+// secret returns the key for a key ID.
+func (k *keyRing) secret(id string) ([]byte, bool) {
+	secret, ok := k.keys[id]
+	return secret, ok
+}
+
+// streamingUpload reports whether r is an h2 or h3 stream the server takes
+// as one, whose body can't be read ahead to check its signature.
+func (s *Server) streamingUpload(r *http.Request) bool {
+	return r.Method == http.MethodPost && hasCapability(r, "stream") &&
+		((r.ProtoMajor == 2 && s.h2streams) || (r.ProtoMajor == 3 && s.h3streams))
+}
+
+// sessionToken is the per-session token of clients that predate request
+// signing, accepted with -legacy-auth.
+func sessionToken(secret []byte, sessionID string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sessionID))
+	return mac.Sum(nil)
+}
+
+// authenticate checks the X-Csrf-Token header against the -psk keys, or the
+// zone's, and for inv_ key IDs, redeemed invitations. It returns the
+// matching key ID, the destination an invitation credential is restricted
+// to, if any, and the key itself for -e2e sessions.
+//
+// The header is "keyID.timestamp.signature", the signature covering the
+// request itself (see requestSignature), so a captured request can't be
+// changed or sent again.
+func (s *Server) authenticate(r *http.Request, sessionID string) (string, string, []byte, bool) {
+	keyID, rest, ok := strings.Cut(r.Header.Get("X-Csrf-Token"), ".")
+	if !ok {
+		return "", "", nil, false
+	}
+
+	var secret []byte
+	name, allowedDest := keyID, ""
+	if s.invites != nil && strings.HasPrefix(keyID, invitePrefix) {
+		secret, name, allowedDest, ok = s.invites.lookup(keyID)
+	} else if keys := s.zoneFor(r).keyRing(s.keys); keys != nil {
+		secret, ok = keys.secret(keyID)
+	}
+	if !ok {
+		return name, "", nil, false
+	}
+
+	timestamp, signature, signed := strings.Cut(rest, ".")
+	if !signed {
+		got, err := hex.DecodeString(rest)
+		ok = s.legacyAuth && err == nil && hmac.Equal(got, sessionToken(secret, sessionID))
+		return name, allowedDest, secret, ok
+	}
+	if err := s.signatures.verify(r, secret, sessionID, timestamp, signature, s.streamingUpload(r), s.legacyAuth); err != nil {
+		s.warn("Rejected signature", "key", name, "err", err)
+		return name, "", nil, false
+	}
+	return name, allowedDest, secret, true
+}
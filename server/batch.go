@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	maxBatchBytes  = 8 << 20
+	maxBatchFrames = 256
+)
+
+// batchHeaders are the only request headers a frame may carry. Everything
+// else, the client IP in particular, comes from the request carrying it.
+var batchHeaders = []string{
+	"X-For", "X-Requested-With", "X-Csrf-Token", "X-Connection-Close",
+	"X-Capabilities", "X-Otp", "X-Break-Glass", "X-Checksum", "X-Resend",
+	"X-Seq", "X-Ack", "X-Packed",
+}
+
+// batchFrameKey marks the context of a request that came as a frame.
+type batchFrameKey struct{}
+
+// batchFrame is one tunnel request inside a batch.
+type batchFrame struct {
+	method string
+	path   string // as the client requested it, for its signature
+	header http.Header
+	body   []byte
+}
+
+// batchResponse records what the handler answers to one frame.
+type batchResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *batchResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *batchResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *batchResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// handleBatch answers a request carrying several tunnel requests (-batch on
+// the client), usually for different sessions. Each frame goes through the
+// regular handler as if it had arrived on its own; frames for one session
+// run in order, different sessions in parallel.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request, clientIP string) {
+	if s.zoneFor(r).keyRing(s.keys) != nil || s.invites != nil {
+		if keyID, _, _, ok := s.authenticate(r, r.Header.Get("X-For")); !ok {
+			if keyID == "" {
+				keyID = "none"
+			}
+			s.warn("Auth failed", "client", clientIP, "key", keyID)
+			s.metrics.authFailures.Inc()
+			s.sendRedirect(w, r, clientIP)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBatchBytes+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(body) > maxBatchBytes {
+		http.Error(w, "Batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	frames, err := decodeBatch(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bySession := make(map[string][]int)
+	for i, f := range frames {
+		id := f.header.Get("X-For")
+		bySession[id] = append(bySession[id], i)
+	}
+	responses := make([]*batchResponse, len(frames))
+	var wg sync.WaitGroup
+	for _, indexes := range bySession {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, i := range indexes {
+				responses[i] = s.serveFrame(r, frames[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	var out bytes.Buffer
+	for _, resp := range responses {
+		meta := strconv.Itoa(resp.status) + "\n" + encodeHeader(resp.header)
+		writeChunk(&out, []byte(meta))
+		writeChunk(&out, resp.body.Bytes())
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(out.Bytes())
+}
+
+// serveFrame runs one frame through handleRequest.
+func (s *Server) serveFrame(outer *http.Request, frame *batchFrame) *batchResponse {
+	r := outer.Clone(context.WithValue(outer.Context(), batchFrameKey{}, true))
+	for _, name := range batchHeaders {
+		r.Header.Del(name)
+	}
+	// Nor the cookies and query the batch's own fields may have come in
+	r.Header.Del("Cookie")
+	r.URL.RawQuery = ""
+	for name, values := range frame.header {
+		r.Header[name] = values
+	}
+	r.Method = frame.method
+	if frame.path != "" {
+		r.RequestURI = frame.path
+	}
+	r.Body = io.NopCloser(bytes.NewReader(frame.body))
+	r.ContentLength = int64(len(frame.body))
+
+	resp := &batchResponse{header: make(http.Header)}
+	if hasCapability(r, "batch") {
+		http.Error(resp, "Nested batch", http.StatusBadRequest)
+		return resp
+	}
+	s.handleRequest(resp, r)
+	resp.WriteHeader(http.StatusOK)
+	return resp
+}
+
+// A batch is a sequence of frames, each a uvarint-prefixed meta block
+// ("METHOD PATH\nName: value\n...") followed by a uvarint-prefixed body.
+// Older clients leave out the path. Answers use the same layout with the
+// status code in place of the request line.
+func decodeBatch(data []byte) ([]*batchFrame, error) {
+	var frames []*batchFrame
+	for len(data) > 0 {
+		if len(frames) == maxBatchFrames {
+			return nil, errors.New("too many frames in batch")
+		}
+		meta, rest, err := readChunk(data)
+		if err != nil {
+			return nil, err
+		}
+		body, rest, err := readChunk(rest)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		requestLine, headerBlock, _ := strings.Cut(string(meta), "\n")
+		method, path, _ := strings.Cut(requestLine, " ")
+		if method != http.MethodGet && method != http.MethodPost {
+			return nil, fmt.Errorf("invalid frame method %q", method)
+		}
+		frame := &batchFrame{method: method, path: path, header: make(http.Header), body: body}
+		scanner := bufio.NewScanner(strings.NewReader(headerBlock))
+		for scanner.Scan() {
+			name, value, ok := strings.Cut(scanner.Text(), ": ")
+			if !ok {
+				return nil, errors.New("invalid frame header")
+			}
+			name = http.CanonicalHeaderKey(name)
+			if !allowedBatchHeader(name) {
+				return nil, fmt.Errorf("header %s not allowed in frames", name)
+			}
+			frame.header.Add(name, value)
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+func allowedBatchHeader(name string) bool {
+	for _, h := range batchHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeHeader(header http.Header) string {
+	var b strings.Builder
+	for name, values := range header {
+		for _, v := range values {
+			b.WriteString(name + ": " + v + "\n")
+		}
+	}
+	return b.String()
+}
+
+func readChunk(data []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || n > uint64(len(data)-size) {
+		return nil, nil, errors.New("truncated batch")
+	}
+	end := size + int(n)
+	return data[size:end], data[end:], nil
+}
+
+func writeChunk(b *bytes.Buffer, chunk []byte) {
+	b.Write(binary.AppendUvarint(nil, uint64(len(chunk))))
+	b.Write(chunk)
+}
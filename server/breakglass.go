@@ -0,0 +1,203 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	breakGlassDefaultTTL = time.Hour
+	breakGlassMaxTTL     = 24 * time.Hour
+)
+
+// breakGlassGrant lets sessions reach destinations the ACLs would deny,
+// until it expires or is revoked. Grants only live in memory.
+type breakGlassGrant struct {
+	ID      string    `json:"id"`
+	Dest    string    `json:"dest"`
+	Client  string    `json:"client,omitempty"` // empty for any client
+	Reason  string    `json:"reason"`
+	Issuer  string    `json:"issuer"`
+	Expires time.Time `json:"expires"`
+
+	allowed *destMatcher
+}
+
+type breakGlass struct {
+	mu      sync.Mutex
+	byToken map[string]*breakGlassGrant // sha256(token) -> grant
+}
+
+func newBreakGlass() *breakGlass {
+	return &breakGlass{byToken: make(map[string]*breakGlassGrant)}
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// audit logs break-glass activity. Unlike other logs it ignores -s and
+// -nolog-dest.
+func audit(format string, v ...interface{}) {
+	log.Printf("AUDIT break-glass: "+format, v...)
+}
+
+// issue creates a grant and returns it with its token, which is only ever
+// shown here.
+func (b *breakGlass) issue(dest, client, reason, issuer string, ttl time.Duration) (*breakGlassGrant, string, error) {
+	allowed, err := parseDestMatcher(dest)
+	if err != nil {
+		return nil, "", err
+	}
+	raw := make([]byte, 24)
+	if _, err := cryptorand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	token := "bg_" + hex.EncodeToString(raw)
+	grant := &breakGlassGrant{
+		ID:      hex.EncodeToString(raw[:4]),
+		Dest:    dest,
+		Client:  client,
+		Reason:  reason,
+		Issuer:  issuer,
+		Expires: time.Now().Add(ttl).UTC().Truncate(time.Second),
+		allowed: allowed,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.byToken[tokenHash(token)] = grant
+	b.prune()
+	return grant, token, nil
+}
+
+// unlock returns the grant behind token if it covers client and destination.
+func (b *breakGlass) unlock(token, client, destination string) *breakGlassGrant {
+	if b == nil || token == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	grant, ok := b.byToken[tokenHash(token)]
+	if !ok || time.Now().After(grant.Expires) {
+		return nil
+	}
+	if grant.Client != "" && grant.Client != client {
+		return nil
+	}
+	if !grant.allowed.match(destination) {
+		return nil
+	}
+	return grant
+}
+
+func (b *breakGlass) revoke(id string) *breakGlassGrant {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for hash, grant := range b.byToken {
+		if grant.ID == id {
+			delete(b.byToken, hash)
+			return grant
+		}
+	}
+	return nil
+}
+
+func (b *breakGlass) list() []*breakGlassGrant {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+	grants := make([]*breakGlassGrant, 0, len(b.byToken))
+	for _, grant := range b.byToken {
+		grants = append(grants, grant)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Expires.Before(grants[j].Expires)
+	})
+	return grants
+}
+
+// prune drops expired grants. Callers must hold b.mu.
+func (b *breakGlass) prune() {
+	now := time.Now()
+	for hash, grant := range b.byToken {
+		if now.After(grant.Expires) {
+			delete(b.byToken, hash)
+		}
+	}
+}
+
+func (a *adminAPI) issueBreakGlass(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Dest   string `json:"dest"`
+		Client string `json:"client"`
+		Reason string `json:"reason"`
+		TTL    string `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Dest) == "" || strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "dest and reason are required", http.StatusBadRequest)
+		return
+	}
+	ttl := breakGlassDefaultTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl > breakGlassMaxTTL {
+		http.Error(w, fmt.Sprintf("ttl can't be longer than %s", breakGlassMaxTTL), http.StatusBadRequest)
+		return
+	}
+
+	grant, token, err := a.server.breakGlass.issue(req.Dest, req.Client, req.Reason, r.RemoteAddr, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	audit("%s issued %s for %s (client %s) until %s: %s",
+		r.RemoteAddr, grant.ID, grant.Dest, orAny(grant.Client), grant.Expires.Format(time.RFC3339), grant.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*breakGlassGrant
+		Token string `json:"token"`
+	}{grant, token})
+}
+
+func (a *adminAPI) listBreakGlass(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.server.breakGlass.list())
+}
+
+func (a *adminAPI) revokeBreakGlass(w http.ResponseWriter, r *http.Request) {
+	grant := a.server.breakGlass.revoke(r.PathValue("id"))
+	if grant == nil {
+		http.Error(w, "Grant not found", http.StatusNotFound)
+		return
+	}
+	audit("%s revoked %s for %s", r.RemoteAddr, grant.ID, grant.Dest)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func orAny(client string) string {
+	if client == "" {
+		return "any"
+	}
+	return client
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+)
+
+// canarySize is how much data a canary poll carries, enough for a CDN to
+// consider compressing or rewriting it.
+const canarySize = 16 * 1024
+
+// canaryData is the content of a canary poll. Both ends derive it from the
+// session ID, so the client can tell whether it arrived unchanged.
+func canaryData(sessionID string) []byte {
+	data := make([]byte, 0, canarySize)
+	block := sha256.Sum256([]byte("darkflare canary " + sessionID))
+	for len(data) < canarySize {
+		data = append(data, block[:]...)
+		block = sha256.Sum256(block[:])
+	}
+	return data[:canarySize]
+}
+
+// serveCanary answers a canary poll exactly like a poll carrying
+// canaryData would be answered, plus a marker so the client knows this
+// server understood the request.
+func (s *Server) serveCanary(w http.ResponseWriter, r *http.Request, sessionID string) {
+	s.setTunnelHeaders(w, r)
+	w.Header().Set("X-Canary", "1")
+	data := canaryData(sessionID)
+
+	if hasCapability(r, "png") {
+		body, err := encodePNG(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+		return
+	}
+
+	encoding := pollEncoding(r)
+	encoded := encodePoll(w, encoding, data)
+	if s.padding != nil && hasCapability(r, "pad") {
+		encoded = s.padding.padResponse(w, encoded, encoding)
+	}
+	if hasCapability(r, "crc") {
+		w.Header().Set("X-Checksum", payloadChecksum(data))
+	}
+	w.Write(encoded)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sessionFacts is what a capture filter can look at.
+type sessionFacts struct {
+	destination string // as the client asked for it (may be a service name)
+	target      string // host:port actually dialed
+	user        string // key ID, certificate user or client host
+	tenant      string
+}
+
+// captureFilter is a tcpdump-style expression selecting sessions, e.g.
+// "host 10.0.0.0/8 and port 5432 and not user ci-*". Primitives are
+// host, port (n or n-m), dst (host:port patterns), user and tenant (globs),
+// combined with and/&&, or/||, not/! and parentheses. A bare word is a list
+// of destination patterns, same as -nolog-dest.
+type captureFilter func(f *sessionFacts) bool
+
+func parseCaptureFilter(expr string) (captureFilter, error) {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr)
+	p := &filterParser{tokens: strings.Fields(expr)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty filter")
+	}
+	filter, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+	return filter, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *filterParser) or() (captureFilter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *sessionFacts) bool { return l(f) || right(f) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (captureFilter, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *sessionFacts) bool { return l(f) && right(f) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) not() (captureFilter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		inner, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *sessionFacts) bool { return !inner(f) }, nil
+	case "(":
+		p.next()
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return inner, nil
+	}
+	return p.primitive()
+}
+
+func (p *filterParser) primitive() (captureFilter, error) {
+	keyword := p.next()
+	switch keyword {
+	case "":
+		return nil, fmt.Errorf("filter ends too early")
+	case ")", "and", "&&", "or", "||":
+		return nil, fmt.Errorf("unexpected %q in filter", keyword)
+	case "host", "port", "dst", "user", "tenant":
+	default:
+		// A bare destination pattern list
+		m, err := parseDestMatcher(keyword)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *sessionFacts) bool { return m.match(f.destination) || m.match(f.target) }, nil
+	}
+
+	value := p.next()
+	switch value {
+	case "", "(", ")", "and", "&&", "or", "||", "not", "!":
+		return nil, fmt.Errorf("missing value after %q in filter", keyword)
+	}
+
+	switch keyword {
+	case "host", "dst":
+		if _, _, err := net.SplitHostPort(value); err == nil && keyword == "host" {
+			return nil, fmt.Errorf("host %q has a port, use dst or port", value)
+		}
+		m, err := parseDestMatcher(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *sessionFacts) bool { return m.match(f.destination) || m.match(f.target) }, nil
+	case "port":
+		low, high, err := parsePortRange(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *sessionFacts) bool {
+			_, port, err := net.SplitHostPort(f.target)
+			if err != nil {
+				return false
+			}
+			n, err := strconv.Atoi(port)
+			return err == nil && n >= low && n <= high
+		}, nil
+	default:
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q in filter: %v", value, err)
+		}
+		return func(f *sessionFacts) bool {
+			field := f.user
+			if keyword == "tenant" {
+				field = f.tenant
+			}
+			ok, _ := path.Match(value, field)
+			return ok
+		}, nil
+	}
+}
+
+// parsePortRange parses "22" or "5000-6000".
+func parsePortRange(value string) (int, int, error) {
+	lowStr, highStr, isRange := strings.Cut(value, "-")
+	if !isRange {
+		highStr = lowStr
+	}
+	low, err1 := strconv.Atoi(lowStr)
+	high, err2 := strconv.Atoi(highStr)
+	if err1 != nil || err2 != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port %q in filter", value)
+	}
+	return low, high, nil
+}
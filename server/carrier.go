@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// carriedFields are the tunnel's request headers with the cookie and query
+// parameter names clients send them under when the zone's WAF won't let the
+// headers through (-carrier on the client).
+var carriedFields = []struct{ header, name string }{
+	{"X-For", "sid"},
+	{"X-Requested-With", "ref"},
+	{"X-Csrf-Token", "csrf"},
+	{"X-Capabilities", "v"},
+	{"X-Connection-Close", "close"},
+	{"X-Otp", "otp"},
+	{"X-Break-Glass", "bg"},
+	{"X-Checksum", "sum"},
+	{"X-Resend", "resend"},
+	{"X-Seq", "seq"},
+	{"X-Ack", "ack"},
+	{"X-Packed", "packed"},
+	{"X-Invite", "invite"},
+}
+
+// liftCarriedFields moves tunnel fields sent as cookies or query parameters
+// into the headers everything else reads them from, and returns how they
+// came: "header", "cookie" or "query".
+func liftCarriedFields(r *http.Request) string {
+	carrier := "header"
+	query := r.URL.Query()
+	for _, f := range carriedFields {
+		if r.Header.Get(f.header) != "" {
+			continue
+		}
+		if cookie, err := r.Cookie(f.name); err == nil {
+			if value, err := url.QueryUnescape(cookie.Value); err == nil && value != "" {
+				r.Header.Set(f.header, value)
+				carrier = "cookie"
+				continue
+			}
+		}
+		if value := query.Get(f.name); value != "" {
+			r.Header.Set(f.header, value)
+			carrier = "query"
+		}
+	}
+	return carrier
+}
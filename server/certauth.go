@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// certUser is a darkflare user identified by a client certificate that
+// Cloudflare checked at the edge (API Shield mTLS).
+type certUser struct {
+	name    string
+	allowed *destMatcher // nil allows any destination
+}
+
+// certUsers maps certificate identities to users. Entries match either the
+// certificate's SHA-256 fingerprint or its subject common name.
+type certUsers struct {
+	bySHA256 map[string]*certUser
+	byCN     map[string]*certUser
+}
+
+// loadCertUsers reads a users file with one user per line:
+//
+//	# user  identity             allowed destinations (optional)
+//	alice   sha256:3f2a...       *.corp.internal:22
+//	bob     cn:bob@example.com   10.0.0.0/8,postgres-prod
+func loadCertUsers(path string) (*certUsers, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := &certUsers{
+		bySHA256: make(map[string]*certUser),
+		byCN:     make(map[string]*certUser),
+	}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected user, identity and optional destinations", lineNum)
+		}
+
+		user := &certUser{name: fields[0]}
+		if len(fields) == 3 {
+			if user.allowed, err = parseDestMatcher(fields[2]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+		}
+
+		kind, value, _ := strings.Cut(fields[1], ":")
+		switch kind {
+		case "sha256":
+			users.bySHA256[normalizeFingerprint(value)] = user
+		case "cn":
+			users.byCN[value] = user
+		default:
+			return nil, fmt.Errorf("line %d: identity must be sha256:<fingerprint> or cn:<name>", lineNum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users.bySHA256)+len(users.byCN) == 0 {
+		return nil, fmt.Errorf("no users in %s", path)
+	}
+	return users, nil
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+}
+
+// subjectCN extracts the CN from a subject DN such as "CN=bob,O=Example".
+func subjectCN(dn string) string {
+	for _, part := range strings.Split(dn, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) > 3 && strings.EqualFold(part[:3], "CN=") {
+			return part[3:]
+		}
+	}
+	return ""
+}
+
+// identifyCertUser returns the user for the request's client certificate.
+// The Cf-Cert-* headers are only believed from the edge: with Authenticated
+// Origin Pulls, through the unix socket, or from a -trusted-proxies address.
+func (s *Server) identifyCertUser(r *http.Request) (*certUser, error) {
+	if !s.originPulls && !s.unixSocket && (s.trustedProxies == nil || !s.trustedProxies.match(r.RemoteAddr)) {
+		return nil, fmt.Errorf("certificate headers not from a trusted proxy")
+	}
+	return s.certUsers.identify(r)
+}
+
+// identify returns the user for the client certificate Cloudflare reported
+// in the request headers, or an error saying why there is none.
+func (u *certUsers) identify(r *http.Request) (*certUser, error) {
+	if r.Header.Get("Cf-Cert-Presented") == "false" {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	if r.Header.Get("Cf-Cert-Verified") != "true" {
+		return nil, fmt.Errorf("client certificate not verified by the edge")
+	}
+	if r.Header.Get("Cf-Cert-Revoked") == "true" {
+		return nil, fmt.Errorf("client certificate revoked")
+	}
+
+	fingerprint := r.Header.Get("Cf-Cert-Fingerprint-Sha256")
+	if fingerprint == "" {
+		fingerprint = r.Header.Get("Cf-Client-Cert-Sha256")
+	}
+	if user, ok := u.bySHA256[normalizeFingerprint(fingerprint)]; ok && fingerprint != "" {
+		return user, nil
+	}
+
+	dn := r.Header.Get("Cf-Cert-Subject-Dn-Rfc2253")
+	if dn == "" {
+		dn = r.Header.Get("Cf-Cert-Subject-Dn")
+	}
+	if cn := subjectCN(dn); cn != "" {
+		if user, ok := u.byCN[cn]; ok {
+			return user, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown client certificate %s", fingerprint)
+}
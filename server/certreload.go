@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are looked at for
+// changes.
+const certCheckInterval = 30 * time.Second
+
+// certReloader serves the -c and -k certificate to new TLS connections and
+// loads it again when the files change or on SIGHUP, so a renewal doesn't
+// need a restart that would kill every tunnel. Connections already open
+// keep the certificate they started with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	changed time.Time // latest modification time of the two files, when loaded
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the certificate and key. The one being served stays if they
+// don't load, such as halfway through a renewal writing them.
+func (c *certReloader) load() error {
+	changed := c.modTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.changed = changed
+	c.mu.Unlock()
+	return nil
+}
+
+// modTime is when either file last changed. Renewal tools that swap
+// symlinks change what the files point at, which Stat follows.
+func (c *certReloader) modTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// getCertificate is for tls.Config.GetCertificate.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// watch reloads the certificate when the files change or the server gets a
+// SIGHUP.
+func (c *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			c.mu.RLock()
+			changed := c.changed
+			c.mu.RUnlock()
+			if !c.modTime().After(changed) {
+				continue
+			}
+		}
+		if err := c.load(); err != nil {
+			slog.Warn("Keeping the current TLS certificate", "err", err)
+			continue
+		}
+		c.mu.RLock()
+		expires := c.cert.Leaf.NotAfter
+		c.mu.RUnlock()
+		log.Printf("Reloaded TLS certificate from %s (expires %s)", c.certFile, expires.Format(time.DateOnly))
+	}
+}
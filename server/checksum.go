@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// payloadChecksum is sent in X-Checksum with poll responses and expected
+// with uploads, so the client can catch bodies a middlebox has mangled.
+func payloadChecksum(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(data, castagnoli))
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// tunnelHeaders are the request headers clients send. WAF rules that look
+// at them are likely to block the tunnel.
+var tunnelHeaders = []string{
+	"x-requested-with", "x-for", "x-csrf-token", "x-capabilities", "x-checksum",
+	"x-resend", "x-connection-close", "x-otp", "x-break-glass", "x-invite",
+}
+
+// errAPINotFound is returned for API objects that don't exist, like the
+// ruleset of a phase nobody has configured.
+var errAPINotFound = errors.New("not found")
+
+// cloudflareAPI is just enough of the Cloudflare v4 API for check-zone.
+type cloudflareAPI struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func (a *cloudflareAPI) get(path string, result interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, a.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errAPINotFound
+	}
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("HTTP %d: %v", resp.StatusCode, err)
+	}
+	if !envelope.Success {
+		if len(envelope.Errors) > 0 {
+			return fmt.Errorf("%s (code %d)", envelope.Errors[0].Message, envelope.Errors[0].Code)
+		}
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+type cfZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type cfRule struct {
+	Description      string          `json:"description"`
+	Expression       string          `json:"expression"`
+	Action           string          `json:"action"`
+	Enabled          bool            `json:"enabled"`
+	ActionParameters json.RawMessage `json:"action_parameters"`
+	RateLimit        *struct {
+		Period            int `json:"period"`
+		RequestsPerPeriod int `json:"requests_per_period"`
+	} `json:"ratelimit"`
+}
+
+// zoneChecker collects findings for one hostname.
+type zoneChecker struct {
+	api      *cloudflareAPI
+	host     string
+	zone     cfZone
+	problems int
+}
+
+func (z *zoneChecker) ok(format string, v ...interface{}) {
+	fmt.Printf("  OK    %s\n", fmt.Sprintf(format, v...))
+}
+
+func (z *zoneChecker) warn(format string, v ...interface{}) {
+	fmt.Printf("  WARN  %s\n", fmt.Sprintf(format, v...))
+}
+
+func (z *zoneChecker) fail(format string, v ...interface{}) {
+	z.problems++
+	fmt.Printf("  FAIL  %s\n", fmt.Sprintf(format, v...))
+}
+
+func (z *zoneChecker) skip(what string, err error) {
+	fmt.Printf("  SKIP  Couldn't read %s: %v\n", what, err)
+}
+
+// findZone looks up the zone for z.host, or for name if given.
+func (z *zoneChecker) findZone(name string) error {
+	candidates := []string{name}
+	if name == "" {
+		candidates = nil
+		labels := strings.Split(z.host, ".")
+		for i := 0; i < len(labels)-1; i++ {
+			candidates = append(candidates, strings.Join(labels[i:], "."))
+		}
+	}
+	for _, candidate := range candidates {
+		var zones []cfZone
+		if err := z.api.get("/zones?name="+url.QueryEscape(candidate), &zones); err != nil {
+			return err
+		}
+		if len(zones) > 0 {
+			z.zone = zones[0]
+			return nil
+		}
+	}
+	return fmt.Errorf("no zone for %s visible to this token", z.host)
+}
+
+func (z *zoneChecker) checkDNS() {
+	var records []struct {
+		Type    string `json:"type"`
+		Proxied bool   `json:"proxied"`
+	}
+	if err := z.api.get(fmt.Sprintf("/zones/%s/dns_records?name=%s", z.zone.ID, url.QueryEscape(z.host)), &records); err != nil {
+		z.skip("DNS records", err)
+		return
+	}
+	if len(records) == 0 {
+		z.fail("No DNS record for %s", z.host)
+		return
+	}
+	for _, record := range records {
+		if !record.Proxied {
+			z.fail("%s record for %s is DNS only: turn on the proxy (orange cloud) or traffic bypasses Cloudflare", record.Type, z.host)
+			return
+		}
+	}
+	z.ok("DNS record for %s is proxied", z.host)
+}
+
+func (z *zoneChecker) checkSettings() {
+	var settings []struct {
+		ID    string          `json:"id"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := z.api.get(fmt.Sprintf("/zones/%s/settings", z.zone.ID), &settings); err != nil {
+		z.skip("zone settings", err)
+		return
+	}
+	values := make(map[string]string)
+	for _, setting := range settings {
+		var value string
+		if json.Unmarshal(setting.Value, &value) == nil {
+			values[setting.ID] = value
+			continue
+		}
+		if setting.ID == "minify" {
+			var minify map[string]string
+			json.Unmarshal(setting.Value, &minify)
+			var on []string
+			for _, kind := range []string{"html", "js", "css"} {
+				if minify[kind] == "on" {
+					on = append(on, kind)
+				}
+			}
+			if len(on) > 0 {
+				z.warn("Auto Minify is on for %s: harmless for tunnel responses unless their type gets changed, but off is safer", strings.Join(on, ", "))
+			}
+		}
+	}
+
+	if values["security_level"] == "under_attack" {
+		z.fail("Security level is I'm Under Attack: every request gets a JavaScript challenge the client can't solve")
+	}
+	if values["brotli"] == "on" {
+		z.warn("Brotli is on: responses may arrive compressed; the client detects it and asks for identity, or turn it off")
+	}
+	if values["email_obfuscation"] == "on" {
+		z.warn("Email Obfuscation is on: it rewrites HTML bodies; turn it off for %s", z.host)
+	}
+	if values["rocket_loader"] == "on" {
+		z.warn("Rocket Loader is on: it injects scripts into HTML bodies; turn it off for %s", z.host)
+	}
+	if polish := values["polish"]; polish != "" && polish != "off" {
+		z.warn("Polish is %s: it re-encodes images and breaks -stego png", polish)
+	}
+	if values["browser_check"] == "on" {
+		z.warn("Browser Integrity Check is on: fine while requests look like Chrome, turn it off if they get 403s")
+	}
+	if values["always_online"] == "on" {
+		z.warn("Always Online is on: when the server is down, clients may get cached pages instead of an error")
+	}
+	if values["websockets"] == "off" {
+		z.warn("WebSockets are off: -transport ws won't work")
+	}
+	if values["http3"] == "off" {
+		z.warn("HTTP/3 is off: -transport h3 won't work")
+	}
+	if values["ssl"] == "off" {
+		z.warn("SSL is off: clients have to use http:// targets")
+	}
+}
+
+func (z *zoneChecker) entrypoint(phase string) ([]cfRule, error) {
+	var ruleset struct {
+		Rules []cfRule `json:"rules"`
+	}
+	err := z.api.get(fmt.Sprintf("/zones/%s/rulesets/phases/%s/entrypoint", z.zone.ID, phase), &ruleset)
+	if errors.Is(err, errAPINotFound) {
+		return nil, nil
+	}
+	var rules []cfRule
+	for _, rule := range ruleset.Rules {
+		if rule.Enabled {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, err
+}
+
+// appliesToHost guesses whether a rule expression can match the tunnel's
+// hostname: it either doesn't look at the host or mentions it.
+func (z *zoneChecker) appliesToHost(expression string) bool {
+	return !strings.Contains(expression, "http.host") || strings.Contains(expression, z.host)
+}
+
+func ruleName(rule cfRule) string {
+	if rule.Description != "" {
+		return fmt.Sprintf("%q", rule.Description)
+	}
+	return fmt.Sprintf("(%s)", rule.Expression)
+}
+
+func (z *zoneChecker) checkCaching() {
+	rules, err := z.entrypoint("http_request_cache_settings")
+	if err != nil {
+		z.skip("cache rules", err)
+		return
+	}
+	found := false
+	for _, rule := range rules {
+		if rule.Action != "set_cache_settings" || !z.appliesToHost(rule.Expression) {
+			continue
+		}
+		var params struct {
+			Cache   *bool `json:"cache"`
+			EdgeTTL *struct {
+				Mode string `json:"mode"`
+			} `json:"edge_ttl"`
+		}
+		json.Unmarshal(rule.ActionParameters, &params)
+		if params.Cache == nil || !*params.Cache {
+			continue
+		}
+		found = true
+		if params.EdgeTTL != nil && params.EdgeTTL.Mode == "override_origin" {
+			z.fail("Cache rule %s caches responses regardless of Cache-Control; exclude %s from it", ruleName(rule), z.host)
+		} else {
+			z.warn("Cache rule %s makes responses cacheable; the server's no-store keeps tunnel responses out, but excluding %s is safer", ruleName(rule), z.host)
+		}
+	}
+
+	var pageRules []struct {
+		Targets []struct {
+			Constraint struct {
+				Value string `json:"value"`
+			} `json:"constraint"`
+		} `json:"targets"`
+		Actions []struct {
+			ID    string          `json:"id"`
+			Value json.RawMessage `json:"value"`
+		} `json:"actions"`
+	}
+	if err := z.api.get(fmt.Sprintf("/zones/%s/pagerules?status=active", z.zone.ID), &pageRules); err != nil && !errors.Is(err, errAPINotFound) {
+		z.skip("page rules", err)
+		return
+	}
+	for _, pageRule := range pageRules {
+		target := ""
+		if len(pageRule.Targets) > 0 {
+			target = pageRule.Targets[0].Constraint.Value
+		}
+		if !strings.Contains(target, z.host) && !strings.HasPrefix(target, "*") {
+			continue
+		}
+		for _, action := range pageRule.Actions {
+			var value string
+			json.Unmarshal(action.Value, &value)
+			if action.ID == "cache_level" && value == "cache_everything" {
+				found = true
+				z.fail("Page rule for %s caches everything; tunnel responses would be served from cache", target)
+			}
+		}
+	}
+	if !found {
+		z.ok("No cache rules cover tunnel responses")
+	}
+}
+
+func (z *zoneChecker) checkWAF() {
+	rules, err := z.entrypoint("http_request_firewall_custom")
+	if err != nil {
+		z.skip("WAF custom rules", err)
+	} else {
+		clean := true
+		for _, rule := range rules {
+			switch rule.Action {
+			case "block", "challenge", "js_challenge", "managed_challenge":
+			default:
+				continue
+			}
+			expression := strings.ToLower(rule.Expression)
+			for _, header := range tunnelHeaders {
+				if strings.Contains(expression, `"`+header+`"`) {
+					clean = false
+					z.fail("WAF rule %s (%s) looks at the %s header the tunnel sends", ruleName(rule), rule.Action, header)
+					break
+				}
+			}
+		}
+		if clean {
+			z.ok("No WAF custom rules look at tunnel headers")
+		}
+	}
+
+	managed, err := z.entrypoint("http_request_firewall_managed")
+	if err != nil {
+		z.skip("WAF managed rules", err)
+	} else if len(managed) > 0 {
+		z.warn("Managed WAF rules are on: if tunnel requests get 403s, add a skip rule for %s", z.host)
+	}
+
+	limits, err := z.entrypoint("http_ratelimit")
+	if err != nil {
+		z.skip("rate limiting rules", err)
+	} else {
+		for _, rule := range limits {
+			if rule.RateLimit == nil || rule.RateLimit.Period <= 0 || !z.appliesToHost(rule.Expression) {
+				continue
+			}
+			// Each polling connection makes about 20 requests a second
+			if perSecond := rule.RateLimit.RequestsPerPeriod / rule.RateLimit.Period; perSecond < 100 {
+				z.fail("Rate limiting rule %s allows %d requests per %ds; a polling connection alone makes about 20 a second", ruleName(rule), rule.RateLimit.RequestsPerPeriod, rule.RateLimit.Period)
+			}
+		}
+	}
+
+	var bots struct {
+		FightMode bool `json:"fight_mode"`
+	}
+	if err := z.api.get(fmt.Sprintf("/zones/%s/bot_management", z.zone.ID), &bots); err != nil {
+		if !errors.Is(err, errAPINotFound) {
+			z.skip("bot settings", err)
+		}
+	} else if bots.FightMode {
+		z.fail("Bot Fight Mode is on: it challenges the client's requests and can't be bypassed per hostname")
+	}
+}
+
+// runCheckZone implements the "check-zone" subcommand.
+func runCheckZone(args []string) {
+	fs := flag.NewFlagSet("check-zone", flag.ExitOnError)
+	token := fs.String("token", os.Getenv("CLOUDFLARE_API_TOKEN"), "Cloudflare API token with read access to the zone (or CLOUDFLARE_API_TOKEN)")
+	host := fs.String("host", "", "Hostname clients connect to (e.g. cdn.example.com)")
+	zone := fs.String("zone", "", "Zone name, if it can't be worked out from -host")
+	api := fs.String("api", "https://api.cloudflare.com/client/v4", "Cloudflare API base URL")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s check-zone -token <token> -host <hostname> [-zone <zone>]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Checks the Cloudflare settings for the tunnel's hostname and reports what\n")
+		fmt.Fprintf(os.Stderr, "would break it. The token needs Zone Read, DNS Read, Zone Settings Read,\n")
+		fmt.Fprintf(os.Stderr, "Cache Rules Read, Firewall Services Read and Bot Management Read;\n")
+		fmt.Fprintf(os.Stderr, "whatever it can't read is skipped.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *token == "" || *host == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	z := &zoneChecker{
+		api: &cloudflareAPI{
+			base:   strings.TrimSuffix(*api, "/"),
+			token:  *token,
+			client: &http.Client{Timeout: 30 * time.Second},
+		},
+		host: strings.ToLower(strings.TrimSuffix(*host, ".")),
+	}
+	if err := z.findZone(*zone); err != nil {
+		fmt.Fprintf(os.Stderr, "Error finding zone: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Zone %s, host %s\n", z.zone.Name, z.host)
+	z.checkDNS()
+	z.checkSettings()
+	z.checkCaching()
+	z.checkWAF()
+
+	if z.problems > 0 {
+		fmt.Printf("%d problem(s) will break the tunnel\n", z.problems)
+		os.Exit(1)
+	}
+	fmt.Println("Nothing that should break the tunnel")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// coloLimit bounds how many colos are counted; without Cloudflare in
+	// front (-allow-direct) clients can send any Cf-Ray they like.
+	coloLimit = 512
+	// otherColo counts everything beyond coloLimit.
+	otherColo = "other"
+)
+
+// coloGapBuckets are the histogram buckets for the time between a session's
+// requests, in seconds.
+var coloGapBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	coloRequestsDesc = prometheus.NewDesc("darkflare_colo_requests_total",
+		"Tunnel requests, by the Cloudflare data center that forwarded them.", []string{"colo"}, nil)
+	coloRetriesDesc = prometheus.NewDesc("darkflare_colo_retries_total",
+		"Requests that repeated one that arrived corrupted, by colo.", []string{"colo"}, nil)
+	coloGapsDesc = prometheus.NewDesc("darkflare_colo_request_gap_seconds",
+		"Time between a session's requests, by the colo of the later one.", []string{"colo"}, nil)
+)
+
+// coloStats counts tunnel requests by the Cloudflare data center (colo) they
+// came through, so trouble can be pinned on a POP: a colo with many retries
+// damages responses, one with long gaps between a session's requests holds
+// them up. The colo is the end of the Cf-Ray header ("8a1b2c3d4e5f6789-LHR").
+// Requests without one, like direct ones, aren't counted.
+type coloStats struct {
+	mu    sync.Mutex
+	colos map[string]*coloCounters
+}
+
+type coloCounters struct {
+	requests uint64
+	retries  uint64
+	gaps     []uint64 // per coloGapBuckets, not cumulative
+	gapCount uint64
+	gapSum   float64
+	lastSeen time.Time
+}
+
+func newColoStats() *coloStats {
+	return &coloStats{colos: make(map[string]*coloCounters)}
+}
+
+// requestColo returns the colo r came through, or "".
+func requestColo(r *http.Request) string {
+	_, colo, ok := strings.Cut(r.Header.Get("Cf-Ray"), "-")
+	if !ok || len(colo) != 3 {
+		return ""
+	}
+	for _, c := range colo {
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+	}
+	return colo
+}
+
+// counters returns colo's counters. c.mu must be held.
+func (c *coloStats) counters(colo string) *coloCounters {
+	counters := c.colos[colo]
+	if counters == nil {
+		if len(c.colos) >= coloLimit {
+			colo = otherColo
+			if counters = c.colos[colo]; counters != nil {
+				return counters
+			}
+		}
+		counters = &coloCounters{gaps: make([]uint64, len(coloGapBuckets))}
+		c.colos[colo] = counters
+	}
+	return counters
+}
+
+func (c *coloStats) request(colo string) {
+	if colo == "" {
+		return
+	}
+	c.mu.Lock()
+	counters := c.counters(colo)
+	counters.requests++
+	counters.lastSeen = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *coloStats) retry(colo string) {
+	if colo == "" {
+		return
+	}
+	c.mu.Lock()
+	c.counters(colo).retries++
+	c.mu.Unlock()
+}
+
+// gap records the time since the session's previous request.
+func (c *coloStats) gap(colo string, gap time.Duration) {
+	if colo == "" {
+		return
+	}
+	seconds := gap.Seconds()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counters := c.counters(colo)
+	counters.gapCount++
+	counters.gapSum += seconds
+	for i, bound := range coloGapBuckets {
+		if seconds <= bound {
+			counters.gaps[i]++
+			break
+		}
+	}
+}
+
+func (c *coloStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- coloRequestsDesc
+	ch <- coloRetriesDesc
+	ch <- coloGapsDesc
+}
+
+func (c *coloStats) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for colo, counters := range c.colos {
+		ch <- prometheus.MustNewConstMetric(coloRequestsDesc, prometheus.CounterValue, float64(counters.requests), colo)
+		ch <- prometheus.MustNewConstMetric(coloRetriesDesc, prometheus.CounterValue, float64(counters.retries), colo)
+		buckets := make(map[float64]uint64, len(coloGapBuckets))
+		var cumulative uint64
+		for i, bound := range coloGapBuckets {
+			cumulative += counters.gaps[i]
+			buckets[bound] = cumulative
+		}
+		ch <- prometheus.MustNewConstHistogram(coloGapsDesc, counters.gapCount, counters.gapSum, buckets, colo)
+	}
+}
+
+// coloInfo is a colo as the admin API shows it.
+type coloInfo struct {
+	Colo      string  `json:"colo"`
+	Requests  uint64  `json:"requests"`
+	Retries   uint64  `json:"retries"`
+	RetryRate float64 `json:"retry_rate"`
+	MeanGap   string  `json:"mean_gap,omitempty"`
+	LastSeen  string  `json:"last_seen"`
+}
+
+// snapshot returns every colo, busiest first.
+func (c *coloStats) snapshot() []coloInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	colos := make([]coloInfo, 0, len(c.colos))
+	for colo, counters := range c.colos {
+		info := coloInfo{
+			Colo:     colo,
+			Requests: counters.requests,
+			Retries:  counters.retries,
+			LastSeen: now.Sub(counters.lastSeen).Round(time.Second).String() + " ago",
+		}
+		if counters.requests > 0 {
+			info.RetryRate = float64(counters.retries) / float64(counters.requests)
+		}
+		if counters.gapCount > 0 {
+			mean := time.Duration(counters.gapSum / float64(counters.gapCount) * float64(time.Second))
+			info.MeanGap = mean.Round(time.Millisecond).String()
+		}
+		colos = append(colos, info)
+	}
+	sort.Slice(colos, func(i, j int) bool {
+		if colos[i].Requests != colos[j].Requests {
+			return colos[i].Requests > colos[j].Requests
+		}
+		return colos[i].Colo < colos[j].Colo
+	})
+	return colos
+}
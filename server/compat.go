@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"strings"
+)
+
+// compatV1 names protocol v1, the documented subset of the tunnel protocol
+// other clients can implement (PROTOCOL.md). Its requests carry the "v1"
+// capability and are only served with -compat v1. What v1 means doesn't
+// change with this repo's client: v1 requests get none of the capabilities
+// added since, and have their own copy of the signature.
+const compatV1 = "v1"
+
+// v1Capabilities are the capabilities a v1 request may use. The rest are
+// dropped before anything looks at them.
+var v1Capabilities = map[string]bool{compatV1: true, "crc": true}
+
+// restrictToV1 drops the capabilities v1 doesn't have from r.
+func restrictToV1(r *http.Request) {
+	var kept []string
+	for _, c := range strings.Split(r.Header.Get("X-Capabilities"), ",") {
+		if c = strings.TrimSpace(c); v1Capabilities[c] {
+			kept = append(kept, c)
+		}
+	}
+	r.Header.Set("X-Capabilities", strings.Join(kept, ","))
+}
+
+// validV1SessionID reports whether id is 32 lowercase hex characters.
+func validV1SessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// v1Signature is the five-line signature of a v1 request, as PROTOCOL.md
+// first specified it, and what requestSignature was before it covered the
+// destination, close flag and capabilities. v1 clients may sign either; this
+// one mustn't follow requestSignature when that changes.
+func v1Signature(secret []byte, method, file, sessionID, timestamp, bodyHash string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + file + "\n" + sessionID + "\n" + timestamp + "\n" + bodyHash))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Clients with -compress list the algorithms they take in X-Capabilities,
+// the one they prefer first. The server answers poll and upload requests
+// with its pick in X-Compression, and from then on either side may
+// compress a body with it, saying so in X-Packed. Checksums are of the
+// body as sent. Payloads that look random, which is what encrypted and
+// already compressed streams look like, go as they are.
+
+const (
+	// minPackSize is the smallest payload worth compressing.
+	minPackSize = 256
+	// maxUnpackedSize bounds what a compressed body may expand to.
+	maxUnpackedSize = 16 << 20
+	// randomEntropy is the entropy per byte above which a payload is taken
+	// as random and not compressed.
+	randomEntropy = 7.5
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxUnpackedSize), zstd.WithDecoderConcurrency(1))
+	gzipWriters    = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	}}
+)
+
+// parseCompression parses -compress, a comma separated list of algorithms
+// or "off".
+func parseCompression(spec string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "" || name == "off":
+		case name == "zstd" || name == "gzip":
+			allowed[name] = true
+		default:
+			return nil, fmt.Errorf("unknown algorithm %q (use zstd, gzip or off)", name)
+		}
+	}
+	return allowed, nil
+}
+
+// compressionFor returns the algorithm to use with the client that sent r,
+// the first it offers that -compress allows, or "".
+func (s *Server) compressionFor(r *http.Request) string {
+	for _, c := range strings.Split(r.Header.Get("X-Capabilities"), ",") {
+		if c = strings.TrimSpace(c); s.compression[c] {
+			return c
+		}
+	}
+	return ""
+}
+
+// pack compresses data with algorithm, if it looks like it would shrink
+// and does. It reports false for data to send as it is.
+func pack(algorithm string, data []byte) ([]byte, bool) {
+	if len(data) < minPackSize || entropy(data[:min(len(data), 4096)]) > randomEntropy {
+		return nil, false
+	}
+	var packed []byte
+	switch algorithm {
+	case "zstd":
+		packed = zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	case "gzip":
+		var b bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		w.Reset(&b)
+		w.Write(data)
+		w.Close()
+		gzipWriters.Put(w)
+		packed = b.Bytes()
+	default:
+		return nil, false
+	}
+	// Not worth the header otherwise
+	if len(packed) > len(data)-len(data)/8 {
+		return nil, false
+	}
+	return packed, true
+}
+
+// unpack undoes pack.
+func unpack(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case "zstd":
+		return zstdDecoder.DecodeAll(data, nil)
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(io.LimitReader(r, maxUnpackedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxUnpackedSize {
+			return nil, fmt.Errorf("compressed body too large")
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
+
+// entropy is the Shannon entropy of data in bits per byte.
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	bits := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A -config file holds the server's flags, keyed by flag name without the
+// dash, in YAML (so JSON works too):
+//
+//	listen: https://0.0.0.0:443
+//	tls:
+//	  cert: /etc/darkflare/cert.pem
+//	  key: /etc/darkflare/key.pem
+//	auth:
+//	  psk: [k1:secret-one, k2:secret-two]
+//	policy:
+//	  allow-dest: [10.0.0.0/8, "*.internal"]
+//	  deny-ports: 25
+//	logging:
+//	  log-format: json
+//
+// Sections like tls and auth are only there to group things, any flag can
+// go in any of them. Lists are joined with commas, except for flags that can
+// be given more than once. Flags on the command line win over the file.
+
+// configAliases are readable names for the one-letter flags.
+var configAliases = map[string]string{
+	"listen": "o",
+	"cert":   "c",
+	"key":    "k",
+	"app":    "a",
+	"silent": "s",
+}
+
+// repeatableFlags take each list item as a flag of its own.
+var repeatableFlags = map[string]bool{
+	"mirror": true,
+}
+
+// loadConfig sets every flag in the file that wasn't given on the command
+// line.
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file map[string]interface{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	values := make(map[string][]string)
+	if err := flattenConfig(file, "", values); err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if explicit[name] {
+			continue
+		}
+		for _, value := range values[name] {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flattenConfig collects the flag values in section, which is at path in
+// the file.
+func flattenConfig(section map[string]interface{}, path string, values map[string][]string) error {
+	for key, value := range section {
+		name := key
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+		if sub, ok := value.(map[string]interface{}); ok {
+			if err := flattenConfig(sub, path+key+".", values); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %s%s", path, key)
+		}
+		if _, seen := values[name]; seen {
+			return fmt.Errorf("%s%s is set more than once", path, key)
+		}
+
+		switch v := value.(type) {
+		case nil:
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			if repeatableFlags[name] {
+				values[name] = items
+			} else {
+				values[name] = []string{strings.Join(items, ",")}
+			}
+		default:
+			values[name] = []string{fmt.Sprint(v)}
+		}
+	}
+	return nil
+}
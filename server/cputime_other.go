@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// processCPUTime is not implemented here, so -max-cpu has no effect.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
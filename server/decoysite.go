@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// -decoy-site answers stray visitors with a static website instead of a
+// redirect: a directory of the operator's, or "builtin", a small studio site
+// named after the host it's reached as. POSTs and other methods get pages
+// too, like from a PHP site, so probing with them gives nothing away.
+
+//go:embed site
+var builtinSiteFiles embed.FS
+
+// decoySite serves files from a directory or the builtin site.
+type decoySite struct {
+	files     fs.FS
+	templates bool      // the builtin site's pages are templates, see siteData
+	started   time.Time // Last-Modified of files without a time of their own
+}
+
+// siteData fills in the builtin site's pages.
+type siteData struct {
+	Name   string // "Acme Tools" for cdn.acme-tools.com
+	Domain string // example.com
+	Year   int
+}
+
+func newDecoySite(spec string) (*decoySite, error) {
+	if spec == "builtin" {
+		files, err := fs.Sub(builtinSiteFiles, "site")
+		if err != nil {
+			return nil, err
+		}
+		return &decoySite{files: files, templates: true, started: time.Now()}, nil
+	}
+	info, err := os.Stat(spec)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", spec)
+	}
+	if _, err := os.Stat(path.Join(spec, "index.html")); err != nil {
+		return nil, fmt.Errorf("no index.html in %s", spec)
+	}
+	return &decoySite{files: os.DirFS(spec), started: time.Now()}, nil
+}
+
+// serve answers r with the file its path names. Directories serve their
+// index.html, names without an extension try .html, and hidden files and
+// anything else missing get the site's 404.html (or the stock 404 page).
+func (d *decoySite) serve(w http.ResponseWriter, r *http.Request, profile string) {
+	for name, value := range headerProfiles[profile] {
+		w.Header().Set(name, value)
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			d.notFound(w, r, profile)
+			return
+		}
+	}
+	if name == "" {
+		name = "."
+	}
+	if info, err := fs.Stat(d.files, name); err == nil && info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// Like Apache and nginx, so relative links work. Relative
+			// itself, as the path may be under -path-prefix
+			w.Header().Set("Location", path.Base(name)+"/")
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		name = path.Join(name, "index.html")
+	} else if err != nil && path.Ext(name) == "" {
+		name += ".html"
+	}
+
+	if !d.serveFile(w, r, name, http.StatusOK) {
+		d.notFound(w, r, profile)
+	}
+}
+
+func (d *decoySite) notFound(w http.ResponseWriter, r *http.Request, profile string) {
+	if !d.serveFile(w, r, "404.html", http.StatusNotFound) {
+		sendNotFound(w, r, profile)
+	}
+}
+
+// serveFile writes the file with its content type, handling conditional
+// and range requests for files served as they are. It reports false if
+// there's no such file.
+func (d *decoySite) serveFile(w http.ResponseWriter, r *http.Request, name string, status int) bool {
+	content, err := fs.ReadFile(d.files, name)
+	if err != nil {
+		return false
+	}
+	modTime := d.started
+	if info, err := fs.Stat(d.files, name); err == nil && !info.ModTime().IsZero() {
+		modTime = info.ModTime()
+	}
+	if d.templates && path.Ext(name) == ".html" {
+		page, err := template.New(name).Parse(string(content))
+		if err != nil {
+			slog.Debug("Decoy site template failed", "file", name, "err", err)
+			return false
+		}
+		var b bytes.Buffer
+		if err := page.Execute(&b, newSiteData(r.Host)); err != nil {
+			slog.Debug("Decoy site template failed", "file", name, "err", err)
+			return false
+		}
+		content = b.Bytes()
+	}
+
+	if status != http.StatusOK {
+		// ServeContent only answers 200, 206 and 304
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			w.Write(content)
+		}
+		return true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// A POST gets the page, not a range of it or a 304
+		r = r.Clone(r.Context())
+		r.Method = http.MethodGet
+		r.Header.Del("Range")
+		r.Header.Del("If-Modified-Since")
+		r.Header.Del("If-None-Match")
+	}
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(content))
+	return true
+}
+
+func newSiteData(hostport string) siteData {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(host, ".")), ".")
+	// example.com, example.co.uk
+	keep := 2
+	if len(labels) > 2 && len(labels[len(labels)-2]) <= 3 && len(labels[len(labels)-1]) == 2 {
+		keep = 3
+	}
+	if len(labels) > keep {
+		labels = labels[len(labels)-keep:]
+	}
+	domain := strings.Join(labels, ".")
+	name := labels[0]
+	if net.ParseIP(host) != nil || name == "" {
+		domain, name = "example.com", "studio"
+	}
+	words := strings.FieldsFunc(name, func(r rune) bool { return r == '-' || r == '_' })
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return siteData{
+		Name:   strings.Join(words, " "),
+		Domain: domain,
+		Year:   time.Now().Year(),
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// destPattern matches a destination host:port. The host part is either a
+// CIDR range or a hostname/IP glob such as *.internal, the port part is a
+// port number or * for any port.
+type destPattern struct {
+	host string
+	cidr *net.IPNet
+	port string
+}
+
+// destMatcher is a list of destination patterns, any of which may match.
+type destMatcher struct {
+	patterns []destPattern
+}
+
+// parseDestMatcher parses a comma separated list of patterns, for example
+// "*.corp.internal,10.0.0.0/8:22,db.example.com:5432".
+func parseDestMatcher(spec string) (*destMatcher, error) {
+	m := &destMatcher{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		p := destPattern{host: entry, port: "*"}
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			p.host, p.port = host, port
+		}
+		if p.host == "" {
+			return nil, fmt.Errorf("invalid destination pattern %q", entry)
+		}
+		if p.port != "*" {
+			if _, err := net.LookupPort("tcp", p.port); err != nil {
+				return nil, fmt.Errorf("invalid port in pattern %q", entry)
+			}
+		}
+		if strings.Contains(p.host, "/") {
+			_, cidr, err := net.ParseCIDR(p.host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR in pattern %q: %v", entry, err)
+			}
+			p.cidr = cidr
+		} else if _, err := path.Match(p.host, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob in pattern %q: %v", entry, err)
+		}
+		p.host = strings.TrimSuffix(strings.ToLower(p.host), ".")
+		m.patterns = append(m.patterns, p)
+	}
+	if len(m.patterns) == 0 {
+		return nil, fmt.Errorf("no patterns")
+	}
+	return m, nil
+}
+
+// match reports whether dest (host:port) matches any pattern. Hostnames are
+// never resolved; CIDR patterns only match literal IP destinations. A fully
+// qualified name with its trailing dot is the same host as without.
+func (m *destMatcher) match(dest string) bool {
+	if m == nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		host, port = dest, ""
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+
+	for _, p := range m.patterns {
+		if p.port != "*" && p.port != port {
+			continue
+		}
+		if p.cidr != nil {
+			if ip != nil && p.cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(p.host, host); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestDestMatcher(t *testing.T) {
+	m, err := parseDestMatcher("*.internal, 10.0.0.0/8:22, DB.Example.com.:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dest string
+		want bool
+	}{
+		{"db.internal:5432", true},
+		{"db.internal.:5432", true},
+		{"DB.INTERNAL.:5432", true},
+		{"db.internal", true},
+		{"internal:5432", false},
+		{"db.internal.evil.com:5432", false},
+		{"10.1.2.3:22", true},
+		{"10.1.2.3:23", false},
+		{"11.1.2.3:22", false},
+		{"db.example.com:5432", true},
+		{"db.example.com.:5432", true},
+		{"db.example.com:5433", false},
+	}
+	for _, tt := range tests {
+		if got := m.match(tt.dest); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.dest, got, tt.want)
+		}
+	}
+
+	var none *destMatcher
+	if none.match("db.internal:5432") {
+		t.Error("nil matcher matched")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// destPolicy is what -allow-dest, -deny-dest, -allow-ports and -deny-ports
+// let clients connect to. Patterns are checked against the destination as
+// the client named it and against every address it resolves to, so a
+// hostname that points into a denied network (or anywhere outside the
+// allowed ones) doesn't get through.
+type destPolicy struct {
+	allow *destMatcher // nil allows anything that isn't denied
+	deny  *destMatcher
+
+	allowPorts portSet // -allow-ports, nil allows any port that isn't denied
+	denyPorts  portSet // -deny-ports
+}
+
+// portSet is a list of ports and port ranges such as "22,443,8000-8999".
+type portSet [][2]int
+
+func parsePortSet(spec string) (portSet, error) {
+	var set portSet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			high = low
+		}
+		from, err := strconv.Atoi(low)
+		if err != nil || from < 1 || from > 65535 {
+			return nil, fmt.Errorf("invalid port %q", entry)
+		}
+		to, err := strconv.Atoi(high)
+		if err != nil || to < from || to > 65535 {
+			return nil, fmt.Errorf("invalid port range %q", entry)
+		}
+		set = append(set, [2]int{from, to})
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no ports")
+	}
+	return set, nil
+}
+
+func (set portSet) contains(port int) bool {
+	for _, r := range set {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// vet checks dest (host:port) and returns the address to dial. That's an
+// address that passed the check rather than the name, so DNS can't answer
+// differently between the check and the dial.
+func (p *destPolicy) vet(dest string) (string, error) {
+	if p == nil {
+		return dest, nil
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return "", err
+	}
+	if portNum, _ := strconv.Atoi(port); p.denyPorts.contains(portNum) {
+		return "", fmt.Errorf("port %s is denied", port)
+	} else if p.allowPorts != nil && !p.allowPorts.contains(portNum) {
+		return "", fmt.Errorf("port %s is not in -allow-ports", port)
+	}
+	if p.deny.match(dest) {
+		return "", fmt.Errorf("%s is denied", dest)
+	}
+	named := p.allow == nil || p.allow.match(dest)
+
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		if addrs, err = net.LookupHost(host); err != nil {
+			return "", err
+		}
+	}
+	var vetted string
+	for _, addr := range addrs {
+		addr = net.JoinHostPort(addr, port)
+		if p.deny.match(addr) {
+			return "", fmt.Errorf("%s resolves to denied address %s", dest, addr)
+		}
+		if vetted == "" && (named || p.allow.match(addr)) {
+			vetted = addr
+		}
+	}
+	if vetted == "" {
+		return "", fmt.Errorf("%s is not in -allow-dest", dest)
+	}
+	return vetted, nil
+}
+
+// permits checks a packet from a -tun session to dest. There's no name to
+// go by, only the address, and port is 0 for packets without one (ICMP,
+// later fragments), which only the address patterns apply to.
+func (p *destPolicy) permits(dest netip.Addr, port int) bool {
+	if p == nil {
+		return true
+	}
+	addr := dest.String()
+	if port != 0 {
+		if p.denyPorts.contains(port) || (p.allowPorts != nil && !p.allowPorts.contains(port)) {
+			return false
+		}
+		addr = net.JoinHostPort(addr, strconv.Itoa(port))
+	}
+	return !p.deny.match(addr) && (p.allow == nil || p.allow.match(addr))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// drainPoll is how often a draining server checks whether its sessions are
+// all gone.
+const drainPoll = 250 * time.Millisecond
+
+// A server shutting down with -drain tells its clients before it goes. Every
+// tunnel response carries X-Drain with the seconds left, new sessions get a
+// 503 with Retry-After, and -mux sessions get a yamux go-away so no new
+// streams are opened on them. Clients with an -on-drain hook can move
+// elsewhere while their open sessions finish.
+
+// draining reports whether the server is shutting down and how long the
+// open sessions have left.
+func (s *Server) draining() (time.Duration, bool) {
+	until := s.drainUntil.Load()
+	if until == 0 {
+		return 0, false
+	}
+	return max(time.Until(time.Unix(0, until)), 0), true
+}
+
+// setDrainHeader tells the client about a drain, if there is one.
+func (s *Server) setDrainHeader(w http.ResponseWriter) {
+	if left, ok := s.draining(); ok {
+		w.Header().Set("X-Drain", strconv.Itoa(int(left.Seconds())))
+	}
+}
+
+// drainOnSignal waits for SIGTERM or SIGINT, then drains for up to period
+// and exits. A second signal exits straight away.
+func (s *Server) drainOnSignal(period time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+
+	s.drainUntil.Store(time.Now().Add(period).UnixNano())
+	log.Printf("Draining for up to %s before exiting", period)
+	sdNotify("STOPPING=1")
+	s.muxes.Range(func(key, _ interface{}) bool {
+		key.(*yamux.Session).GoAway()
+		return true
+	})
+
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-signals:
+			log.Printf("Exiting without waiting for the drain")
+			os.Exit(1)
+		case <-ticker.C:
+		}
+		left, _ := s.draining()
+		open := s.openSessions()
+		if open == 0 || left == 0 {
+			if open > 0 {
+				slog.Warn("Drain period over, closing sessions", "sessions", open)
+			}
+			log.Printf("Drained, exiting")
+			os.Exit(0)
+		}
+	}
+}
+
+// openSessions counts the sessions still open.
+func (s *Server) openSessions() int {
+	count := 0
+	s.sessions.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
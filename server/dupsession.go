@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// dupPolicy decides what happens when a request for an existing session comes
+// from a different client IP than the one that opened it.
+type dupPolicy int
+
+const (
+	// dupShare lets both clients use the one upstream connection.
+	dupShare dupPolicy = iota
+	// dupReject refuses requests from anyone but the session's owner.
+	dupReject
+	// dupTakeover hands the session to the newest client and tells the
+	// previous one it has been displaced.
+	dupTakeover
+	// dupParallel gives the second client an upstream connection of its own.
+	dupParallel
+)
+
+func parseDupPolicy(name string) (dupPolicy, error) {
+	switch name {
+	case "share":
+		return dupShare, nil
+	case "reject":
+		return dupReject, nil
+	case "takeover":
+		return dupTakeover, nil
+	case "parallel":
+		return dupParallel, nil
+	}
+	return dupShare, fmt.Errorf("unknown policy %q (share, reject, takeover or parallel)", name)
+}
+
+// clientHost strips the port from RemoteAddr style addresses so a client
+// reconnecting from a new source port is still the same client.
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// claimSession applies the duplicate session policy to a request for
+// sessionID. It returns the key the session is stored under, or false if the
+// request has already been answered.
+func (s *Server) claimSession(w http.ResponseWriter, sessionID, clientIP string) (string, bool) {
+	value, exists := s.sessions.Load(sessionID)
+	if !exists {
+		return sessionID, true
+	}
+	session := value.(*Session)
+	client := clientHost(clientIP)
+	display := shortID(sessionID[strings.LastIndex(sessionID, "/")+1:])
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	owner := clientHost(session.clientIP)
+	if client == owner {
+		return sessionID, true
+	}
+
+	// Log each new duplicate once rather than on every poll
+	firstSeen := session.duplicateIP != client
+	session.duplicateIP = client
+
+	switch s.dupSessions {
+	case dupReject:
+		if firstSeen {
+			s.warn("Duplicate session rejected", "client", clientIP, "session", display, "owner", owner)
+		}
+		http.Error(w, "Session in use", http.StatusConflict)
+		return "", false
+
+	case dupTakeover:
+		if client == session.displacedIP {
+			w.Header().Set("X-Session-Takeover", "true")
+			http.Error(w, "Session taken over", http.StatusConflict)
+			return "", false
+		}
+		s.info("Duplicate session taken over", "client", clientIP, "session", display, "owner", owner)
+		session.displacedIP = owner
+		session.clientIP = clientIP
+		return sessionID, true
+
+	case dupParallel:
+		if firstSeen {
+			slog.Debug("Duplicate session in parallel", "client", clientIP, "session", display, "owner", owner)
+		}
+		return sessionID + "@" + client, true
+	}
+
+	if firstSeen {
+		s.info("Duplicate session shared", "client", clientIP, "session", display, "owner", owner)
+	}
+	return sessionID, true
+}
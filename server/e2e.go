@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// e2eSaltSize is the random salt each side sends first; every
+	// direction of every session gets a key of its own from it.
+	e2eSaltSize = 16
+	// e2eMaxRecord is the most plaintext one record carries, so its
+	// ciphertext length fits the 2-byte prefix.
+	e2eMaxRecord = 65535 - chacha20poly1305.Overhead
+)
+
+// errE2EOpen means data from the client didn't decrypt, so something
+// changed it in transit.
+var errE2EOpen = errors.New("data from the client doesn't decrypt")
+
+// sealedConn is the server's end of -e2e encryption, wrapped around the
+// destination connection. Reads return the destination's data in records
+// sealed with ChaCha20-Poly1305 for the tunnel; writes take records from the
+// tunnel and pass on what they decrypt to the destination.
+//
+// Each side starts its direction with a random salt. The key is derived
+// from the pre-shared key, the session ID and the salt, and nonces count
+// records, so records can't be dropped, reordered or replayed unnoticed.
+//
+// client/e2e.go has the client's copy, the modules don't share code. Keep
+// the two the same; e2e_test.go, also the same in both, checks them
+// against one test vector.
+type sealedConn struct {
+	net.Conn
+	secret    []byte
+	sessionID string
+	recvLabel string
+
+	readMu  sync.Mutex
+	send    cipher.AEAD
+	sendSeq uint64
+	out     []byte // sealed data not yet returned by Read
+	plain   []byte
+
+	writeMu sync.Mutex
+	recv    cipher.AEAD
+	recvSeq uint64
+	in      []byte // tunnel data not yet decrypted
+}
+
+// newSealedConn wraps conn for one end of a session. sendLabel and
+// recvLabel name the directions ("client" and "server").
+func newSealedConn(conn net.Conn, secret []byte, sessionID, sendLabel, recvLabel string) (*sealedConn, error) {
+	salt := make([]byte, e2eSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	send, err := e2eCipher(secret, sessionID, sendLabel, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedConn{
+		Conn:      conn,
+		secret:    secret,
+		sessionID: sessionID,
+		recvLabel: recvLabel,
+		send:      send,
+		out:       salt,
+		plain:     make([]byte, e2eMaxRecord),
+	}, nil
+}
+
+func e2eCipher(secret []byte, sessionID, label string, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, secret, salt, []byte("darkflare e2e "+label+" "+sessionID))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func e2eNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// Read reads from the connection and returns it sealed: records of a
+// 2-byte length followed by the ciphertext.
+func (s *sealedConn) Read(b []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if len(s.out) == 0 {
+		// Fill b with one record if there's that much to read, callers
+		// take a full buffer as a sign to keep reading
+		size := len(b) - 2 - chacha20poly1305.Overhead
+		if size <= 0 || size > e2eMaxRecord {
+			size = e2eMaxRecord
+		}
+		n, err := s.Conn.Read(s.plain[:size])
+		if n == 0 {
+			return 0, err
+		}
+		sealed := s.send.Seal(nil, e2eNonce(s.sendSeq), s.plain[:n], nil)
+		s.sendSeq++
+		s.out = binary.BigEndian.AppendUint16(s.out, uint16(len(sealed)))
+		s.out = append(s.out, sealed...)
+	}
+	n := copy(b, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// Write takes sealed data from the tunnel, in pieces of any size, and
+// writes what it decrypts to the connection.
+func (s *sealedConn) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.in = append(s.in, b...)
+	if s.recv == nil {
+		if len(s.in) < e2eSaltSize {
+			return len(b), nil
+		}
+		recv, err := e2eCipher(s.secret, s.sessionID, s.recvLabel, s.in[:e2eSaltSize])
+		if err != nil {
+			return 0, err
+		}
+		s.recv = recv
+		s.in = s.in[e2eSaltSize:]
+	}
+	for len(s.in) >= 2 {
+		size := int(binary.BigEndian.Uint16(s.in))
+		if len(s.in) < 2+size {
+			break
+		}
+		plain, err := s.recv.Open(nil, e2eNonce(s.recvSeq), s.in[2:2+size], nil)
+		if err != nil {
+			return 0, errE2EOpen
+		}
+		s.recvSeq++
+		s.in = s.in[2+size:]
+		if _, err := s.Conn.Write(plain); err != nil {
+			return 0, err
+		}
+	}
+	if len(s.in) == 0 {
+		s.in = nil
+	}
+	return len(b), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+)
+
+// This file is the same in the client and the server module, so the two
+// copies of sealedConn are checked against the same records.
+
+var (
+	e2eTestSecret  = []byte("correct horse battery staple")
+	e2eTestSession = "0123456789abcdef0123456789abcdef"
+)
+
+// bufConn is a connection that reads what's in r and keeps what's written.
+type bufConn struct {
+	net.Conn
+	r, w bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// seal returns what a sealedConn sending as label makes of the chunks, read
+// one at a time as if they came from the connection one by one.
+func seal(t *testing.T, label string, chunks ...[]byte) []byte {
+	t.Helper()
+	conn := &bufConn{}
+	s, err := newSealedConn(conn, e2eTestSecret, e2eTestSession, label, "unused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed []byte
+	buf := make([]byte, 70000)
+	for _, chunk := range chunks {
+		conn.r.Write(chunk)
+		for conn.r.Len() > 0 || len(s.out) > 0 {
+			n, err := s.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sealed = append(sealed, buf[:n]...)
+		}
+	}
+	return sealed
+}
+
+// open feeds sealed to a sealedConn receiving label, in pieces of the given
+// size, and returns what it wrote to the connection.
+func open(label string, sealed []byte, piece int) ([]byte, error) {
+	conn := &bufConn{}
+	s, err := newSealedConn(conn, e2eTestSecret, e2eTestSession, "unused", label)
+	if err != nil {
+		return nil, err
+	}
+	for len(sealed) > 0 {
+		n := min(piece, len(sealed))
+		if _, err := s.Write(sealed[:n]); err != nil {
+			return conn.w.Bytes(), err
+		}
+		sealed = sealed[n:]
+	}
+	return conn.w.Bytes(), nil
+}
+
+func TestSealedConnRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 20000)
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		piece  int // size of the pieces the tunnel delivers
+	}{
+		{"one byte", [][]byte{{'x'}}, 1 << 20},
+		{"a few records", [][]byte{[]byte("hello"), []byte(", "), []byte("darkflare")}, 1 << 20},
+		{"byte by byte", [][]byte{[]byte("hello"), []byte("darkflare")}, 1},
+		{"odd pieces", [][]byte{[]byte("hello"), big, []byte("darkflare")}, 7},
+		{"larger than a record", [][]byte{big}, 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := seal(t, "client", tt.chunks...)
+			want := bytes.Join(tt.chunks, nil)
+			if bytes.Contains(sealed, []byte("darkflare")) || bytes.Contains(sealed, []byte("0123456789")) {
+				t.Fatal("plaintext in the sealed stream")
+			}
+			got, err := open("client", sealed, tt.piece)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %d bytes back, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestSealedConnTampered(t *testing.T) {
+	sealed := seal(t, "client", []byte("first"), []byte("second"), []byte("third"))
+	// salt, then records of a 2-byte length and the ciphertext
+	first := e2eSaltSize
+	second := first + 2 + int(binary.BigEndian.Uint16(sealed[first:]))
+	third := second + 2 + int(binary.BigEndian.Uint16(sealed[second:]))
+
+	tests := []struct {
+		name   string
+		tamper func(b []byte) []byte
+		label  string
+		want   string // what gets through before the error
+	}{
+		{"salt changed", func(b []byte) []byte { b[0] ^= 1; return b }, "client", ""},
+		{"ciphertext changed", func(b []byte) []byte { b[second+4] ^= 1; return b }, "client", "first"},
+		{"tag changed", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, "client", "firstsecond"},
+		{"record dropped", func(b []byte) []byte { return append(b[:second:second], b[third:]...) }, "client", "first"},
+		{"records swapped", func(b []byte) []byte {
+			swapped := append([]byte{}, b[:first]...)
+			swapped = append(swapped, b[second:third]...)
+			return append(swapped, b[first:second]...)
+		}, "client", ""},
+		{"record replayed", func(b []byte) []byte { return append(b, b[first:second]...) }, "client", "firstsecondthird"},
+		{"other direction", func(b []byte) []byte { return b }, "server", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := open(tt.label, tt.tamper(append([]byte{}, sealed...)), 1<<20)
+			if !errors.Is(err, errE2EOpen) {
+				t.Fatalf("open: %v, want %v", err, errE2EOpen)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got %q through, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestE2ENonceSequence(t *testing.T) {
+	tests := []struct {
+		seq  uint64
+		want string
+	}{
+		{0, "000000000000000000000000"},
+		{1, "000000000000000000000001"},
+		{256, "000000000000000000000100"},
+		{1 << 32, "000000000000000100000000"},
+		{^uint64(0), "00000000ffffffffffffffff"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(e2eNonce(tt.seq)); got != tt.want {
+			t.Errorf("e2eNonce(%d) = %s, want %s", tt.seq, got, tt.want)
+		}
+	}
+
+	// Records are sealed with the nonces in order, from 0
+	sealed := seal(t, "client", []byte("a"), []byte("b"), []byte("c"))
+	recv, err := e2eCipher(e2eTestSecret, e2eTestSession, "client", sealed[:e2eSaltSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := sealed[e2eSaltSize:]
+	for seq, want := range []string{"a", "b", "c"} {
+		size := int(binary.BigEndian.Uint16(records))
+		plain, err := recv.Open(nil, e2eNonce(uint64(seq)), records[2:2+size], nil)
+		if err != nil || string(plain) != want {
+			t.Fatalf("record %d: %q, %v, want %q", seq, plain, err, want)
+		}
+		records = records[2+size:]
+	}
+}
+
+// TestE2EVector pins the key derivation and the record format. The client
+// and the server module check the same vector, so neither can change on
+// its own.
+func TestE2EVector(t *testing.T) {
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	aead, err := e2eCipher(e2eTestSecret, e2eTestSession, "client", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		seq  uint64
+		want string
+	}{
+		{0, "465dd9494643d4c7344c3ad6946208fd6c1e843b72cb08948b2a33a9364d5678"},
+		{1, "3720b96450b2ffc816bbeee8b055e8c03920f1a74a58b4bfa7a6fcedd27e4fc9"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(aead.Seal(nil, e2eNonce(tt.seq), []byte("hello, darkflare"), nil)); got != tt.want {
+			t.Errorf("record %d = %s, want %s", tt.seq, got, tt.want)
+		}
+	}
+}
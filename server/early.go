@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// Early data: a client started with -early-data sends the first bytes its
+// application wrote along with the request that opens the session, marked
+// with the "early" capability, and gets the destination's first answer back
+// in the same response instead of waiting for the next poll.
+//
+// Sending data with the first request means a captured request could open
+// a session and replay that data to the destination. Signed requests (-psk)
+// are only accepted once within the signature window, and a session ID
+// whose session was closed can't be opened again with early data for
+// retiredSessionTTL after, which outlasts that window.
+const (
+	// earlyReplyWait is how long an early data request waits for the
+	// destination's first answer.
+	earlyReplyWait = 500 * time.Millisecond
+	// retiredSessionTTL is how long a closed session's ID is remembered.
+	retiredSessionTTL = 15 * time.Minute
+)
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+)
+
+// Poll responses used to be hex, doubling what they carry. Clients now ask
+// for "binary" or "base64" in X-Capabilities and get it, marked with
+// X-Encoding. Those that don't ask, older ones and the browser client among
+// them, still get hex.
+
+// pollEncoding is how poll data for r is encoded: "binary", "base64" or
+// "hex".
+func pollEncoding(r *http.Request) string {
+	switch {
+	case hasCapability(r, "binary"):
+		return "binary"
+	case hasCapability(r, "base64"):
+		return "base64"
+	}
+	return "hex"
+}
+
+// encodePoll encodes poll data the way the client asked, saying how in
+// X-Encoding.
+func encodePoll(w http.ResponseWriter, encoding string, data []byte) []byte {
+	if encoding != "hex" {
+		w.Header().Set("X-Encoding", encoding)
+	}
+	return encodeAs(encoding, data)
+}
+
+func encodeAs(encoding string, data []byte) []byte {
+	switch encoding {
+	case "binary":
+		return data
+	case "base64":
+		return []byte(base64.StdEncoding.EncodeToString(data))
+	}
+	return []byte(hex.EncodeToString(data))
+}
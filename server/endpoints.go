@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// -endpoints hands clients the operator's signed list of other ways to reach
+// this server (made with "go run ./tools/release endpoints"). Clients with
+// -endpoints-key fetch it once they get through and fall back to it when
+// their -t stops answering. The server only passes the list on, it can't
+// sign one: the key stays with the operator.
+
+// maxEndpointsSize bounds the list the server reads from disk.
+const maxEndpointsSize = 64 << 10
+
+// signedEndpoints is what a client gets: the list exactly as it was signed,
+// and the signature, both base64 in JSON.
+type signedEndpoints struct {
+	List      []byte `json:"list"`
+	Signature []byte `json:"signature"`
+}
+
+// readEndpoints reads the list and the signature next to it. They're read
+// for every request, so a new list goes out without a restart.
+func readEndpoints(path string) (*signedEndpoints, error) {
+	list, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > maxEndpointsSize {
+		return nil, fmt.Errorf("%s: larger than %d bytes", path, maxEndpointsSize)
+	}
+	sig, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return nil, fmt.Errorf("%s.sig: %v", path, err)
+	}
+	return &signedEndpoints{List: list, Signature: signature}, nil
+}
+
+// serveEndpoints answers an authenticated client's request for the list.
+// X-Endpoints tells it this server understood the request, even if the
+// list can't be read right now.
+func (s *Server) serveEndpoints(w http.ResponseWriter, r *http.Request, clientIP string) {
+	s.setTunnelHeaders(w, r)
+	w.Header().Set("X-Endpoints", "1")
+	endpoints, err := readEndpoints(s.endpointsFile)
+	if err != nil {
+		s.warn("Can't serve -endpoints", "client", clientIP, "err", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoints)
+}
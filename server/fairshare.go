@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fairTick is how often queued transfers are handed their share.
+	fairTick = 10 * time.Millisecond
+	// fairQuantum is what a client with weight 1 may send per round.
+	fairQuantum = 16 * 1024
+)
+
+// fairShare splits -fair-share bandwidth between clients, separately for
+// each direction, so one client with many busy sessions can't starve
+// everyone else. A nil fairShare lets everything through.
+type fairShare struct {
+	upstream   *fairQueue
+	downstream *fairQueue
+}
+
+func newFairShare(rate int64, weights map[string]int) *fairShare {
+	return &fairShare{
+		upstream:   newFairQueue(rate, weights),
+		downstream: newFairQueue(rate, weights),
+	}
+}
+
+// wait blocks until client may move n more bytes in direction ("upstream"
+// or "downstream", as in the metrics).
+func (f *fairShare) wait(ctx context.Context, direction, client string, n int) error {
+	if f == nil || n <= 0 {
+		return nil
+	}
+	if direction == "upstream" {
+		return f.upstream.wait(ctx, client, n)
+	}
+	return f.downstream.wait(ctx, client, n)
+}
+
+type fairRequest struct {
+	n       int
+	granted bool
+	ready   chan struct{}
+}
+
+type fairClient struct {
+	name    string
+	weight  int
+	deficit int
+	queue   []*fairRequest
+}
+
+// fairQueue is a token bucket that, once it runs dry, hands out bytes by
+// deficit round robin over the clients waiting for it.
+type fairQueue struct {
+	rate    int64
+	burst   int64
+	weights map[string]int
+	wake    chan struct{}
+
+	mu      sync.Mutex
+	budget  int64
+	refill  time.Time
+	clients map[string]*fairClient
+	active  []*fairClient // round robin order
+}
+
+func newFairQueue(rate int64, weights map[string]int) *fairQueue {
+	burst := max(rate/10, 64*1024)
+	q := &fairQueue{
+		rate:    rate,
+		burst:   burst,
+		weights: weights,
+		wake:    make(chan struct{}, 1),
+		budget:  burst,
+		refill:  time.Now(),
+		clients: make(map[string]*fairClient),
+	}
+	go q.schedule()
+	return q
+}
+
+// topUp adds what the rate allows since the last call. Callers must hold q.mu.
+func (q *fairQueue) topUp() {
+	now := time.Now()
+	q.budget = min(q.budget+int64(now.Sub(q.refill).Seconds()*float64(q.rate)), q.burst)
+	q.refill = now
+}
+
+func (q *fairQueue) wait(ctx context.Context, name string, n int) error {
+	q.mu.Lock()
+	q.topUp()
+	// Nobody is queued, so there's nothing to be fair about
+	if len(q.active) == 0 && q.budget > 0 {
+		q.budget -= int64(n)
+		q.mu.Unlock()
+		return nil
+	}
+
+	c := q.clients[name]
+	if c == nil {
+		weight, ok := q.weights[name]
+		if !ok {
+			weight = 1
+		}
+		c = &fairClient{name: name, weight: weight}
+		q.clients[name] = c
+		q.active = append(q.active, c)
+	}
+	req := &fairRequest{n: n, ready: make(chan struct{})}
+	c.queue = append(c.queue, req)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-req.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if req.granted {
+			return nil
+		}
+		for i, queued := range c.queue {
+			if queued == req {
+				c.queue = append(c.queue[:i], c.queue[i+1:]...)
+				break
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+func (q *fairQueue) schedule() {
+	ticker := time.NewTicker(fairTick)
+	defer ticker.Stop()
+	for {
+		q.mu.Lock()
+		idle := len(q.active) == 0
+		q.mu.Unlock()
+		if idle {
+			<-q.wake
+		}
+		<-ticker.C
+		q.round()
+	}
+}
+
+// round hands out the budget built up since the last tick. Each visit adds
+// a weighted quantum to a client's deficit and grants its queued transfers
+// while the deficit covers them; clients that run out of transfers drop out
+// of the rotation and lose their deficit.
+func (q *fairQueue) round() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.topUp()
+	for q.budget > 0 && len(q.active) > 0 {
+		c := q.active[0]
+		q.active = q.active[1:]
+		c.deficit += fairQuantum * c.weight
+		for len(c.queue) > 0 && c.queue[0].n <= c.deficit && q.budget > 0 {
+			req := c.queue[0]
+			c.queue = c.queue[1:]
+			c.deficit -= req.n
+			q.budget -= int64(req.n)
+			req.granted = true
+			close(req.ready)
+		}
+		if len(c.queue) > 0 {
+			q.active = append(q.active, c)
+		} else {
+			delete(q.clients, c.name)
+		}
+	}
+}
+
+// parseFairWeights parses "client=weight[,client=weight...]", where client
+// is a user name, key ID or client IP as used for -fair-share.
+func parseFairWeights(spec string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || strings.TrimSpace(name) == "" || err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid entry %q (want client=weight)", entry)
+		}
+		weights[strings.TrimSpace(name)] = weight
+	}
+	return weights, nil
+}
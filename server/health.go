@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const healthDialTimeout = 2 * time.Second
+
+// healthCheck is the result of dialing one address.
+type healthCheck struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+	OK      bool   `json:"ok"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// healthReport is what /healthz answers. Status is "ok", "degraded" when
+// a backend can't be reached, or "down" when the tunnel listener can't.
+type healthReport struct {
+	Status   string        `json:"status"`
+	Listener healthCheck   `json:"listener"`
+	Sessions int           `json:"sessions"`
+	Backends []healthCheck `json:"backends,omitempty"`
+}
+
+// serveHealth answers a health probe without touching any session. Only
+// "ok" gets a 200, so monitors that look at the status code alone see a
+// missing backend too.
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	report := s.health()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// health checks the tunnel listener and the backends, the named services
+// and -override-dest, all at once.
+func (s *Server) health() *healthReport {
+	report := &healthReport{Status: "ok", Sessions: s.openSessions()}
+
+	var backends []healthCheck
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, addr := range s.services[name].addrs() {
+			backends = append(backends, healthCheck{Name: name, Address: addr})
+		}
+	}
+	if s.overrideDest != "" {
+		backends = append(backends, healthCheck{Name: "override", Address: s.overrideDest})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		report.Listener = dialCheck(healthCheck{Address: s.listenAddr}, s.listenNetwork)
+	}()
+	for i := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backends[i] = dialCheck(backends[i], "tcp")
+		}()
+	}
+	wg.Wait()
+	report.Backends = backends
+
+	if !report.Listener.OK {
+		report.Status = "down"
+	} else {
+		for _, b := range backends {
+			if !b.OK {
+				report.Status = "degraded"
+			}
+		}
+	}
+	return report
+}
+
+// dialCheck fills in whether c.Address answers on network.
+func dialCheck(c healthCheck, network string) healthCheck {
+	start := time.Now()
+	conn, err := net.DialTimeout(network, c.Address, healthDialTimeout)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	conn.Close()
+	c.OK = true
+	c.Latency = time.Since(start).Round(time.Microsecond).String()
+	return c
+}
+
+// localDialAddr turns the address the tunnel listener binds to into one
+// to dial it at.
+func localDialAddr(host, port string) string {
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}
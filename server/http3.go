@@ -0,0 +1,35 @@
+//go:build !noh3
+
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// haveH3 reports whether this build can serve -transport h3. Building with
+// -tags noh3 leaves out QUIC.
+const haveH3 = true
+
+// listenHTTP3 serves handler over QUIC on the same address as the HTTPS
+// listener (UDP instead of TCP), for -transport h3 clients in direct mode.
+// It returns once the UDP socket is bound.
+func listenHTTP3(addr string, tlsConfig *tls.Config, handler http.Handler) {
+	server := &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig.Clone()),
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Fatalf("HTTP/3: %v", err)
+	}
+	log.Printf("Starting HTTP/3 server on %s (UDP)", addr)
+	go func() {
+		log.Fatal(server.Serve(conn))
+	}()
+}
@@ -0,0 +1,14 @@
+//go:build noh3
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+const haveH3 = false
+
+func listenHTTP3(addr string, tlsConfig *tls.Config, handler http.Handler) {
+	panic("-transport h3 isn't in this build")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// invitePrefix marks key IDs that are invitation credentials rather than
+// entries from -psk.
+const invitePrefix = "inv_"
+
+// invitation is the signed blob handed to a new user. It can be redeemed once
+// for a credential that only works for dest until the invitation expires.
+type invitation struct {
+	ID        string `json:"id"`
+	Expires   int64  `json:"exp"`
+	Dest      string `json:"dest"`
+	Endpoint  string `json:"endpoint"`
+	Signature string `json:"sig"`
+}
+
+// inviteAuthority issues and redeems invitations. Credentials are derived
+// from the invite key, so the only state is the list of redeemed IDs.
+type inviteAuthority struct {
+	key    []byte
+	dbPath string
+
+	mu       sync.Mutex
+	redeemed map[string]int64 // invitation ID -> expiry
+}
+
+func newInviteAuthority(key, dbPath string) (*inviteAuthority, error) {
+	a := &inviteAuthority{
+		key:      []byte(key),
+		dbPath:   dbPath,
+		redeemed: make(map[string]int64),
+	}
+	data, err := os.ReadFile(dbPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &a.redeemed); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", dbPath, err)
+		}
+	}
+	return a, nil
+}
+
+func (a *inviteAuthority) mac(parts ...string) []byte {
+	m := hmac.New(sha256.New, a.key)
+	m.Write([]byte(strings.Join(parts, "|")))
+	return m.Sum(nil)
+}
+
+func (a *inviteAuthority) sign(inv *invitation) string {
+	return hex.EncodeToString(a.mac("invite", inv.ID, strconv.FormatInt(inv.Expires, 10), inv.Dest, inv.Endpoint))
+}
+
+// issue creates an encoded invitation for dest that expires after ttl.
+func (a *inviteAuthority) issue(dest, endpoint string, ttl time.Duration) (string, error) {
+	id := make([]byte, 8)
+	if _, err := cryptorand.Read(id); err != nil {
+		return "", err
+	}
+	inv := &invitation{
+		ID:       hex.EncodeToString(id),
+		Expires:  time.Now().Add(ttl).Unix(),
+		Dest:     dest,
+		Endpoint: endpoint,
+	}
+	inv.Signature = a.sign(inv)
+
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// credential returns the key ID and secret a redeemed invitation grants.
+func (a *inviteAuthority) credential(inv *invitation) (string, string) {
+	keyID := invitePrefix + base64.RawURLEncoding.EncodeToString(
+		[]byte(inv.ID+"|"+strconv.FormatInt(inv.Expires, 10)+"|"+inv.Dest))
+	return keyID, hex.EncodeToString(a.mac("credential", keyID))
+}
+
+// redeem validates an invitation blob, marks it used and returns the
+// credential as a client config.
+func (a *inviteAuthority) redeem(blob string) (map[string]string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, errors.New("malformed invitation")
+	}
+	inv := &invitation{}
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, errors.New("malformed invitation")
+	}
+	sig, err := hex.DecodeString(inv.Signature)
+	if err != nil || !hmac.Equal(sig, a.mac("invite", inv.ID, strconv.FormatInt(inv.Expires, 10), inv.Dest, inv.Endpoint)) {
+		return nil, errors.New("invalid invitation signature")
+	}
+	if time.Now().Unix() > inv.Expires {
+		return nil, fmt.Errorf("invitation %s expired", inv.ID)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, used := a.redeemed[inv.ID]; used {
+		return nil, fmt.Errorf("invitation %s already redeemed", inv.ID)
+	}
+	a.redeemed[inv.ID] = inv.Expires
+	if err := a.save(); err != nil {
+		delete(a.redeemed, inv.ID)
+		return nil, err
+	}
+
+	keyID, secret := a.credential(inv)
+	return map[string]string{
+		"target": inv.Endpoint,
+		"dest":   inv.Dest,
+		"psk":    keyID + ":" + secret,
+	}, nil
+}
+
+// save writes the redeemed list, dropping invitations that have expired
+// anyway. Callers must hold a.mu.
+func (a *inviteAuthority) save() error {
+	now := time.Now().Unix()
+	for id, expires := range a.redeemed {
+		if expires < now {
+			delete(a.redeemed, id)
+		}
+	}
+	data, err := json.Marshal(a.redeemed)
+	if err != nil {
+		return err
+	}
+	tmp := a.dbPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.dbPath)
+}
+
+// lookup finds the key of a redeemed invitation credential ("inv_..." key
+// ID) and returns it with the name to log it under and the destination it's
+// limited to.
+func (a *inviteAuthority) lookup(keyID string) ([]byte, string, string, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(keyID, invitePrefix))
+	if err != nil {
+		return nil, keyID, "", false
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 {
+		return nil, keyID, "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, keyID, "", false
+	}
+	secret := hex.EncodeToString(a.mac("credential", keyID))
+	return []byte(secret), invitePrefix + parts[0], parts[2], true
+}
+
+func (s *Server) handleRedeem(w http.ResponseWriter, r *http.Request, clientIP, blob string) {
+	config, err := s.invites.redeem(blob)
+	if err != nil {
+		s.warn("Invite redemption failed", "client", clientIP, "err", err)
+		s.sendRedirect(w, r, clientIP)
+		return
+	}
+	s.info("Invite redeemed", "client", clientIP, "dest", config["dest"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// runInvite implements the "invite" subcommand.
+func runInvite(args []string) {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	key := fs.String("invite-key", os.Getenv("DARKFLARE_INVITE_KEY"), "Invitation signing key (same as the server's -invite-key)")
+	ttl := fs.Duration("ttl", 24*time.Hour, "How long the invitation and its credential stay valid")
+	dest := fs.String("dest", "", "Destination the invited client may connect to (host:port)")
+	endpoint := fs.String("endpoint", "", "Server URL the client should use (e.g. https://cdn.example.com)")
+	showQR := fs.Bool("qr", false, "Also show the invitation as a QR code on stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s invite -invite-key <key> -endpoint <url> -dest <host:port> [-ttl 24h] [-qr]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints a single-use invitation for darkflare-client -redeem.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *key == "" || *dest == "" || *endpoint == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if _, err := url.Parse(*endpoint); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid endpoint: %v\n", err)
+		os.Exit(1)
+	}
+	if *ttl <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid ttl: %s\n", *ttl)
+		os.Exit(1)
+	}
+
+	authority := &inviteAuthority{key: []byte(*key)}
+	blob, err := authority.issue(*dest, *endpoint, *ttl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create invitation: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(blob)
+	if *showQR {
+		fmt.Fprintln(os.Stderr)
+		if err := writeQR(os.Stderr, blob); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render QR code: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Invitation for %s valid until %s\n", *dest, time.Now().Add(*ttl).Format(time.RFC1123))
+}
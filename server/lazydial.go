@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// lazyDialBuffer is how much a session takes in from its client while the
+// destination is still being dialed. Writes beyond it wait for the dial.
+const lazyDialBuffer = 256 * 1024
+
+// lazyConn is a session's connection to its destination while it's being
+// dialed. A session opened by an upload doesn't wait for the dial: the data
+// is kept and written once the connection is up, so the client's next
+// requests overlap with the dial instead of queueing behind it. Reads wait
+// for the dial (or their deadline), and a failed dial shows up as the error
+// of the next read or write.
+type lazyConn struct {
+	ready  chan struct{} // closed when the dial finished
+	closed chan struct{}
+	conn   net.Conn
+	err    error
+
+	mu            sync.Mutex
+	pending       []byte // written before the dial finished
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closeOnce     sync.Once
+}
+
+func newLazyConn(dial func() (net.Conn, error)) *lazyConn {
+	c := &lazyConn{ready: make(chan struct{}), closed: make(chan struct{})}
+	go c.dial(dial)
+	return c
+}
+
+func (c *lazyConn) dial(dial func() (net.Conn, error)) {
+	conn, err := dial()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(c.ready)
+	if err != nil {
+		c.err = err
+		return
+	}
+	select {
+	case <-c.closed:
+		conn.Close()
+		c.err = net.ErrClosed
+		return
+	default:
+	}
+	conn.SetReadDeadline(c.readDeadline)
+	conn.SetWriteDeadline(c.writeDeadline)
+	if len(c.pending) > 0 {
+		if _, err := conn.Write(c.pending); err != nil {
+			conn.Close()
+			c.err = err
+			return
+		}
+		c.pending = nil
+	}
+	c.conn = conn
+}
+
+// wait waits for the dial until deadline, if there is one.
+func (c *lazyConn) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-c.ready:
+		return c.err
+	case <-c.closed:
+		return net.ErrClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *lazyConn) dialed() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *lazyConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	if err := c.wait(deadline); err != nil {
+		return 0, err
+	}
+	return c.conn.Read(b)
+}
+
+func (c *lazyConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.dialed() && len(c.pending)+len(b) <= lazyDialBuffer {
+		c.pending = append(c.pending, b...)
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if err := c.wait(deadline); err != nil {
+		return 0, err
+	}
+	return c.conn.Write(b)
+}
+
+func (c *lazyConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dialed() && c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+func (c *lazyConn) LocalAddr() net.Addr {
+	if c.dialed() && c.conn != nil {
+		return c.conn.LocalAddr()
+	}
+	return pipeAddr{}
+}
+
+func (c *lazyConn) RemoteAddr() net.Addr {
+	if c.dialed() && c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return pipeAddr{}
+}
+
+func (c *lazyConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *lazyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.dialed() && c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *lazyConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	if c.dialed() && c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
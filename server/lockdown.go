@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+)
+
+// lockdown is what the server gives up once its listeners are bound, so a
+// compromised handler can do less: root (-user), the rest of the filesystem
+// (-chroot) and syscalls it has no use for (-sandbox).
+type lockdown struct {
+	user      string // USER[:GROUP]
+	chroot    string
+	sandbox   bool
+	allowExec bool     // -a may still run its command under -sandbox
+	writable  []string // directories written to after starting
+}
+
+func (l *lockdown) enabled() bool {
+	return l.user != "" || l.chroot != "" || l.sandbox
+}
+
+func (l *lockdown) validate(appMode bool) error {
+	if !l.enabled() {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("-user, -chroot and -sandbox aren't supported on Windows")
+	}
+	if l.sandbox && runtime.GOOS != "linux" {
+		return fmt.Errorf("-sandbox is Linux only")
+	}
+	if l.chroot != "" && l.user == "" {
+		// Root can walk out of a chroot
+		return fmt.Errorf("-chroot requires -user")
+	}
+	if l.sandbox && appMode && !l.allowExec {
+		return fmt.Errorf("-sandbox doesn't let -a run its command, add -allow-exec if it should")
+	}
+	return nil
+}
+
+// allowWrites adds the directory of a file the server writes, or a
+// directory it creates files in.
+func (l *lockdown) allowWrites(dir string) {
+	if dir != "" {
+		l.writable = append(l.writable, filepath.Clean(dir))
+	}
+}
+
+// apply is called once every listener is bound. Failing is fatal: better
+// not to serve at all than to serve with more than was asked for.
+func (l *lockdown) apply() {
+	if !l.enabled() {
+		return
+	}
+	if err := l.drop(); err != nil {
+		log.Fatalf("Failed to lock down: %v", err)
+	}
+	if l.user != "" {
+		log.Printf("Running as %s", l.user)
+	}
+	if l.chroot != "" {
+		log.Printf("Confined to %s", l.chroot)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+func (l *lockdown) drop() error {
+	return fmt.Errorf("not supported on this platform")
+}
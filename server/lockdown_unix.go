@@ -0,0 +1,81 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// drop chroots, switches to -user and applies -sandbox, in that order: the
+// user is looked up while /etc/passwd is still in sight, and chroot needs
+// root.
+func (l *lockdown) drop() error {
+	uid, gid := -1, -1
+	if l.user != "" {
+		var err error
+		if uid, gid, err = lookupUser(l.user); err != nil {
+			return fmt.Errorf("-user: %v", err)
+		}
+	}
+	if l.chroot != "" {
+		if err := syscall.Chroot(l.chroot); err != nil {
+			return fmt.Errorf("-chroot: %v", err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("-chroot: %v", err)
+		}
+	}
+	if uid >= 0 {
+		// Only the one group, not root's supplementary ones
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("-user needs the server started as root: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("-user: %v", err)
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("-user: %v", err)
+		}
+		if uid != 0 && syscall.Setuid(0) == nil {
+			return fmt.Errorf("-user: root could be regained")
+		}
+	}
+	if l.sandbox {
+		return l.applySandbox()
+	}
+	return nil
+}
+
+// lookupUser resolves USER[:GROUP], by name or number. Without a group, the
+// user's primary group.
+func lookupUser(spec string) (uid, gid int, err error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", name)
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, fmt.Errorf("user %q has no numeric ID", name)
+	}
+	gidString := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", group)
+			}
+		}
+		gidString = g.Gid
+	}
+	if gid, err = strconv.Atoi(gidString); err != nil {
+		return 0, 0, fmt.Errorf("group of %q has no numeric ID", spec)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// encryptedLogWriter encrypts every log record to a set of age recipients and
+// writes it base64 encoded on a line of its own. Records are independent, so
+// a crash never leaves a half-written stream and the server never holds the
+// key needed to read its own history.
+type encryptedLogWriter struct {
+	mu         sync.Mutex
+	out        io.Writer
+	recipients []age.Recipient
+}
+
+func newEncryptedLogWriter(out io.Writer, recipientSpec string) (*encryptedLogWriter, error) {
+	var recipients []age.Recipient
+	for _, spec := range strings.Split(recipientSpec, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		recipient, err := age.ParseX25519Recipient(spec)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients")
+	}
+	return &encryptedLogWriter{out: out, recipients: recipients}, nil
+}
+
+func (w *encryptedLogWriter) Write(p []byte) (int, error) {
+	var sealed bytes.Buffer
+	enc, err := age.Encrypt(&sealed, w.recipients...)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := enc.Write(p); err != nil {
+		return 0, err
+	}
+	if err := enc.Close(); err != nil {
+		return 0, err
+	}
+
+	line := base64.StdEncoding.EncodeToString(sealed.Bytes()) + "\n"
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := io.WriteString(w.out, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// decryptLogFile writes the plaintext of an encrypted log to out using the
+// age identities in identityFile.
+func decryptLogFile(path, identityFile string, out io.Writer) error {
+	keys, err := os.Open(identityFile)
+	if err != nil {
+		return err
+	}
+	identities, err := age.ParseIdentities(keys)
+	keys.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		sealed, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		dec, err := age.Decrypt(bytes.NewReader(sealed), identities...)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if _, err := io.Copy(out, dec); err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Session events are logged with slog, with their details as fields:
+// client, session, dest, key, sent and received. In text (the default) they
+// come out through the standard logger like everything else:
+//
+//	2026/10/17 03:42:21 INFO Connection client=203.0.113.7 session=1f2e3d4c dest=localhost:22
+//
+// With -log-format json every line is a JSON object, log.Printf lines that
+// don't have fields yet included, with just a message.
+
+// setupLogging sends logs to w in format ("text" or "json") at level
+// ("debug", "info", "warn" or "error").
+func setupLogging(w io.Writer, format, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown -log-level %q (use debug, info, warn or error)", level)
+	}
+	switch strings.ToLower(format) {
+	case "text":
+		log.SetOutput(w)
+		slog.SetLogLoggerLevel(l)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})))
+	default:
+		return fmt.Errorf("unknown -log-format %q (use text or json)", format)
+	}
+	return nil
+}
+
+// info logs a session event unless -s silenced the server.
+func (s *Server) info(msg string, args ...any) {
+	if !s.silent {
+		slog.Info(msg, args...)
+	}
+}
+
+// warn logs a refused or failed request unless -s silenced the server.
+func (s *Server) warn(msg string, args ...any) {
+	if !s.silent {
+		slog.Warn(msg, args...)
+	}
+}
+
+// sessionAttrs are the fields every event about a session carries.
+func sessionAttrs(clientIP, sessionID, destination string) []any {
+	return []any{"client", clientIP, "session", shortID(sessionID), "dest", destination}
+}
+
+// shortID is the part of a session ID that goes in the logs. IDs come from
+// the client, so they may well be shorter than that.
+func shortID(sessionID string) string {
+	if len(sessionID) > 8 {
+		return sessionID[:8]
+	}
+	return sessionID
+}
+
+// addBytes counts n tunneled bytes for the session, for its log lines, and
+// for the metrics.
+func (s *Server) addBytes(session *Session, direction, tenant, host string, n int) {
+	if direction == "upstream" {
+		session.sent.Add(int64(n))
+	} else {
+		session.received.Add(int64(n))
+	}
+	s.metrics.addBytes(direction, tenant, host, n)
+}
+
+// byteAttrs are the byte counts of a session ending.
+func byteAttrs(session *Session) []any {
+	return []any{"sent", session.sent.Load(), "received", session.received.Load()}
+}
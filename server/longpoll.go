@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// wantsStreamedPoll reports whether a poll can be held open and streamed:
+// the client must understand it and the server mustn't be shedding load.
+func (s *Server) wantsStreamedPoll(r *http.Request) bool {
+	return s.streamPolls > 0 && r.Method == http.MethodGet &&
+		hasCapability(r, "chunked") && !hasCapability(r, "png") &&
+		s.shedder.current() < shedBulk
+}
+
+// streamPoll holds a poll open for up to -stream-polls and flushes upstream
+// data into it as soon as it's read, raw for clients that take binary and
+// hex otherwise (base64 can't be cut into pieces). That gets rid of the
+// 64KB per poll cap and the wait for the next poll.
+func (s *Server) streamPoll(w http.ResponseWriter, r *http.Request, session *Session, tenant, metricsHost string) {
+	rc := http.NewResponseController(w)
+	if hasCapability(r, "safe") {
+		w.Header().Set("Cache-Control", "no-cache, no-transform")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("X-Accel-Buffering", "no") // also marks the response as streamed
+	binary := hasCapability(r, "binary")
+	if binary {
+		w.Header().Set("X-Encoding", "binary")
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	// Don't leave a read behind that would eat data meant for the next poll
+	session.conn.SetReadDeadline(time.Now().Add(s.streamPolls))
+	stop := context.AfterFunc(r.Context(), func() {
+		session.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	buffer := make([]byte, 32*1024)
+	encoded := make([]byte, hex.EncodedLen(len(buffer)))
+	for {
+		n, err := session.conn.Read(buffer)
+		if n > 0 {
+			session.mu.Lock()
+			session.lastActive = time.Now()
+			session.mu.Unlock()
+
+			if s.fair.wait(r.Context(), "downstream", session.owner, n) != nil {
+				return
+			}
+			out := buffer[:n]
+			if !binary {
+				hex.Encode(encoded, out)
+				out = encoded[:hex.EncodedLen(n)]
+			}
+			if _, werr := w.Write(out); werr != nil {
+				return
+			}
+			if rc.Flush() != nil {
+				return
+			}
+			s.addBytes(session, "downstream", tenant, metricsHost, n)
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); (!ok || !ne.Timeout()) && err != io.EOF {
+				slog.Debug("Reading from destination failed", "client", session.clientIP, "err", err)
+			}
+			return
+		}
+	}
+}
@@ -3,41 +3,123 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
-	"encoding/hex"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type Session struct {
-	conn       net.Conn
-	lastActive time.Time
-	buffer     []byte
-	mu         sync.Mutex
+	conn        *pushConn // the destination, read ahead of the polls
+	lastActive  time.Time
+	created     time.Time
+	clientIP    string
+	destination string
+	tenant      string
+	owner       string // who opened it, for -fair-share
+	colo        string // Cloudflare data center of the latest request
+	unacked     []byte // last poll response, kept until the next poll
+	upSeq       uint64 // with "seq": upload bytes written to the destination
+	upAhead     map[uint64][]byte
+	downSeq     uint64 // with "seq": where inFlight starts in the stream back
+	inFlight    []byte // with "seq": sent in poll responses, not acked yet
+	buffer      []byte
+	mu          sync.Mutex
+	sent        atomic.Int64 // bytes to the destination, see addBytes
+	received    atomic.Int64 // and from it
+
+	transport string        // poll, ws, sse, h2 or h3
+	gap       time.Duration // smoothed time between the client's requests
+
+	// Set by claimSession when another client uses the same session ID
+	duplicateIP string
+	displacedIP string
 }
 
 type Server struct {
-	sessions     sync.Map
-	destHost     string
-	destPort     string
-	debug        bool
-	appCommand   string
-	isAppMode    bool
-	allowDirect  bool
-	silent       bool
-	redirect     string
-	overrideDest string
+	sessions      sync.Map
+	destHost      string
+	destPort      string
+	debug         bool
+	appCommand    string
+	isAppMode     bool
+	allowDirect   bool
+	silent        bool
+	redirect      string
+	overrideDest  string
+	keys          *keyRing
+	legacyAuth    bool   // accept unsigned session tokens from old clients
+	requireE2E    bool   // refuse sessions without end-to-end encryption
+	compat        string // protocol version other clients may speak, set with -compat
+	webClientPath string // where the browser client is served, set with -web-client
+	healthPath    string // where /healthz is also served on the tunnel listener
+	listenNetwork string // the tunnel listener, for health checks to dial
+	listenAddr    string
+	signatures    *signatureCheck
+	retired       sync.Map // session key → when it was closed, see retiredSessionTTL
+	metrics       *metrics
+	noLogDests    *destMatcher
+	destPolicy    *destPolicy // set with -allow-dest, -deny-dest and the port lists
+	padding       *padHistogram
+	schedule      *schedule
+	invites       *inviteAuthority
+	services      map[string]*service
+	servicesOnly  bool
+	dupSessions   dupPolicy
+	probes        *probeSet // set with -probe
+	certUsers     *certUsers
+	originPulls   bool // -origin-pull-ca, only Cloudflare can connect
+
+	// Set when running behind a local web server
+	trustedProxies *destMatcher
+	unixSocket     bool
+	passthrough    http.Handler
+	decoySite      *decoySite // answers stray visitors instead of the redirect
+
+	shedder *loadShedder
+	fair    *fairShare
+	tenants map[string]*tenant // by key ID
+	zones   *zoneSet
+	muxes   sync.Map // open -mux sessions, for go-aways when draining
+	stepUp  *stepUp
+
+	drainUntil atomic.Int64 // unix nanoseconds, once shutting down with -drain
+
+	breakGlass *breakGlass
+	mirrors    mirrorPolicies
+
+	websockets bool // accept -transport ws clients
+	h2streams  bool // accept -transport h2 clients
+	h3streams  bool // accept -transport h3 clients on a QUIC listener
+	sse        bool // accept -transport sse clients
+	batches    bool // accept -batch clients
+	udp        bool // relay UDP for -l udp:PORT clients
+	tun        *tunServer
+
+	streamPolls time.Duration   // how long polls may be held open and streamed
+	compression map[string]bool // algorithms -compress allows
+
+	endpointsFile string // the signed list -endpoints hands out
 }
 
 func NewServer(destHost, destPort string, appCommand string, debug bool, allowDirect bool, silent bool, redirect string, overrideDest string) *Server {
@@ -51,6 +133,7 @@ func NewServer(destHost, destPort string, appCommand string, debug bool, allowDi
 		silent:       silent,
 		redirect:     redirect,
 		overrideDest: overrideDest,
+		signatures:   newSignatureCheck(),
 	}
 
 	if s.isAppMode && s.debug && !s.silent {
@@ -71,10 +154,22 @@ func (s *Server) cleanupSessions() {
 			if now.Sub(session.lastActive) > 5*time.Minute {
 				session.conn.Close()
 				s.sessions.Delete(key)
+				s.retired.Store(key, now)
+				if !s.noLogDests.match(session.destination) {
+					id := key.(string)
+					id = id[strings.LastIndex(id, "/")+1:]
+					s.info("Session expired", append(sessionAttrs(session.clientIP, id, session.destination), byteAttrs(session)...)...)
+				}
 			}
 			session.mu.Unlock()
 			return true
 		})
+		s.retired.Range(func(key, value interface{}) bool {
+			if now.Sub(value.(time.Time)) > retiredSessionTTL {
+				s.retired.Delete(key)
+			}
+			return true
+		})
 	}
 }
 
@@ -157,8 +252,26 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Health checks come before anything a tunnel request would count
+	if s.healthPath != "" && r.Method == http.MethodGet && r.URL.Path == s.healthPath {
+		s.serveHealth(w, r)
+		return
+	}
+
+	start := time.Now()
+	carrier := liftCarriedFields(r)
+	v1 := hasCapability(r, compatV1)
+	if v1 {
+		restrictToV1(r)
+	}
+	colo := requestColo(r)
+	if r.Context().Value(batchFrameKey{}) == nil {
+		// A batch's frames came with it, they aren't requests of their own
+		s.metrics.colos.request(colo)
+	}
+
 	// Add basic connection logging
-	clientIP := r.Header.Get("X-Forwarded-For")
+	clientIP := s.forwardedFor(r)
 	if clientIP == "" {
 		clientIP = r.Header.Get("Cf-Connecting-Ip")
 	}
@@ -166,6 +279,38 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 		clientIP = r.RemoteAddr
 	}
 
+	// Outside the availability windows only the decoy answers
+	if s.schedule != nil && !s.schedule.active(time.Now()) {
+		slog.Debug("Outside availability window", "client", clientIP)
+		s.sendRedirect(w, r, clientIP)
+		return
+	}
+
+	// Under a strict -zones file, other hostnames only get the decoy
+	zone := s.zoneFor(r)
+	if zone == nil && s.zones != nil && s.zones.strict {
+		slog.Debug("No zone", "client", clientIP, "host", r.Host)
+		s.sendRedirect(w, r, clientIP)
+		return
+	}
+
+	if s.serveWebClient(w, r) {
+		slog.Debug("Served web client", "client", clientIP)
+		return
+	}
+
+	// Invitation redemption is a one-off exchange, not a tunnel request
+	if blob := r.Header.Get("X-Invite"); blob != "" && s.invites != nil {
+		s.handleRedeem(w, r, clientIP, blob)
+		return
+	}
+
+	// Several tunnel requests in one, each handled as if it came on its own
+	if s.batches && r.Method == http.MethodPost && hasCapability(r, "batch") {
+		s.handleBatch(w, r, clientIP)
+		return
+	}
+
 	// Get session ID early
 	sessionID := r.Header.Get("X-For")
 	if sessionID == "" {
@@ -174,25 +319,107 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 			sessionID = r.Header.Get("Cf-Connecting-Ip")
 		}
 	}
+	// It comes from the client and ends up in logs, file names and metrics
+	if sessionID != "" && !isValidSessionID(sessionID) {
+		slog.Debug("Invalid session ID", "client", clientIP)
+		s.sendRedirect(w, r, clientIP)
+		return
+	}
 
 	// Get and decode destination early
 	encodedDest := r.Header.Get("X-Requested-With")
-	if encodedDest == "" {
-		redirectURL := s.redirect
-		if redirectURL == "" {
-			redirectURL = "https://github.com/doxx/darkflare"
+	if encodedDest == "" && !hasCapability(r, "endpoints") {
+		s.sendRedirect(w, r, clientIP)
+		return
+	}
+
+	// Verify the pre-shared key before touching any session state
+	var inviteDest string
+	var ten *tenant
+	var keyID string
+	var secret []byte
+	authenticated := false
+	if zone.keyRing(s.keys) != nil || s.invites != nil {
+		var allowedDest string
+		var ok bool
+		keyID, allowedDest, secret, ok = s.authenticate(r, sessionID)
+		if !ok {
+			if keyID == "" {
+				keyID = "none"
+			}
+			s.warn("Auth failed", "client", clientIP, "key", keyID)
+			s.metrics.authFailures.Inc()
+			s.sendRedirect(w, r, clientIP)
+			return
+		}
+		slog.Debug("Authenticated", "client", clientIP, "key", keyID)
+		authenticated = true
+		inviteDest = allowedDest
+		ten = s.tenants[keyID]
+	}
+
+	// Map the client certificate checked at the edge to a user
+	var user *certUser
+	if s.certUsers != nil {
+		var err error
+		user, err = s.identifyCertUser(r)
+		if err != nil {
+			s.warn("Auth failed", "client", clientIP, "err", err)
+			s.metrics.authFailures.Inc()
+			s.sendRedirect(w, r, clientIP)
+			return
 		}
-		log.Printf("Redirect: %s → %s", clientIP, redirectURL)
-		http.Redirect(w, r, redirectURL, http.StatusFound)
+		slog.Debug("Authenticated", "client", clientIP, "user", user.name)
+		authenticated = true
+	}
+
+	// The endpoints list goes to clients that proved who they are, no
+	// destination needed. Everyone else gets the decoy, so asking for it
+	// doesn't tell a prober there's a tunnel here
+	if r.Method == http.MethodGet && hasCapability(r, "endpoints") {
+		if s.endpointsFile != "" && authenticated && (r.Header.Get("Cf-Connecting-Ip") != "" || s.allowDirect) {
+			s.serveEndpoints(w, r, clientIP)
+			return
+		}
+		if encodedDest == "" {
+			s.sendRedirect(w, r, clientIP)
+			return
+		}
+	}
+
+	// Other clients speak the frozen protocol v1, see PROTOCOL.md
+	if v1 {
+		if s.compat != compatV1 {
+			http.Error(w, "Protocol v1 not enabled, start the server with -compat v1", http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("X-Protocol", compatV1)
+		if !validV1SessionID(r.Header.Get("X-For")) {
+			http.Error(w, "Invalid session ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A preflight probe only wants to know whether its fields got here
+	if hasCapability(r, "preflight") {
+		w.Header().Set("X-Carrier", carrier)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// A canary poll shows the client what the CDN does to responses
+	if r.Method == http.MethodGet && hasCapability(r, "canary") {
+		s.serveCanary(w, r, sessionID)
 		return
 	}
 
 	var destination string
-	if s.overrideDest != "" {
+	if encodedDest == base64.StdEncoding.EncodeToString([]byte(muxDestination)) {
+		// Streams name their destinations themselves, -override-dest applies to each
+		destination = muxDestination
+	} else if s.overrideDest != "" {
 		destination = s.overrideDest
-		if s.debug {
-			log.Printf("Using override destination: %s", destination)
-		}
+		slog.Debug("Using override destination", "client", clientIP, "dest", destination)
 	} else {
 		destBytes, err := base64.StdEncoding.DecodeString(encodedDest)
 		if err != nil {
@@ -202,31 +429,110 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 		destination = string(destBytes)
 	}
 
+	// Invitation credentials only reach the destination they were issued for
+	if inviteDest != "" && destination != inviteDest && destination != muxDestination {
+		s.warn("Auth failed", "client", clientIP, "dest", destination, "err", "invitation for "+inviteDest)
+		s.metrics.authFailures.Inc()
+		s.sendRedirect(w, r, clientIP)
+		return
+	}
+
+	// Who the client is, for step-up and break-glass
+	client := clientHost(clientIP)
+	if user != nil {
+		client = user.name
+	} else if keyID != "" {
+		client = keyID
+	}
+
+	// A break-glass token can unlock destinations the ACLs deny
+	var denied string
+	if destination == muxDestination {
+		// Each stream gets checked instead
+	} else if ten != nil && ten.allowed != nil && !ten.allowed.match(destination) {
+		denied = fmt.Sprintf("tenant %s not allowed to reach %s", ten.name, destination)
+	} else if user != nil && user.allowed != nil && !user.allowed.match(destination) {
+		denied = fmt.Sprintf("user %s not allowed to reach %s", user.name, destination)
+	}
+	var grant *breakGlassGrant
+	if denied != "" {
+		grant = s.breakGlass.unlock(r.Header.Get("X-Break-Glass"), client, destination)
+		if grant == nil {
+			s.warn("Auth failed", "client", clientIP, "dest", destination, "err", denied)
+			s.metrics.authFailures.Inc()
+			s.sendRedirect(w, r, clientIP)
+			return
+		}
+	}
+
+	// Named services are resolved here; everything client-facing, including
+	// the logs, keeps using the name
+	target := destination
+	service := false
+	named, isNamed := s.services[destination]
+	if isNamed {
+		// Standbys are only looked at when dialing
+		target = named.primary()
+		service = true
+	} else if destination == tunDestination && s.tun != nil {
+		// The device's own address stands in for the destination
+		target = s.tun.target()
+		service = true
+	} else if destination == muxDestination {
+		// Never dialed, but it has to pass the checks below
+		target = "127.0.0.1:1"
+		service = true
+	} else if s.servicesOnly && r.Header.Get("X-Connection-Close") != "true" {
+		s.warn("Unknown service", "client", clientIP, "dest", destination)
+		http.Error(w, "Unknown service", http.StatusForbidden)
+		return
+	}
+
+	// Sessions to do-not-log destinations only show up in aggregate metrics
+	private := s.noLogDests.match(destination) || s.noLogDests.match(target)
+	// and refusals leave them out
+	logDest := destination
+	if private {
+		logDest = ""
+	}
+
+	// Tenants and zones get a session namespace of their own
+	sessionKey := sessionID
+	tenantName := ""
+	if ten != nil {
+		tenantName = ten.name
+		sessionKey = ten.name + "/" + sessionID
+	}
+	sessionKey = zone.sessionNamespace() + sessionKey
+
+	// Sort out requests for a session opened by a different client
+	if sessionID != "" {
+		key, ok := s.claimSession(w, sessionKey, clientIP)
+		if !ok {
+			return
+		}
+		sessionKey = key
+	}
+
 	// Check for connection termination
 	if r.Header.Get("X-Connection-Close") == "true" {
-		sessionDisplay := "no-session"
-		if sessionID != "" {
-			sessionDisplay = sessionID[:8]
-		}
-		log.Printf("Disconnect: %s [%s]", clientIP, sessionDisplay)
-		if sessionInterface, exists := s.sessions.LoadAndDelete(sessionID); exists {
+		attrs := sessionAttrs(clientIP, sessionID, destination)
+		if sessionInterface, exists := s.sessions.LoadAndDelete(sessionKey); exists {
 			session := sessionInterface.(*Session)
 			session.conn.Close()
+			s.retired.Store(sessionKey, time.Now())
+			attrs = append(attrs, byteAttrs(session)...)
+		}
+		if !private {
+			slog.Info("Disconnect", attrs...)
 		}
 		return
 	}
 
 	// Always log basic connection info
-	sessionDisplay := "no-session"
-	if sessionID != "" {
-		sessionDisplay = sessionID[:8] // First 8 chars of session ID
-	}
-	s.logf("Connection: %s [%s] → %s", clientIP, sessionDisplay, destination)
-
-	// Debug logging only when enabled
-	if s.debug {
-		log.Printf("Headers: %+v", r.Header)
-		// ... rest of debug logging ...
+	if !private {
+		s.info("Connection", sessionAttrs(clientIP, sessionID, destination)...)
+		slog.Debug("Headers", "headers", r.Header)
 	}
 
 	// Verify Cloudflare connection
@@ -236,34 +542,19 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set Apache-like headers
-	w.Header().Set("Server", "Apache/2.4.41 (Ubuntu)")
-	w.Header().Set("X-Powered-By", "PHP/7.4.33")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-Frame-Options", "SAMEORIGIN")
-	w.Header().Set("X-XSS-Protection", "1; mode=block")
-
-	// Cache control headers
-	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
-	w.Header().Set("Content-Type", "application/octet-stream")
+	s.setTunnelHeaders(w, r)
 
 	// Validate the destination format and DNS resolution
-	host, port, err := net.SplitHostPort(destination)
+	host, port, err := net.SplitHostPort(target)
 	if err != nil {
-		if s.debug {
-			log.Printf("[DEBUG] Invalid destination format %s: %v", destination, err)
-		}
+		slog.Debug("Invalid destination", "client", clientIP, "dest", destination, "err", err)
 		http.Error(w, fmt.Sprintf("Invalid destination format: %v", err), http.StatusBadRequest)
 		return
 	}
 
 	// Additional host validation
 	if host == "" {
-		if s.debug {
-			log.Printf("[DEBUG] Empty host in destination: %s", destination)
-		}
+		slog.Debug("Empty host in destination", "client", clientIP, "dest", destination)
 		http.Error(w, "Empty host not allowed", http.StatusBadRequest)
 		return
 	}
@@ -271,9 +562,7 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	// Validate port
 	portNum, err := strconv.Atoi(port)
 	if err != nil || portNum < 1 || portNum > 65535 {
-		if s.debug {
-			log.Printf("[DEBUG] Invalid port %s in destination: %v", port, err)
-		}
+		slog.Debug("Invalid port in destination", "client", clientIP, "dest", destination)
 		http.Error(w, fmt.Sprintf("Invalid port number: %s", port), http.StatusBadRequest)
 		return
 	}
@@ -282,36 +571,38 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	if ip := net.ParseIP(host); ip == nil {
 		ips, err := net.LookupHost(host)
 		if err != nil {
-			if s.debug {
-				log.Printf("[DEBUG] DNS resolution failed for %s: %v", host, err)
-			}
+			slog.Debug("DNS resolution failed", "client", clientIP, "dest", destination, "err", err)
 			http.Error(w, fmt.Sprintf("DNS resolution failed: %v", err), http.StatusBadRequest)
 			return
 		}
 		if len(ips) == 0 {
-			if s.debug {
-				log.Printf("[DEBUG] No IP addresses found for host: %s", host)
-			}
+			slog.Debug("No IP addresses for host", "client", clientIP, "dest", destination)
 			http.Error(w, "No IP addresses found for host", http.StatusBadRequest)
 			return
 		}
-		if s.debug {
-			log.Printf("[DEBUG] Resolved %s to %v", host, ips)
+		if !private {
+			slog.Debug("Resolved", "host", host, "addrs", ips)
 		}
 	}
 
 	// Validate the destination
-	if !isValidDestination(destination) {
-		if s.debug {
-			log.Printf("[DEBUG] Invalid destination format: %s", destination)
-		}
+	if !isValidDestination(target) {
+		slog.Debug("Invalid destination", "client", clientIP, "dest", destination)
 		http.Error(w, "Invalid destination", http.StatusForbidden)
 		return
 	}
 
 	// Use the decoded destination for the connection
-	if s.debug {
-		log.Printf("[DEBUG] Connecting to %s:%s", host, port)
+	if !private {
+		slog.Debug("Connecting", "client", clientIP, "dest", destination)
+	}
+
+	metricsHost := host
+	if service {
+		metricsHost = destination
+	}
+	if private {
+		metricsHost = privateDestLabel
 	}
 
 	// Try to get session ID from various possible headers
@@ -326,107 +617,455 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if sessionID == "" {
-		if s.debug {
-			log.Printf("Error: Missing session ID from %s", r.Header.Get("Cf-Connecting-Ip"))
-		}
+		slog.Debug("Missing session ID", "client", clientIP)
 		http.Error(w, "Missing session ID", http.StatusBadRequest)
 		return
 	}
+	defer s.metrics.observeRequest(r.Method, metricsHost, sessionID, start)
 
+	early := r.Method == http.MethodPost && hasCapability(r, "early")
 	var session *Session
-	sessionInterface, exists := s.sessions.Load(sessionID)
+	sessionInterface, exists := s.sessions.Load(sessionKey)
 	if !exists {
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if _, closed := s.retired.Load(sessionKey); closed && early {
+			// A session's first request sent again must not open it again
+			s.warn("Refused early data for closed session", sessionAttrs(clientIP, sessionID, logDest)...)
+			http.Error(w, "Session closed", http.StatusGone)
+			return
+		}
+		if hasCapability(r, "known") {
+			// The client had this session, so a new one would write the
+			// middle of its stream into a fresh connection
+			if !private {
+				s.warn("Unknown session", sessionAttrs(clientIP, sessionID, destination)...)
+			}
+			sendSessionUnknown(w)
+			return
+		}
+		if s.shedder.current() >= shedNewSessions {
+			s.metrics.shedRejections.Inc()
+			slog.Debug("Shedding load, refused new session", "client", clientIP)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if left, ok := s.draining(); ok {
+			slog.Debug("Draining, refused new session", "client", clientIP)
+			w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if ten != nil && ten.maxSessions > 0 && s.tenantSessions(ten) >= ten.maxSessions {
+			s.warn("Tenant session limit reached", "client", clientIP, "tenant", ten.name, "limit", ten.maxSessions)
+			http.Error(w, "Too Many Sessions", http.StatusTooManyRequests)
+			return
+		}
+
+		if s.stepUp != nil && (s.stepUp.sensitive.match(destination) || s.stepUp.sensitive.match(target)) {
+			if !s.requireStepUp(w, r, client, clientIP, destination) {
+				return
+			}
+		}
+
+		// Named services are the operator's own choice, everything else
+		// has to pass -allow-dest and -deny-dest
+		addr := net.JoinHostPort(host, port)
+		if !service {
+			if addr, err = zone.policy(s.destPolicy).vet(addr); err != nil {
+				// The error names the destination too
+				attrs := sessionAttrs(clientIP, sessionID, logDest)
+				if !private {
+					attrs = append(attrs, "err", err)
+				}
+				s.warn("Destination refused", attrs...)
+				http.Error(w, "Destination not allowed", http.StatusForbidden)
+				return
+			}
+		}
+
+		if s.probes.unhealthy(destination, target) {
+			slog.Debug("Destination unhealthy, refused new session", sessionAttrs(clientIP, sessionID, logDest)...)
+			w.Header().Set("X-Destination-Unhealthy", "1")
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.probes.interval.Seconds())))
+			http.Error(w, "Destination unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+
+		e2e := hasCapability(r, "e2e")
+		if e2e && secret == nil {
+			http.Error(w, "End-to-end encryption needs -psk on the server", http.StatusBadRequest)
+			return
+		}
+		if !e2e && s.requireE2E {
+			s.warn("Refused unencrypted session", sessionAttrs(clientIP, sessionID, logDest)...)
+			http.Error(w, "End-to-end encryption required, use -e2e", http.StatusForbidden)
 			return
 		}
 
+		dial := func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+		if isNamed {
+			dial = func(string) (net.Conn, error) { return s.dialService(destination, named, client) }
+		}
+		// Sessions opened by an upload take its data in while they dial;
+		// tun and mux sessions attach right away anyway
+		lazy := r.Method == http.MethodPost
+		if hasCapability(r, "udp") {
+			if !s.udp {
+				http.Error(w, "UDP not enabled", http.StatusNotImplemented)
+				return
+			}
+			dial = dialDatagram
+		}
+		if destination == tunDestination && s.tun != nil {
+			// Each packet has to pass -allow-dest and -deny-dest instead
+			policy := zone.policy(s.destPolicy)
+			dial = func(string) (net.Conn, error) { return s.tun.attach(policy) }
+			lazy = false
+		}
+		if destination == muxDestination {
+			access := &muxAccess{clientIP: clientIP, client: client, sessionID: sessionID, inviteDest: inviteDest, tenant: ten, user: user, zone: zone}
+			dial = func(string) (net.Conn, error) { return s.attachMux(access) }
+			lazy = false
+		}
+		facts := &sessionFacts{destination: destination, target: target, user: client, tenant: tenantName}
+		sinks := s.mirrors.forSession(facts)
+		var conn net.Conn
+		if lazy && len(sinks) == 0 {
+			// Mirrors need the connection's addresses up front
+			conn = newLazyConn(func() (net.Conn, error) {
+				conn, err := dial(addr)
+				if err != nil && !private {
+					slog.Debug("Dial failed", append(sessionAttrs(clientIP, sessionID, destination), "err", err)...)
+				}
+				return conn, err
+			})
+		} else {
+			conn, err = dial(addr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if len(sinks) > 0 {
+			conn = s.mirror(conn, sinks, clientIP, sessionID)
+		}
+		if e2e {
+			// Mirrors above still see the destination's side in the clear
+			sealed, err := newSealedConn(conn, secret, sessionID, "server", "client")
+			if err != nil {
+				conn.Close()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			conn = sealed
+		}
+
 		session = &Session{
-			conn:       conn,
-			lastActive: time.Now(),
-			buffer:     make([]byte, 0),
+			conn:        newPushConn(conn),
+			lastActive:  time.Now(),
+			created:     time.Now(),
+			clientIP:    clientIP,
+			destination: destination,
+			tenant:      tenantName,
+			owner:       client,
+			buffer:      make([]byte, 0),
+		}
+		s.sessions.Store(sessionKey, session)
+		s.metrics.sessionOpened(tenantName, metricsHost)
+		if grant != nil {
+			audit("%s [%s] used %s for session %s → %s (%s)", client, clientIP, grant.ID, shortID(sessionID), destination, denied)
 		}
-		s.sessions.Store(sessionID, session)
 	} else {
 		session = sessionInterface.(*Session)
 	}
 
+	if s.websockets && websocket.IsWebSocketUpgrade(r) {
+		session.setTransport("ws")
+		s.serveWebSocket(w, r, session, sessionKey, tenantName, metricsHost)
+		return
+	}
+	if s.sse && isEventStream(r) {
+		session.setTransport("sse")
+		s.serveSSE(w, r, session, tenantName, metricsHost)
+		return
+	}
+	if s.wantsStreamedPoll(r) {
+		s.streamPoll(w, r, session, tenantName, metricsHost)
+		return
+	}
+	if hasCapability(r, "stream") {
+		// Reading a stream like a POST would never finish
+		if !s.streamingUpload(r) {
+			http.Error(w, "Streaming not enabled", http.StatusNotImplemented)
+			return
+		}
+		session.setTransport(fmt.Sprintf("h%d", r.ProtoMajor))
+		s.serveStream(w, r, session, sessionKey, tenantName, metricsHost)
+		return
+	}
+
+	packWith := s.compressionFor(r)
+	if packWith != "" {
+		w.Header().Set("X-Compression", packWith)
+	}
+
 	session.mu.Lock()
 	defer session.mu.Unlock()
-	session.lastActive = time.Now()
+	now := time.Now()
+	gap := now.Sub(session.lastActive)
+	s.metrics.colos.gap(colo, gap)
+	if session.gap == 0 {
+		session.gap = gap
+	} else {
+		session.gap += (gap - session.gap) / 8
+	}
+	session.lastActive = now
+	if session.transport == "" {
+		// sse sessions upload this way too
+		session.transport = "poll"
+	}
+	if colo != "" {
+		session.colo = colo
+	}
 
 	if r.Method == http.MethodPost {
 		data, err := io.ReadAll(r.Body)
 		if err != nil {
-			if s.debug {
-				log.Printf("Error reading request body: %v", err)
-			}
+			slog.Debug("Reading request body failed", "client", clientIP, "err", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if sum := r.Header.Get("X-Checksum"); sum != "" && sum != payloadChecksum(data) {
+			// Nothing has been written, so the client can simply send it again
+			s.metrics.badChecksums.WithLabelValues("upstream").Inc()
+			s.metrics.colos.retry(colo)
+			slog.Debug("Upload checksum mismatch", "client", clientIP, "session", shortID(sessionID), "bytes", len(data))
+			http.Error(w, "Checksum mismatch", http.StatusUnprocessableEntity)
+			return
+		}
+		if packed := r.Header.Get("X-Packed"); packed != "" {
+			if !s.compression[packed] {
+				http.Error(w, "Compression not enabled", http.StatusBadRequest)
+				return
+			}
+			if data, err = unpack(packed, data); err != nil {
+				slog.Debug("Unpacking upload failed", "client", clientIP, "session", shortID(sessionID), "err", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if hasCapability(r, "seq") {
+			if data, err = session.sequenceUpload(r.Header.Get("X-Seq"), data); err != nil {
+				slog.Debug("Upload out of sequence", "client", clientIP, "session", shortID(sessionID), "err", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("X-Seq", strconv.FormatUint(session.upSeq, 10))
+		}
 		if len(data) > 0 {
-			if s.debug {
-				log.Printf("POST: Writing %d bytes to connection for session %s",
-					len(data),
-					sessionID[:8], // First 8 chars of session ID for brevity
-				)
+			slog.Debug("Upload", "client", clientIP, "session", shortID(sessionID), "bytes", len(data))
+			if s.fair.wait(r.Context(), "upstream", session.owner, len(data)) != nil {
+				return
 			}
 			_, err = session.conn.Write(data)
 			if err != nil {
-				if s.debug {
-					log.Printf("Error writing to connection: %v", err)
-				}
+				slog.Debug("Writing to destination failed", "client", clientIP, "session", shortID(sessionID), "err", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			s.addBytes(session, "upstream", tenantName, metricsHost, len(data))
+		}
+		if !early {
+			return
+		}
+		// Early data gets the destination's first answer back like a poll
+	}
+
+	// For GET requests, take what the destination sent since the last one
+	readLimit := 64 * 1024
+	if s.shedder.current() >= shedBulk {
+		readLimit = shedBulkReadLimit
+	}
+	seq := hasCapability(r, "seq")
+	if seq {
+		if err := session.ackDownload(r.Header.Get("X-Ack")); err != nil {
+			slog.Debug("Poll out of sequence", "client", clientIP, "session", shortID(sessionID), "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		// What the client doesn't have yet goes first
+		readLimit -= len(session.inFlight)
+	}
+
+	wait := 100 * time.Millisecond
+	if early {
+		wait = earlyReplyWait
+	}
+	var readData []byte
+	if readLimit > 0 {
+		readData, err = session.conn.take(readLimit, wait)
+		if err != nil && err != io.EOF {
+			slog.Debug("Reading from destination failed", "client", clientIP, "session", shortID(sessionID), "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if s.fair.wait(r.Context(), "downstream", session.owner, len(readData)) != nil {
 		return
 	}
 
-	// For GET requests, read any available data
-	buffer := make([]byte, 32*1024)      // 32KB buffer
-	readData := make([]byte, 0, 64*1024) // 64KB initial capacity
+	fresh := len(readData)
+	if seq {
+		if len(session.inFlight) > 0 {
+			// The response to the last poll never made it, a CDN error
+			// or timeout the client retried past
+			s.metrics.resentBytes.Add(float64(len(session.inFlight)))
+			s.metrics.colos.retry(colo)
+			slog.Debug("Resending", "client", clientIP, "session", shortID(sessionID), "bytes", len(session.inFlight))
+		}
+		session.inFlight = append(session.inFlight, readData...)
+		readData = session.inFlight
+		w.Header().Set("X-Seq", strconv.FormatUint(session.downSeq, 10))
+	}
 
-	for {
-		session.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) // Increased from 10ms to 100ms
-		n, err := session.conn.Read(buffer)
-		if err != nil {
-			if err != io.EOF && !err.(net.Error).Timeout() {
-				if s.debug {
-					log.Printf("Error reading from connection: %v", err)
-				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			break
+	// Checksumming clients ask again for a response that arrived corrupted;
+	// any other poll means the last one got through. Sequenced ones just
+	// don't ack it
+	if hasCapability(r, "crc") && !seq {
+		if r.Header.Get("X-Resend") == "1" && len(session.unacked) > 0 {
+			s.metrics.badChecksums.WithLabelValues("downstream").Inc()
+			s.metrics.colos.retry(colo)
+			slog.Debug("Resending", "client", clientIP, "session", shortID(sessionID), "bytes", len(session.unacked))
+			readData = append(session.unacked, readData...)
 		}
-		if n > 0 {
-			readData = append(readData, buffer[:n]...)
+		session.unacked = readData
+	}
+	payload := readData
+	if packWith != "" {
+		if packed, ok := pack(packWith, readData); ok {
+			payload = packed
+			w.Header().Set("X-Packed", packWith)
 		}
-		if n < len(buffer) || len(readData) >= 64*1024 { // Added size limit check
-			break
+	}
+	if hasCapability(r, "crc") && len(payload) > 0 {
+		w.Header().Set("X-Checksum", payloadChecksum(payload))
+	}
+
+	// Image transport clients always get a valid PNG, even without data
+	if hasCapability(r, "png") {
+		body, err := encodePNG(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+		if fresh > 0 {
+			s.addBytes(session, "downstream", tenantName, metricsHost, fresh)
+		}
+		return
 	}
 
 	// Only encode and send if we have data
 	if len(readData) > 0 {
-		encoded := hex.EncodeToString(readData)
-		if s.debug {
-			log.Printf("Response: Sending %d bytes (encoded: %d bytes) for session %s path %s",
-				len(readData),
-				len(encoded),
-				sessionID[:8],
-				r.URL.Path,
-			)
-		}
-		w.Write([]byte(encoded))
-	} else if s.debug {
-		log.Printf("Response: No data to send for session %s path %s",
-			sessionID[:8],
-			r.URL.Path,
-		)
+		encoding := pollEncoding(r)
+		encoded := encodePoll(w, encoding, payload)
+		if s.padding != nil && hasCapability(r, "pad") {
+			encoded = s.padding.padResponse(w, encoded, encoding)
+		}
+		slog.Debug("Response", "client", clientIP, "session", shortID(sessionID), "bytes", len(readData), "encoded", len(encoded), "path", r.URL.Path)
+		w.Write(encoded)
+		s.addBytes(session, "downstream", tenantName, metricsHost, fresh)
+	} else {
+		slog.Debug("Response", "client", clientIP, "session", shortID(sessionID), "bytes", 0, "path", r.URL.Path)
+	}
+}
+
+// setTunnelHeaders makes tunnel responses look like they come from a PHP
+// app (or whatever the zone's header profile says) and keeps them out of
+// caches. Clients that found the CDN changing response bodies ask for them
+// to be left alone.
+func (s *Server) setTunnelHeaders(w http.ResponseWriter, r *http.Request) {
+	for name, value := range headerProfiles[s.zoneFor(r).headerProfile()] {
+		w.Header().Set(name, value)
+	}
+
+	// Cache control headers
+	if hasCapability(r, "safe") {
+		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, no-transform")
+	} else {
+		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	}
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	s.setDrainHeader(w)
+}
+
+func (s *Server) sendRedirect(w http.ResponseWriter, r *http.Request, clientIP string) {
+	zone := s.zoneFor(r)
+	if site := zone.decoySite(s.decoySite); site != nil {
+		slog.Info("Decoy site", "client", clientIP, "path", r.URL.Path)
+		site.serve(w, r, zone.headerProfile())
+		return
+	}
+	redirectURL, _ := zone.decoy(s.redirect, nil)
+	if redirectURL == "404" {
+		slog.Info("Not found", "client", clientIP)
+		sendNotFound(w, r, zone.headerProfile())
+		return
+	}
+	if redirectURL == "" {
+		redirectURL = "https://github.com/doxx/darkflare"
+	}
+	slog.Info("Redirect", "client", clientIP, "to", redirectURL)
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// sendSessionUnknown tells a client the server doesn't have a session it
+// had, after a restart or once it expired. Clients close the connection, or
+// open the session again with -resume.
+func sendSessionUnknown(w http.ResponseWriter) {
+	w.Header().Set("X-Session-Unknown", "1")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	fmt.Fprintln(w, `{"error":"session_unknown"}`)
+}
+
+// sendNotFound answers like a stock Apache (or nginx, for that header
+// profile) would for a missing file.
+func sendNotFound(w http.ResponseWriter, r *http.Request, profile string) {
+	port := "80"
+	if r.TLS != nil || strings.Contains(r.Header.Get("Cf-Visitor"), "https") {
+		port = "443"
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if profile == "nginx" {
+		w.Header().Set("Server", "nginx")
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<html>\r\n<head><title>404 Not Found</title></head>\r\n<body>\r\n"+
+			"<center><h1>404 Not Found</h1></center>\r\n<hr><center>nginx</center>\r\n</body>\r\n</html>\r\n")
+		return
+	}
+	if profile == "apache" {
+		w.Header().Set("Server", "Apache/2.4.41 (Ubuntu)")
 	}
+	w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>404 Not Found</title>
+</head><body>
+<h1>Not Found</h1>
+<p>The requested URL was not found on this server.</p>
+<hr>
+<address>Apache/2.4.41 (Ubuntu) Server at %s Port %s</address>
+</body></html>
+`, html.EscapeString(host), port)
 }
 
 func main() {
@@ -437,48 +1076,94 @@ func main() {
 	var allowDirect bool
 	var appCommand string
 	var silent bool
+	var quiet bool
 	var redirect string
 	var overrideDest string
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "DarkFlare Server - TCP-over-CDN tunnel server component\n")
-		fmt.Fprintf(os.Stderr, "(c) 2024 Barrett Lyon\n\n")
-		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		fmt.Fprintf(os.Stderr, "  -o        Listen address for the server\n")
-		fmt.Fprintf(os.Stderr, "            Format: proto://[host]:port\n")
-		fmt.Fprintf(os.Stderr, "            Default: http://0.0.0.0:8080\n\n")
-		fmt.Fprintf(os.Stderr, "  -allow-direct\n")
-		fmt.Fprintf(os.Stderr, "            Allow direct connections not coming through Cloudflare\n")
-		fmt.Fprintf(os.Stderr, "            Default: false (only allow Cloudflare IPs)\n\n")
-		fmt.Fprintf(os.Stderr, "  -c        Path to TLS certificate file\n")
-		fmt.Fprintf(os.Stderr, "            Default: Auto-generated self-signed cert\n\n")
-		fmt.Fprintf(os.Stderr, "  -k        Path to TLS private key file\n")
-		fmt.Fprintf(os.Stderr, "            Default: Auto-generated with cert\n\n")
-		fmt.Fprintf(os.Stderr, "  -debug    Enable detailed debug logging\n")
-		fmt.Fprintf(os.Stderr, "            Shows connection details and errors\n\n")
-		fmt.Fprintf(os.Stderr, "  -s        Silent mode\n")
-		fmt.Fprintf(os.Stderr, "            Suppresses all non-error output\n\n")
-		fmt.Fprintf(os.Stderr, "  -redirect Custom URL to redirect unauthorized requests\n")
-		fmt.Fprintf(os.Stderr, "            Default: GitHub project page\n\n")
-		fmt.Fprintf(os.Stderr, "  -override-dest\n")
-		fmt.Fprintf(os.Stderr, "            Override client destination with server-side setting\n")
-		fmt.Fprintf(os.Stderr, "            Format: host:port\n")
-		fmt.Fprintf(os.Stderr, "            Default: Use client-provided destination\n\n")
-		fmt.Fprintf(os.Stderr, "Examples:\n")
-		fmt.Fprintf(os.Stderr, "  Basic setup:\n")
-		fmt.Fprintf(os.Stderr, "    %s -o http://0.0.0.0:8080\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  With custom TLS certificates:\n")
-		fmt.Fprintf(os.Stderr, "    %s -o https://0.0.0.0:443 -c /path/to/cert.pem -k /path/to/key.pem\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  Debug mode with metrics:\n")
-		fmt.Fprintf(os.Stderr, "    %s -o http://0.0.0.0:8080 -debug\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Notes:\n")
-		fmt.Fprintf(os.Stderr, "  - Server accepts destination from client via X-Requested-With header\n")
-		fmt.Fprintf(os.Stderr, "  - Destination validation is performed for security\n")
-		fmt.Fprintf(os.Stderr, "  - Use with Cloudflare as reverse proxy for best security\n\n")
-		fmt.Fprintf(os.Stderr, "For more information: https://github.com/doxx/darkflare\n")
+	var psk string
+	var adminAddr string
+	var adminToken string
+	var viewerToken string
+	var healthPath string
+	var metricsDestLimit int
+	var logFile string
+	var logFormat string
+	var logLevel string
+	var logEncryptKey string
+	var decryptLog string
+	var logIdentity string
+	var noLogDest string
+	var allowDest string
+	var denyDest string
+	var allowPorts string
+	var denyPorts string
+	var mirrors mirrorPolicies
+	var pskKDF string
+	var legacyAuth bool
+	var requireE2E bool
+	var compat string
+	var webClient string
+	var padSizes string
+	var endpointsFile string
+	var compress string
+	var activeHours string
+	var activeTZ string
+	var inviteKey string
+	var inviteDB string
+	var services string
+	var servicesOnly bool
+	var roundRobin string
+	var sticky string
+	var probes string
+	var probeInterval time.Duration
+	var probeGate bool
+	var dupSession string
+	var certUsersFile string
+	var originPullCA string
+	var configFile string
+	var acmeHosts string
+	var acmeEmail string
+	var acmeCache string
+	var acmeHTTP string
+	var trustedProxies string
+	var pathPrefix string
+	var passthrough string
+	var decoySite string
+	var maxCPU float64
+	var drain time.Duration
+	var maxMemory string
+	var fairRate string
+	var fairWeights string
+	var streamPolls time.Duration
+	var udp bool
+	var tunNetwork string
+	var tenantsFile string
+	var zonesFile string
+	var transport string
+	var sensitive string
+	var mfaTOTP string
+	var mfaWebhook string
+	var runAs string
+	var chroot string
+	var sandbox bool
+	var allowExec bool
+
+	if len(os.Args) > 1 && os.Args[1] == "invite" {
+		runInvite(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-zone" {
+		runCheckZone(os.Args[2:])
+		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		runWatch(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		runServiceCommand(os.Args[2:])
+	}
+
+	flag.Usage = usage
 
 	flag.StringVar(&origin, "o", "http://0.0.0.0:8080", "")
 	flag.StringVar(&certFile, "c", "", "")
@@ -487,10 +1172,126 @@ func main() {
 	flag.BoolVar(&debug, "debug", false, "")
 	flag.BoolVar(&allowDirect, "allow-direct", false, "")
 	flag.BoolVar(&silent, "s", false, "")
-	flag.StringVar(&redirect, "redirect", "", "Custom URL to redirect unauthorized requests (default: GitHub project page)")
+	flag.BoolVar(&quiet, "quiet", false, "Log nothing unless -log-file is given, and no banner")
+	flag.StringVar(&redirect, "redirect", "", "Custom URL to redirect unauthorized requests, or 404 (default: GitHub project page)")
+	flag.StringVar(&decoySite, "decoy-site", "", "Serve unauthorized requests a static site from this directory, or builtin")
 	flag.StringVar(&overrideDest, "override-dest", "", "Override destination address (format: host:port)")
+	flag.StringVar(&psk, "psk", "", "Pre-shared keys (format: id:secret[,id:secret...])")
+	flag.StringVar(&adminAddr, "admin", "", "Admin API listen address (format: host:port)")
+	flag.StringVar(&adminToken, "admin-token", "", "Admin API token with full access")
+	flag.StringVar(&viewerToken, "viewer-token", "", "Admin API token with read-only access")
+	flag.StringVar(&healthPath, "health-path", "", "Secret path for health checks on the tunnel listener")
+	flag.IntVar(&metricsDestLimit, "metrics-dest-limit", 10, "Max destination hosts with their own metrics label")
+	flag.StringVar(&logFile, "log-file", "", "Log file path")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format (text or json)")
+	flag.StringVar(&logLevel, "log-level", "", "Log level (debug, info, warn or error)")
+	flag.StringVar(&logEncryptKey, "log-encrypt-key", "", "age recipients to encrypt log lines to")
+	flag.StringVar(&decryptLog, "decrypt-log", "", "Decrypt an encrypted log file and exit")
+	flag.StringVar(&logIdentity, "log-identity", "", "age identity file for -decrypt-log")
+	flag.StringVar(&noLogDest, "nolog-dest", "", "Destination patterns that are never logged")
+	flag.StringVar(&allowDest, "allow-dest", "", "Destination patterns clients may connect to")
+	flag.StringVar(&denyDest, "deny-dest", "", "Destination patterns clients may never connect to")
+	flag.StringVar(&allowPorts, "allow-ports", "", "Ports clients may connect to (e.g. 22,443,8000-8999)")
+	flag.StringVar(&denyPorts, "deny-ports", "", "Ports clients may never connect to (e.g. 25,445)")
+	flag.Var(&mirrors, "mirror", "Mirror matching sessions (filter=tcp://host:port or filter=pcap:/dir)")
+	flag.StringVar(&pskKDF, "psk-kdf", "", "Key derivation for password-style keys (argon2id[:t=,m=,p=])")
+	flag.BoolVar(&legacyAuth, "legacy-auth", false, "Accept unsigned session tokens from old clients")
+	flag.BoolVar(&requireE2E, "require-e2e", false, "Refuse sessions without end-to-end encryption")
+	flag.StringVar(&compat, "compat", "", "Protocol version to serve other clients (v1)")
+	flag.StringVar(&webClient, "web-client", "", "Secret path to serve the browser client at")
+	flag.StringVar(&padSizes, "pad-sizes", "", "Response size histogram to pad to (bytes:weight,...)")
+	flag.StringVar(&endpointsFile, "endpoints", "", "Signed endpoints list to hand to clients (endpoints.json, .sig next to it)")
+	flag.StringVar(&compress, "compress", "zstd,gzip", "Payload compression to use with clients that ask for it (zstd, gzip or off)")
+	flag.StringVar(&activeHours, "active-hours", "", "Availability windows (e.g. Mon-Fri 08:00-18:00)")
+	flag.StringVar(&activeTZ, "active-tz", "Local", "Time zone for -active-hours")
+	flag.StringVar(&inviteKey, "invite-key", os.Getenv("DARKFLARE_INVITE_KEY"), "Invitation signing key")
+	flag.StringVar(&inviteDB, "invite-db", "darkflare-invites.json", "Redeemed invitation database")
+	flag.StringVar(&services, "service", "", "Named services (format: name=host:port[,name=host:port...])")
+	flag.BoolVar(&servicesOnly, "services-only", false, "Only allow named services as destinations")
+	flag.StringVar(&roundRobin, "round-robin", "", "Services whose backends take turns (comma separated)")
+	flag.StringVar(&sticky, "sticky", "", "Services that send each client to the same backend (comma separated)")
+	flag.StringVar(&probes, "probe", "", "Destination health probes (format: dest=tcp|tls|http[:/path]|https[:/path],...)")
+	flag.DurationVar(&probeInterval, "probe-interval", 15*time.Second, "How often to run -probe health probes")
+	flag.BoolVar(&probeGate, "probe-gate", false, "Refuse new sessions to destinations failing their probe")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Addresses allowed to set X-Forwarded-For")
+	flag.StringVar(&pathPrefix, "path-prefix", "", "URL path prefix the tunnel is served under")
+	flag.StringVar(&transport, "transport", "poll", "Transports to accept (poll, ws, h2, h3, sse, batch)")
+	flag.StringVar(&sensitive, "sensitive", "", "Destinations that need a second factor (patterns)")
+	flag.StringVar(&mfaTOTP, "mfa-totp", "", "TOTP secrets file for -sensitive destinations")
+	flag.StringVar(&mfaWebhook, "mfa-webhook", "", "Approval webhook for -sensitive destinations")
+	flag.StringVar(&tenantsFile, "tenants", "", "Tenants file (JSON)")
+	flag.StringVar(&zonesFile, "zones", "", "Per-hostname settings file (JSON)")
+	flag.DurationVar(&drain, "drain", 0, "How long to let sessions finish on SIGTERM before exiting")
+	flag.Float64Var(&maxCPU, "max-cpu", 0, "CPU use in percent above which load is shed")
+	flag.StringVar(&maxMemory, "max-memory", "", "Memory use above which load is shed (e.g. 512MB)")
+	flag.StringVar(&fairRate, "fair-share", "", "Bandwidth per second to share fairly between clients (e.g. 10MB)")
+	flag.StringVar(&fairWeights, "fair-weights", "", "Per-client weights for -fair-share (client=weight,...)")
+	flag.DurationVar(&streamPolls, "stream-polls", 0, "How long to hold polls open and stream into them (e.g. 90s)")
+	flag.BoolVar(&udp, "udp", false, "Relay UDP for -l udp:PORT clients")
+	flag.StringVar(&tunNetwork, "tun", "", "Network to hand -tun clients addresses from (e.g. 10.99.0.0/24)")
+	flag.StringVar(&passthrough, "passthrough", "", "Site to proxy requests outside -path-prefix to")
+	flag.StringVar(&originPullCA, "origin-pull-ca", "", "CA for Cloudflare Authenticated Origin Pulls")
+	flag.StringVar(&acmeHosts, "acme", "", "Hostnames to get Let's Encrypt certificates for")
+	flag.StringVar(&acmeEmail, "acme-email", "", "Contact address for the ACME account")
+	flag.StringVar(&acmeCache, "acme-cache", "", "Directory for ACME certificates and keys")
+	flag.StringVar(&acmeHTTP, "acme-http", "", "Address to answer ACME HTTP-01 challenges on (e.g. :80)")
+	flag.StringVar(&certUsersFile, "cert-users", "", "Client certificate users file")
+	flag.StringVar(&dupSession, "dup-session", "share", "Duplicate session policy (share, reject, takeover, parallel)")
+	flag.StringVar(&runAs, "user", "", "User to drop to after binding (user[:group])")
+	flag.StringVar(&chroot, "chroot", "", "Directory to confine the server to after binding")
+	flag.BoolVar(&sandbox, "sandbox", false, "Restrict file writes and syscalls after binding (Linux)")
+	flag.BoolVar(&allowExec, "allow-exec", false, "Let -a run its command under -sandbox")
+	flag.StringVar(&configFile, "config", "", "Config file (YAML)")
 	flag.Parse()
 
+	if configFile != "" {
+		if err := loadConfig(configFile); err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+	}
+
+	if decryptLog != "" {
+		if logIdentity == "" {
+			log.Fatal("-decrypt-log requires -log-identity")
+		}
+		if err := decryptLogFile(decryptLog, logIdentity, os.Stdout); err != nil {
+			log.Fatalf("Failed to decrypt log: %v", err)
+		}
+		return
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		logOutput = f
+		if logEncryptKey != "" {
+			w, err := newEncryptedLogWriter(f, logEncryptKey)
+			if err != nil {
+				log.Fatalf("Invalid -log-encrypt-key: %v", err)
+			}
+			logOutput = w
+		}
+	} else if logEncryptKey != "" {
+		log.Fatal("-log-encrypt-key requires -log-file")
+	} else if quiet {
+		// Logs only go where the operator asked for them
+		logOutput = io.Discard
+	}
+	if logLevel == "" {
+		logLevel = "info"
+		if debug {
+			logLevel = "debug"
+		}
+	} else if strings.EqualFold(logLevel, "debug") {
+		debug = true
+	}
+	if err := setupLogging(logOutput, logFormat, logLevel); err != nil {
+		log.Fatalf("Invalid logging options: %v", err)
+	}
+
 	// Parse origin URL
 	originURL, err := url.Parse(origin)
 	if err != nil {
@@ -498,22 +1299,29 @@ func main() {
 	}
 
 	// Validate scheme
-	if originURL.Scheme != "http" && originURL.Scheme != "https" {
-		log.Fatal("Origin scheme must be either 'http' or 'https'")
+	if originURL.Scheme != "http" && originURL.Scheme != "https" && originURL.Scheme != "unix" {
+		log.Fatal("Origin scheme must be either 'http', 'https' or 'unix'")
 	}
 
-	// Validate and extract host/port
-	originHost, originPort, err := net.SplitHostPort(originURL.Host)
-	if err != nil {
-		log.Fatalf("Invalid origin address: %v", err)
-	}
+	var originHost, originPort string
+	if originURL.Scheme == "unix" {
+		if originURL.Path == "" {
+			log.Fatal("Unix socket origin needs a path, e.g. unix:///run/darkflare.sock")
+		}
+	} else {
+		// Validate and extract host/port
+		originHost, originPort, err = net.SplitHostPort(originURL.Host)
+		if err != nil {
+			log.Fatalf("Invalid origin address: %v", err)
+		}
 
-	// Validate IP is local
-	if !isLocalIP(originHost) {
-		log.Fatal("Origin host must be a local IP address")
+		// Validate IP is local
+		if !isLocalIP(originHost) {
+			log.Fatal("Origin host must be a local IP address")
+		}
 	}
 
-	if !silent {
+	if !silent && !quiet {
 		log.Printf("DarkFlare server listening on %s", origin)
 	}
 
@@ -527,42 +1335,485 @@ func main() {
 		}
 	}
 
+	lock := &lockdown{user: runAs, chroot: chroot, sandbox: sandbox, allowExec: allowExec}
+	if err := lock.validate(appCommand != ""); err != nil {
+		log.Fatal(err)
+	}
+
 	server := NewServer(originHost, originPort, appCommand, debug, allowDirect, silent, redirect, overrideDest)
+	server.metrics = newMetrics(server, metricsDestLimit)
+
+	if activeHours != "" {
+		location, err := time.LoadLocation(activeTZ)
+		if err != nil {
+			log.Fatalf("Invalid -active-tz: %v", err)
+		}
+		sched, err := parseSchedule(activeHours, location)
+		if err != nil {
+			log.Fatalf("Invalid -active-hours: %v", err)
+		}
+		server.schedule = sched
+		if !silent {
+			log.Printf("Tunnel active during: %s (%s)", activeHours, location)
+		}
+	}
+
+	if padSizes != "" {
+		padding, err := parsePadHistogram(padSizes)
+		if err != nil {
+			log.Fatalf("Invalid -pad-sizes: %v", err)
+		}
+		server.padding = padding
+	}
+
+	if endpointsFile != "" {
+		if _, err := readEndpoints(endpointsFile); err != nil {
+			log.Fatalf("Invalid -endpoints: %v", err)
+		}
+		server.endpointsFile = endpointsFile
+	}
+
+	server.compression, err = parseCompression(compress)
+	if err != nil {
+		log.Fatalf("Invalid -compress: %v", err)
+	}
+
+	policy, err := parseDupPolicy(dupSession)
+	if err != nil {
+		log.Fatalf("Invalid -dup-session: %v", err)
+	}
+	server.dupSessions = policy
+
+	if services != "" {
+		catalog, err := parseServices(services)
+		if err != nil {
+			log.Fatalf("Invalid -service: %v", err)
+		}
+		if err := setRoundRobin(catalog, roundRobin); err != nil {
+			log.Fatalf("Invalid -round-robin: %v", err)
+		}
+		if err := setSticky(catalog, sticky); err != nil {
+			log.Fatalf("Invalid -sticky: %v", err)
+		}
+		server.services = catalog
+		server.metrics.registry.MustRegister(servicesCollector(catalog))
+		if !silent {
+			log.Printf("Serving %d named services", len(catalog))
+		}
+	}
+	if roundRobin != "" && services == "" {
+		log.Fatal("-round-robin requires -service")
+	}
+	if sticky != "" && services == "" {
+		log.Fatal("-sticky requires -service")
+	}
+	if servicesOnly {
+		if services == "" {
+			log.Fatal("-services-only requires -service")
+		}
+		server.servicesOnly = true
+	}
+	if probes != "" {
+		set, err := parseProbes(probes, server.services)
+		if err != nil {
+			log.Fatalf("Invalid -probe: %v", err)
+		}
+		if probeInterval <= 0 {
+			log.Fatalf("Invalid -probe-interval: %s", probeInterval)
+		}
+		set.interval = probeInterval
+		set.gate = probeGate
+		server.probes = set
+		server.metrics.registry.MustRegister(set)
+		go set.run()
+	} else if probeGate {
+		log.Fatal("-probe-gate requires -probe")
+	}
+
+	if noLogDest != "" {
+		matcher, err := parseDestMatcher(noLogDest)
+		if err != nil {
+			log.Fatalf("Invalid -nolog-dest: %v", err)
+		}
+		server.noLogDests = matcher
+	}
+	if allowDest != "" || denyDest != "" || allowPorts != "" || denyPorts != "" {
+		server.destPolicy = &destPolicy{}
+		if allowDest != "" {
+			if server.destPolicy.allow, err = parseDestMatcher(allowDest); err != nil {
+				log.Fatalf("Invalid -allow-dest: %v", err)
+			}
+		}
+		if denyDest != "" {
+			if server.destPolicy.deny, err = parseDestMatcher(denyDest); err != nil {
+				log.Fatalf("Invalid -deny-dest: %v", err)
+			}
+		}
+		if allowPorts != "" {
+			if server.destPolicy.allowPorts, err = parsePortSet(allowPorts); err != nil {
+				log.Fatalf("Invalid -allow-ports: %v", err)
+			}
+		}
+		if denyPorts != "" {
+			if server.destPolicy.denyPorts, err = parsePortSet(denyPorts); err != nil {
+				log.Fatalf("Invalid -deny-ports: %v", err)
+			}
+		}
+	}
+	server.mirrors = mirrors
+	for _, policy := range mirrors {
+		if policy.sink.Scheme == "pcap" {
+			lock.allowWrites(policy.sink.Opaque + policy.sink.Path)
+		}
+	}
+
+	if psk != "" || tenantsFile != "" {
+		var keys *keyRing
+		if psk != "" {
+			keys, err = parseKeyRing(psk)
+			if err != nil {
+				log.Fatalf("Invalid -psk: %v", err)
+			}
+		}
+		if tenantsFile != "" {
+			keys, server.tenants, err = loadTenants(tenantsFile, keys)
+			if err != nil {
+				log.Fatalf("Invalid -tenants: %v", err)
+			}
+		}
+		if pskKDF != "" {
+			params, err := parseKDF(pskKDF)
+			if err != nil {
+				log.Fatalf("Invalid -psk-kdf: %v", err)
+			}
+			keys.derive(params)
+		}
+		server.keys = keys
+		if !silent {
+			log.Printf("Client authentication enabled (keys: %s)", strings.Join(keys.order, ", "))
+		}
+	}
+	if zonesFile != "" {
+		server.zones, err = loadZones(zonesFile, server.keys)
+		if err != nil {
+			log.Fatalf("Invalid -zones: %v", err)
+		}
+		if pskKDF != "" {
+			params, err := parseKDF(pskKDF)
+			if err != nil {
+				log.Fatalf("Invalid -psk-kdf: %v", err)
+			}
+			server.zones.derive(params)
+		}
+		if server.zones.hasPassthrough() && pathPrefix == "" {
+			log.Fatal("A zone with passthrough requires -path-prefix")
+		}
+		if !silent {
+			log.Printf("Serving %d zones", len(server.zones.byHost))
+		}
+	}
+
+	server.legacyAuth = legacyAuth
+	server.requireE2E = requireE2E
+	if compat != "" && compat != compatV1 {
+		log.Fatalf("Invalid -compat: unknown protocol version %q (use v1)", compat)
+	}
+	server.compat = compat
+	if webClient != "" {
+		if compat != compatV1 {
+			log.Fatalf("Invalid -web-client: needs -compat v1, the page speaks protocol v1")
+		}
+		server.webClientPath = cleanWebClientPath(webClient)
+	}
+
+	server.unixSocket = originURL.Scheme == "unix"
+	if server.unixSocket {
+		server.listenNetwork, server.listenAddr = "unix", originURL.Path
+	} else {
+		server.listenNetwork, server.listenAddr = "tcp", localDialAddr(originHost, originPort)
+	}
+	if healthPath != "" {
+		server.healthPath = "/" + strings.Trim(healthPath, "/")
+	}
+	if trustedProxies != "" {
+		proxies, err := parseDestMatcher(trustedProxies)
+		if err != nil {
+			log.Fatalf("Invalid -trusted-proxies: %v", err)
+		}
+		server.trustedProxies = proxies
+	}
+
+	if sensitive != "" {
+		matcher, err := parseDestMatcher(sensitive)
+		if err != nil {
+			log.Fatalf("Invalid -sensitive: %v", err)
+		}
+		if mfaTOTP == "" && mfaWebhook == "" {
+			log.Fatal("-sensitive requires -mfa-totp and/or -mfa-webhook")
+		}
+		var secrets map[string][]byte
+		if mfaTOTP != "" {
+			if secrets, err = loadTOTPSecrets(mfaTOTP); err != nil {
+				log.Fatalf("Invalid -mfa-totp: %v", err)
+			}
+		}
+		if mfaWebhook != "" {
+			if u, err := url.Parse(mfaWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				log.Fatalf("Invalid -mfa-webhook: %s", mfaWebhook)
+			}
+		}
+		server.stepUp = newStepUp(matcher, secrets, mfaWebhook)
+	} else if mfaTOTP != "" || mfaWebhook != "" {
+		log.Fatal("-mfa-totp and -mfa-webhook need -sensitive")
+	}
+
+	for _, t := range strings.Split(transport, ",") {
+		switch strings.TrimSpace(t) {
+		case "poll":
+		case "ws":
+			server.websockets = true
+		case "h2":
+			server.h2streams = true
+		case "h3":
+			if !haveH3 {
+				log.Fatal("-transport h3 isn't in this build (built with -tags noh3)")
+			}
+			if originURL.Scheme != "https" {
+				log.Fatal("-transport h3 needs an https origin")
+			}
+			server.h3streams = true
+		case "sse":
+			server.sse = true
+		case "batch":
+			server.batches = true
+		default:
+			log.Fatalf("Invalid -transport: %s (use poll, ws, h2, h3, sse and/or batch)", t)
+		}
+	}
+	if streamPolls < 0 {
+		log.Fatalf("Invalid -stream-polls: %s", streamPolls)
+	}
+	server.streamPolls = streamPolls
+	server.udp = udp
+	if tunNetwork != "" {
+		tun, err := newTunServer(tunNetwork)
+		if err != nil {
+			log.Fatalf("Invalid -tun: %v", err)
+		}
+		server.tun = tun
+		log.Printf("TUN device %s up as %s", tun.name, netip.PrefixFrom(tun.gateway, tun.network.Bits()))
+	}
+
+	if maxCPU > 0 || maxMemory != "" {
+		var memoryLimit uint64
+		if maxMemory != "" {
+			limit, err := parseByteSize(maxMemory)
+			if err != nil {
+				log.Fatalf("Invalid -max-memory: %v", err)
+			}
+			memoryLimit = uint64(limit)
+		}
+		server.shedder = newLoadShedder(maxCPU, memoryLimit, silent)
+	}
+
+	if fairRate != "" {
+		rate, err := parseByteSize(fairRate)
+		if err != nil {
+			log.Fatalf("Invalid -fair-share: %v", err)
+		}
+		weights, err := parseFairWeights(fairWeights)
+		if err != nil {
+			log.Fatalf("Invalid -fair-weights: %v", err)
+		}
+		server.fair = newFairShare(rate, weights)
+	} else if fairWeights != "" {
+		log.Fatal("-fair-weights requires -fair-share")
+	}
+
+	if passthrough != "" {
+		if pathPrefix == "" {
+			log.Fatal("-passthrough requires -path-prefix")
+		}
+		proxy, err := newPassthrough(passthrough)
+		if err != nil {
+			log.Fatalf("Invalid -passthrough: %v", err)
+		}
+		server.passthrough = proxy
+	}
+	if decoySite != "" {
+		if server.decoySite, err = newDecoySite(decoySite); err != nil {
+			log.Fatalf("Invalid -decoy-site: %v", err)
+		}
+	}
+
+	if certUsersFile != "" {
+		users, err := loadCertUsers(certUsersFile)
+		if err != nil {
+			log.Fatalf("Invalid -cert-users: %v", err)
+		}
+		server.certUsers = users
+		if !silent {
+			log.Printf("Client certificate authentication enabled")
+		}
+	}
+
+	if inviteKey != "" {
+		invites, err := newInviteAuthority(inviteKey, inviteDB)
+		if err != nil {
+			log.Fatalf("Failed to load -invite-db: %v", err)
+		}
+		server.invites = invites
+		lock.allowWrites(filepath.Dir(inviteDB))
+		if !silent {
+			log.Printf("Client invitations enabled (redeemed list: %s)", inviteDB)
+		}
+	}
 
-	log.Printf("DarkFlare server running on %s://%s:%s", originURL.Scheme, originHost, originPort)
+	if adminAddr != "" {
+		if adminToken == "" && viewerToken == "" {
+			log.Fatal("Admin API requires -admin-token and/or -viewer-token")
+		}
+		if adminToken != "" && adminToken == viewerToken {
+			log.Fatal("-admin-token and -viewer-token must differ")
+		}
+		server.breakGlass = newBreakGlass()
+		newAdminAPI(server, adminToken, viewerToken).listenAndServe(adminAddr)
+	}
+
+	if !quiet {
+		if originURL.Scheme == "unix" {
+			log.Printf("DarkFlare server running on %s", origin)
+		} else {
+			log.Printf("DarkFlare server running on %s://%s:%s", originURL.Scheme, originHost, originPort)
+		}
+	}
 	if allowDirect {
-		log.Printf("Warning: Direct connections allowed (no Cloudflare required)")
+		slog.Warn("Direct connections allowed (no Cloudflare required)")
+	}
+	if requireE2E && server.keys == nil && !server.zones.allKeyed() && server.invites == nil {
+		log.Fatal("-require-e2e needs -psk, -tenants or -invite-key, the encryption keys are derived from them")
+	}
+	if endpointsFile != "" && server.keys == nil && !server.zones.allKeyed() && server.certUsers == nil && server.invites == nil {
+		log.Fatal("-endpoints needs -psk, -tenants, -cert-users or -invite-key, only clients that authenticate get the list")
+	}
+	if server.keys == nil && !server.zones.allKeyed() && server.certUsers == nil && server.invites == nil {
+		slog.Warn("No client authentication (-psk, -tenants, -cert-users or -invite-key), anyone who finds this server can use it")
+	}
+
+	if originPullCA != "" && originURL.Scheme != "https" {
+		log.Fatal("-origin-pull-ca requires an https origin")
+	}
+	if certUsersFile != "" && originPullCA == "" && !server.unixSocket && server.trustedProxies == nil {
+		log.Fatal("-cert-users needs -origin-pull-ca, a unix socket origin or -trusted-proxies, anyone reaching the origin directly could forge the certificate headers otherwise")
+	}
+	server.originPulls = originPullCA != ""
+	if acmeHosts != "" {
+		if originURL.Scheme != "https" {
+			log.Fatal("-acme requires an https origin")
+		}
+		if certFile != "" || keyFile != "" {
+			log.Fatal("-acme replaces -c and -k, use one or the other")
+		}
+	} else if acmeEmail != "" || acmeCache != "" || acmeHTTP != "" {
+		log.Fatal("-acme-email, -acme-cache and -acme-http require -acme")
+	}
+
+	if drain < 0 {
+		log.Fatal("Invalid -drain: must not be negative")
+	}
+	if drain > 0 {
+		go server.drainOnSignal(drain)
+	}
+
+	var handler http.Handler = http.HandlerFunc(server.handleRequest)
+	if pathPrefix != "" {
+		handler = server.mountAt(pathPrefix, handler)
+	}
+	serveHTTP3 := server.h3streams
+
+	// A systemd .socket unit may have bound the listener for us
+	listener, err := systemdListener()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if listener != nil {
+		log.Printf("Listening on %s from systemd", listener.Addr())
+		server.listenNetwork = listener.Addr().Network()
+		server.listenAddr = listener.Addr().String()
+		if host, port, err := net.SplitHostPort(server.listenAddr); err == nil {
+			server.listenAddr = localDialAddr(host, port)
+		}
 	}
 
 	// Start server with appropriate protocol
-	if originURL.Scheme == "https" {
-		if certFile == "" || keyFile == "" {
-			log.Fatal("HTTPS requires both certificate (-c) and key (-k) files")
+	if originURL.Scheme == "unix" {
+		if listener == nil {
+			if listener, err = listenUnix(originURL.Path); err != nil {
+				log.Fatalf("Failed to listen on %s: %v", originURL.Path, err)
+			}
+		}
+		lock.apply()
+		sdNotify("READY=1")
+		log.Fatal(http.Serve(listener, handler))
+	} else if originURL.Scheme == "https" {
+		// Load and verify certificates, and again whenever they're renewed
+		var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+		nextProtos := []string{"h2", "http/1.1"}
+		if acmeHosts != "" {
+			manager, err := newACMEManager(acmeHosts, acmeEmail, acmeCache)
+			if err != nil {
+				log.Fatalf("Invalid -acme: %v", err)
+			}
+			if acmeHTTP != "" {
+				serveACMEChallenges(manager, acmeHTTP)
+			}
+			if cache, ok := manager.Cache.(autocert.DirCache); ok {
+				lock.allowWrites(string(cache))
+			}
+			getCertificate = manager.GetCertificate
+			nextProtos = append(nextProtos, acme.ALPNProto)
+			log.Printf("Certificates for %s come from Let's Encrypt", acmeHosts)
+		} else {
+			if certFile == "" || keyFile == "" {
+				log.Fatal("HTTPS requires both certificate (-c) and key (-k) files, or -acme")
+			}
+			certs, err := newCertReloader(certFile, keyFile)
+			if err != nil {
+				log.Fatalf("Failed to load certificate and key: %v", err)
+			}
+			go certs.watch()
+			getCertificate = certs.getCertificate
 		}
 
-		// Load and verify certificates
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			log.Fatalf("Failed to load certificate and key: %v", err)
+		// Only accept connections from Cloudflare when origin pulls are enforced
+		clientAuth := tls.NoClientCert
+		var clientCAs *x509.CertPool
+		if originPullCA != "" {
+			clientCAs, err = loadOriginPullCA(originPullCA)
+			if err != nil {
+				log.Fatalf("Invalid -origin-pull-ca: %v", err)
+			}
+			clientAuth = tls.RequireAndVerifyClientCert
+			log.Printf("Authenticated Origin Pulls enforced")
 		}
 
 		server := &http.Server{
 			Addr:    fmt.Sprintf("%s:%s", originHost, originPort),
-			Handler: http.HandlerFunc(server.handleRequest),
+			Handler: handler,
 			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				MinVersion:   tls.VersionTLS12,
-				MaxVersion:   tls.VersionTLS13,
+				MinVersion: tls.VersionTLS12,
+				MaxVersion: tls.VersionTLS13,
 				// Allow any cipher suites
 				CipherSuites: nil,
-				// Don't verify client certs
-				ClientAuth: tls.NoClientCert,
+				// Client certs are only checked for Authenticated Origin Pulls
+				ClientAuth: clientAuth,
+				ClientCAs:  clientCAs,
 				// Handle SNI
 				GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
 					if debug {
 						log.Printf("Client requesting certificate for server name: %s", info.ServerName)
 					}
-					return &cert, nil
+					return getCertificate(info)
 				},
 				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
 					if debug {
@@ -588,10 +1839,10 @@ func main() {
 					}
 					return nil
 				},
-				// Enable HTTP/2 support
-				NextProtos: []string{"h2", "http/1.1"},
+				// Enable HTTP/2 support, and TLS-ALPN-01 for -acme
+				NextProtos: nextProtos,
 			},
-			ErrorLog: log.New(os.Stderr, "[HTTPS] ", log.LstdFlags),
+			ErrorLog: log.New(log.Writer(), "[HTTPS] ", log.LstdFlags),
 			ConnState: func(conn net.Conn, state http.ConnState) {
 				if debug {
 					log.Printf("Connection state changed to %s from %s",
@@ -605,18 +1856,37 @@ func main() {
 			log.Printf("TLS Configuration:")
 			log.Printf("  Minimum Version: %x", server.TLSConfig.MinVersion)
 			log.Printf("  Maximum Version: %x", server.TLSConfig.MaxVersion)
-			log.Printf("  Certificates Loaded: %d", len(server.TLSConfig.Certificates))
+			if acmeHosts == "" {
+				log.Printf("  Certificate: %s (reloaded when it changes or on SIGHUP)", certFile)
+			}
 			log.Printf("  Listening Address: %s", server.Addr)
 			log.Printf("  Supported Protocols: %v", server.TLSConfig.NextProtos)
 		}
 
-		log.Fatal(server.ListenAndServeTLS(certFile, keyFile))
+		if serveHTTP3 {
+			listenHTTP3(server.Addr, server.TLSConfig, handler)
+		}
+		if listener == nil {
+			if listener, err = net.Listen("tcp", server.Addr); err != nil {
+				log.Fatal(err)
+			}
+		}
+		lock.apply()
+		sdNotify("READY=1")
+		log.Fatal(server.ServeTLS(listener, "", ""))
 	} else {
 		server := &http.Server{
 			Addr:    fmt.Sprintf("%s:%s", originHost, originPort),
-			Handler: http.HandlerFunc(server.handleRequest),
+			Handler: handler,
 		}
-		log.Fatal(server.ListenAndServe())
+		if listener == nil {
+			if listener, err = net.Listen("tcp", server.Addr); err != nil {
+				log.Fatal(err)
+			}
+		}
+		lock.apply()
+		sdNotify("READY=1")
+		log.Fatal(server.Serve(listener))
 	}
 }
 
@@ -667,6 +1937,20 @@ func isLocalIP(ip string) bool {
 	return false
 }
 
+// isValidSessionID accepts what clients, Cf-Ray and client addresses use
+// as session IDs: up to 64 letters, digits, dots, colons and dashes.
+func isValidSessionID(id string) bool {
+	if len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && c != '.' && c != ':' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
 func isValidDestination(dest string) bool {
 	host, portStr, err := net.SplitHostPort(dest)
 	if err != nil {
@@ -693,9 +1977,3 @@ func isValidDestination(dest string) bool {
 	ips, err := net.LookupHost(host)
 	return err == nil && len(ips) > 0
 }
-
-func (s *Server) logf(format string, v ...interface{}) {
-	if !s.silent {
-		log.Printf(format, v...)
-	}
-}
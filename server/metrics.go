@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// destPromoteAfter is how many sessions a destination host needs before
+	// it is considered for its own label.
+	destPromoteAfter = 3
+	// destHashBuckets is the number of "other-NN" labels rare destinations
+	// are hashed into.
+	destHashBuckets = 16
+	// destTrackLimit bounds how many not-yet-promoted hosts are counted.
+	destTrackLimit = 4096
+	// privateDestLabel stands in for destinations excluded from logging.
+	privateDestLabel = "private"
+)
+
+// destLabeler maps destination hosts to metric label values. At most limit
+// hosts get a label of their own; everything else is hashed into a fixed set
+// of buckets so the number of series stays bounded no matter what clients
+// ask for.
+type destLabeler struct {
+	mu       sync.Mutex
+	limit    int
+	promoted map[string]bool
+	seen     map[string]int
+}
+
+func newDestLabeler(limit int) *destLabeler {
+	return &destLabeler{
+		limit:    limit,
+		promoted: make(map[string]bool),
+		seen:     make(map[string]int),
+	}
+}
+
+// observe records a new session to host and returns its label.
+func (d *destLabeler) observe(host string) string {
+	if host == privateDestLabel {
+		return host
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.promoted[host] {
+		return host
+	}
+	if len(d.promoted) < d.limit {
+		count, tracked := d.seen[host]
+		if tracked || len(d.seen) < destTrackLimit {
+			count++
+			d.seen[host] = count
+		}
+		if count >= destPromoteAfter {
+			delete(d.seen, host)
+			d.promoted[host] = true
+			return host
+		}
+	}
+	return hashedDestLabel(host)
+}
+
+// label returns the current label for host without counting a session.
+func (d *destLabeler) label(host string) string {
+	if host == privateDestLabel {
+		return host
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.promoted[host] {
+		return host
+	}
+	return hashedDestLabel(host)
+}
+
+func hashedDestLabel(host string) string {
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return fmt.Sprintf("other-%02d", h.Sum32()%destHashBuckets)
+}
+
+type metrics struct {
+	registry        *prometheus.Registry
+	dests           *destLabeler
+	sessionsTotal   *prometheus.CounterVec
+	bytesTotal      *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	authFailures    prometheus.Counter
+	shedRejections  prometheus.Counter
+	badChecksums    *prometheus.CounterVec
+	resentBytes     prometheus.Counter
+	colos           *coloStats
+}
+
+func newMetrics(s *Server, destLimit int) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		dests:    newDestLabeler(destLimit),
+		colos:    newColoStats(),
+		sessionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "darkflare_sessions_total",
+			Help: "Tunnel sessions opened, by tenant and destination host.",
+		}, []string{"tenant", "destination"}),
+		bytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "darkflare_bytes_total",
+			Help: "Tunneled payload bytes, by direction, tenant and destination host.",
+		}, []string{"direction", "tenant", "destination"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "darkflare_request_duration_seconds",
+			Help:    "Tunnel request handling time, by method and destination host.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .15, .25, .5, 1, 2.5},
+		}, []string{"method", "destination"}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "darkflare_auth_failures_total",
+			Help: "Requests rejected for a missing or invalid pre-shared key.",
+		}),
+		shedRejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "darkflare_shed_rejections_total",
+			Help: "New sessions refused while shedding load.",
+		}),
+		badChecksums: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "darkflare_checksum_failures_total",
+			Help: "Payloads that arrived corrupted and were sent again, by direction.",
+		}, []string{"direction"}),
+		resentBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "darkflare_resent_bytes_total",
+			Help: "Poll data sent again because the client didn't get it the first time.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.sessionsTotal,
+		m.bytesTotal,
+		m.requestDuration,
+		m.authFailures,
+		m.shedRejections,
+		m.badChecksums,
+		m.resentBytes,
+		m.colos,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "darkflare_shed_level",
+			Help: "Load shedding level: 0 none, 1 refusing new sessions, 2 also throttling bulk transfers.",
+		}, func() float64 {
+			return float64(s.shedder.current())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "darkflare_active_sessions",
+			Help: "Currently open tunnel sessions.",
+		}, func() float64 {
+			count := 0
+			s.sessions.Range(func(key, value interface{}) bool {
+				count++
+				return true
+			})
+			return float64(count)
+		}),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+func (m *metrics) sessionOpened(tenant, host string) {
+	m.sessionsTotal.WithLabelValues(tenant, m.dests.observe(host)).Inc()
+}
+
+func (m *metrics) addBytes(direction, tenant, host string, n int) {
+	m.bytesTotal.WithLabelValues(direction, tenant, m.dests.label(host)).Add(float64(n))
+}
+
+// observeRequest records the request duration with the session ID attached
+// as an exemplar, so a slow bucket can be traced back to a session. Methods
+// other than GET and POST share one label, since clients pick the method.
+func (m *metrics) observeRequest(method, host, sessionID string, start time.Time) {
+	if method != http.MethodGet && method != http.MethodPost {
+		method = "other"
+	}
+	observer := m.requestDuration.WithLabelValues(method, m.dests.label(host))
+	elapsed := time.Since(start).Seconds()
+	if len(sessionID) >= 8 && host != privateDestLabel {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(elapsed, prometheus.Labels{"session": sessionID[:8]})
+		return
+	}
+	observer.Observe(elapsed)
+}
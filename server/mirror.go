@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mirrorQueue is how many chunks a mirror may fall behind before copies are
+// dropped. Mirroring never slows down the session itself.
+const mirrorQueue = 256
+
+// mirrorPolicy copies the traffic of sessions matching a capture filter to
+// a sink: "tcp://host:port" gets what the client sends upstream, "pcap:/dir"
+// gets a capture file per session with both directions.
+type mirrorPolicy struct {
+	filter captureFilter
+	sink   *url.URL
+}
+
+// mirrorPolicies is the repeatable -mirror flag.
+type mirrorPolicies []mirrorPolicy
+
+func (m *mirrorPolicies) String() string {
+	return ""
+}
+
+func (m *mirrorPolicies) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expected filter=sink, got %q", value)
+	}
+	filter, err := parseCaptureFilter(value[:i])
+	if err != nil {
+		return err
+	}
+	sink := value[i+1:]
+	u, err := url.Parse(sink)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return fmt.Errorf("invalid mirror address %q", u.Host)
+		}
+	case "pcap":
+		dir := u.Opaque + u.Path
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("capture directory %q doesn't exist", dir)
+		}
+	default:
+		return fmt.Errorf("unsupported mirror sink %q (use tcp://host:port or pcap:/dir)", sink)
+	}
+	*m = append(*m, mirrorPolicy{filter: filter, sink: u})
+	return nil
+}
+
+// forSession returns the sinks whose filters select a session.
+func (m mirrorPolicies) forSession(facts *sessionFacts) []*url.URL {
+	var sinks []*url.URL
+	for _, p := range m {
+		if p.filter(facts) {
+			sinks = append(sinks, p.sink)
+		}
+	}
+	return sinks
+}
+
+type mirrorChunk struct {
+	upstream bool
+	data     []byte
+}
+
+// mirrorSink receives copies of a session's traffic.
+type mirrorSink interface {
+	write(chunk mirrorChunk) error
+	close()
+}
+
+// mirrorConn wraps a session's upstream connection and queues a copy of
+// everything written to or read from it for the sinks.
+type mirrorConn struct {
+	net.Conn
+	queue     chan mirrorChunk
+	dropped   atomic.Int64
+	closeOnce sync.Once
+}
+
+func (s *Server) mirror(conn net.Conn, sinks []*url.URL, clientIP, sessionID string) net.Conn {
+	m := &mirrorConn{Conn: conn, queue: make(chan mirrorChunk, mirrorQueue)}
+	var opened []mirrorSink
+	for _, u := range sinks {
+		sink, err := openMirrorSink(u, conn, clientIP, sessionID)
+		if err != nil {
+			slog.Warn("Mirror failed", "session", shortID(sessionID), "mirror", u, "err", err)
+			continue
+		}
+		s.info("Mirror", "session", shortID(sessionID), "mirror", u)
+		opened = append(opened, sink)
+	}
+	if len(opened) == 0 {
+		return conn
+	}
+
+	go func() {
+		for chunk := range m.queue {
+			for i, sink := range opened {
+				if sink == nil {
+					continue
+				}
+				if err := sink.write(chunk); err != nil {
+					slog.Warn("Mirror stopped", "session", shortID(sessionID), "err", err)
+					sink.close()
+					opened[i] = nil
+				}
+			}
+		}
+		for _, sink := range opened {
+			if sink != nil {
+				sink.close()
+			}
+		}
+		if dropped := m.dropped.Load(); dropped > 0 {
+			slog.Warn("Mirror dropped chunks, sink too slow", "session", shortID(sessionID), "chunks", dropped)
+		}
+	}()
+	return m
+}
+
+func (m *mirrorConn) record(upstream bool, p []byte) {
+	chunk := mirrorChunk{upstream: upstream, data: append([]byte(nil), p...)}
+	select {
+	case m.queue <- chunk:
+	default:
+		m.dropped.Add(1)
+	}
+}
+
+func (m *mirrorConn) Write(p []byte) (int, error) {
+	n, err := m.Conn.Write(p)
+	if n > 0 {
+		m.record(true, p[:n])
+	}
+	return n, err
+}
+
+func (m *mirrorConn) Read(p []byte) (int, error) {
+	n, err := m.Conn.Read(p)
+	if n > 0 {
+		m.record(false, p[:n])
+	}
+	return n, err
+}
+
+func (m *mirrorConn) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.queue)
+	})
+	return m.Conn.Close()
+}
+
+func openMirrorSink(u *url.URL, conn net.Conn, clientIP, sessionID string) (mirrorSink, error) {
+	if u.Scheme == "tcp" {
+		c, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpMirror{conn: c}, nil
+	}
+
+	name := fmt.Sprintf("%s-%s.pcap", time.Now().UTC().Format("20060102-150405"), shortID(sessionID))
+	f, err := os.OpenFile(filepath.Join(u.Opaque+u.Path, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	p := newPcapMirror(f, clientIP, conn.RemoteAddr())
+	if err := p.start(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// tcpMirror forwards the client's side of the conversation, as is.
+type tcpMirror struct {
+	conn net.Conn
+}
+
+func (t *tcpMirror) write(chunk mirrorChunk) error {
+	if !chunk.upstream {
+		return nil
+	}
+	t.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := t.conn.Write(chunk.data)
+	return err
+}
+
+func (t *tcpMirror) close() {
+	t.conn.Close()
+}
+
+// pcapMirror writes the session as a synthetic TCP flow between the client
+// and the destination, so Wireshark or an IDS can take it apart like a
+// normal capture. Non-IPv4 addresses are replaced with documentation ones.
+type pcapMirror struct {
+	f   *os.File
+	w   *bufio.Writer
+	src net.IP
+	dst net.IP
+
+	srcPort, dstPort uint16
+	clientSeq        uint32
+	serverSeq        uint32
+}
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	pcapMaxSegment = 16 * 1024
+)
+
+func newPcapMirror(f *os.File, clientIP string, upstream net.Addr) *pcapMirror {
+	p := &pcapMirror{
+		f:       f,
+		w:       bufio.NewWriter(f),
+		src:     net.IPv4(192, 0, 2, 1).To4(),
+		dst:     net.IPv4(198, 51, 100, 1).To4(),
+		srcPort: 40000,
+		dstPort: 80,
+	}
+	host, port, err := net.SplitHostPort(clientIP)
+	if err != nil {
+		host = clientIP
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		p.src = ip
+	}
+	if n, err := strconv.Atoi(port); err == nil {
+		p.srcPort = uint16(n)
+	}
+	if tcp, ok := upstream.(*net.TCPAddr); ok {
+		if ip := tcp.IP.To4(); ip != nil {
+			p.dst = ip
+		}
+		p.dstPort = uint16(tcp.Port)
+	}
+	// Any stable initial sequence numbers will do
+	p.clientSeq = crc32.ChecksumIEEE([]byte(clientIP))
+	p.serverSeq = crc32.ChecksumIEEE([]byte(upstream.String()))
+	return p
+}
+
+// start writes the file header and a three-way handshake.
+func (p *pcapMirror) start() error {
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], 101) // LINKTYPE_RAW
+	if _, err := p.w.Write(header[:]); err != nil {
+		return err
+	}
+	p.packet(true, tcpSYN, nil)
+	p.clientSeq++
+	p.packet(false, tcpSYN|tcpACK, nil)
+	p.serverSeq++
+	p.packet(true, tcpACK, nil)
+	return p.w.Flush()
+}
+
+func (p *pcapMirror) write(chunk mirrorChunk) error {
+	for data := chunk.data; len(data) > 0; {
+		n := min(len(data), pcapMaxSegment)
+		p.packet(chunk.upstream, tcpPSH|tcpACK, data[:n])
+		if chunk.upstream {
+			p.clientSeq += uint32(n)
+		} else {
+			p.serverSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+	return p.w.Flush()
+}
+
+func (p *pcapMirror) close() {
+	p.packet(true, tcpFIN|tcpACK, nil)
+	p.clientSeq++
+	p.packet(false, tcpFIN|tcpACK, nil)
+	p.serverSeq++
+	p.packet(true, tcpACK, nil)
+	p.w.Flush()
+	p.f.Close()
+}
+
+// packet appends one IPv4/TCP packet going upstream (client to destination)
+// or back.
+func (p *pcapMirror) packet(upstream bool, flags byte, payload []byte) {
+	src, dst, srcPort, dstPort := p.src, p.dst, p.srcPort, p.dstPort
+	seq, ack := p.clientSeq, p.serverSeq
+	if !upstream {
+		src, dst, srcPort, dstPort = dst, src, dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	pkt := make([]byte, 40+len(payload))
+	ip, tcp := pkt[:20], pkt[20:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64
+	ip[9] = 6 // TCP
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	pseudo := sum16(src) + sum16(dst) + 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	now := time.Now()
+	var record [16]byte
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(pkt)))
+	p.w.Write(record[:])
+	p.w.Write(pkt)
+}
+
+func sum16(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksum is the Internet checksum of b plus an initial (pseudo header) sum.
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial + sum16(b)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	// muxDestination is what -mux clients ask for. The session then carries
+	// yamux streams, each starting with its own destination on a line.
+	muxDestination = "mux"
+	// muxHeaderTimeout is how long a new stream may take to name its
+	// destination.
+	muxHeaderTimeout = 30 * time.Second
+)
+
+// muxConfig suits yamux to a transport that may be a string of polls: a
+// write can wait for a slow POST, so give it longer than usual.
+func muxConfig(debug bool) *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.ConnectionWriteTimeout = time.Minute
+	config.LogOutput = io.Discard
+	if debug {
+		config.LogOutput = log.Writer()
+	}
+	return config
+}
+
+// muxAccess is what a multiplexed session's client may reach, taken from
+// the request that opened it. Each stream is held to it like a session of
+// its own would be.
+type muxAccess struct {
+	clientIP   string
+	client     string // who, for -sticky services
+	sessionID  string
+	inviteDest string
+	tenant     *tenant
+	user       *certUser
+	zone       *zone
+}
+
+// attachMux starts serving streams for a new multiplexed session and
+// returns the session's end of it.
+func (s *Server) attachMux(access *muxAccess) (net.Conn, error) {
+	session, tunnel := bufferedPipe()
+	mux, err := yamux.Server(tunnel, muxConfig(s.debug))
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	s.muxes.Store(mux, struct{}{})
+	go func() {
+		defer s.muxes.Delete(mux)
+		defer mux.Close()
+		for {
+			stream, err := mux.AcceptStream()
+			if err != nil {
+				return
+			}
+			go s.serveMuxStream(stream, access)
+		}
+	}()
+	return session, nil
+}
+
+func (s *Server) serveMuxStream(stream *yamux.Stream, access *muxAccess) {
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(muxHeaderTimeout))
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+	destination := strings.TrimSpace(line)
+	if s.overrideDest != "" {
+		destination = s.overrideDest
+	}
+
+	target, private, err := s.streamTarget(destination, access)
+	if err != nil {
+		s.warn("Stream refused", append(sessionAttrs(access.clientIP, access.sessionID, destination), "err", err)...)
+		return
+	}
+	if !private {
+		s.info("Stream", sessionAttrs(access.clientIP, access.sessionID, destination)...)
+	}
+
+	var conn net.Conn
+	if svc, ok := s.services[destination]; ok {
+		conn, err = s.dialService(destination, svc, access.client)
+	} else {
+		conn, err = net.DialTimeout("tcp", target, 10*time.Second)
+	}
+	if err != nil {
+		if !private {
+			slog.Debug("Dial failed", append(sessionAttrs(access.clientIP, access.sessionID, destination), "err", err)...)
+		}
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, reader)
+		if half, ok := conn.(interface{ CloseWrite() error }); ok {
+			half.CloseWrite()
+		}
+	}()
+	io.Copy(stream, conn)
+}
+
+// streamTarget checks destination against what the session's client may
+// reach and returns the address to dial, and whether to keep it out of the
+// logs. Break-glass and step-up need a session of their own.
+func (s *Server) streamTarget(destination string, access *muxAccess) (string, bool, error) {
+	if access.inviteDest != "" && destination != access.inviteDest {
+		return "", false, fmt.Errorf("invitation is for %s", access.inviteDest)
+	}
+	if t := access.tenant; t != nil && t.allowed != nil && !t.allowed.match(destination) {
+		return "", false, fmt.Errorf("tenant %s not allowed to reach %s", t.name, destination)
+	}
+	if u := access.user; u != nil && u.allowed != nil && !u.allowed.match(destination) {
+		return "", false, fmt.Errorf("user %s not allowed to reach %s", u.name, destination)
+	}
+
+	target := destination
+	service := false
+	if svc, ok := s.services[destination]; ok {
+		target = svc.primary()
+		service = true
+	} else if destination == muxDestination || destination == tunDestination {
+		return "", false, fmt.Errorf("%s can't be reached from a stream", destination)
+	} else if s.servicesOnly {
+		return "", false, fmt.Errorf("unknown service")
+	}
+	if s.stepUp != nil && (s.stepUp.sensitive.match(destination) || s.stepUp.sensitive.match(target)) {
+		return "", false, fmt.Errorf("needs step-up, connect without -mux")
+	}
+	if !isValidDestination(target) {
+		return "", false, fmt.Errorf("invalid destination")
+	}
+	private := s.noLogDests.match(destination) || s.noLogDests.match(target)
+	if !service {
+		var err error
+		if target, err = access.zone.policy(s.destPolicy).vet(target); err != nil {
+			return "", false, err
+		}
+	}
+	return target, private, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// loadOriginPullCA reads the CA that signs Cloudflare's Authenticated Origin
+// Pulls certificate. With it the TLS listener only accepts connections that
+// present a certificate from that CA, i.e. that came through Cloudflare.
+func loadOriginPullCA(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// padHistogram is a distribution of response body sizes, typically taken
+// from real web traffic. Downstream responses are padded up to a size drawn
+// from it so the tunnel doesn't leak exact payload sizes.
+type padHistogram struct {
+	sizes   []int
+	weights []int
+}
+
+// parsePadHistogram parses "size:weight[,size:weight...]", for example
+// "1024:30,4096:30,16384:25,65536:15".
+func parsePadHistogram(spec string) (*padHistogram, error) {
+	type bucket struct{ size, weight int }
+	var buckets []bucket
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		sizeStr, weightStr, ok := strings.Cut(entry, ":")
+		if !ok {
+			weightStr = "1"
+		}
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size in %q", entry)
+		}
+		weight, err := strconv.Atoi(weightStr)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight in %q", entry)
+		}
+		buckets = append(buckets, bucket{size, weight})
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no sizes")
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].size < buckets[j].size })
+
+	h := &padHistogram{}
+	for _, b := range buckets {
+		h.sizes = append(h.sizes, b.size)
+		h.weights = append(h.weights, b.weight)
+	}
+	return h, nil
+}
+
+// sample returns a padded body size of at least n. A bucket is picked by
+// weight among those large enough for n, then a size is drawn uniformly
+// between the previous bucket boundary and the chosen one. Bodies larger
+// than every bucket are left alone.
+func (h *padHistogram) sample(n int) int {
+	first := sort.SearchInts(h.sizes, n)
+	if first == len(h.sizes) {
+		return n
+	}
+
+	total := 0
+	for _, w := range h.weights[first:] {
+		total += w
+	}
+	pick := rand.Intn(total)
+	i := first
+	for ; i < len(h.sizes)-1; i++ {
+		pick -= h.weights[i]
+		if pick < 0 {
+			break
+		}
+	}
+
+	low := n
+	if i > 0 && h.sizes[i-1] > low {
+		low = h.sizes[i-1]
+	}
+	return low + rand.Intn(h.sizes[i]-low+1)
+}
+
+// padResponse pads an encoded body to a sampled size with random data,
+// encoded like the body. The real length goes out in an Apache style ETag
+// ("<len>-<mtime>" in hex) so only clients that asked for padding know
+// where the payload ends.
+func (h *padHistogram) padResponse(w http.ResponseWriter, body []byte, encoding string) []byte {
+	payloadLen := len(body)
+	target := h.sample(payloadLen)
+	if target > payloadLen {
+		filler := make([]byte, target-payloadLen)
+		cryptorand.Read(filler)
+		body = append(body, encodeAs(encoding, filler)[:target-payloadLen]...)
+	}
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", payloadLen, rand.Int63n(1<<52)))
+	return body
+}
+
+// hasCapability reports whether the client listed capability in its
+// X-Capabilities header.
+func hasCapability(r *http.Request, capability string) bool {
+	for _, c := range strings.Split(r.Header.Get("X-Capabilities"), ",") {
+		if strings.TrimSpace(c) == capability {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	probeTimeout = 5 * time.Second
+	// probeFailures in a row make a destination unhealthy, so one lost
+	// packet doesn't turn clients away.
+	probeFailures = 2
+)
+
+var (
+	probeUpDesc = prometheus.NewDesc("darkflare_destination_up",
+		"Whether the destination's last health probes passed (1) or not (0).", []string{"destination", "address", "probe"}, nil)
+	probeLatencyDesc = prometheus.NewDesc("darkflare_destination_probe_seconds",
+		"How long the destination's last passing health probe took.", []string{"destination", "address", "probe"}, nil)
+)
+
+// destProbe checks one destination the way its clients use it: a TCP
+// connect, a TLS handshake, or an HTTP GET that must answer below 400.
+type destProbe struct {
+	name    string // as given to -probe, a service name or host:port
+	addr    string
+	kind    string // tcp, tls, http or https
+	path    string // for http and https
+	checked time.Time
+	latency time.Duration
+	err     error
+	fails   int
+}
+
+// probeSet runs the -probe health checks every interval.
+type probeSet struct {
+	interval time.Duration
+	gate     bool // refuse new sessions to unhealthy destinations
+
+	mu     sync.Mutex
+	probes []*destProbe
+}
+
+// parseProbes parses dest=kind[,dest=kind...], where dest is a named
+// service or host:port and kind is tcp, tls, http[:/path] or https[:/path].
+// A service gets a probe for each of its backends.
+func parseProbes(spec string, services map[string]*service) (*probeSet, error) {
+	set := &probeSet{}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, kind, ok := strings.Cut(entry, "=")
+		name, kind = strings.TrimSpace(name), strings.TrimSpace(kind)
+		if !ok || name == "" || kind == "" {
+			return nil, fmt.Errorf("invalid probe %q (format: dest=tcp|tls|http[:/path]|https[:/path])", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s is probed twice", name)
+		}
+		seen[name] = true
+
+		addrs := []string{name}
+		if svc, ok := services[name]; ok {
+			addrs = svc.addrs()
+		} else if !isValidDestination(name) {
+			return nil, fmt.Errorf("%s is neither a -service nor host:port", name)
+		}
+		kind, path, _ := strings.Cut(kind, ":")
+		switch kind {
+		case "tcp", "tls":
+			if path != "" {
+				return nil, fmt.Errorf("%s probes don't take a path", kind)
+			}
+		case "http", "https":
+			if path == "" {
+				path = "/"
+			}
+			if !strings.HasPrefix(path, "/") {
+				return nil, fmt.Errorf("invalid path %q for %s", path, name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid probe kind %q for %s (use tcp, tls, http or https)", kind, name)
+		}
+		for _, addr := range addrs {
+			set.probes = append(set.probes, &destProbe{name: name, addr: addr, kind: kind, path: path})
+		}
+	}
+	if len(set.probes) == 0 {
+		return nil, fmt.Errorf("no probes")
+	}
+	return set, nil
+}
+
+// run probes every destination now and then every interval.
+func (p *probeSet) run() {
+	for {
+		var wg sync.WaitGroup
+		for _, probe := range p.probes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				err := probe.check()
+				p.record(probe, start, err)
+			}()
+		}
+		wg.Wait()
+		time.Sleep(p.interval)
+	}
+}
+
+// record keeps a probe's result and logs destinations going up or down.
+func (p *probeSet) record(probe *destProbe, start time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wasHealthy := probe.healthy()
+	probe.checked = start
+	probe.err = err
+	if err != nil {
+		probe.fails++
+	} else {
+		probe.fails = 0
+		probe.latency = time.Since(start)
+	}
+	switch {
+	case wasHealthy && !probe.healthy():
+		log.Printf("Destination %s is unhealthy: %v", probe.label(), err)
+	case !wasHealthy && probe.healthy():
+		log.Printf("Destination %s is healthy again", probe.label())
+	}
+}
+
+// label names the probe in logs, with the backend for services.
+func (d *destProbe) label() string {
+	if d.addr == d.name {
+		return d.name
+	}
+	return d.name + " (" + d.addr + ")"
+}
+
+// healthy needs p.mu held.
+func (d *destProbe) healthy() bool {
+	return d.fails < probeFailures
+}
+
+func (d *destProbe) check() error {
+	switch d.kind {
+	case "http", "https":
+		client := &http.Client{
+			Timeout: probeTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				DisableKeepAlives: true,
+			},
+			// A redirect is an answer
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := client.Get(d.kind + "://" + d.addr + d.path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", d.addr, probeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if d.kind == "tls" {
+		// Internal services often have certificates nothing would
+		// verify, the handshake completing is what counts
+		host, _, _ := net.SplitHostPort(d.addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		tlsConn.SetDeadline(time.Now().Add(probeTimeout))
+		return tlsConn.Handshake()
+	}
+	return nil
+}
+
+// unhealthy reports whether new sessions to destination, which resolves to
+// target, should be refused: it's probed, and nothing it could go to is
+// healthy.
+func (p *probeSet) unhealthy(destination, target string) bool {
+	if p == nil || !p.gate {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	probed := false
+	for _, probe := range p.probes {
+		if probe.name == destination || probe.addr == target {
+			if probe.healthy() {
+				return false
+			}
+			probed = true
+		}
+	}
+	return probed
+}
+
+// backendDown reports whether a probe of addr is failing.
+func (p *probeSet) backendDown(addr string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, probe := range p.probes {
+		if probe.addr == addr && !probe.healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *probeSet) Describe(ch chan<- *prometheus.Desc) {
+	ch <- probeUpDesc
+	ch <- probeLatencyDesc
+}
+
+func (p *probeSet) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, probe := range p.probes {
+		if probe.checked.IsZero() {
+			continue
+		}
+		up := 0.0
+		if probe.healthy() {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(probeUpDesc, prometheus.GaugeValue, up, probe.name, probe.addr, probe.kind)
+		if probe.latency > 0 {
+			ch <- prometheus.MustNewConstMetric(probeLatencyDesc, prometheus.GaugeValue, probe.latency.Seconds(), probe.name, probe.addr, probe.kind)
+		}
+	}
+}
+
+// probeInfo is a probe as the admin API shows it.
+type probeInfo struct {
+	Destination string `json:"destination"`
+	Address     string `json:"address"`
+	Probe       string `json:"probe"`
+	Healthy     bool   `json:"healthy"`
+	Latency     string `json:"latency,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Checked     string `json:"checked,omitempty"`
+}
+
+// snapshot returns every probe, by destination and, for services, in the
+// order of their backends.
+func (p *probeSet) snapshot() []probeInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	probes := make([]probeInfo, 0, len(p.probes))
+	for _, probe := range p.probes {
+		info := probeInfo{
+			Destination: probe.name,
+			Address:     probe.addr,
+			Probe:       probe.kind,
+			Healthy:     probe.healthy(),
+		}
+		if probe.kind == "http" || probe.kind == "https" {
+			info.Probe += ":" + probe.path
+		}
+		if !probe.checked.IsZero() {
+			info.Checked = now.Sub(probe.checked).Round(time.Second).String() + " ago"
+		}
+		if probe.latency > 0 {
+			info.Latency = probe.latency.Round(time.Microsecond).String()
+		}
+		if probe.err != nil {
+			info.Error = probe.err.Error()
+		}
+		probes = append(probes, info)
+	}
+	sort.SliceStable(probes, func(i, j int) bool {
+		return probes[i].Destination < probes[j].Destination
+	})
+	return probes
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// listenUnix listens on a unix socket for a local web server to proxy to.
+// A stale socket from a previous run is removed first.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Let the web server's group connect
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// forwardedFor returns the client address from X-Forwarded-For. With
+// -trusted-proxies set the header is only believed when the request comes
+// from one of them, and the right-most hop that isn't a trusted proxy wins,
+// so clients can't just prepend an address of their choosing.
+func (s *Server) forwardedFor(r *http.Request) string {
+	header := r.Header.Get("X-Forwarded-For")
+	if s.trustedProxies == nil || header == "" {
+		return header
+	}
+	if !s.unixSocket && !s.trustedProxies.match(r.RemoteAddr) {
+		return ""
+	}
+
+	hops := strings.Split(header, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop != "" && !s.trustedProxies.match(hop) {
+			return hop
+		}
+	}
+	return strings.TrimSpace(hops[0])
+}
+
+// mountAt serves h under prefix only, with the prefix stripped. Anything
+// outside of it goes to the passthrough site or gets the decoy redirect.
+func (s *Server) mountAt(prefix string, h http.Handler) http.Handler {
+	prefix = "/" + strings.Trim(prefix, "/")
+	stripped := http.StripPrefix(prefix, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			stripped.ServeHTTP(w, r)
+			return
+		}
+		if _, passthrough := s.zoneFor(r).decoy("", s.passthrough); passthrough != nil {
+			passthrough.ServeHTTP(w, r)
+			return
+		}
+		clientIP := s.forwardedFor(r)
+		if clientIP == "" {
+			clientIP = r.RemoteAddr
+		}
+		s.sendRedirect(w, r, clientIP)
+	})
+}
+
+// newPassthrough returns a reverse proxy to the real site that requests
+// outside -path-prefix are sent to.
+func newPassthrough(target string) (*httputil.ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("passthrough URL must be http or https")
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = u.Host
+	}
+	return proxy, nil
+}
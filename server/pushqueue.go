@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pushQueueSize is how far a session reads ahead of its client. Once that
+// much is waiting the reader stops, and TCP flow control slows the
+// destination down instead of the server buffering without end.
+const pushQueueSize = 256 * 1024
+
+// pushConn is a session's connection to its destination, read continuously
+// into a bounded queue. Whatever arrives between polls waits for the next
+// one, and no read is ever cut off by a poll's deadline. Reads come from
+// the queue; writes, Close and the addresses go straight to the
+// destination.
+type pushConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	data     []byte
+	err      error // what stopped the reader, returned once data is empty
+	deadline time.Time
+	ready    chan struct{} // nudged when data or err arrives, and on deadline changes
+	space    chan struct{} // nudged when reads make room
+	done     chan struct{} // closed by Close
+	once     sync.Once
+}
+
+func newPushConn(conn net.Conn) *pushConn {
+	c := &pushConn{
+		Conn:  conn,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	go c.fill()
+	return c
+}
+
+func nudge(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// fill reads the destination until it ends, waiting whenever the queue is
+// full.
+func (c *pushConn) fill() {
+	buffer := make([]byte, 32*1024)
+	for {
+		c.mu.Lock()
+		for len(c.data) >= pushQueueSize {
+			c.mu.Unlock()
+			select {
+			case <-c.space:
+			case <-c.done:
+				return
+			}
+			c.mu.Lock()
+		}
+		room := min(len(buffer), pushQueueSize-len(c.data))
+		c.mu.Unlock()
+
+		n, err := c.Conn.Read(buffer[:room])
+		c.mu.Lock()
+		c.data = append(c.data, buffer[:n]...)
+		c.err = err
+		c.mu.Unlock()
+		nudge(c.ready)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// next hands out up to len(b) queued bytes, or the reader's error once the
+// queue is empty. ok is false when there's neither yet.
+func (c *pushConn) next(b []byte) (n int, ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.data) > 0 {
+		n = copy(b, c.data)
+		c.data = c.data[n:]
+		if len(c.data) == 0 {
+			c.data = nil
+		} else {
+			nudge(c.ready)
+		}
+		nudge(c.space)
+		return n, true, nil
+	}
+	if c.err != nil {
+		return 0, true, c.err
+	}
+	return 0, false, nil
+}
+
+// wait waits for the reader until deadline, if there is one. It reports
+// false once the deadline has passed.
+func (c *pushConn) wait(deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-c.ready
+		return true
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-c.ready:
+	case <-timer.C:
+	}
+	return true
+}
+
+func (c *pushConn) Read(b []byte) (int, error) {
+	for {
+		if n, ok, err := c.next(b); ok {
+			return n, err
+		}
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		if !c.wait(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// take returns up to limit queued bytes for a poll, waiting up to wait for
+// the first ones. The error is what ended the destination, once everything
+// before it has been taken.
+func (c *pushConn) take(limit int, wait time.Duration) ([]byte, error) {
+	data := make([]byte, limit)
+	deadline := time.Now().Add(wait)
+	for {
+		if n, ok, err := c.next(data); ok {
+			return data[:n], err
+		}
+		if !c.wait(deadline) {
+			return nil, nil
+		}
+	}
+}
+
+func (c *pushConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *pushConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	nudge(c.ready)
+	return nil
+}
+
+func (c *pushConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
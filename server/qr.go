@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the blank border, in modules, scanners need around a code.
+const qrQuietZone = 2
+
+// writeQR renders text as a QR code using half-block characters, two module
+// rows per line of output. Light modules are drawn as blocks, so the code
+// scans on the usual light-on-dark terminal.
+func writeQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return err
+	}
+
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return true
+		}
+		return !code.Black(x, y)
+	}
+
+	var b strings.Builder
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,197 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// applySandbox confines every thread, for good: Landlock lets it read
+// anywhere but write only under l.writable, and a seccomp filter refuses
+// syscalls the server never makes, execve included unless -allow-exec.
+// Whatever -a runs inherits both.
+func (l *lockdown) applySandbox() error {
+	// Both need it, and setuid binaries can't hand privileges back
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return fmt.Errorf("-sandbox: %v", err)
+	}
+	if err := l.landlock(); err != nil {
+		return fmt.Errorf("-sandbox: %v", err)
+	}
+	if err := l.seccomp(); err != nil {
+		return fmt.Errorf("-sandbox: %v", err)
+	}
+	return nil
+}
+
+// allThreads makes a syscall on every thread of the process, which Go can
+// only do without cgo.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	if _, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("%v: cgo builds can't change every thread, build with CGO_ENABLED=0", errno)
+		}
+		return errno
+	}
+	return nil
+}
+
+const (
+	landlockRead  = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockFiles = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+		unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+)
+
+// landlockRights are the filesystem rights each Landlock ABI knows.
+var landlockRights = []uint64{
+	1: 0x1fff,
+	2: 0x1fff | unix.LANDLOCK_ACCESS_FS_REFER,
+	3: 0x1fff | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE,
+	4: 0x1fff | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE,
+	5: 0x1fff | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+		unix.LANDLOCK_ACCESS_FS_IOCTL_DEV,
+}
+
+func (l *lockdown) landlock() error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		log.Printf("Warning: Landlock isn't available (%v), -sandbox can't limit file access", errno)
+		return nil
+	}
+	handled := landlockRights[min(int(abi), len(landlockRights)-1)]
+	read := uint64(landlockRead)
+	if l.allowExec {
+		read |= unix.LANDLOCK_ACCESS_FS_EXECUTE
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	ruleset, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: %v", errno)
+	}
+	defer unix.Close(int(ruleset))
+
+	allow := func(path string, access uint64) error {
+		fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("landlock %s: %v", path, err)
+		}
+		defer unix.Close(fd)
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			return fmt.Errorf("landlock: %v", err)
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			access &= landlockFiles
+		}
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access & handled, Parent_fd: int32(fd)}
+		_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, ruleset, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("landlock %s: %v", path, errno)
+		}
+		return nil
+	}
+	if err := allow("/", read); err != nil {
+		return err
+	}
+	for _, dir := range l.writable {
+		if err := allow(dir, handled&^unix.LANDLOCK_ACCESS_FS_EXECUTE|read); err != nil {
+			return err
+		}
+	}
+	if l.allowExec {
+		// Where the command's unused stdio goes
+		if err := allow("/dev/null", unix.LANDLOCK_ACCESS_FS_WRITE_FILE|read); err != nil {
+			return err
+		}
+	}
+	return allThreads(unix.SYS_LANDLOCK_RESTRICT_SELF, ruleset, 0, 0)
+}
+
+// seccompArch is the AUDIT_ARCH of this build's syscalls. The filter refuses
+// any other, like 32-bit ones on a 64-bit kernel.
+var seccompArch = map[string]uint32{
+	"386":      unix.AUDIT_ARCH_I386,
+	"amd64":    unix.AUDIT_ARCH_X86_64,
+	"arm":      unix.AUDIT_ARCH_ARM,
+	"arm64":    unix.AUDIT_ARCH_AARCH64,
+	"loong64":  unix.AUDIT_ARCH_LOONGARCH64,
+	"mips":     unix.AUDIT_ARCH_MIPS,
+	"mipsle":   unix.AUDIT_ARCH_MIPSEL,
+	"mips64":   unix.AUDIT_ARCH_MIPS64,
+	"mips64le": unix.AUDIT_ARCH_MIPSEL64,
+	"ppc64":    unix.AUDIT_ARCH_PPC64,
+	"ppc64le":  unix.AUDIT_ARCH_PPC64LE,
+	"riscv64":  unix.AUDIT_ARCH_RISCV64,
+	"s390x":    unix.AUDIT_ARCH_S390X,
+}
+
+// sandboxDenied are syscalls a tunnel has no business making: debugging
+// other processes, mounts and namespaces, kernel modules and kexec, BPF and
+// perf, the keyring, file handles that bypass paths, and rebooting.
+var sandboxDenied = []uintptr{
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE, unix.SYS_KEXEC_LOAD,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY, unix.SYS_KEYCTL,
+	unix.SYS_NAME_TO_HANDLE_AT, unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF,
+}
+
+func (l *lockdown) seccomp() error {
+	arch, ok := seccompArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("no seccomp filter for %s", runtime.GOARCH)
+	}
+	denied := sandboxDenied
+	if !l.allowExec {
+		denied = append(denied[:len(denied):len(denied)], unix.SYS_EXECVE, unix.SYS_EXECVEAT)
+	}
+
+	// Refused syscalls fail with EPERM rather than killing the server
+	deny := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	filter := []unix.SockFilter{
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4), // seccomp_data.arch
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, deny),
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0), // seccomp_data.nr
+	}
+	if runtime.GOARCH == "amd64" {
+		// x32 syscalls share the arch, with this bit set
+		filter = append(filter, bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, 0x40000000, uint8(len(denied)+1), 0))
+	}
+	for i, nr := range denied {
+		filter = append(filter, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), uint8(len(denied)-i), 0))
+	}
+	filter = append(filter,
+		bpfStatement(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, deny),
+	)
+
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	thread, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %v", errno)
+	}
+	if thread != 0 {
+		return fmt.Errorf("seccomp: thread %d couldn't be filtered", thread)
+	}
+	return nil
+}
+
+func bpfStatement(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jumpTrue, jumpFalse uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jumpTrue, Jf: jumpFalse, K: k}
+}
@@ -0,0 +1,9 @@
+//go:build unix && !linux
+
+package main
+
+import "fmt"
+
+func (l *lockdown) applySandbox() error {
+	return fmt.Errorf("-sandbox is Linux only")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow is a daily time range on a set of weekdays. A window whose end
+// is before its start runs past midnight into the next day.
+type timeWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+}
+
+// schedule limits when the tunnel handler answers. Outside every window the
+// server behaves as if the tunnel didn't exist.
+type schedule struct {
+	windows  []timeWindow
+	location *time.Location
+}
+
+// parseSchedule parses a comma separated list of windows such as
+// "Mon-Fri 08:00-18:00,Sat 10:00-14:00" or "daily 22:00-02:00".
+func parseSchedule(spec string, location *time.Location) (*schedule, error) {
+	sched := &schedule{location: location}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		dayPart, timePart, ok := strings.Cut(entry, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q (format: Mon-Fri 08:00-18:00)", entry)
+		}
+
+		var window timeWindow
+		if err := parseDays(strings.ToLower(dayPart), &window.days); err != nil {
+			return nil, fmt.Errorf("invalid window %q: %v", entry, err)
+		}
+
+		startStr, endStr, ok := strings.Cut(strings.TrimSpace(timePart), "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q: missing time range", entry)
+		}
+		var err error
+		if window.start, err = parseClock(startStr); err != nil {
+			return nil, fmt.Errorf("invalid window %q: %v", entry, err)
+		}
+		if window.end, err = parseClock(endStr); err != nil {
+			return nil, fmt.Errorf("invalid window %q: %v", entry, err)
+		}
+		if window.start == window.end {
+			return nil, fmt.Errorf("invalid window %q: empty time range", entry)
+		}
+		sched.windows = append(sched.windows, window)
+	}
+	if len(sched.windows) == 0 {
+		return nil, fmt.Errorf("no windows")
+	}
+	return sched, nil
+}
+
+func parseDays(spec string, days *[7]bool) error {
+	if spec == "daily" || spec == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+	first, last, isRange := strings.Cut(spec, "-")
+	from, ok := weekdays[first]
+	if !ok {
+		return fmt.Errorf("unknown day %q", first)
+	}
+	to := from
+	if isRange {
+		if to, ok = weekdays[last]; !ok {
+			return fmt.Errorf("unknown day %q", last)
+		}
+	}
+	for d := from; ; d = (d + 1) % 7 {
+		days[d] = true
+		if d == to {
+			break
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (format: HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether t falls inside any window.
+func (s *schedule) active(t time.Time) bool {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// Overnight window: the evening part belongs to today, the early
+		// morning part to the window that started yesterday.
+		if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
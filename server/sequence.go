@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// With "seq" in X-Capabilities both directions of a session are numbered by
+// byte offset, so requests the CDN retries or delivers out of order can't
+// duplicate or shuffle the stream. Uploads say where their body starts in
+// X-Seq; the server writes each byte to the destination once, in order, and
+// holds on to uploads that arrive before the ones they follow. Polls say in
+// X-Ack how much the client has; the server answers with everything after
+// that, what it sent before and the client didn't get first, and says in
+// X-Seq where the response starts.
+
+// maxUploadsAhead bounds the uploads held for a gap before them.
+const maxUploadsAhead = 64
+
+func parseOffset(value string) (uint64, error) {
+	offset, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset %q", value)
+	}
+	return offset, nil
+}
+
+// sequenceUpload returns what of an upload starting at seq is to be written
+// to the destination now: nothing for one seen before, or one early, and
+// for the next in line, it along with anything held that follows it.
+// session.mu must be held.
+func (session *Session) sequenceUpload(seq string, data []byte) ([]byte, error) {
+	offset, err := parseOffset(seq)
+	if err != nil {
+		return nil, err
+	}
+	end := offset + uint64(len(data))
+	switch {
+	case end <= session.upSeq:
+		return nil, nil
+	case offset > session.upSeq:
+		if session.upAhead == nil {
+			session.upAhead = make(map[uint64][]byte)
+		}
+		if len(session.upAhead) >= maxUploadsAhead {
+			return nil, fmt.Errorf("too many uploads ahead of %d", session.upSeq)
+		}
+		session.upAhead[offset] = data
+		return nil, nil
+	}
+
+	data = data[session.upSeq-offset:]
+	session.upSeq = end
+	for more := true; more; {
+		more = false
+		for offset, held := range session.upAhead {
+			if offset > session.upSeq {
+				continue
+			}
+			delete(session.upAhead, offset)
+			if end := offset + uint64(len(held)); end > session.upSeq {
+				data = append(data, held[session.upSeq-offset:]...)
+				session.upSeq = end
+				more = true
+			}
+		}
+	}
+	return data, nil
+}
+
+// ackDownload forgets what the client says it has of the stream back.
+// session.mu must be held.
+func (session *Session) ackDownload(ack string) error {
+	if ack == "" {
+		return nil
+	}
+	offset, err := parseOffset(ack)
+	if err != nil {
+		return err
+	}
+	if offset < session.downSeq {
+		// A poll the CDN held on to, the client has acked more since
+		return nil
+	}
+	if offset > session.downSeq+uint64(len(session.inFlight)) {
+		return fmt.Errorf("ack %d beyond what was sent", offset)
+	}
+	session.inFlight = session.inFlight[offset-session.downSeq:]
+	session.downSeq = offset
+	return nil
+}
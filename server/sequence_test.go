@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSequenceUpload(t *testing.T) {
+	type upload struct {
+		seq  uint64
+		data string
+	}
+	tests := []struct {
+		name    string
+		uploads []upload
+		want    string // written to the destination, in order
+		upSeq   uint64
+	}{
+		{
+			name:    "in order",
+			uploads: []upload{{0, "hello"}, {5, ", "}, {7, "world"}},
+			want:    "hello, world",
+			upSeq:   12,
+		},
+		{
+			name:    "duplicated",
+			uploads: []upload{{0, "hello"}, {0, "hello"}, {5, "world"}, {5, "world"}},
+			want:    "helloworld",
+			upSeq:   10,
+		},
+		{
+			name:    "resent with more",
+			uploads: []upload{{0, "hel"}, {0, "hello"}, {3, "lo world"}},
+			want:    "hello world",
+			upSeq:   11,
+		},
+		{
+			name:    "ahead",
+			uploads: []upload{{5, "world"}, {0, "hello"}},
+			want:    "helloworld",
+			upSeq:   10,
+		},
+		{
+			name:    "ahead, several and out of order",
+			uploads: []upload{{7, "c"}, {5, "ab"}, {8, "d"}, {0, "01234"}},
+			want:    "01234abcd",
+			upSeq:   9,
+		},
+		{
+			name:    "ahead and resent",
+			uploads: []upload{{5, "world"}, {5, "world"}, {0, "hello"}, {5, "world"}},
+			want:    "helloworld",
+			upSeq:   10,
+		},
+		{
+			name:    "held upload overtaken by a resend",
+			uploads: []upload{{5, "wo"}, {0, "hellowor"}, {8, "ld"}},
+			want:    "helloworld",
+			upSeq:   10,
+		},
+		{
+			name:    "gap never filled",
+			uploads: []upload{{0, "hello"}, {9, "d"}},
+			want:    "hello",
+			upSeq:   5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &Session{}
+			var written strings.Builder
+			for _, u := range tt.uploads {
+				data, err := session.sequenceUpload(strconv.FormatUint(u.seq, 10), []byte(u.data))
+				if err != nil {
+					t.Fatalf("upload at %d: %v", u.seq, err)
+				}
+				written.Write(data)
+			}
+			if written.String() != tt.want {
+				t.Errorf("wrote %q, want %q", written.String(), tt.want)
+			}
+			if session.upSeq != tt.upSeq {
+				t.Errorf("upSeq = %d, want %d", session.upSeq, tt.upSeq)
+			}
+		})
+	}
+}
+
+func TestSequenceUploadErrors(t *testing.T) {
+	session := &Session{}
+	if _, err := session.sequenceUpload("-1", []byte("x")); err == nil {
+		t.Error("negative offset accepted")
+	}
+	if _, err := session.sequenceUpload("", []byte("x")); err == nil {
+		t.Error("empty offset accepted")
+	}
+
+	// Uploads held for a gap are bounded
+	for i := 0; i < maxUploadsAhead; i++ {
+		if _, err := session.sequenceUpload(strconv.Itoa(10+i), []byte("x")); err != nil {
+			t.Fatalf("upload %d ahead: %v", i, err)
+		}
+	}
+	if _, err := session.sequenceUpload(strconv.Itoa(10+maxUploadsAhead), []byte("x")); err == nil {
+		t.Errorf("upload %d ahead accepted", maxUploadsAhead+1)
+	}
+}
+
+func TestAckDownload(t *testing.T) {
+	tests := []struct {
+		name     string
+		acks     []string
+		downSeq  uint64
+		inFlight string // what's left to send again
+		wantErr  bool   // for the last ack
+	}{
+		{name: "nothing acked", acks: []string{""}, downSeq: 100, inFlight: "abcdef"},
+		{name: "all of it", acks: []string{"106"}, downSeq: 106, inFlight: ""},
+		{name: "part of it", acks: []string{"102"}, downSeq: 102, inFlight: "cdef"},
+		{name: "in steps", acks: []string{"101", "103", "106"}, downSeq: 106, inFlight: ""},
+		{name: "same ack again", acks: []string{"102", "102"}, downSeq: 102, inFlight: "cdef"},
+		{name: "older ack", acks: []string{"104", "102"}, downSeq: 104, inFlight: "ef"},
+		{name: "ahead of what was sent", acks: []string{"107"}, downSeq: 100, inFlight: "abcdef", wantErr: true},
+		{name: "not a number", acks: []string{"1e3"}, downSeq: 100, inFlight: "abcdef", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &Session{downSeq: 100, inFlight: []byte("abcdef")}
+			var err error
+			for _, ack := range tt.acks {
+				err = session.ackDownload(ack)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ackDownload() = %v, want error %v", err, tt.wantErr)
+			}
+			if session.downSeq != tt.downSeq || string(session.inFlight) != tt.inFlight {
+				t.Errorf("downSeq %d, in flight %q; want %d, %q", session.downSeq, session.inFlight, tt.downSeq, tt.inFlight)
+			}
+		})
+	}
+}
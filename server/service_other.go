@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "log"
+
+func runServiceCommand(args []string) {
+	log.Fatal("The service subcommand is for Windows, use systemd elsewhere (see the README)")
+}
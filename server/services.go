@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serviceDialTimeout bounds each backend's dial, so a dead primary doesn't
+// hold up failing over to the next.
+const serviceDialTimeout = 5 * time.Second
+
+var backendConnsDesc = prometheus.NewDesc("darkflare_backend_connections",
+	"Open connections to each backend of a named service.", []string{"service", "backend"}, nil)
+
+// service is a named destination with one or more backends. Connections go
+// to the first that answers, in order, or spread over them by weight once
+// -round-robin or a weight says so, or with -sticky to the same one for the
+// same client.
+type service struct {
+	backends []*backend
+	balanced bool
+	sticky   bool
+
+	mu sync.Mutex // for the backends' current weights
+}
+
+type backend struct {
+	addr    string
+	weight  int
+	max     int // open connections at most, 0 for no limit
+	active  atomic.Int64
+	current int // smooth weighted round robin state, under service.mu
+}
+
+// primary is the backend that stands in for the service in checks that
+// need an address.
+func (svc *service) primary() string {
+	return svc.backends[0].addr
+}
+
+func (svc *service) addrs() []string {
+	addrs := make([]string, len(svc.backends))
+	for i, b := range svc.backends {
+		addrs[i] = b.addr
+	}
+	return addrs
+}
+
+// parseServices parses a comma separated list of name=host:port entries into
+// the catalog of named services clients may ask for instead of a raw address.
+// A service can have more backends, with a weight and a connection limit:
+// name=host:port[;weight=N][;max=N]|host:port...
+func parseServices(spec string) (map[string]*service, error) {
+	services := make(map[string]*service)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, addrs, ok := strings.Cut(entry, "=")
+		name, addrs = strings.TrimSpace(name), strings.TrimSpace(addrs)
+		if !ok || name == "" || addrs == "" {
+			return nil, fmt.Errorf("invalid service %q (format: name=host:port[|host:port...])", entry)
+		}
+		if strings.Contains(name, ":") {
+			return nil, fmt.Errorf("service name %q must not contain ':'", name)
+		}
+		if _, exists := services[name]; exists {
+			return nil, fmt.Errorf("duplicate service %q", name)
+		}
+		svc := &service{}
+		for _, spec := range strings.Split(addrs, "|") {
+			options := strings.Split(spec, ";")
+			b := &backend{addr: strings.TrimSpace(options[0]), weight: 1}
+			if !isValidDestination(b.addr) {
+				return nil, fmt.Errorf("invalid address %q for service %s", b.addr, name)
+			}
+			for _, option := range options[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("invalid %q for %s in service %s", option, b.addr, name)
+				}
+				switch key {
+				case "weight":
+					b.weight = n
+					svc.balanced = true
+				case "max":
+					b.max = n
+				default:
+					return nil, fmt.Errorf("unknown option %q for %s in service %s (use weight or max)", key, b.addr, name)
+				}
+			}
+			svc.backends = append(svc.backends, b)
+		}
+		services[name] = svc
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no services")
+	}
+	return services, nil
+}
+
+// setRoundRobin makes the listed services take turns between their backends.
+func setRoundRobin(services map[string]*service, names string) error {
+	return markServices(services, names, func(svc *service) { svc.balanced = true })
+}
+
+// setSticky makes the listed services send each client to the same backend.
+func setSticky(services map[string]*service, names string) error {
+	return markServices(services, names, func(svc *service) { svc.sticky = true })
+}
+
+func markServices(services map[string]*service, names string, mark func(*service)) error {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		svc, ok := services[name]
+		if !ok {
+			return fmt.Errorf("no service %q", name)
+		}
+		mark(svc)
+	}
+	return nil
+}
+
+// order returns the backends to try, in order. Balanced services start at
+// the next backend by smooth weighted round robin among the usable ones, so
+// a backend of weight 3 gets three connections for every one of a backend
+// of weight 1, interleaved; the rest follow as fallbacks. Sticky services
+// put them in an order of the client's own.
+func (svc *service) order(usable func(*backend) bool, client string) []*backend {
+	if svc.sticky && client != "" {
+		return svc.stickyOrder(client)
+	}
+	if !svc.balanced {
+		return svc.backends
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	total := 0
+	next := -1
+	for i, b := range svc.backends {
+		if !usable(b) {
+			continue
+		}
+		b.current += b.weight
+		total += b.weight
+		if next < 0 || b.current > svc.backends[next].current {
+			next = i
+		}
+	}
+	if next < 0 {
+		next = 0
+	} else {
+		svc.backends[next].current -= total
+	}
+	order := make([]*backend, 0, len(svc.backends))
+	for i := range svc.backends {
+		order = append(order, svc.backends[(next+i)%len(svc.backends)])
+	}
+	return order
+}
+
+// stickyOrder ranks the backends for client by weighted rendezvous hashing:
+// each client gets the same first choice every time, as long as it's up,
+// and backends coming and going only move the clients that were on them.
+// Weights share the clients out like they share connections.
+func (svc *service) stickyOrder(client string) []*backend {
+	scores := make(map[*backend]float64, len(svc.backends))
+	for _, b := range svc.backends {
+		sum := sha256.Sum256([]byte(client + "\x00" + b.addr))
+		// A uniform draw in (0, 1) from the hash
+		u := (float64(binary.BigEndian.Uint64(sum[:])>>11) + 0.5) / (1 << 53)
+		scores[b] = float64(b.weight) / -math.Log(u)
+	}
+	order := append([]*backend(nil), svc.backends...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	return order
+}
+
+// full reports whether b is at its connection limit.
+func (b *backend) full() bool {
+	return b.max > 0 && b.active.Load() >= int64(b.max)
+}
+
+// reserve takes one of b's connections, if it has one left.
+func (b *backend) reserve() bool {
+	if b.active.Add(1) > int64(b.max) && b.max > 0 {
+		b.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+// backendConn gives its backend's connection back when closed.
+type backendConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() { c.backend.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+func (c *backendConn) CloseWrite() error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		return tcp.CloseWrite()
+	}
+	return nil
+}
+
+// dialService connects to one of the backends of svc, called name, for
+// client. Backends whose -probe is failing are only tried once the others
+// didn't answer, and ones at their connection limit not at all.
+func (s *Server) dialService(name string, svc *service, client string) (net.Conn, error) {
+	var up, down []*backend
+	usable := func(b *backend) bool { return !b.full() && !s.probes.backendDown(b.addr) }
+	for _, b := range svc.order(usable, client) {
+		if s.probes.backendDown(b.addr) {
+			down = append(down, b)
+		} else {
+			up = append(up, b)
+		}
+	}
+
+	err := fmt.Errorf("every backend of %s is at its connection limit", name)
+	for _, b := range append(up, down...) {
+		if !b.reserve() {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", b.addr, serviceDialTimeout); err == nil {
+			return &backendConn{Conn: conn, backend: b}, nil
+		}
+		b.active.Add(-1)
+		if len(svc.backends) > 1 {
+			s.warn("Service backend failed", "service", name, "backend", b.addr, "err", err)
+		}
+	}
+	return nil, err
+}
+
+// servicesCollector exports the open connections of every backend.
+type servicesCollector map[string]*service
+
+func (c servicesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendConnsDesc
+}
+
+func (c servicesCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, svc := range c {
+		for _, b := range svc.backends {
+			ch <- prometheus.MustNewConstMetric(backendConnsDesc, prometheus.GaugeValue, float64(b.active.Load()), name, b.addr)
+		}
+	}
+}
+
+// backendInfo is a service's backend as the admin API shows it.
+type backendInfo struct {
+	Address     string `json:"address"`
+	Weight      int    `json:"weight"`
+	Max         int    `json:"max,omitempty"`
+	Connections int64  `json:"connections"`
+	Down        bool   `json:"down,omitempty"` // its -probe is failing
+}
+
+type serviceInfo struct {
+	Name     string        `json:"name"`
+	Balanced bool          `json:"balanced"`
+	Sticky   bool          `json:"sticky,omitempty"`
+	Backends []backendInfo `json:"backends"`
+}
+
+// describeServices returns the catalog with its backends' connections.
+func (s *Server) describeServices() []serviceInfo {
+	services := make([]serviceInfo, 0, len(s.services))
+	for name, svc := range s.services {
+		info := serviceInfo{Name: name, Balanced: svc.balanced, Sticky: svc.sticky}
+		for _, b := range svc.backends {
+			info.Backends = append(info.Backends, backendInfo{
+				Address:     b.addr,
+				Weight:      b.weight,
+				Max:         b.max,
+				Connections: b.active.Load(),
+				Down:        s.probes.backendDown(b.addr),
+			})
+		}
+		services = append(services, info)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	rtmetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// Load shedding levels, from least to most drastic.
+const (
+	shedNone = iota
+	// shedNewSessions refuses new sessions, existing ones carry on.
+	shedNewSessions
+	// shedBulk also caps how much a session gets per poll, which slows down
+	// bulk transfers while leaving interactive sessions alone.
+	shedBulk
+)
+
+const (
+	shedSampleInterval = time.Second
+	// shedBulkAfter is how many consecutive samples over a limit it takes to
+	// go from refusing new sessions to throttling existing ones.
+	shedBulkAfter = 5
+	// shedBulkReadLimit is the per-poll read cap while throttling.
+	shedBulkReadLimit = 16 * 1024
+)
+
+// loadShedder watches the process's own CPU and memory use against the
+// configured limits and decides how much load to shed.
+type loadShedder struct {
+	maxCPU    float64 // percent of all CPUs, 0 for no limit
+	maxMemory uint64  // bytes, 0 for no limit
+	silent    bool
+
+	level atomic.Int32
+}
+
+func newLoadShedder(maxCPU float64, maxMemory uint64, silent bool) *loadShedder {
+	l := &loadShedder{maxCPU: maxCPU, maxMemory: maxMemory, silent: silent}
+	if maxMemory > 0 {
+		// Have the GC work harder before memory runs out, with some room
+		// past the limit: shedding should bring use down first, not a GC
+		// running flat out on a heap it can't shrink
+		debug.SetMemoryLimit(int64(maxMemory) / 4 * 5)
+	}
+	go l.monitor()
+	return l
+}
+
+// current returns the shedding level; a nil shedder never sheds.
+func (l *loadShedder) current() int {
+	if l == nil {
+		return shedNone
+	}
+	return int(l.level.Load())
+}
+
+func (l *loadShedder) monitor() {
+	samples := []rtmetrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	lastCPU, _ := processCPUTime()
+	lastSample := time.Now()
+	over := 0
+
+	for range time.Tick(shedSampleInterval) {
+		now := time.Now()
+		cpuTime, ok := processCPUTime()
+		cpuPercent := 0.0
+		if ok {
+			elapsed := now.Sub(lastSample).Seconds() * float64(runtime.NumCPU())
+			cpuPercent = (cpuTime - lastCPU).Seconds() / elapsed * 100
+		}
+		lastCPU, lastSample = cpuTime, now
+
+		rtmetrics.Read(samples)
+		memory := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+
+		if (l.maxCPU > 0 && cpuPercent >= l.maxCPU) || (l.maxMemory > 0 && memory >= l.maxMemory) {
+			over++
+		} else {
+			over = 0
+		}
+
+		level := shedNone
+		switch {
+		case over >= shedBulkAfter:
+			level = shedBulk
+		case over > 0:
+			level = shedNewSessions
+		}
+		if previous := int(l.level.Swap(int32(level))); previous != level && !l.silent {
+			slog.Warn("Load shedding level changed", "from", previous, "to", level,
+				"cpu_percent", int(cpuPercent), "memory_mb", memory>>20)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// signatureWindow is how far a request's timestamp may be from the
+	// server's clock, either way.
+	signatureWindow = 5 * time.Minute
+	// unsignedBody stands in for the body hash of streamed uploads, which
+	// can't be hashed before they're sent.
+	unsignedBody = "-"
+)
+
+// requestSignature is what clients sign every request with: the method, the
+// file name the request asks for, the session, the time, a SHA-256 of the
+// body, and the fields that say what to do with it: the destination as
+// sent, the close flag and the capabilities (see signedCapabilities). Only
+// the file name of the path is covered, so -path-prefix and proxies
+// rewriting the path don't get in the way.
+func requestSignature(secret []byte, method, file, sessionID, timestamp, bodyHash, destination, closeFlag, capabilities string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, file, sessionID, timestamp, bodyHash, destination, closeFlag, capabilities}, "\n")))
+	return mac.Sum(nil)
+}
+
+// signedCapabilities is X-Capabilities as signed: trimmed, without empty or
+// repeated entries, sorted and joined with commas, so the order clients
+// build the list in doesn't matter.
+func signedCapabilities(header string) string {
+	var capabilities []string
+	seen := make(map[string]bool)
+	for _, c := range strings.Split(header, ",") {
+		if c = strings.TrimSpace(c); c != "" && !seen[c] {
+			seen[c] = true
+			capabilities = append(capabilities, c)
+		}
+	}
+	sort.Strings(capabilities)
+	return strings.Join(capabilities, ",")
+}
+
+// requestFile is the last element of the path the client asked for, before
+// any -path-prefix was stripped.
+func requestFile(r *http.Request) string {
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.Path
+	}
+	uri, _, _ = strings.Cut(uri, "?")
+	return path.Base(uri)
+}
+
+// signatureCheck verifies request signatures and turns away any it has
+// seen before, remembering each until its timestamp leaves the window.
+type signatureCheck struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+func newSignatureCheck() *signatureCheck {
+	return &signatureCheck{seen: make(map[string]time.Time), swept: time.Now()}
+}
+
+// verify checks the signature of r. It reads the body to hash it and puts
+// it back for the handler, except for streamed uploads, which are signed
+// with unsignedBody: only requests the server takes as streams (h2 and h3
+// with -transport) may be. legacy accepts the signatures of clients from
+// before requestSignature covered the destination (-legacy-auth).
+func (c *signatureCheck) verify(r *http.Request, secret []byte, sessionID, timestamp, signature string, streaming, legacy bool) error {
+	millis, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	signedAt := time.UnixMilli(millis)
+	if skew := time.Since(signedAt); skew > signatureWindow || skew < -signatureWindow {
+		return fmt.Errorf("timestamp is %s off, check the client's clock", skew.Round(time.Second))
+	}
+
+	bodyHash := unsignedBody
+	if hasCapability(r, "stream") && !streaming {
+		// Reading a stream like a POST would never finish
+		return errors.New("streamed body outside a stream")
+	}
+	if !streaming {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBatchBytes+1))
+		if err != nil {
+			return err
+		}
+		if len(body) > maxBatchBytes {
+			return errors.New("body too large")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		bodyHash = hex.EncodeToString(sum[:])
+	}
+
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("bad signature")
+	}
+	file := requestFile(r)
+	ok := hmac.Equal(got, requestSignature(secret, r.Method, file, sessionID, timestamp, bodyHash,
+		r.Header.Get("X-Requested-With"), r.Header.Get("X-Connection-Close"), signedCapabilities(r.Header.Get("X-Capabilities"))))
+	if !ok && (legacy || hasCapability(r, compatV1)) {
+		// Signed like before the destination, close flag and capabilities
+		// were covered
+		ok = hmac.Equal(got, v1Signature(secret, r.Method, file, sessionID, timestamp, bodyHash))
+	}
+	if !ok {
+		return errors.New("bad signature")
+	}
+
+	// Keyed on the MAC itself: the hex may come in either case
+	key := string(got)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, seen := c.seen[key]; seen {
+		return errors.New("replayed request")
+	}
+	now := time.Now()
+	if now.Sub(c.swept) > time.Minute {
+		for sig, expires := range c.seen {
+			if now.After(expires) {
+				delete(c.seen, sig)
+			}
+		}
+		c.swept = now
+	}
+	c.seen[key] = signedAt.Add(signatureWindow)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("correct horse battery staple")
+
+// signedRequest is a request as a client sends it, signed with sign.
+type signedRequest struct {
+	body         string
+	destination  string
+	closeFlag    string
+	capabilities string
+	signedAt     time.Time
+}
+
+func (s signedRequest) build(sign func(timestamp, bodyHash string) []byte, unsigned bool) (*http.Request, string, string) {
+	r := httptest.NewRequest(http.MethodPost, "/assets/app.js", strings.NewReader(s.body))
+	r.Header.Set("X-Requested-With", s.destination)
+	if s.closeFlag != "" {
+		r.Header.Set("X-Connection-Close", s.closeFlag)
+	}
+	if s.capabilities != "" {
+		r.Header.Set("X-Capabilities", s.capabilities)
+	}
+	signedAt := s.signedAt
+	if signedAt.IsZero() {
+		signedAt = time.Now()
+	}
+	timestamp := strconv.FormatInt(signedAt.UnixMilli(), 10)
+	bodyHash := unsignedBody
+	if !unsigned {
+		sum := sha256.Sum256([]byte(s.body))
+		bodyHash = hex.EncodeToString(sum[:])
+	}
+	return r, timestamp, hex.EncodeToString(sign(timestamp, bodyHash))
+}
+
+func TestVerifySignature(t *testing.T) {
+	const sessionID = "0123456789abcdef0123456789abcdef"
+	signed := signedRequest{body: "hello", destination: "bG9jYWxob3N0OjIy", capabilities: "pad,seq,crc"}
+	sign := func(secret []byte, s signedRequest) func(string, string) []byte {
+		return func(timestamp, bodyHash string) []byte {
+			return requestSignature(secret, http.MethodPost, "app.js", sessionID, timestamp, bodyHash,
+				s.destination, s.closeFlag, signedCapabilities(s.capabilities))
+		}
+	}
+	fiveLines := func(timestamp, bodyHash string) []byte {
+		return v1Signature(testSecret, http.MethodPost, "app.js", sessionID, timestamp, bodyHash)
+	}
+
+	tests := []struct {
+		name      string
+		sent      signedRequest               // what the request carries
+		sign      func(string, string) []byte // nil signs sent with testSecret
+		signature string                      // sent instead of the signature
+		tamper    func(r *http.Request)       // changes the request after signing
+		streaming bool                        // the server takes it as a stream
+		legacy    bool                        // -legacy-auth
+		unsigned  bool                        // signed with unsignedBody
+		wantErr   string                      // "" for accepted
+	}{
+		{name: "valid", sent: signed},
+		{name: "capabilities in another order", sent: signed, tamper: func(r *http.Request) {
+			r.Header.Set("X-Capabilities", "crc, seq,pad,pad")
+		}},
+		{name: "wrong secret", sent: signed, sign: sign([]byte("wrong"), signed), wantErr: "bad signature"},
+		{name: "not hex", sent: signed, signature: "not hex", wantErr: "bad signature"},
+		{name: "destination changed", sent: signed, tamper: func(r *http.Request) {
+			r.Header.Set("X-Requested-With", "ZXZpbC5leGFtcGxlOjIy")
+		}, wantErr: "bad signature"},
+		{name: "close flag added", sent: signed, tamper: func(r *http.Request) {
+			r.Header.Set("X-Connection-Close", "true")
+		}, wantErr: "bad signature"},
+		{name: "capability added", sent: signed, tamper: func(r *http.Request) {
+			r.Header.Set("X-Capabilities", "pad,seq,crc,known")
+		}, wantErr: "bad signature"},
+		{name: "method changed", sent: signed, tamper: func(r *http.Request) {
+			r.Method = http.MethodGet
+		}, wantErr: "bad signature"},
+		{name: "body changed", sent: signed, tamper: func(r *http.Request) {
+			r.Body = http.NoBody
+		}, wantErr: "bad signature"},
+		{name: "clock a little behind", sent: signedRequest{body: "hello", signedAt: time.Now().Add(-4 * time.Minute)}},
+		{name: "clock a little ahead", sent: signedRequest{body: "hello", signedAt: time.Now().Add(4 * time.Minute)}},
+		{name: "clock too far behind", sent: signedRequest{body: "hello", signedAt: time.Now().Add(-6 * time.Minute)}, wantErr: "check the client's clock"},
+		{name: "clock too far ahead", sent: signedRequest{body: "hello", signedAt: time.Now().Add(6 * time.Minute)}, wantErr: "check the client's clock"},
+		{name: "five lines", sent: signed, sign: fiveLines, wantErr: "bad signature"},
+		{name: "five lines with -legacy-auth", sent: signed, sign: fiveLines, legacy: true},
+		{name: "five lines from a v1 client", sent: signedRequest{body: "hello", capabilities: "v1"}, sign: fiveLines},
+		{name: "stream", sent: signedRequest{capabilities: "stream"}, streaming: true, unsigned: true},
+		{name: "stream capability on a POST", sent: signedRequest{body: "hello", capabilities: "stream"}, unsigned: true, wantErr: "streamed body outside a stream"},
+		{name: "unsigned body on a POST", sent: signed, unsigned: true, wantErr: "bad signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signWith := tt.sign
+			if signWith == nil {
+				signWith = sign(testSecret, tt.sent)
+			}
+			r, timestamp, signature := tt.sent.build(signWith, tt.unsigned)
+			if tt.signature != "" {
+				signature = tt.signature
+			}
+			if tt.tamper != nil {
+				tt.tamper(r)
+			}
+			err := newSignatureCheck().verify(r, testSecret, sessionID, timestamp, signature, tt.streaming, tt.legacy)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("verify() = %v, want accepted", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("verify() accepted, want %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("verify() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureReplay(t *testing.T) {
+	const sessionID = "0123456789abcdef0123456789abcdef"
+	sent := signedRequest{body: "hello", destination: "bG9jYWxob3N0OjIy"}
+	sign := func(timestamp, bodyHash string) []byte {
+		return requestSignature(testSecret, http.MethodPost, "app.js", sessionID, timestamp, bodyHash, sent.destination, "", "")
+	}
+	check := newSignatureCheck()
+
+	r, timestamp, signature := sent.build(sign, false)
+	if err := check.verify(r, testSecret, sessionID, timestamp, signature, false, false); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	r, _, _ = sent.build(sign, false)
+	if err := check.verify(r, testSecret, sessionID, timestamp, signature, false, false); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("replayed request: verify() = %v, want replayed", err)
+	}
+	r, _, _ = sent.build(sign, false)
+	if err := check.verify(r, testSecret, sessionID, timestamp, strings.ToUpper(signature), false, false); err == nil || !strings.Contains(err.Error(), "replayed request") {
+		t.Fatalf("replayed in upper case: verify() = %v, want replayed request", err)
+	}
+
+	// The same request signed a moment later is a new one
+	sent.signedAt = time.Now().Add(time.Millisecond * 5)
+	r, timestamp, signature = sent.build(sign, false)
+	if err := check.verify(r, testSecret, sessionID, timestamp, signature, false, false); err != nil {
+		t.Fatalf("request signed again: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sseKeepalive is how often an idle event stream gets a comment line, well
+// inside the CDN's idle timeout.
+const sseKeepalive = 20 * time.Second
+
+// isEventStream reports whether a GET asks for -transport sse downstream.
+func isEventStream(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// serveSSE pushes upstream data to the client as server-sent events for as
+// long as the request lasts; the client keeps uploading with POSTs. When the
+// upstream connection ends the client gets a "close" event.
+func (s *Server) serveSSE(w http.ResponseWriter, r *http.Request, session *Session, tenant, metricsHost string) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	buffer := make([]byte, 32*1024)
+	for r.Context().Err() == nil {
+		session.conn.SetReadDeadline(time.Now().Add(sseKeepalive))
+		n, err := session.conn.Read(buffer)
+		if n > 0 {
+			session.mu.Lock()
+			session.lastActive = time.Now()
+			session.mu.Unlock()
+
+			if s.fair.wait(r.Context(), "downstream", session.owner, n) != nil {
+				return
+			}
+			event := "data: " + base64.StdEncoding.EncodeToString(buffer[:n]) + "\n\n"
+			if _, werr := io.WriteString(w, event); werr != nil {
+				return
+			}
+			s.addBytes(session, "downstream", tenant, metricsHost, n)
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if n == 0 {
+				io.WriteString(w, ":\n\n")
+			}
+		} else if err != nil {
+			if err != io.EOF {
+				slog.Debug("Reading from destination failed", "client", session.clientIP, "err", err)
+			}
+			io.WriteString(w, "event: close\ndata:\n\n")
+			rc.Flush()
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"math"
+)
+
+// encodePNG hides data in the pixels of a grayscale PNG. The first four
+// pixels hold the payload length (big endian), the payload follows and the
+// rest of the last row is random noise. The result is a perfectly valid image
+// with correct chunk CRCs, so it survives content sniffing and validation.
+func encodePNG(data []byte) ([]byte, error) {
+	n := 4 + len(data)
+	width := int(math.Ceil(math.Sqrt(float64(n))))
+	height := (n + width - 1) / width
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	binary.BigEndian.PutUint32(img.Pix, uint32(len(data)))
+	copy(img.Pix[4:], data)
+	cryptorand.Read(img.Pix[n:])
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
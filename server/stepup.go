@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// An approval covers one client and destination for this long
+	stepUpValidity = 24 * time.Hour
+	// Clients give up on a request after 30 seconds
+	stepUpWebhookTimeout = 25 * time.Second
+	totpPeriod           = 30
+	// After this many wrong codes in a row a client is locked out of TOTP,
+	// for a minute at first and twice as long with each wrong code after
+	maxTOTPFailures = 5
+	totpLockout     = time.Minute
+	maxTOTPLockout  = time.Hour
+)
+
+// stepUp asks for a second factor before the first session of the day from
+// a client to a sensitive destination: a TOTP code sent by the client, or an
+// approval from a webhook.
+type stepUp struct {
+	sensitive *destMatcher
+	totp      map[string][]byte // client -> secret, "*" for anyone else
+	webhook   string
+
+	mu       sync.Mutex
+	approved map[string]time.Time // client|destination -> expiry
+	lastStep map[string]int64     // client -> last TOTP step used
+	failures map[string]*totpFailures
+	pending  map[string]*stepUpCheck
+}
+
+// totpFailures are the wrong codes a client sent since its last good one.
+type totpFailures struct {
+	count int
+	until time.Time // locked out until then
+}
+
+// stepUpCheck is a webhook call that concurrent requests for the same client
+// and destination wait on together.
+type stepUpCheck struct {
+	done     chan struct{}
+	approved bool
+}
+
+func newStepUp(sensitive *destMatcher, totp map[string][]byte, webhook string) *stepUp {
+	return &stepUp{
+		sensitive: sensitive,
+		totp:      totp,
+		webhook:   webhook,
+		approved:  make(map[string]time.Time),
+		lastStep:  make(map[string]int64),
+		failures:  make(map[string]*totpFailures),
+		pending:   make(map[string]*stepUpCheck),
+	}
+}
+
+// loadTOTPSecrets reads "client base32-secret" lines, where client is a key
+// ID, a client certificate user or * for everyone else.
+func loadTOTPSecrets(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secrets := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"client secret\"", path, line)
+		}
+		encoded := strings.ToUpper(strings.TrimRight(fields[1], "="))
+		secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("%s:%d: invalid base32 secret", path, line)
+		}
+		secrets[fields[0]] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// totpCode computes the RFC 6238 code (SHA-1, 6 digits) for a time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// checkTOTP accepts the current code or either neighbour, but never the same
+// or an older step twice for one client. Wrong codes count towards a
+// lockout, a good one clears them.
+func (u *stepUp) checkTOTP(secret []byte, client, code string) bool {
+	now := time.Now().Unix() / totpPeriod
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for step := now - 1; step <= now+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+		if step <= u.lastStep[client] {
+			break
+		}
+		u.lastStep[client] = step
+		delete(u.failures, client)
+		return true
+	}
+
+	f := u.failures[client]
+	if f == nil {
+		f = &totpFailures{}
+		u.failures[client] = f
+	}
+	f.count++
+	if f.count >= maxTOTPFailures {
+		lockout := min(totpLockout<<min(f.count-maxTOTPFailures, 6), maxTOTPLockout)
+		f.until = time.Now().Add(lockout)
+	}
+	return false
+}
+
+// lockedOut is how long client has to wait before it may send a code again.
+func (u *stepUp) lockedOut(client string) time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if f := u.failures[client]; f != nil {
+		return max(time.Until(f.until), 0)
+	}
+	return 0
+}
+
+// askWebhook posts the request to the webhook and treats any 2xx answer
+// within the timeout as approval.
+func (u *stepUp) askWebhook(client, clientIP, destination string) bool {
+	body, err := json.Marshal(map[string]string{
+		"client":      client,
+		"client_ip":   clientIP,
+		"destination": destination,
+	})
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stepUpWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.webhook, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Step-up webhook failed: %v", err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// webhookApproval runs at most one webhook call per client and destination
+// at a time.
+func (u *stepUp) webhookApproval(key, client, clientIP, destination string) bool {
+	u.mu.Lock()
+	check, running := u.pending[key]
+	if !running {
+		check = &stepUpCheck{done: make(chan struct{})}
+		u.pending[key] = check
+	}
+	u.mu.Unlock()
+
+	if running {
+		<-check.done
+		return check.approved
+	}
+	check.approved = u.askWebhook(client, clientIP, destination)
+	u.mu.Lock()
+	delete(u.pending, key)
+	u.mu.Unlock()
+	close(check.done)
+	return check.approved
+}
+
+// requireStepUp decides whether a new session from client to destination
+// may go ahead, answering the request itself when it may not.
+func (s *Server) requireStepUp(w http.ResponseWriter, r *http.Request, client, clientIP, destination string) bool {
+	u := s.stepUp
+	key := client + "|" + destination
+
+	u.mu.Lock()
+	expires, ok := u.approved[key]
+	u.mu.Unlock()
+	if ok && time.Now().Before(expires) {
+		return true
+	}
+
+	secret, hasTOTP := u.totp[client]
+	if !hasTOTP {
+		secret, hasTOTP = u.totp["*"]
+	}
+
+	var approved bool
+	var method string
+	switch {
+	case hasTOTP:
+		method = "TOTP"
+		if left := u.lockedOut(client); left > 0 {
+			s.warn("Step-up locked out", "client", client, "retry_in", left.Round(time.Second))
+			s.metrics.authFailures.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return false
+		}
+		// X-Otp isn't signed, and needn't be: a code is good once (see
+		// checkTOTP) and only approves the request it came on, whose client
+		// and destination are. Lifting it off the wire gets nobody a session
+		// without the client's key or certificate.
+		code := r.Header.Get("X-Otp")
+		if code == "" {
+			w.Header().Set("X-Step-Up", "totp")
+			http.Error(w, "Step-up required", http.StatusUnauthorized)
+			return false
+		}
+		approved = u.checkTOTP(secret, client, code)
+	case u.webhook != "":
+		method = "webhook"
+		approved = u.webhookApproval(key, client, clientIP, destination)
+	default:
+		method = "no second factor"
+	}
+
+	// -nolog-dest destinations are left out, the rest of the line stays
+	attrs := []any{"method", method, "client", client}
+	if !s.noLogDests.match(destination) {
+		attrs = append(attrs, "dest", destination)
+	}
+	if !approved {
+		s.warn("Step-up denied", attrs...)
+		s.metrics.authFailures.Inc()
+		if method == "TOTP" {
+			w.Header().Set("X-Step-Up", "totp")
+			http.Error(w, "Step-up required", http.StatusUnauthorized)
+			return false
+		}
+		http.Error(w, "Step-up denied", http.StatusForbidden)
+		return false
+	}
+
+	u.mu.Lock()
+	u.approved[key] = time.Now().Add(stepUpValidity)
+	for k, expires := range u.approved {
+		if time.Now().After(expires) {
+			delete(u.approved, k)
+		}
+	}
+	u.mu.Unlock()
+	s.info("Step-up approved", append(attrs, "valid", stepUpValidity)...)
+	return true
+}
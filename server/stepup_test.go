@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStepUpLockout(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	s := &Server{silent: true, stepUp: newStepUp(nil, map[string][]byte{"alice": secret}, "")}
+	s.metrics = newMetrics(s, 10)
+	u := s.stepUp
+
+	step := func(client, code string) int {
+		r := httptest.NewRequest(http.MethodPost, "/assets/app.js", nil)
+		r.Header.Set("X-Otp", code)
+		w := httptest.NewRecorder()
+		s.requireStepUp(w, r, client, "192.0.2.1", "db.internal:5432")
+		return w.Code
+	}
+	good := func() string { return totpCode(secret, time.Now().Unix()/totpPeriod) }
+
+	// A good code clears the wrong ones before it
+	for i := 0; i < maxTOTPFailures-1; i++ {
+		if code := step("alice", "000000"); code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status %d, want %d", i+1, code, http.StatusUnauthorized)
+		}
+	}
+	if code := step("alice", good()); code != http.StatusOK {
+		t.Fatalf("good code: status %d, want %d", code, http.StatusOK)
+	}
+	if u.failures["alice"] != nil {
+		t.Fatalf("good code left %d failures", u.failures["alice"].count)
+	}
+
+	u.approved = make(map[string]time.Time)
+	for i := 0; i < maxTOTPFailures; i++ {
+		step("alice", "000000")
+	}
+	if left := u.lockedOut("alice"); left <= totpLockout-time.Second || left > totpLockout {
+		t.Fatalf("locked out for %v after %d wrong codes, want %v", left, maxTOTPFailures, totpLockout)
+	}
+	if left := u.lockedOut("bob"); left != 0 {
+		t.Fatalf("bob locked out for %v", left)
+	}
+
+	// Even a good code is refused while locked out
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/assets/app.js", nil)
+	r.Header.Set("X-Otp", good())
+	s.requireStepUp(w, r, "alice", "192.0.2.1", "db.internal:5432")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("good code while locked out: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Each wrong code after the lockout doubles it, up to maxTOTPLockout
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{maxTOTPFailures + 1, 2 * totpLockout},
+		{maxTOTPFailures + 2, 4 * totpLockout},
+		{maxTOTPFailures + 20, maxTOTPLockout},
+	}
+	for _, tt := range tests {
+		u.failures["alice"] = &totpFailures{count: tt.failures - 1}
+		u.checkTOTP(secret, "alice", "000000")
+		if left := u.lockedOut("alice"); left <= tt.want-time.Second || left > tt.want {
+			t.Errorf("locked out for %v after %d wrong codes, want %v", left, tt.failures, tt.want)
+		}
+	}
+}
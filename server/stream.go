@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// serveStream carries a whole session over one HTTP/2 request: the request
+// body is streamed upstream as it arrives and upstream data is flushed into
+// the response as soon as it's read. The session ends with the request.
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request, session *Session, sessionKey, tenant, metricsHost string) {
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	defer func() {
+		if _, exists := s.sessions.LoadAndDelete(sessionKey); exists {
+			session.conn.Close()
+		}
+	}()
+
+	// Polls leave a short read deadline behind
+	session.conn.SetReadDeadline(time.Time{})
+
+	touch := func() {
+		session.mu.Lock()
+		session.lastActive = time.Now()
+		session.mu.Unlock()
+	}
+
+	// Client to upstream
+	go func() {
+		defer session.conn.Close()
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := r.Body.Read(buffer)
+			if n > 0 {
+				touch()
+				if s.fair.wait(r.Context(), "upstream", session.owner, n) != nil {
+					return
+				}
+				if _, werr := session.conn.Write(buffer[:n]); werr != nil {
+					slog.Debug("Writing to destination failed", "client", session.clientIP, "err", werr)
+					return
+				}
+				s.addBytes(session, "upstream", tenant, metricsHost, n)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Upstream to client
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := session.conn.Read(buffer)
+		if n > 0 {
+			touch()
+			if s.fair.wait(r.Context(), "downstream", session.owner, n) != nil {
+				return
+			}
+			if _, werr := w.Write(buffer[:n]); werr != nil {
+				return
+			}
+			if rc.Flush() != nil {
+				return
+			}
+			s.addBytes(session, "downstream", tenant, metricsHost, n)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
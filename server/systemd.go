@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemd passes sockets it listens on for us, with a .socket unit, as file
+// descriptors from 3 on, and says how many in LISTEN_FDS. That lets it bind
+// port 443 while the server runs as a user that couldn't.
+const listenFDsStart = 3
+
+// systemdListener returns the first socket systemd passed, or nil when it
+// didn't pass any.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	// Not for the -a app or anything else we start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if count > 1 {
+		log.Printf("systemd passed %d sockets, only using the first", count)
+		for fd := listenFDsStart + 1; fd < listenFDsStart+count; fd++ {
+			os.NewFile(uintptr(fd), "").Close()
+		}
+	}
+	file := os.NewFile(listenFDsStart, "systemd socket")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket from systemd: %v", err)
+	}
+	return listener, nil
+}
+
+// sdNotify tells systemd about the server's state, for Type=notify units.
+// It does nothing when not started by one.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// Abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+	}
+}
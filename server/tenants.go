@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tenant is a team sharing the server with others. Its keys, allowed
+// destinations, session limit and session namespace are its own.
+type tenant struct {
+	name        string
+	allowed     *destMatcher // nil allows any destination
+	maxSessions int          // 0 for no limit
+}
+
+// tenantsFile is the -tenants file format:
+//
+//	{"tenants": [
+//	  {"name": "team-a", "keys": ["a1:secret"], "allow": ["*.a.internal"], "max_sessions": 20}
+//	]}
+type tenantsFile struct {
+	Tenants []struct {
+		Name        string   `json:"name"`
+		Keys        []string `json:"keys"`
+		Allow       []string `json:"allow"`
+		MaxSessions int      `json:"max_sessions"`
+	} `json:"tenants"`
+}
+
+// loadTenants reads a tenants file and adds every tenant's keys to keys,
+// which may be nil. It returns the combined key ring and the tenant each
+// key ID belongs to. Key IDs must be unique across tenants and -psk.
+func loadTenants(path string, keys *keyRing) (*keyRing, map[string]*tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var file tenantsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if len(file.Tenants) == 0 {
+		return nil, nil, fmt.Errorf("no tenants in %s", path)
+	}
+
+	if keys == nil {
+		keys = &keyRing{keys: make(map[string][]byte)}
+	}
+	byKey := make(map[string]*tenant)
+	names := make(map[string]bool)
+	for _, t := range file.Tenants {
+		if t.Name == "" || strings.ContainsAny(t.Name, "/@") {
+			return nil, nil, fmt.Errorf("invalid tenant name %q", t.Name)
+		}
+		if names[t.Name] {
+			return nil, nil, fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+
+		ten := &tenant{name: t.Name, maxSessions: t.MaxSessions}
+		if len(t.Allow) > 0 {
+			if ten.allowed, err = parseDestMatcher(strings.Join(t.Allow, ",")); err != nil {
+				return nil, nil, fmt.Errorf("tenant %s: %v", t.Name, err)
+			}
+		}
+
+		ring, err := parseKeyRing(strings.Join(t.Keys, ","))
+		if err != nil {
+			return nil, nil, fmt.Errorf("tenant %s: %v", t.Name, err)
+		}
+		for _, id := range ring.order {
+			if _, exists := keys.keys[id]; exists {
+				return nil, nil, fmt.Errorf("tenant %s: key ID %q is already in use", t.Name, id)
+			}
+			keys.keys[id] = ring.keys[id]
+			keys.order = append(keys.order, id)
+			byKey[id] = ten
+		}
+	}
+	return keys, byKey, nil
+}
+
+// tenantSessions counts the open sessions belonging to t.
+func (s *Server) tenantSessions(t *tenant) int {
+	count := 0
+	s.sessions.Range(func(key, value interface{}) bool {
+		if value.(*Session).tenant == t.name {
+			count++
+		}
+		return true
+	})
+	return count
+}
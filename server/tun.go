@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+const (
+	// tunDestination is the destination -tun clients ask for. It works like
+	// a named service, so restricted users and tenants need it allowed.
+	tunDestination = "tun"
+	// tunMTU leaves room for the tunnel's own overhead on typical paths.
+	tunMTU = 1400
+	// tunQueue is how many packets may wait for a client's next poll
+	// before more are dropped.
+	tunQueue = 256
+	// tunWriteSize is about how much is handed to a session at once, so a
+	// burst of packets goes out in one response.
+	tunWriteSize = 32 * 1024
+)
+
+// tunServer hands each -tun session an address on its network and moves IP
+// packets between the sessions and a TUN device. Packets travel the tunnel
+// as length-prefixed frames, like UDP datagrams; the first frame a session
+// gets is a zero byte followed by its settings.
+type tunServer struct {
+	dev     io.ReadWriteCloser
+	name    string
+	network netip.Prefix
+	gateway netip.Addr
+
+	mu    sync.Mutex
+	peers map[netip.Addr]chan []byte
+}
+
+func newTunServer(cidr string) (*tunServer, error) {
+	network, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	network = network.Masked()
+	if !network.Addr().Is4() || network.Bits() > 30 {
+		return nil, fmt.Errorf("%s: need an IPv4 network of at least four addresses", cidr)
+	}
+
+	dev, name, err := openTun("darkflare%d")
+	if err != nil {
+		return nil, err
+	}
+	t := &tunServer{
+		dev:     dev,
+		name:    name,
+		network: network,
+		gateway: network.Addr().Next(),
+		peers:   make(map[netip.Addr]chan []byte),
+	}
+	gateway := netip.PrefixFrom(t.gateway, network.Bits()).String()
+	if err := ipCommand("addr", "add", gateway, "dev", name); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := ipCommand("link", "set", "dev", name, "mtu", fmt.Sprint(tunMTU), "up"); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	go t.readPackets()
+	return t, nil
+}
+
+// target is what the destination checks see for a -tun session.
+func (t *tunServer) target() string {
+	return net.JoinHostPort(t.gateway.String(), "1")
+}
+
+// attach gives a new session an address and returns its end of the
+// tunnel. Packets from it only go out if policy lets them.
+func (t *tunServer) attach(policy *destPolicy) (net.Conn, error) {
+	t.mu.Lock()
+	addr := t.gateway.Next()
+	for ; t.network.Contains(addr.Next()); addr = addr.Next() {
+		if _, used := t.peers[addr]; !used {
+			break
+		}
+	}
+	if !t.network.Contains(addr.Next()) {
+		t.mu.Unlock()
+		return nil, errors.New("no free addresses left on the -tun network")
+	}
+	in := make(chan []byte, tunQueue)
+	t.peers[addr] = in
+	t.mu.Unlock()
+
+	session, tunnel := net.Pipe()
+	go t.serve(tunnel, addr, in, policy)
+	return session, nil
+}
+
+func (t *tunServer) serve(tunnel net.Conn, addr netip.Addr, in chan []byte, policy *destPolicy) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.peers, addr)
+		t.mu.Unlock()
+		tunnel.Close()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		settings := fmt.Sprintf("\x00addr=%s gateway=%s mtu=%d",
+			netip.PrefixFrom(addr, t.network.Bits()), t.gateway, tunMTU)
+		if _, err := tunnel.Write(appendFrame(nil, []byte(settings))); err != nil {
+			return
+		}
+		for {
+			select {
+			case packet := <-in:
+				if writeQueued(tunnel, packet, in) != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Only packets from the session's own address, to somewhere the
+	// destination policy allows, go out
+	var partial []byte
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := tunnel.Read(buffer)
+		if err != nil {
+			return
+		}
+		partial, _ = splitFrames(append(partial, buffer[:n]...), func(packet []byte) error {
+			if len(packet) < 20 || packet[0]>>4 != 4 || netip.AddrFrom4([4]byte(packet[12:16])) != addr {
+				return nil
+			}
+			if dest, port, ok := packetDest(packet); ok && policy.permits(dest, port) {
+				t.dev.Write(packet)
+			}
+			return nil
+		})
+	}
+}
+
+// packetDest returns where an IPv4 packet goes: the address, and for TCP
+// and UDP the port, 0 for other protocols and later fragments. ok is false
+// for packets that don't say, and for fragments at offset 8 that could
+// overwrite the port of the first one (RFC 1858).
+func packetDest(packet []byte) (dest netip.Addr, port int, ok bool) {
+	headerSize := int(packet[0]&0x0f) * 4
+	if headerSize < 20 || len(packet) < headerSize {
+		return netip.Addr{}, 0, false
+	}
+	dest = netip.AddrFrom4([4]byte(packet[16:20]))
+	protocol := packet[9]
+	if protocol != 6 && protocol != 17 {
+		return dest, 0, true
+	}
+	switch binary.BigEndian.Uint16(packet[6:8]) & 0x1fff {
+	case 0:
+		if len(packet) < headerSize+4 {
+			return netip.Addr{}, 0, false
+		}
+		return dest, int(binary.BigEndian.Uint16(packet[headerSize+2:])), true
+	case 1:
+		return netip.Addr{}, 0, false
+	}
+	return dest, 0, true
+}
+
+func (t *tunServer) readPackets() {
+	buffer := make([]byte, 65535)
+	for {
+		n, err := t.dev.Read(buffer)
+		if err != nil {
+			log.Printf("Error reading from %s: %v", t.name, err)
+			return
+		}
+		if n < 20 || buffer[0]>>4 != 4 {
+			continue
+		}
+		t.mu.Lock()
+		in := t.peers[netip.AddrFrom4([4]byte(buffer[16:20]))]
+		t.mu.Unlock()
+		if in == nil {
+			continue
+		}
+		select {
+		case in <- append([]byte(nil), buffer[:n]...):
+		default:
+		}
+	}
+}
+
+// writeQueued writes packet and whatever else is already queued as one
+// batch of frames.
+func writeQueued(w io.Writer, packet []byte, queue chan []byte) error {
+	batch := appendFrame(nil, packet)
+drain:
+	for len(batch) < tunWriteSize {
+		select {
+		case packet := <-queue:
+			batch = appendFrame(batch, packet)
+		default:
+			break drain
+		}
+	}
+	_, err := w.Write(batch)
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openTun(pattern string) (io.ReadWriteCloser, string, error) {
+	return nil, "", errors.New("-tun is only supported on Linux")
+}
+
+func ipCommand(args ...string) error {
+	return errors.New("-tun is only supported on Linux")
+}
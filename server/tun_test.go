@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// ipv4Packet is a bare IPv4 packet to dest of the given protocol and
+// fragment offset, with the ports of a TCP or UDP header after it.
+func ipv4Packet(dest string, protocol byte, fragment uint16, destPort uint16) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[6:], fragment)
+	packet[9] = protocol
+	copy(packet[12:16], netip.MustParseAddr("10.99.0.2").AsSlice())
+	copy(packet[16:20], netip.MustParseAddr(dest).AsSlice())
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], destPort)
+	return packet
+}
+
+func TestTunPacketPolicy(t *testing.T) {
+	policy := &destPolicy{denyPorts: portSet{{25, 25}, {445, 445}}}
+	policy.deny, _ = parseDestMatcher("169.254.0.0/16")
+	policy.allow, _ = parseDestMatcher("10.0.0.0/8,192.168.1.10:22")
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"tcp allowed", ipv4Packet("10.1.2.3", 6, 0, 443), true},
+		{"udp allowed", ipv4Packet("10.1.2.3", 17, 0, 53), true},
+		{"denied port", ipv4Packet("10.1.2.3", 6, 0, 445), false},
+		{"denied port over udp", ipv4Packet("10.1.2.3", 17, 0, 25), false},
+		{"denied network", ipv4Packet("169.254.169.254", 6, 0, 80), false},
+		{"not allowed", ipv4Packet("8.8.8.8", 17, 0, 53), false},
+		{"allowed on one port", ipv4Packet("192.168.1.10", 6, 0, 22), true},
+		{"allowed on another port", ipv4Packet("192.168.1.10", 6, 0, 80), false},
+		{"icmp to an allowed network", ipv4Packet("10.1.2.3", 1, 0, 0), true},
+		{"icmp to a host allowed on one port", ipv4Packet("192.168.1.10", 1, 0, 0), false},
+		{"later fragment", ipv4Packet("10.1.2.3", 6, 100, 445), true},
+		{"fragment overwriting the port", ipv4Packet("10.1.2.3", 6, 1, 443), false},
+		{"header cut short", ipv4Packet("10.1.2.3", 6, 0, 443)[:21], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, port, ok := packetDest(tt.packet)
+			if got := ok && policy.permits(dest, port); got != tt.want {
+				t.Errorf("let through: %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// datagramConn relays UDP for clients listening with -l udp:PORT. The tunnel
+// carries each datagram as its length in two big-endian bytes followed by
+// the payload; datagramConn turns that stream back into datagrams and back.
+type datagramConn struct {
+	*net.UDPConn
+	readBuf []byte
+	unread  []byte // rest of the frame being read
+	partial []byte // incomplete frame from the client
+}
+
+func dialDatagram(addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{UDPConn: conn, readBuf: make([]byte, 2+65535)}, nil
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	for len(c.unread) == 0 {
+		n, err := c.UDPConn.Read(c.readBuf[2:])
+		if refused(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(c.readBuf, uint16(n))
+		c.unread = c.readBuf[:2+n]
+	}
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	var err error
+	c.partial, err = splitFrames(append(c.partial, p...), func(datagram []byte) error {
+		if _, err := c.UDPConn.Write(datagram); err != nil && !refused(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// splitFrames calls send for each complete length-prefixed frame in data
+// and returns what's left of an incomplete one, reusing data's storage.
+func splitFrames(data []byte, send func([]byte) error) ([]byte, error) {
+	rest := data
+	for len(rest) >= 2 {
+		n := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+n {
+			break
+		}
+		if err := send(rest[2 : 2+n]); err != nil {
+			return nil, err
+		}
+		rest = rest[2+n:]
+	}
+	return append(data[:0], rest...), nil
+}
+
+// appendFrame appends payload to b as one length-prefixed frame.
+func appendFrame(b, payload []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
@@ -0,0 +1,15 @@
+//go:build !plan9
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// refused reports an ICMP port unreachable for an earlier datagram. That's
+// routine for UDP (the destination isn't up yet) and shouldn't end the
+// session.
+func refused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
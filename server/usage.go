@@ -0,0 +1,285 @@
+//go:build !stealth
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// usage prints the server's options. Stealth builds print a bare list
+// instead, see usage_stealth.go.
+func usage() {
+	fmt.Fprintf(os.Stderr, "DarkFlare Server - TCP-over-CDN tunnel server component\n")
+	fmt.Fprintf(os.Stderr, "(c) 2024 Barrett Lyon\n\n")
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s invite [options]   Create a client invitation\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s check-zone [options]   Check the Cloudflare zone for problems\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s watch [options]   Live view of the sessions via the admin API\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s service install|uninstall|start|stop [name] [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "            Run as a Windows service\n\n")
+	fmt.Fprintf(os.Stderr, "Options:\n")
+	fmt.Fprintf(os.Stderr, "  -config   Load flags from a YAML file, keyed by flag name\n")
+	fmt.Fprintf(os.Stderr, "            (listen, cert, key, app and silent for the short ones)\n")
+	fmt.Fprintf(os.Stderr, "            Flags on the command line override the file\n\n")
+	fmt.Fprintf(os.Stderr, "  -o        Listen address for the server\n")
+	fmt.Fprintf(os.Stderr, "            Format: proto://[host]:port or unix:///path/to.sock\n")
+	fmt.Fprintf(os.Stderr, "            Default: http://0.0.0.0:8080\n\n")
+	fmt.Fprintf(os.Stderr, "  -trusted-proxies\n")
+	fmt.Fprintf(os.Stderr, "            Only believe X-Forwarded-For from these addresses\n")
+	fmt.Fprintf(os.Stderr, "            Format: ip|cidr[,ip|cidr...] (unix socket peers are trusted)\n")
+	fmt.Fprintf(os.Stderr, "            Default: Believe it from anyone\n\n")
+	fmt.Fprintf(os.Stderr, "  -path-prefix\n")
+	fmt.Fprintf(os.Stderr, "            Only serve the tunnel under this URL path, e.g. /assets/\n")
+	fmt.Fprintf(os.Stderr, "            The prefix is stripped; other paths get the redirect\n")
+	fmt.Fprintf(os.Stderr, "            Clients must use the same -path-prefix\n\n")
+	fmt.Fprintf(os.Stderr, "  -passthrough\n")
+	fmt.Fprintf(os.Stderr, "            Proxy paths outside -path-prefix to this site instead\n")
+	fmt.Fprintf(os.Stderr, "            of redirecting, e.g. http://127.0.0.1:8081\n\n")
+	fmt.Fprintf(os.Stderr, "  -allow-direct\n")
+	fmt.Fprintf(os.Stderr, "            Allow direct connections not coming through Cloudflare\n")
+	fmt.Fprintf(os.Stderr, "            Default: false (only allow Cloudflare IPs)\n\n")
+	fmt.Fprintf(os.Stderr, "  -c        Path to TLS certificate file\n")
+	fmt.Fprintf(os.Stderr, "            Required for https unless -acme is used\n")
+	fmt.Fprintf(os.Stderr, "            Reloaded when it changes or on SIGHUP\n\n")
+	fmt.Fprintf(os.Stderr, "  -k        Path to TLS private key file\n\n")
+	fmt.Fprintf(os.Stderr, "  -acme     Get certificates for these hostnames from Let's Encrypt\n")
+	fmt.Fprintf(os.Stderr, "            and renew them automatically, instead of -c and -k\n")
+	fmt.Fprintf(os.Stderr, "            Format: host[,host...] (https only)\n\n")
+	fmt.Fprintf(os.Stderr, "  -acme-email\n")
+	fmt.Fprintf(os.Stderr, "            Contact address for expiry and account notices\n\n")
+	fmt.Fprintf(os.Stderr, "  -acme-cache\n")
+	fmt.Fprintf(os.Stderr, "            Where certificates and the account key are kept\n")
+	fmt.Fprintf(os.Stderr, "            Default: <user cache dir>/darkflare/acme\n\n")
+	fmt.Fprintf(os.Stderr, "  -acme-http\n")
+	fmt.Fprintf(os.Stderr, "            Also answer HTTP-01 challenges on this address, e.g. :80\n")
+	fmt.Fprintf(os.Stderr, "            Default: TLS-ALPN-01 on the https listener only\n\n")
+	fmt.Fprintf(os.Stderr, "  -origin-pull-ca\n")
+	fmt.Fprintf(os.Stderr, "            Require Cloudflare's Authenticated Origin Pulls certificate\n")
+	fmt.Fprintf(os.Stderr, "            Path to the origin pull CA (PEM), HTTPS only\n")
+	fmt.Fprintf(os.Stderr, "            Default: Don't require client certificates\n\n")
+	fmt.Fprintf(os.Stderr, "  -debug    Enable detailed debug logging\n")
+	fmt.Fprintf(os.Stderr, "            Shows connection details and errors\n\n")
+	fmt.Fprintf(os.Stderr, "  -s        Silent mode\n")
+	fmt.Fprintf(os.Stderr, "            Suppresses all non-error output\n\n")
+	fmt.Fprintf(os.Stderr, "  -quiet    Print nothing, not even the startup banner or errors, unless\n")
+	fmt.Fprintf(os.Stderr, "            -log-file says where logs go (and then no banner there either)\n\n")
+	fmt.Fprintf(os.Stderr, "  -active-hours\n")
+	fmt.Fprintf(os.Stderr, "            Only run the tunnel during these windows\n")
+	fmt.Fprintf(os.Stderr, "            Format: Mon-Fri 08:00-18:00[,Sat 10:00-14:00...]\n")
+	fmt.Fprintf(os.Stderr, "            Outside them every request gets the redirect\n")
+	fmt.Fprintf(os.Stderr, "            Default: Always active\n\n")
+	fmt.Fprintf(os.Stderr, "  -active-tz\n")
+	fmt.Fprintf(os.Stderr, "            Time zone for -active-hours, e.g. Europe/Berlin\n")
+	fmt.Fprintf(os.Stderr, "            Default: Local\n\n")
+	fmt.Fprintf(os.Stderr, "  -pad-sizes\n")
+	fmt.Fprintf(os.Stderr, "            Pad responses to sizes drawn from this histogram\n")
+	fmt.Fprintf(os.Stderr, "            Format: bytes:weight[,bytes:weight...]\n")
+	fmt.Fprintf(os.Stderr, "            Example: 1024:30,4096:30,16384:25,65536:15\n")
+	fmt.Fprintf(os.Stderr, "            Default: No padding\n\n")
+	fmt.Fprintf(os.Stderr, "  -compress\n")
+	fmt.Fprintf(os.Stderr, "            Compression to use with -compress clients, in order of preference\n")
+	fmt.Fprintf(os.Stderr, "            Payloads that look encrypted or compressed are sent as they are\n")
+	fmt.Fprintf(os.Stderr, "            Default: zstd,gzip (off to never compress)\n\n")
+	fmt.Fprintf(os.Stderr, "  -endpoints\n")
+	fmt.Fprintf(os.Stderr, "            Signed list of other ways in to hand to -endpoints-key clients,\n")
+	fmt.Fprintf(os.Stderr, "            from go run ./tools/release endpoints (the .sig goes next to it)\n")
+	fmt.Fprintf(os.Stderr, "            Needs client authentication, others get the decoy\n")
+	fmt.Fprintf(os.Stderr, "            Re-read for every request, so it can be replaced at any time\n\n")
+	fmt.Fprintf(os.Stderr, "  -drain    On SIGTERM or SIGINT, tell clients and let open sessions\n")
+	fmt.Fprintf(os.Stderr, "            finish for up to this long before exiting, e.g. 60s\n")
+	fmt.Fprintf(os.Stderr, "            Default: Exit straight away\n\n")
+	fmt.Fprintf(os.Stderr, "  -max-cpu  Shed load above this CPU use, in percent of all CPUs\n")
+	fmt.Fprintf(os.Stderr, "            New sessions are refused first; if that doesn't help\n")
+	fmt.Fprintf(os.Stderr, "            within 5s, bulk transfers are slowed down too\n")
+	fmt.Fprintf(os.Stderr, "            Default: No limit (not supported on Windows)\n\n")
+	fmt.Fprintf(os.Stderr, "  -max-memory\n")
+	fmt.Fprintf(os.Stderr, "            Shed load above this memory use, e.g. 512MB\n")
+	fmt.Fprintf(os.Stderr, "            Default: No limit\n\n")
+	fmt.Fprintf(os.Stderr, "  -fair-share\n")
+	fmt.Fprintf(os.Stderr, "            Bandwidth per second, each way, to share fairly between clients\n")
+	fmt.Fprintf(os.Stderr, "            (users, keys or IPs) rather than sessions, e.g. 10MB\n")
+	fmt.Fprintf(os.Stderr, "            Set it a little under what the origin's link can do\n")
+	fmt.Fprintf(os.Stderr, "            Default: Off\n\n")
+	fmt.Fprintf(os.Stderr, "  -fair-weights\n")
+	fmt.Fprintf(os.Stderr, "            Give some clients a bigger share of -fair-share\n")
+	fmt.Fprintf(os.Stderr, "            Format: client=weight[,client=weight...]\n")
+	fmt.Fprintf(os.Stderr, "            Example: alice=4,203.0.113.7=2 (everyone else gets 1)\n\n")
+	fmt.Fprintf(os.Stderr, "  -log-file Write logs to a file instead of stderr\n\n")
+	fmt.Fprintf(os.Stderr, "  -log-format\n")
+	fmt.Fprintf(os.Stderr, "            text or json (one object per line, for log pipelines)\n")
+	fmt.Fprintf(os.Stderr, "            Default: text\n\n")
+	fmt.Fprintf(os.Stderr, "  -log-level\n")
+	fmt.Fprintf(os.Stderr, "            debug, info, warn or error (debug is the same as -debug)\n")
+	fmt.Fprintf(os.Stderr, "            Default: info\n\n")
+	fmt.Fprintf(os.Stderr, "  -log-encrypt-key\n")
+	fmt.Fprintf(os.Stderr, "            Encrypt each log line to these age public keys\n")
+	fmt.Fprintf(os.Stderr, "            Format: age1...[,age1...] (requires -log-file)\n\n")
+	fmt.Fprintf(os.Stderr, "  -nolog-dest\n")
+	fmt.Fprintf(os.Stderr, "            Never log sessions to these destinations\n")
+	fmt.Fprintf(os.Stderr, "            They are only counted in aggregate metrics\n")
+	fmt.Fprintf(os.Stderr, "            Format: pattern[,pattern...], e.g. *.corp.internal,10.0.0.0/8:22\n\n")
+	fmt.Fprintf(os.Stderr, "  -allow-dest\n")
+	fmt.Fprintf(os.Stderr, "            Only let clients connect to these destinations\n")
+	fmt.Fprintf(os.Stderr, "            Hostnames are resolved and checked by address too\n")
+	fmt.Fprintf(os.Stderr, "            Same patterns as -nolog-dest, e.g. 10.0.0.0/8:22,*.corp.internal\n\n")
+	fmt.Fprintf(os.Stderr, "  -deny-dest\n")
+	fmt.Fprintf(os.Stderr, "            Never let clients connect to these, even if allowed\n")
+	fmt.Fprintf(os.Stderr, "            Example: 127.0.0.0/8,169.254.0.0/16,10.0.0.0/8\n\n")
+	fmt.Fprintf(os.Stderr, "  -allow-ports\n")
+	fmt.Fprintf(os.Stderr, "            Only let clients connect to these ports\n")
+	fmt.Fprintf(os.Stderr, "            Format: port or range[,...], e.g. 22,443,8000-8999\n\n")
+	fmt.Fprintf(os.Stderr, "  -deny-ports\n")
+	fmt.Fprintf(os.Stderr, "            Never let clients connect to these ports\n")
+	fmt.Fprintf(os.Stderr, "            Example: 25,135-139,445 (mail and Windows file sharing)\n\n")
+	fmt.Fprintf(os.Stderr, "  -mirror   Copy the traffic of matching sessions somewhere\n")
+	fmt.Fprintf(os.Stderr, "            tcp://host:port gets what clients send, as is\n")
+	fmt.Fprintf(os.Stderr, "            pcap:/dir gets a capture file per session (both directions)\n")
+	fmt.Fprintf(os.Stderr, "            Format: filter=sink (repeat for more policies), where filter is\n")
+	fmt.Fprintf(os.Stderr, "            destination patterns or an expression like\n")
+	fmt.Fprintf(os.Stderr, "            \"host 10.0.0.0/8 and port 5432 and not user ci-*\"\n")
+	fmt.Fprintf(os.Stderr, "            Default: Nothing is mirrored\n\n")
+	fmt.Fprintf(os.Stderr, "  -decrypt-log\n")
+	fmt.Fprintf(os.Stderr, "            Decrypt an encrypted log file to stdout and exit\n")
+	fmt.Fprintf(os.Stderr, "            Requires -log-identity with the age private key file\n\n")
+	fmt.Fprintf(os.Stderr, "  -dup-session\n")
+	fmt.Fprintf(os.Stderr, "            What to do when a second client IP uses an existing session\n")
+	fmt.Fprintf(os.Stderr, "            share:    both use the same upstream connection\n")
+	fmt.Fprintf(os.Stderr, "            reject:   only the first client may use it\n")
+	fmt.Fprintf(os.Stderr, "            takeover: the newest client gets it, the old one is told\n")
+	fmt.Fprintf(os.Stderr, "            parallel: the second client gets its own connection\n")
+	fmt.Fprintf(os.Stderr, "            Default: share\n\n")
+	fmt.Fprintf(os.Stderr, "  -redirect Custom URL to redirect unauthorized requests, or 404 to\n")
+	fmt.Fprintf(os.Stderr, "            answer them with Apache's Not Found page instead\n")
+	fmt.Fprintf(os.Stderr, "            Default: GitHub project page\n\n")
+	fmt.Fprintf(os.Stderr, "  -decoy-site\n")
+	fmt.Fprintf(os.Stderr, "            Answer unauthorized requests with a static website instead\n")
+	fmt.Fprintf(os.Stderr, "            of the redirect: a directory with an index.html, or builtin\n")
+	fmt.Fprintf(os.Stderr, "            for a small studio site named after the hostname\n\n")
+	fmt.Fprintf(os.Stderr, "  -override-dest\n")
+	fmt.Fprintf(os.Stderr, "            Override client destination with server-side setting\n")
+	fmt.Fprintf(os.Stderr, "            Format: host:port\n")
+	fmt.Fprintf(os.Stderr, "            Default: Use client-provided destination\n\n")
+	fmt.Fprintf(os.Stderr, "  -service  Named services clients can use as their destination\n")
+	fmt.Fprintf(os.Stderr, "            Format: name=host:port[|standby:port...][,name=...]\n")
+	fmt.Fprintf(os.Stderr, "            Standbys are used in order when the ones before fail\n")
+	fmt.Fprintf(os.Stderr, "            Backends can have ;weight=N to share connections by\n")
+	fmt.Fprintf(os.Stderr, "            weight, and ;max=N to take at most N at once\n")
+	fmt.Fprintf(os.Stderr, "            Logs and metrics only show the name\n\n")
+	fmt.Fprintf(os.Stderr, "  -round-robin\n")
+	fmt.Fprintf(os.Stderr, "            Services whose backends take turns instead (comma separated)\n\n")
+	fmt.Fprintf(os.Stderr, "  -sticky   Services that send each client to the same backend, by its\n")
+	fmt.Fprintf(os.Stderr, "            user, key or address, unless that one is down (comma separated)\n\n")
+	fmt.Fprintf(os.Stderr, "  -services-only\n")
+	fmt.Fprintf(os.Stderr, "            Reject destinations that aren't a named service\n\n")
+	fmt.Fprintf(os.Stderr, "  -probe    Health probes for destinations, in metrics and /probes\n")
+	fmt.Fprintf(os.Stderr, "            Format: dest=tcp|tls|http[:/path]|https[:/path][,...]\n")
+	fmt.Fprintf(os.Stderr, "            dest is a named service or host:port\n\n")
+	fmt.Fprintf(os.Stderr, "  -probe-interval\n")
+	fmt.Fprintf(os.Stderr, "            How often to probe (default: 15s)\n\n")
+	fmt.Fprintf(os.Stderr, "  -probe-gate\n")
+	fmt.Fprintf(os.Stderr, "            Refuse new sessions to destinations failing their probe\n\n")
+	fmt.Fprintf(os.Stderr, "  -transport\n")
+	fmt.Fprintf(os.Stderr, "            Comma separated transports to accept besides polling\n")
+	fmt.Fprintf(os.Stderr, "            ws: clients using -transport ws\n")
+	fmt.Fprintf(os.Stderr, "            h2: clients using -transport h2 (HTTPS listeners only)\n")
+	fmt.Fprintf(os.Stderr, "            h3: clients using -transport h3, on an extra QUIC (UDP)\n")
+	fmt.Fprintf(os.Stderr, "                listener at the -o address, for direct mode\n")
+	fmt.Fprintf(os.Stderr, "            sse: clients using -transport sse\n")
+	fmt.Fprintf(os.Stderr, "            batch: clients using -batch (many requests in one)\n")
+	fmt.Fprintf(os.Stderr, "            Default: poll (plain GET/POST polling only)\n\n")
+	fmt.Fprintf(os.Stderr, "  -stream-polls\n")
+	fmt.Fprintf(os.Stderr, "            Hold polls from -stream-polls clients open this long and stream\n")
+	fmt.Fprintf(os.Stderr, "            data into them as it arrives; keep it under the CDN's timeout\n")
+	fmt.Fprintf(os.Stderr, "            Default: 0 (answer each poll right away)\n\n")
+	fmt.Fprintf(os.Stderr, "  -udp      Relay UDP for clients listening with -l udp:PORT\n")
+	fmt.Fprintf(os.Stderr, "            (WireGuard, DNS, games); destination ACLs still apply\n\n")
+	fmt.Fprintf(os.Stderr, "  -tun      Carry whole-device traffic for clients using -tun, handing\n")
+	fmt.Fprintf(os.Stderr, "            them addresses from this network (Linux, needs root)\n")
+	fmt.Fprintf(os.Stderr, "            Example: 10.99.0.0/24 (the server itself is 10.99.0.1)\n")
+	fmt.Fprintf(os.Stderr, "            Restricted users and tenants need \"tun\" in their allowed list\n\n")
+	fmt.Fprintf(os.Stderr, "  -psk      Pre-shared keys clients must authenticate with\n")
+	fmt.Fprintf(os.Stderr, "            Format: id:secret[,id:secret...]\n")
+	fmt.Fprintf(os.Stderr, "            List the current and next key to rotate without downtime\n")
+	fmt.Fprintf(os.Stderr, "            Default: No authentication\n\n")
+	fmt.Fprintf(os.Stderr, "  -tenants  JSON file defining tenants with their own keys, allowed\n")
+	fmt.Fprintf(os.Stderr, "            destinations, session limit and session namespace\n\n")
+	fmt.Fprintf(os.Stderr, "  -zones    JSON file of hostnames with their own keys, allowed\n")
+	fmt.Fprintf(os.Stderr, "            destinations, decoy and response headers\n\n")
+	fmt.Fprintf(os.Stderr, "  -sensitive\n")
+	fmt.Fprintf(os.Stderr, "            Destinations that need a second factor once a day per client\n")
+	fmt.Fprintf(os.Stderr, "            Same patterns as -nolog-dest\n\n")
+	fmt.Fprintf(os.Stderr, "  -mfa-totp File of \"client base32-secret\" lines (client is a key ID,\n")
+	fmt.Fprintf(os.Stderr, "            certificate user or *); clients are prompted for the code\n\n")
+	fmt.Fprintf(os.Stderr, "  -mfa-webhook\n")
+	fmt.Fprintf(os.Stderr, "            URL that approves -sensitive sessions by answering 2xx\n")
+	fmt.Fprintf(os.Stderr, "            Used for clients without a TOTP secret\n\n")
+	fmt.Fprintf(os.Stderr, "  -psk-kdf  Treat -psk secrets as passwords and stretch them\n")
+	fmt.Fprintf(os.Stderr, "            Format: argon2id[:t=3,m=65536,p=4] (m in KiB)\n")
+	fmt.Fprintf(os.Stderr, "            Clients must use the same setting\n\n")
+	fmt.Fprintf(os.Stderr, "  -legacy-auth\n")
+	fmt.Fprintf(os.Stderr, "            Also accept clients that don't sign their requests, or don't\n")
+	fmt.Fprintf(os.Stderr, "            sign their destination, close flag and capabilities\n")
+	fmt.Fprintf(os.Stderr, "            Their requests can be replayed or changed, use only while upgrading\n\n")
+	fmt.Fprintf(os.Stderr, "  -require-e2e\n")
+	fmt.Fprintf(os.Stderr, "            Refuse sessions from clients that don't encrypt end to end\n")
+	fmt.Fprintf(os.Stderr, "            (-e2e on the client, needs -psk)\n\n")
+	fmt.Fprintf(os.Stderr, "  -compat   Also serve clients of a documented protocol version (v1),\n")
+	fmt.Fprintf(os.Stderr, "            for clients not written in Go (see PROTOCOL.md)\n\n")
+	fmt.Fprintf(os.Stderr, "  -web-client\n")
+	fmt.Fprintf(os.Stderr, "            Serve a browser client at this secret path (needs -compat v1)\n")
+	fmt.Fprintf(os.Stderr, "            Default: Disabled\n\n")
+	fmt.Fprintf(os.Stderr, "  -invite-key\n")
+	fmt.Fprintf(os.Stderr, "            Secret that signs invitations from the invite subcommand\n")
+	fmt.Fprintf(os.Stderr, "            Also read from DARKFLARE_INVITE_KEY\n")
+	fmt.Fprintf(os.Stderr, "            Default: Invitations disabled\n\n")
+	fmt.Fprintf(os.Stderr, "  -invite-db\n")
+	fmt.Fprintf(os.Stderr, "            File recording redeemed invitations\n")
+	fmt.Fprintf(os.Stderr, "            Default: darkflare-invites.json\n\n")
+	fmt.Fprintf(os.Stderr, "  -cert-users\n")
+	fmt.Fprintf(os.Stderr, "            Require a Cloudflare mTLS client certificate and map it to a user\n")
+	fmt.Fprintf(os.Stderr, "            File lines: <user> sha256:<fingerprint>|cn:<name> [dest,...]\n")
+	fmt.Fprintf(os.Stderr, "            Needs the \"Add TLS client auth headers\" managed transform\n")
+	fmt.Fprintf(os.Stderr, "            and -origin-pull-ca, a unix socket origin or -trusted-proxies\n")
+	fmt.Fprintf(os.Stderr, "            Default: No certificate auth\n\n")
+	fmt.Fprintf(os.Stderr, "  -admin    Listen address for the admin API\n")
+	fmt.Fprintf(os.Stderr, "            Format: host:port (keep it off the public interface)\n")
+	fmt.Fprintf(os.Stderr, "            Default: Disabled\n\n")
+	fmt.Fprintf(os.Stderr, "  -admin-token\n")
+	fmt.Fprintf(os.Stderr, "            Bearer token with full admin API access\n\n")
+	fmt.Fprintf(os.Stderr, "  -viewer-token\n")
+	fmt.Fprintf(os.Stderr, "            Bearer token with read-only admin API access\n")
+	fmt.Fprintf(os.Stderr, "            Viewers can list sessions but not close them\n\n")
+	fmt.Fprintf(os.Stderr, "  -health-path\n")
+	fmt.Fprintf(os.Stderr, "            Also answer health checks at this secret path on the\n")
+	fmt.Fprintf(os.Stderr, "            tunnel listener (the admin API always has /healthz)\n")
+	fmt.Fprintf(os.Stderr, "            Default: Disabled\n\n")
+	fmt.Fprintf(os.Stderr, "  -metrics-dest-limit\n")
+	fmt.Fprintf(os.Stderr, "            Max destination hosts with their own metrics label\n")
+	fmt.Fprintf(os.Stderr, "            Rarer hosts are hashed into other-NN buckets\n")
+	fmt.Fprintf(os.Stderr, "            Default: 10\n\n")
+	fmt.Fprintf(os.Stderr, "  -user     Drop to this user once the listeners are bound (started as root)\n")
+	fmt.Fprintf(os.Stderr, "            Format: user[:group], by name or number\n\n")
+	fmt.Fprintf(os.Stderr, "  -chroot   Confine the server to this directory after binding (needs -user)\n")
+	fmt.Fprintf(os.Stderr, "            Paths used later (-invite-db, -acme-cache, pcap mirrors,\n")
+	fmt.Fprintf(os.Stderr, "            certificate reloads) are then inside it\n\n")
+	fmt.Fprintf(os.Stderr, "  -sandbox  After binding, only write where the server needs to and refuse\n")
+	fmt.Fprintf(os.Stderr, "            syscalls it never makes, running commands included (Linux)\n\n")
+	fmt.Fprintf(os.Stderr, "  -allow-exec\n")
+	fmt.Fprintf(os.Stderr, "            Let -a run its command under -sandbox\n\n")
+	fmt.Fprintf(os.Stderr, "Examples:\n")
+	fmt.Fprintf(os.Stderr, "  Basic setup:\n")
+	fmt.Fprintf(os.Stderr, "    %s -o http://0.0.0.0:8080\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  With custom TLS certificates:\n")
+	fmt.Fprintf(os.Stderr, "    %s -o https://0.0.0.0:443 -c /path/to/cert.pem -k /path/to/key.pem\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Invite a contractor to SSH for a day:\n")
+	fmt.Fprintf(os.Stderr, "    %s invite -invite-key <key> -endpoint https://cdn.example.com -dest ssh.internal:22 -ttl 24h\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Debug mode with metrics:\n")
+	fmt.Fprintf(os.Stderr, "    %s -o http://0.0.0.0:8080 -debug\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Notes:\n")
+	fmt.Fprintf(os.Stderr, "  - Server accepts destination from client via X-Requested-With header\n")
+	fmt.Fprintf(os.Stderr, "  - Destination validation is performed for security\n")
+	fmt.Fprintf(os.Stderr, "  - Use with Cloudflare as reverse proxy for best security\n\n")
+	fmt.Fprintf(os.Stderr, "For more information: https://github.com/doxx/darkflare\n")
+}
@@ -0,0 +1,16 @@
+//go:build stealth
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// A stealth build (see "Stealth Builds" in the README) leaves out the
+// usage text, which names the program and its author.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+	flag.PrintDefaults()
+}
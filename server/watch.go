@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runWatch implements the "watch" subcommand: a live, top-like view of the
+// sessions on a server, read from its admin API.
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:9090", "The server's admin API (its -admin address)")
+	token := fs.String("token", os.Getenv("DARKFLARE_ADMIN_TOKEN"), "Admin or viewer token (or DARKFLARE_ADMIN_TOKEN)")
+	interval := fs.Duration("interval", time.Second, "Refresh this often")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s watch -token <token> [-admin <url>] [-interval 1s]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Shows the server's sessions with their throughput, refreshed in place.\n")
+		fmt.Fprintf(os.Stderr, "A viewer token is enough.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *token == "" || *interval <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	base := strings.TrimSuffix(*admin, "/")
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	var previous map[string]sessionInfo
+	var previousAt time.Time
+	for ; ; time.Sleep(*interval) {
+		var sessions []sessionInfo
+		err := getAdmin(httpClient, base+"/sessions", *token, &sessions)
+		now := time.Now()
+
+		var out strings.Builder
+		fmt.Fprintf(&out, "darkflare-server watch %s, every %s, %s\n", base, *interval, now.Format("15:04:05"))
+		if err != nil {
+			fmt.Fprintf(&out, "\n%v\n", err)
+			fmt.Print("\033[H\033[2J" + out.String())
+			previous = nil
+			continue
+		}
+
+		rows := make([]watchRow, len(sessions))
+		var up, down float64
+		for i, session := range sessions {
+			rows[i] = watchRow{info: session}
+			if prev, ok := previous[session.ID]; ok {
+				seconds := now.Sub(previousAt).Seconds()
+				rows[i].up = float64(session.Sent-prev.Sent) / seconds
+				rows[i].down = float64(session.Received-prev.Received) / seconds
+			}
+			up += rows[i].up
+			down += rows[i].down
+		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			return rows[i].up+rows[i].down > rows[j].up+rows[j].down
+		})
+		fmt.Fprintf(&out, "%d sessions, up %s/s, down %s/s\n\n", len(sessions), formatRate(up), formatRate(down))
+
+		tw := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCLIENT\tDESTINATION\tTRANSPORT\tCOLO\tAGE\tIDLE\tUP/S\tDOWN/S\tSENT\tRECEIVED\tGAP")
+		for _, row := range rows {
+			s := row.info
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.ID[:min(8, len(s.ID))], s.ClientIP, s.Destination, orDash(s.Transport), orDash(s.Colo), s.Age, s.Idle,
+				formatRate(row.up), formatRate(row.down), formatByteSize(s.Sent), formatByteSize(s.Received), orDash(s.Gap))
+		}
+		tw.Flush()
+		fmt.Print("\033[H\033[2J" + out.String())
+
+		previous = make(map[string]sessionInfo, len(sessions))
+		for _, session := range sessions {
+			previous[session.ID] = session
+		}
+		previousAt = now
+	}
+}
+
+type watchRow struct {
+	info     sessionInfo
+	up, down float64 // bytes per second since the last refresh
+}
+
+func getAdmin(httpClient *http.Client, url, token string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func formatRate(bytesPerSecond float64) string {
+	return formatByteSize(int64(bytesPerSecond))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+)
+
+// webClientPage is a protocol v1 client for the browser, a text console for
+// line-based protocols. It signs requests itself, so the key is typed into
+// the page and never sent.
+//
+//go:embed webclient.html
+var webClientPage []byte
+
+// webClientCSP keeps the page from loading anything or talking to anyone but
+// this server.
+const webClientCSP = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; " +
+	"connect-src 'self'; frame-ancestors 'none'"
+
+// serveWebClient answers GETs for the -web-client path with the page and
+// reports whether it did. The path is the only thing hiding the page, so
+// anything else falls through to the decoy as before.
+func (s *Server) serveWebClient(w http.ResponseWriter, r *http.Request) bool {
+	if s.webClientPath == "" || r.Method != http.MethodGet || r.URL.Path != s.webClientPath {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Content-Security-Policy", webClientCSP)
+	w.Write(webClientPage)
+	return true
+}
+
+// cleanWebClientPath turns -web-client into the path requests come with,
+// relative to -path-prefix.
+func cleanWebClientPath(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
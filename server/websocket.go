@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients authenticate with the same headers as polling requests, and don't
+// send an Origin, so there is nothing for an origin check to protect.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  32 * 1024,
+	WriteBufferSize: 32 * 1024,
+	CheckOrigin:     func(*http.Request) bool { return true },
+}
+
+// serveWebSocket carries a whole session over one WebSocket instead of
+// repeated polls: binary messages from the client are written upstream and
+// everything read from upstream goes back as binary messages. The session
+// ends when either side closes.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, session *Session, sessionKey, tenant, metricsHost string) {
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered with an error
+		slog.Debug("WebSocket upgrade failed", "client", session.clientIP, "err", err)
+		return
+	}
+	defer func() {
+		ws.Close()
+		if _, exists := s.sessions.LoadAndDelete(sessionKey); exists {
+			session.conn.Close()
+		}
+	}()
+
+	// Polls leave a short read deadline behind
+	session.conn.SetReadDeadline(time.Time{})
+
+	touch := func() {
+		session.mu.Lock()
+		session.lastActive = time.Now()
+		session.mu.Unlock()
+	}
+
+	// Upstream to client
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := session.conn.Read(buffer)
+			if n > 0 {
+				touch()
+				if s.fair.wait(r.Context(), "downstream", session.owner, n) != nil {
+					return
+				}
+				if werr := ws.WriteMessage(websocket.BinaryMessage, buffer[:n]); werr != nil {
+					return
+				}
+				s.addBytes(session, "downstream", tenant, metricsHost, n)
+			}
+			if err != nil {
+				ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				return
+			}
+		}
+	}()
+
+	// Client to upstream
+	for {
+		kind, data, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		if kind != websocket.BinaryMessage || len(data) == 0 {
+			continue
+		}
+		touch()
+		if s.fair.wait(r.Context(), "upstream", session.owner, len(data)) != nil {
+			break
+		}
+		if _, err := session.conn.Write(data); err != nil {
+			slog.Debug("Writing to destination failed", "client", session.clientIP, "err", err)
+			break
+		}
+		s.addBytes(session, "upstream", tenant, metricsHost, len(data))
+	}
+	session.conn.Close()
+	<-done
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// zone is a hostname with policies of its own, for serving several
+// Cloudflare zones from one origin. Anything a zone leaves out is the
+// server's.
+type zone struct {
+	name        string       // the Host it's for, maybe "*.example.com"
+	keys        *keyRing     // replaces -psk and -tenants keys for the zone
+	destPolicy  *destPolicy  // replaces -allow-dest, -deny-dest and the port lists
+	redirect    string       // replaces -redirect
+	passthrough http.Handler // replaces -passthrough
+	site        *decoySite   // replaces -decoy-site
+	headers     string       // header profile, see headerProfiles
+}
+
+// zoneSet is the -zones file, loaded.
+type zoneSet struct {
+	byHost    map[string]*zone
+	wildcards []*zone // longest suffix first
+	strict    bool    // hosts without a zone only get the decoy
+}
+
+// zonesFile is the -zones file format:
+//
+//	{"strict": true, "zones": [
+//	  {"host": "cdn.example.com", "keys": ["a1:secret"], "allow_dest": ["10.0.0.0/8"],
+//	   "allow_ports": "22,443", "redirect": "404", "headers": "nginx"},
+//	  {"host": "*.example.net", "psk_file": "...", "passthrough": "http://127.0.0.1:8080"},
+//	  {"host": "www.example.org", "decoy_site": "/var/www/example"}
+//	]}
+type zonesFile struct {
+	Strict bool `json:"strict"`
+	Zones  []struct {
+		Host        string   `json:"host"`
+		Keys        []string `json:"keys"`
+		AllowDest   []string `json:"allow_dest"`
+		DenyDest    []string `json:"deny_dest"`
+		AllowPorts  string   `json:"allow_ports"`
+		DenyPorts   string   `json:"deny_ports"`
+		Redirect    string   `json:"redirect"`
+		Passthrough string   `json:"passthrough"`
+		DecoySite   string   `json:"decoy_site"`
+		Headers     string   `json:"headers"`
+	} `json:"zones"`
+}
+
+// loadZones reads a zones file. Key IDs must be unique across zones and
+// the server's own keys, so a key can't be mistaken for a tenant's.
+func loadZones(path string, keys *keyRing) (*zoneSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file zonesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if len(file.Zones) == 0 {
+		return nil, fmt.Errorf("no zones in %s", path)
+	}
+
+	zs := &zoneSet{byHost: make(map[string]*zone), strict: file.Strict}
+	keyIDs := make(map[string]bool)
+	if keys != nil {
+		for _, id := range keys.order {
+			keyIDs[id] = true
+		}
+	}
+	for _, z := range file.Zones {
+		host := strings.ToLower(strings.TrimSpace(z.Host))
+		if host == "" || strings.ContainsAny(host, "/@: ") || strings.Contains(host[1:], "*") ||
+			(strings.HasPrefix(host, "*") && !strings.HasPrefix(host, "*.")) {
+			return nil, fmt.Errorf("invalid zone host %q", z.Host)
+		}
+		if zs.byHost[host] != nil {
+			return nil, fmt.Errorf("duplicate zone %q", host)
+		}
+
+		zn := &zone{name: host, redirect: z.Redirect}
+		if len(z.Keys) > 0 {
+			if zn.keys, err = parseKeyRing(strings.Join(z.Keys, ",")); err != nil {
+				return nil, fmt.Errorf("zone %s: %v", host, err)
+			}
+			for _, id := range zn.keys.order {
+				if keyIDs[id] {
+					return nil, fmt.Errorf("zone %s: key ID %q is already in use", host, id)
+				}
+				keyIDs[id] = true
+			}
+		}
+		if len(z.AllowDest) > 0 || len(z.DenyDest) > 0 || z.AllowPorts != "" || z.DenyPorts != "" {
+			zn.destPolicy = &destPolicy{}
+			if len(z.AllowDest) > 0 {
+				if zn.destPolicy.allow, err = parseDestMatcher(strings.Join(z.AllowDest, ",")); err != nil {
+					return nil, fmt.Errorf("zone %s: allow_dest: %v", host, err)
+				}
+			}
+			if len(z.DenyDest) > 0 {
+				if zn.destPolicy.deny, err = parseDestMatcher(strings.Join(z.DenyDest, ",")); err != nil {
+					return nil, fmt.Errorf("zone %s: deny_dest: %v", host, err)
+				}
+			}
+			if z.AllowPorts != "" {
+				if zn.destPolicy.allowPorts, err = parsePortSet(z.AllowPorts); err != nil {
+					return nil, fmt.Errorf("zone %s: allow_ports: %v", host, err)
+				}
+			}
+			if z.DenyPorts != "" {
+				if zn.destPolicy.denyPorts, err = parsePortSet(z.DenyPorts); err != nil {
+					return nil, fmt.Errorf("zone %s: deny_ports: %v", host, err)
+				}
+			}
+		}
+		if z.Passthrough != "" {
+			if zn.passthrough, err = newPassthrough(z.Passthrough); err != nil {
+				return nil, fmt.Errorf("zone %s: passthrough: %v", host, err)
+			}
+		}
+		if z.DecoySite != "" {
+			if zn.site, err = newDecoySite(z.DecoySite); err != nil {
+				return nil, fmt.Errorf("zone %s: decoy_site: %v", host, err)
+			}
+		}
+		if z.Headers != "" {
+			if _, ok := headerProfiles[z.Headers]; !ok {
+				return nil, fmt.Errorf("zone %s: unknown headers %q (use apache, nginx or none)", host, z.Headers)
+			}
+			zn.headers = z.Headers
+		}
+
+		zs.byHost[host] = zn
+		if strings.HasPrefix(host, "*.") {
+			zs.wildcards = append(zs.wildcards, zn)
+		}
+	}
+	sort.SliceStable(zs.wildcards, func(i, j int) bool {
+		return len(zs.wildcards[i].name) > len(zs.wildcards[j].name)
+	})
+	return zs, nil
+}
+
+// lookup finds the zone for a Host header, an exact match first and then
+// the most specific wildcard. "*.example.com" doesn't cover example.com.
+func (zs *zoneSet) lookup(hostport string) *zone {
+	if zs == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if z := zs.byHost[host]; z != nil {
+		return z
+	}
+	for _, z := range zs.wildcards {
+		if strings.HasSuffix(host, z.name[1:]) {
+			return z
+		}
+	}
+	return nil
+}
+
+// derive stretches every zone's keys like -psk-kdf does the server's.
+func (zs *zoneSet) derive(params *argon2Params) {
+	for _, z := range zs.byHost {
+		if z.keys != nil {
+			z.keys.derive(params)
+		}
+	}
+}
+
+// allKeyed reports whether every request needs a zone key: the file is
+// strict and no zone falls back to the server's keys.
+func (zs *zoneSet) allKeyed() bool {
+	if zs == nil || !zs.strict {
+		return false
+	}
+	for _, z := range zs.byHost {
+		if z.keys == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPassthrough reports whether any zone proxies to a site of its own.
+func (zs *zoneSet) hasPassthrough() bool {
+	if zs == nil {
+		return false
+	}
+	for _, z := range zs.byHost {
+		if z.passthrough != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneFor is the zone r was sent to, nil for hosts without one.
+func (s *Server) zoneFor(r *http.Request) *zone {
+	return s.zones.lookup(r.Host)
+}
+
+// keyRing, policy, decoy and headerProfile are the zone's settings, or the
+// server's where the zone has none or there is no zone.
+
+func (z *zone) keyRing(server *keyRing) *keyRing {
+	if z == nil || z.keys == nil {
+		return server
+	}
+	return z.keys
+}
+
+func (z *zone) policy(server *destPolicy) *destPolicy {
+	if z == nil || z.destPolicy == nil {
+		return server
+	}
+	return z.destPolicy
+}
+
+func (z *zone) decoy(redirect string, passthrough http.Handler) (string, http.Handler) {
+	if z == nil {
+		return redirect, passthrough
+	}
+	if z.redirect != "" {
+		redirect = z.redirect
+	}
+	if z.passthrough != nil {
+		passthrough = z.passthrough
+	}
+	return redirect, passthrough
+}
+
+// decoySite is the site stray visitors get, nil for a redirect. A zone's
+// own redirect wins over the server's site.
+func (z *zone) decoySite(server *decoySite) *decoySite {
+	if z == nil {
+		return server
+	}
+	if z.site != nil {
+		return z.site
+	}
+	if z.redirect != "" {
+		return nil
+	}
+	return server
+}
+
+func (z *zone) headerProfile() string {
+	if z == nil || z.headers == "" {
+		return "apache"
+	}
+	return z.headers
+}
+
+// sessionNamespace keeps zones' sessions apart, so a session ID only means
+// something on the hostname it was opened on.
+func (z *zone) sessionNamespace() string {
+	if z == nil {
+		return ""
+	}
+	return z.name + "/"
+}
+
+// headerProfiles are the web servers tunnel responses can pass for.
+var headerProfiles = map[string]map[string]string{
+	"apache": {
+		"Server":                 "Apache/2.4.41 (Ubuntu)",
+		"X-Powered-By":           "PHP/7.4.33",
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "SAMEORIGIN",
+		"X-XSS-Protection":       "1; mode=block",
+	},
+	"nginx": {
+		"Server":                 "nginx",
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "SAMEORIGIN",
+	},
+	"none": {},
+}
@@ -0,0 +1,216 @@
+// Command release makes the signed manifest "darkflare-client update"
+// installs releases from:
+//
+//	go run ./tools/release genkey -out release.key
+//	go run ./tools/release sign -key release.key -version 1.5.0 bin/darkflare-client-*
+//
+// genkey writes a new private key and prints the public key to build
+// clients with (UPDATE_KEY in the Makefile). sign writes manifest.json and
+// manifest.json.sig next to the binaries; upload all of them to the same
+// place. Keep the private key off the build machine if you can.
+//
+// It also signs the endpoints list darkflare-server -endpoints hands out,
+// with a key of its own (clients get the public key with -endpoints-key):
+//
+//	go run ./tools/release endpoints -key operator.key https://alt.example.net https://cdn.example.com=104.16.1.1
+//
+// URL=IP has clients connect to that edge IP for the hostname.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type releaseManifest struct {
+	Version string                 `json:"version"`
+	Files   map[string]releaseFile `json:"files"`
+}
+
+type releaseFile struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type endpointList struct {
+	Issued    time.Time  `json:"issued"`
+	Endpoints []endpoint `json:"endpoints"`
+}
+
+type endpoint struct {
+	URL string `json:"url"`
+	IP  string `json:"ip,omitempty"`
+}
+
+const clientPrefix = "darkflare-client-"
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "genkey":
+		fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+		out := fs.String("out", "release.key", "Private key file to write")
+		fs.Parse(os.Args[2:])
+		if err := genkey(*out); err != nil {
+			log.Fatal(err)
+		}
+	case "sign":
+		fs := flag.NewFlagSet("sign", flag.ExitOnError)
+		keyFile := fs.String("key", "release.key", "Private key file")
+		version := fs.String("version", "", "Release version (e.g. 1.5.0)")
+		fs.Parse(os.Args[2:])
+		if *version == "" || fs.NArg() == 0 {
+			usage()
+		}
+		if err := sign(*keyFile, *version, fs.Args()); err != nil {
+			log.Fatal(err)
+		}
+	case "endpoints":
+		fs := flag.NewFlagSet("endpoints", flag.ExitOnError)
+		keyFile := fs.String("key", "operator.key", "Private key file")
+		out := fs.String("out", "endpoints.json", "List to write, the signature goes next to it")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() == 0 {
+			usage()
+		}
+		if err := signEndpoints(*keyFile, *out, fs.Args()); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: go run ./tools/release genkey [-out FILE]\n")
+	fmt.Fprintf(os.Stderr, "       go run ./tools/release sign [-key FILE] -version VERSION BINARY...\n")
+	fmt.Fprintf(os.Stderr, "       go run ./tools/release endpoints [-key FILE] [-out FILE] URL[=IP]...\n")
+	os.Exit(2)
+}
+
+func genkey(out string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	seed := base64.StdEncoding.EncodeToString(private.Seed())
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, seed); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s. Public key, for UPDATE_KEY:\n%s\n", out, base64.StdEncoding.EncodeToString(public))
+	return nil
+}
+
+// sign lists the client binaries, named darkflare-client-GOOS-GOARCH[.exe]
+// like build-all makes them, in a manifest next to the first one.
+func sign(keyFile, version string, binaries []string) error {
+	private, err := readKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	manifest := releaseManifest{Version: version, Files: make(map[string]releaseFile)}
+	dir := filepath.Dir(binaries[0])
+	for _, path := range binaries {
+		name := filepath.Base(path)
+		platform, ok := strings.CutPrefix(strings.TrimSuffix(name, ".exe"), clientPrefix)
+		if !ok || strings.Count(platform, "-") != 1 || filepath.Dir(path) != dir {
+			return fmt.Errorf("%s: expected %sGOOS-GOARCH next to the others", path, clientPrefix)
+		}
+		binary, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(binary)
+		manifest.Files[platform] = releaseFile{URL: name, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(binary))}
+	}
+
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(dir, "manifest.json")
+	if err := writeSigned(private, manifestPath, append(out, '\n')); err != nil {
+		return err
+	}
+	fmt.Printf("Signed %s with %d clients\n", manifestPath, len(manifest.Files))
+	return nil
+}
+
+// signEndpoints writes a list of the given URL[=IP] entries, issued now.
+// Clients keep the newest list they've seen, so an old one can't be played
+// back to them.
+func signEndpoints(keyFile, out string, entries []string) error {
+	private, err := readKey(keyFile)
+	if err != nil {
+		return err
+	}
+	list := endpointList{Issued: time.Now().UTC().Truncate(time.Second)}
+	for _, entry := range entries {
+		var e endpoint
+		e.URL = entry
+		if i := strings.LastIndex(entry, "="); i > 0 && net.ParseIP(entry[i+1:]) != nil {
+			e.URL, e.IP = entry[:i], entry[i+1:]
+		}
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%s: expected https://host[:port][/prefix][=IP]", entry)
+		}
+		list.Endpoints = append(list.Endpoints, e)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeSigned(private, out, append(data, '\n')); err != nil {
+		return err
+	}
+	fmt.Printf("Signed %s with %d endpoints, hand it out with darkflare-server -endpoints %s\n", out, len(list.Endpoints), out)
+	return nil
+}
+
+func readKey(keyFile string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s isn't a key from genkey", keyFile)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// writeSigned writes data to path and its signature, base64, to path.sig.
+func writeSigned(private ed25519.PrivateKey, path string, data []byte) error {
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(private, data))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(path+".sig", []byte(sig+"\n"), 0644)
+}
@@ -0,0 +1,180 @@
+// Command stealth copies the source tree with identifying strings swapped
+// for others, so binaries built from the copy don't give themselves away to
+// strings(1). make build-stealth runs it, see "Stealth Builds" in the
+// README.
+//
+// The manifest has one "old = new" per line, # starts a comment. Each old
+// string is replaced wherever it appears in a Go string literal (not import
+// paths or struct tags), in the embedded web client and in the module path.
+// Client and server have to be built from the same manifest, since header
+// names and key derivation labels change with it.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func main() {
+	manifest := flag.String("manifest", "", "Replacements, one \"old = new\" per line")
+	out := flag.String("out", "", "Directory to write the rewritten tree to (must not exist)")
+	flag.Parse()
+	if *manifest == "" || *out == "" {
+		fmt.Fprintf(os.Stderr, "Usage: go run ./tools/stealth -manifest FILE -out DIR\n")
+		os.Exit(2)
+	}
+
+	replacer, err := loadManifest(*manifest)
+	if err != nil {
+		log.Fatalf("Invalid -manifest: %v", err)
+	}
+	if _, err := os.Stat(*out); err == nil {
+		log.Fatalf("%s already exists", *out)
+	}
+	if err := rewriteTree(".", *out, replacer); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadManifest reads the replacements, longest first so "DarkFlare Client"
+// wins over "DarkFlare".
+func loadManifest(path string) (*strings.Replacer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type pair struct{ old, new string }
+	var pairs []pair
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		old, new, ok := strings.Cut(text, "=")
+		old, new = strings.TrimSpace(old), strings.TrimSpace(new)
+		if !ok || old == "" {
+			return nil, fmt.Errorf("line %d: expected old = new", line)
+		}
+		if strings.ContainsAny(old+new, "\"`\\") {
+			// They'd end up inside Go string literals
+			return nil, fmt.Errorf("line %d: no quotes or backslashes", line)
+		}
+		pairs = append(pairs, pair{old, new})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no replacements")
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return len(pairs[i].old) > len(pairs[j].old) })
+	var args []string
+	for _, p := range pairs {
+		args = append(args, p.old, p.new)
+	}
+	return strings.NewReplacer(args...), nil
+}
+
+// rewriteTree copies src to dst, rewriting what ends up in the binaries.
+// Version control and earlier builds stay behind.
+func rewriteTree(src, dst string, r *strings.Replacer) error {
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if abs, _ := filepath.Abs(path); abs == absDst || d.Name() == ".git" || d.Name() == "bin" {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dst, path), 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, ".go"):
+			if data, err = rewriteGo(path, data, r); err != nil {
+				return err
+			}
+		case strings.HasSuffix(path, ".html"):
+			data = []byte(r.Replace(string(data)))
+		case d.Name() == "go.mod":
+			data = rewriteModule(data, r)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, path), data, info.Mode().Perm())
+	})
+}
+
+// rewriteGo replaces inside the file's string literals, except import
+// paths and struct tags.
+func rewriteGo(path string, data []byte, r *strings.Replacer) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, data, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[*ast.BasicLit]bool)
+	for _, spec := range file.Imports {
+		skip[spec.Path] = true
+	}
+	var literals []*ast.BasicLit
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Field:
+			if n.Tag != nil {
+				skip[n.Tag] = true
+			}
+		case *ast.BasicLit:
+			if n.Kind == token.STRING && !skip[n] {
+				literals = append(literals, n)
+			}
+		}
+		return true
+	})
+
+	// Back to front, so earlier offsets stay put
+	out := string(data)
+	for i := len(literals) - 1; i >= 0; i-- {
+		lit := literals[i]
+		start := fset.Position(lit.Pos()).Offset
+		end := start + len(lit.Value)
+		out = out[:start] + r.Replace(lit.Value) + out[end:]
+	}
+	return []byte(out), nil
+}
+
+// rewriteModule renames the module, which the binaries record.
+func rewriteModule(data []byte, r *strings.Replacer) []byte {
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if name, ok := strings.CutPrefix(line, "module "); ok {
+			lines[i] = "module " + r.Replace(name)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}